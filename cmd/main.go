@@ -2,97 +2,445 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/debug"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/emersion/go-smtp"
 	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/monitor"
 	"github.com/goodieshq/gopostal/pkg/receiver"
+	"github.com/goodieshq/gopostal/pkg/secrets"
+	"github.com/goodieshq/gopostal/pkg/selftest"
+	"github.com/goodieshq/gopostal/pkg/sender"
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// Version of the build, set with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
 func main() {
+	configFlag := flag.String("config", "", "Path to the configuration file (default: $"+config.ConfigPathEnv+", ./config.yaml or /etc/gopostal/config.yaml)")
+	overrideConfig := flag.String("override-config", "", "Path to a configuration file merged over the configuration file")
+	strict := flag.Bool("strict", true, "Reject unknown configuration keys")
+	showVersion := flag.Bool("version", false, "Print the version and build information, then exit")
+	jsonReport := flag.Bool("json", false, "Print the self-test report as JSON instead of a table")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [selftest [-json]]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	// The selftest subcommand checks the configuration and exits without starting the servers
+	selfTestOnly := flag.Arg(0) == "selftest"
+	if selfTestOnly {
+		sub := flag.NewFlagSet("selftest", flag.ExitOnError)
+		sub.BoolVar(jsonReport, "json", *jsonReport, "Print the self-test report as JSON instead of a table")
+		sub.Parse(flag.Args()[1:])
+	} else if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
 	godotenv.Load()
 
-	// Load configuration from file
-	cfg, err := config.LoadConfig("config.yaml")
+	// Load configuration from file, applying environment-specific overrides if provided
+	configPath, configSource, err := config.ResolveConfigPath(*configFlag)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to load configuration")
+		log.Fatal().Err(err).Msg("Failed to locate configuration")
+	}
+	configFiles := []string{configPath}
+	if *overrideConfig != "" {
+		configFiles = append(configFiles, *overrideConfig)
 	}
+	loadConfig := func() (*config.Config, error) {
+		if *overrideConfig != "" {
+			return config.LoadConfigWithOverride(configPath, *overrideConfig, *strict)
+		}
+		return config.LoadConfig(configPath, *strict)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal().Err(err).Str("path", configPath).Msg("Failed to load configuration")
+	}
+	if abs, err := filepath.Abs(configPath); err == nil {
+		configPath = abs
+	}
+	log.Info().Str("path", configPath).Str("source", configSource).Str("override", *overrideConfig).Str("version", version).Msg("Configuration loaded")
 
-	// Ensure a valid token can be acquired before starting servers
+	if selfTestOnly {
+		report := selftest.Run(context.Background(), cfg, selftest.Options{Bind: true})
+		printReport(report, *jsonReport)
+		if !report.OK {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Ensure a valid token can be acquired for every sender before starting servers
 	if !cfg.Send.AllowStartWithoutGraph {
 		if err := cfg.Send.Sender.Authenticate(context.Background()); err != nil {
 			log.Fatal().Err(err).Msg("Failed to initialize email sender")
 		}
+		for _, ns := range cfg.Send.Senders {
+			if err := ns.Sender.Authenticate(context.Background()); err != nil {
+				log.Fatal().Err(err).Str("sender", ns.Name).Msg("Failed to initialize email sender")
+			}
+		}
 		log.Info().Msg("Email sender authenticated successfully")
 	}
 
-	// Create a list of SMTP servers based on the configuration
-	servers := make([]*smtp.Server, len(cfg.Recv.Listeners))
-	var wg sync.WaitGroup
-
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	// Reload the configuration on SIGHUP, or when its files change if config_watch is set
+	reload := make(chan struct{}, 1)
+	requestReload := func() {
+		select {
+		case reload <- struct{}{}:
+		default: // a reload is already pending
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info().Msg("SIGHUP received, reloading configuration")
+			requestReload()
+		}
+	}()
+	if cfg.System.ConfigWatch {
+		watcher := config.NewConfigWatcher(configFiles...)
+		watcher.OnChange(requestReload)
+		if err := watcher.Start(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to watch the configuration files")
+		}
+	}
+
+	// Run the servers until shutdown, restarting them with the new configuration on each successful reload. The servers
+	// of the previous configuration stop accepting connections and drain in the background, so the sessions in progress
+	// end normally while the new servers take over the listener addresses.
+	var draining sync.WaitGroup
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		drain, released, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+		go func(cfg *config.Config) {
+			defer close(done)
+			run(runCtx, cfg, *jsonReport, drain, released)
+		}(cfg)
+
+		next := waitForReload(ctx, reload, loadConfig)
+		if next == nil {
+			cancel()
+			<-done
+			break
+		}
+		next.KeepState(cfg)
+		close(drain)
+		select {
+		case <-released:
+		case <-done:
+		}
+		draining.Add(1)
+		go func() {
+			defer draining.Done()
+			<-done
+			cancel()
+		}()
+		cfg = next
+		log.Info().Msg("Configuration reloaded, servers restarted")
+	}
+	draining.Wait()
+	log.Info().Msg("All servers have been shut down. Exiting.")
+}
+
+// Close the servers and their connections at once.
+func closeServers(servers []*receiver.Server, httpServer, metricsServer *http.Server) {
+	if httpServer != nil {
+		if err := httpServer.Close(); err != nil {
+			log.Error().Err(err).Msgf("Error shutting down HTTP submission server at %s", httpServer.Addr)
+		}
+	}
+
+	if metricsServer != nil {
+		if err := metricsServer.Close(); err != nil {
+			log.Error().Err(err).Msgf("Error shutting down metrics server at %s", metricsServer.Addr)
+		}
+	}
+
+	for _, srv := range servers {
+		log.Info().Msgf("Shutting down server at %s", srv.Addr)
+		if err := srv.Close(); err != nil {
+			log.Error().Err(err).Msgf("Error shutting down server at %s", srv.Addr)
+		}
+	}
+}
+
+// Wait for the sessions and requests in progress on the servers to end, closing the connections still open once the
+// context is done.
+func drainServers(ctx context.Context, servers []*receiver.Server, httpServer *http.Server) {
+	var wg sync.WaitGroup
+	if httpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The listener was closed already, which Shutdown reports once the requests have ended
+			if err := httpServer.Shutdown(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Warn().Err(err).Msgf("HTTP submission server at %s did not drain, closing its connections", httpServer.Addr)
+				httpServer.Close()
+			}
+		}()
+	}
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Warn().Err(err).Msgf("Server at %s did not drain, closed its connections", srv.Addr)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Returns the version with the module and VCS information embedded by the Go toolchain.
+func versionInfo() string {
+	info := "gopostal " + version
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info += " (" + bi.GoVersion
+	settings := map[string]string{}
+	for _, s := range bi.Settings {
+		settings[s.Key] = s.Value
+	}
+	if rev := settings["vcs.revision"]; rev != "" {
+		info += ", commit " + rev
+		if settings["vcs.modified"] == "true" {
+			info += "-dirty"
+		}
+	}
+	if t := settings["vcs.time"]; t != "" {
+		info += ", built from " + t
+	}
+	return info + ")"
+}
+
+// Print the self-test report as a table to stderr, next to the logs, or as JSON to stdout.
+func printReport(report *selftest.Report, asJSON bool) {
+	if asJSON {
+		report.WriteJSON(os.Stdout)
+		return
+	}
+	report.WriteTable(os.Stderr)
+}
+
+// Wait for a reload request and return the new configuration, or nil once the context is cancelled. The current
+// configuration is kept if the new one is invalid.
+func waitForReload(ctx context.Context, reload <-chan struct{}, load func() (*config.Config, error)) *config.Config {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-reload:
+		}
+		cfg, err := load()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to reload configuration, keeping the current configuration")
+			continue
+		}
+		return cfg
+	}
+}
+
+// Start the servers and background tasks of the configuration and stop them once the context is cancelled, closing the
+// connections at once. Closing drain stops them gracefully instead: the listeners are closed, then released is closed
+// so the servers of the next configuration can bind the same addresses, and the sessions in progress are given
+// system.reload_drain_timeout to end. The self-test report is printed, as JSON if jsonReport is set, before the servers
+// start.
+func run(ctx context.Context, cfg *config.Config, jsonReport bool, drain <-chan struct{}, released chan<- struct{}) {
+	// Keep secret leases (e.g. Vault) alive for as long as the configuration is in use
+	resolvers := []secrets.Resolver{cfg.Send.Graph.ClientSecretResolver, cfg.Send.SendGrid.APIKeyResolver}
+	for _, route := range cfg.Send.UserRoutes {
+		resolvers = append(resolvers, route.Graph.ClientSecretResolver)
+	}
+	for _, ns := range cfg.Send.Senders {
+		resolvers = append(resolvers, ns.Graph.ClientSecretResolver)
+	}
+	for _, resolver := range resolvers {
+		if renewer, ok := resolver.(secrets.Renewer); ok {
+			go renewer.Renew(ctx)
+		}
+	}
+
+	// Probe the sender authentication while it is failing, so new sessions are accepted again once it recovers
+	if cfg.Send.Health != nil {
+		go cfg.Send.Health.Run(ctx, cfg.Send.Sender, cfg.Send.AuthProbeInterval)
+	}
+
+	metrics.SetMaxDomainLabels(cfg.Metrics.MaxDomainLabels)
+
+	// Periodically send a heartbeat through the sender, unless it does not deliver messages
+	var heartbeat *monitor.Heartbeat
+	if hb := cfg.Monitoring.Heartbeat; hb != nil {
+		if dr, ok := cfg.Send.Sender.(sender.DryRunner); ok && dr.DryRun() && !hb.AllowDryRun {
+			log.Warn().Msg("Sender does not deliver messages, not starting the heartbeat (set monitoring.heartbeat.allow_dry_run to override)")
+		} else {
+			heartbeat = monitor.NewHeartbeat(hb, cfg.Send.Sender)
+			go heartbeat.Run(ctx)
+		}
+	}
+
+	// Keep the OCSP responses stapled to the listener certificates fresh
+	for _, lc := range cfg.Recv.Listeners {
+		if lc.OCSPStapler != nil {
+			go lc.OCSPStapler.Run(ctx)
+		}
+	}
+
+	// Check the listeners, certificates, senders and endpoints before serving, reporting the results at /readyz/details
+	report := selftest.Run(ctx, cfg, selftest.Options{Bind: true})
+	printReport(report, jsonReport)
+	if !report.OK {
+		log.Warn().Msg("Self-test found failures, starting anyway")
+	}
+
+	// Create a list of SMTP servers based on the configuration, with the listeners they serve
+	var servers []*receiver.Server
+	var listeners []net.Listener
+	var tracers []*receiver.Tracer
+	var wg sync.WaitGroup
+
 	// Create a new listener for each configured listener
 	for i := range cfg.Recv.Listeners {
 		lcfg := cfg.Recv.Listeners[i]
-		listener := receiver.NewListener(ctx, &lcfg, &cfg.Send, &cfg.Recv.RecvGlobalConfig)
 
 		// create a new SMTP server
-		server := smtp.NewServer(listener)
-		server.Addr = fmt.Sprintf(":%d", lcfg.Port)
-		server.Domain = cfg.Recv.Domain
-		server.TLSConfig = lcfg.TLSConfig
+		server := receiver.NewServer(ctx, &lcfg, &cfg.Send, &cfg.Recv.RecvGlobalConfig)
 
-		servers[i] = server
-		wg.Add(1)
+		// Sessions of plaintext and STARTTLS listeners can be traced, initially if debug_trace is set
+		if lcfg.Type != config.ListenerSMTPS {
+			tracer := receiver.NewTracer(&lcfg, &cfg.Recv.Trace)
+			tracers = append(tracers, tracer)
+			server.SetTracer(tracer)
+		}
 
-		type run func() error
-		var runner run
+		log.Info().Msgf("Starting SMTP (%s) server '%s' on %s", lcfg.Type, lcfg.Name, server.Addr)
+		l, err := receiver.Listen(&lcfg)
+		if err != nil {
+			log.Error().Err(err).Msgf("SMTP (%s) server '%s' failed to listen on %s", lcfg.Type, lcfg.Name, server.Addr)
+			continue
+		}
+		if lcfg.Type == config.ListenerSMTP {
+			log.Warn().Str("server", lcfg.Name).Msg("SMTP listener does not use TLS, allowing insecure authentication. This is not recommended for production environments.")
+		}
 
-		go func(srv *smtp.Server, lc config.ListenerConfig) {
+		servers = append(servers, server)
+		listeners = append(listeners, l)
+		wg.Add(1)
+		go func(srv *receiver.Server, lc config.ListenerConfig) {
 			defer wg.Done()
-			log.Info().Msgf("Starting SMTP (%s) server '%s' on %s", lc.Type, lc.Name, srv.Addr)
-			switch lc.Type {
-			case config.ListenerSMTP:
-				log.Warn().Str("server", lc.Name).Msg("SMTP listener does not use TLS, allowing insecure authentication. This is not recommended for production environments.")
-				srv.AllowInsecureAuth = true
-				runner = srv.ListenAndServe
-			case config.ListenerSMTPS:
-				srv.AllowInsecureAuth = false
-				srv.TLSConfig = lc.TLSConfig
-				runner = srv.ListenAndServeTLS
-			case config.ListenerSTARTTLS:
-				srv.AllowInsecureAuth = false
-				srv.TLSConfig = lc.TLSConfig
-				runner = srv.ListenAndServe
-			}
-			if err := runner(); err != nil {
+			if err := srv.Serve(l); err != nil {
 				log.Error().Err(err).Msgf("SMTP (%s) server '%s' at %s stopped with error", lc.Type, lc.Name, srv.Addr)
 			}
 		}(server, lcfg)
 	}
 
-	<-ctx.Done()
-	log.Info().Msg("Shutdown signal received, closing servers...")
-
-	for _, srv := range servers {
-		if srv != nil {
-			log.Info().Msgf("Shutting down server at %s", srv.Addr)
-			if err := srv.Close(); err != nil {
-				log.Error().Err(err).Msgf("Error shutting down server at %s", srv.Addr)
+	// Serve Prometheus metrics and the readiness endpoint if configured
+	var metricsServer *http.Server
+	if cfg.Metrics.Addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		mux.Handle("/readyz", monitor.ReadyHandler(heartbeat, cfg.Send.Health))
+		mux.Handle("/readyz/details", selftest.Handler(report))
+		mux.Handle("/debug/trace", receiver.TraceHandler(tracers))
+		metricsServer = &http.Server{Addr: cfg.Metrics.Addr, Handler: mux}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Info().Msgf("Starting metrics server on %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Err(err).Msgf("Metrics server at %s stopped with error", metricsServer.Addr)
 			}
+		}()
+	}
+
+	// Serve the HTTP submission API if configured
+	var httpServer *http.Server
+	if cfg.Recv.HTTP != nil {
+		httpServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.Recv.HTTP.Port),
+			Handler: receiver.NewHTTPHandler(ctx, cfg.Recv.HTTP, &cfg.Send, &cfg.Recv.RecvGlobalConfig),
+		}
+		log.Info().Msgf("Starting HTTP submission server on %s", httpServer.Addr)
+		if l, err := net.Listen("tcp", httpServer.Addr); err != nil {
+			log.Error().Err(err).Msgf("HTTP submission server failed to listen on %s", httpServer.Addr)
+			httpServer = nil
+		} else {
+			listeners = append(listeners, l)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := httpServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+					log.Error().Err(err).Msgf("HTTP submission server at %s stopped with error", httpServer.Addr)
+				}
+			}()
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Info().Msg("Closing servers...")
+		closeServers(servers, httpServer, metricsServer)
+	case <-drain:
+		log.Info().Msg("Draining servers...")
+
+		// Release the addresses for the servers of the next configuration before waiting for the sessions
+		for _, l := range listeners {
+			l.Close()
+		}
+		if metricsServer != nil {
+			metricsServer.Close()
 		}
+		close(released)
+
+		drainCtx, cancel := context.WithTimeout(ctx, cfg.System.ReloadDrainTimeout)
+		drainServers(drainCtx, servers, httpServer)
+		cancel()
 	}
 
 	wg.Wait()
-	log.Info().Msg("All servers have been shut down. Exiting.")
+
+	// Stop the background token refresh of the senders
+	senders := []sender.Sender{cfg.Send.Sender}
+	for _, route := range cfg.Send.UserRoutes {
+		senders = append(senders, route.Sender)
+	}
+	for _, ns := range cfg.Send.Senders {
+		senders = append(senders, ns.Sender)
+	}
+	for _, s := range senders {
+		if closer, ok := s.(io.Closer); ok {
+			closer.Close()
+		}
+	}
 }
@@ -0,0 +1,111 @@
+package ban
+
+import (
+	"sync"
+	"time"
+)
+
+// BanList tracks policy violations per source IP and temporarily bans addresses which repeatedly trigger them.
+type BanList struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	errors    map[string][]time.Time
+	bans      map[string]time.Time
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// Create a new ban list. An IP is banned for `duration` once it has accumulated `threshold` violations within
+// `window`. A threshold of zero disables automatic banning.
+func NewBanList(threshold int, window, duration time.Duration) *BanList {
+	return &BanList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		errors:    make(map[string][]time.Time),
+		bans:      make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// Change the threshold, window and ban duration, keeping the recorded violations and the bans in effect.
+func (b *BanList) SetLimits(threshold int, window, duration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = threshold
+	b.window = window
+	b.duration = duration
+}
+
+// Ban the IP until the provided time.
+func (b *BanList) Ban(ip string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans[ip] = until
+	delete(b.errors, ip)
+}
+
+// Returns true if the IP is currently banned. Expired bans are removed.
+func (b *BanList) IsBanned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, found := b.bans[ip]
+	if !found {
+		return false
+	}
+	if b.now().After(until) {
+		delete(b.bans, ip)
+		return false
+	}
+	return true
+}
+
+// Record a policy violation for the IP. Returns true if this violation caused the IP to be banned.
+func (b *BanList) RecordViolation(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 {
+		return false
+	}
+
+	now := b.now()
+	cutoff := now.Add(-b.window)
+	b.prune(now, cutoff)
+
+	// drop violations which have fallen out of the window
+	recent := b.errors[ip][:0]
+	for _, t := range b.errors[ip] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) >= b.threshold {
+		b.bans[ip] = now.Add(b.duration)
+		delete(b.errors, ip)
+		return true
+	}
+	b.errors[ip] = recent
+	return false
+}
+
+// Remove expired bans and violation histories so the tracked IPs stay bounded. Runs at most once per window.
+func (b *BanList) prune(now, cutoff time.Time) {
+	if now.Sub(b.lastPrune) < b.window {
+		return
+	}
+	b.lastPrune = now
+	for ip, until := range b.bans {
+		if now.After(until) {
+			delete(b.bans, ip)
+		}
+	}
+	for ip, times := range b.errors {
+		if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+			delete(b.errors, ip)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package ban
+
+import (
+	"testing"
+	"time"
+)
+
+// Set the ban list's clock to the time, returning a function moving it forward.
+func setClock(b *BanList, now time.Time) func(d time.Duration) {
+	b.now = func() time.Time { return now }
+	return func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func TestRecordViolation(t *testing.T) {
+	b := NewBanList(3, 10*time.Minute, time.Hour)
+	advance := setClock(b, time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+
+	// The threshold reached within the window bans the IP
+	for i := 1; i < 3; i++ {
+		if b.RecordViolation("192.0.2.10") {
+			t.Fatalf("violation %d banned the IP", i)
+		}
+		advance(time.Minute)
+	}
+	if b.IsBanned("192.0.2.10") {
+		t.Fatal("IP banned below the threshold")
+	}
+	if !b.RecordViolation("192.0.2.10") || !b.IsBanned("192.0.2.10") {
+		t.Fatal("IP not banned once it reached the threshold")
+	}
+
+	// Other IPs are counted separately
+	if b.IsBanned("192.0.2.11") || b.RecordViolation("192.0.2.11") {
+		t.Fatal("another IP was banned")
+	}
+}
+
+func TestRecordViolationWindow(t *testing.T) {
+	b := NewBanList(3, 10*time.Minute, time.Hour)
+	advance := setClock(b, time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+
+	// Violations which have fallen out of the window are not counted
+	b.RecordViolation("192.0.2.10")
+	b.RecordViolation("192.0.2.10")
+	advance(11 * time.Minute)
+	if b.RecordViolation("192.0.2.10") || b.IsBanned("192.0.2.10") {
+		t.Fatal("violations outside the window banned the IP")
+	}
+	advance(5 * time.Minute)
+	if b.RecordViolation("192.0.2.10") {
+		t.Fatal("two violations within the window banned the IP")
+	}
+	if !b.RecordViolation("192.0.2.10") {
+		t.Fatal("three violations within the window did not ban the IP")
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	b := NewBanList(1, 10*time.Minute, time.Hour)
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	advance := setClock(b, start)
+
+	if !b.RecordViolation("192.0.2.10") {
+		t.Fatal("violation did not ban the IP")
+	}
+	advance(59 * time.Minute)
+	if !b.IsBanned("192.0.2.10") {
+		t.Fatal("ban expired early")
+	}
+	advance(2 * time.Minute)
+	if b.IsBanned("192.0.2.10") {
+		t.Fatal("ban did not expire")
+	}
+
+	// Explicit bans last until the given time
+	b.Ban("192.0.2.11", start.Add(2*time.Hour))
+	if !b.IsBanned("192.0.2.11") {
+		t.Fatal("explicit ban not in effect")
+	}
+	advance(time.Hour)
+	if b.IsBanned("192.0.2.11") {
+		t.Fatal("explicit ban did not expire")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	b := NewBanList(0, 10*time.Minute, time.Hour)
+	for range 10 {
+		if b.RecordViolation("192.0.2.10") {
+			t.Fatal("a threshold of zero banned the IP")
+		}
+	}
+
+	// Enabling it keeps the list, and banning starts with the violations recorded from then on
+	b.SetLimits(2, 10*time.Minute, time.Hour)
+	if b.RecordViolation("192.0.2.10") || !b.RecordViolation("192.0.2.10") {
+		t.Fatal("the new threshold was not applied")
+	}
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/stapling"
+	"github.com/rs/zerolog/log"
+)
+
+// Certificates expiring within this duration are reported at startup
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// Clock of the certificate validity checks, replaced in tests
+var certNow = time.Now
+
+// Load the certificate and key of a listener, appending the intermediates of the chain file if set. The files must be
+// readable, the key must match the certificate, the certificate must be valid now, for the server name if set, and
+// issued by the first certificate of the chain file. Errors are prefixed by the name of the offending setting.
+func loadListenerCertificate(cfg *TLSConfig) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(cfg.CertFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cert_file: failed to read certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("key_file: failed to read private key: %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not match") {
+			return tls.Certificate{}, fmt.Errorf("key_file: private key does not match the certificate of '%s'", cfg.CertFile)
+		}
+		return tls.Certificate{}, fmt.Errorf("cert_file: failed to load TLS certificate/key: %v", err)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return tls.Certificate{}, fmt.Errorf("cert_file: invalid certificate: %v", err)
+		}
+	}
+
+	if cfg.ServerName != "" {
+		if !isValidDomain(cfg.ServerName) {
+			return tls.Certificate{}, fmt.Errorf("server_name: invalid domain '%s'", cfg.ServerName)
+		}
+		if err := leaf.VerifyHostname(cfg.ServerName); err != nil {
+			return tls.Certificate{}, fmt.Errorf("server_name: certificate of '%s' is not valid for '%s'", leaf.Subject.CommonName, cfg.ServerName)
+		}
+	}
+
+	now := certNow()
+	switch {
+	case now.After(leaf.NotAfter):
+		return tls.Certificate{}, fmt.Errorf("cert_file: certificate of '%s' expired on %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	case now.Before(leaf.NotBefore):
+		return tls.Certificate{}, fmt.Errorf("cert_file: certificate of '%s' is not valid before %s", leaf.Subject.CommonName, leaf.NotBefore.Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		log.Warn().Str("cert_file", cfg.CertFile).Str("subject", leaf.Subject.CommonName).Time("expires", leaf.NotAfter).Msg("TLS certificate expires soon")
+	}
+
+	if cfg.ChainFile != "" {
+		chain, err := readCertificates(cfg.ChainFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("chain_file: %v", err)
+		}
+		if err := leaf.CheckSignatureFrom(chain[0]); err != nil {
+			return tls.Certificate{}, fmt.Errorf("chain_file: certificate of '%s' is not issued by '%s': %v", leaf.Subject.CommonName, chain[0].Subject.CommonName, err)
+		}
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+	}
+	return cert, nil
+}
+
+// Selects the certificate of the TLS handshakes by the server name requested by the client (SNI), falling back to the
+// default certificate for clients requesting no name or another name.
+type sniCertificates struct {
+	def   *tls.Certificate
+	names map[string]*tls.Certificate // lowercase DNS names of the certificates, including wildcards (e.g. "*.example.com")
+}
+
+func (s *sniCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.names[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.names["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.def, nil
+}
+
+// Load the additional certificates of a listener, selected by the DNS names of their certificates. Two certificates,
+// including the default one, cannot claim the same name. Errors are prefixed by the name of the offending setting.
+func loadSNICertificates(def tls.Certificate, cfg *TLSConfig) (*sniCertificates, error) {
+	sni := &sniCertificates{def: &def, names: make(map[string]*tls.Certificate)}
+	claims := make(map[string]string) // setting of the certificate claiming each name
+	defNames, err := certificateNames(def)
+	if err != nil {
+		return nil, fmt.Errorf("cert_file: invalid certificate: %v", err)
+	}
+	for _, name := range defNames {
+		claims[name] = "cert_file"
+	}
+
+	for i, pair := range cfg.Certificates {
+		key := fmt.Sprintf("certificates[%d]", i)
+		if pair.CertFile == "" || pair.KeyFile == "" {
+			return nil, fmt.Errorf("%s: cert_file and key_file must be defined", key)
+		}
+		cert, err := loadListenerCertificate(&TLSConfig{CertFile: pair.CertFile, KeyFile: pair.KeyFile, ChainFile: pair.ChainFile})
+		if err != nil {
+			return nil, fmt.Errorf("%s.%v", key, err)
+		}
+		names, err := certificateNames(cert)
+		if err != nil {
+			return nil, fmt.Errorf("%s.cert_file: invalid certificate: %v", key, err)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("%s.cert_file: certificate of '%s' has no DNS names to select it by", key, pair.CertFile)
+		}
+		for _, name := range names {
+			if owner, ok := claims[name]; ok {
+				return nil, fmt.Errorf("%s.cert_file: name '%s' is already claimed by the certificate of %s", key, name, owner)
+			}
+			claims[name] = key
+			sni.names[name] = &cert
+		}
+	}
+	return sni, nil
+}
+
+// Returns the lowercase DNS names of the certificate.
+func certificateNames(cert tls.Certificate) ([]string, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(leaf.DNSNames))
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	return names, nil
+}
+
+// Create the stapler of the OCSP response of a listener certificate, whose issuer must follow it in the chain.
+func newListenerStapler(cert tls.Certificate) (*stapling.Stapler, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("the issuer of the certificate is required to request its OCSP response, set chain_file")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid issuer certificate: %v", err)
+	}
+	return stapling.NewStapler(cert, leaf, issuer)
+}
+
+// Read the PEM certificates of a file, in order.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificates: %v", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return certs, nil
+}
@@ -0,0 +1,328 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Test certificate with its key, written as PEM files
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// Issue a certificate valid between the times, signed by the parent or self-signed if nil.
+func issueTestCert(t *testing.T, name string, parent *testCert, notBefore, notAfter time.Time) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if strings.Contains(name, ".") {
+		template.DNSNames = []string{name}
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	tc := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	if err := os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// Validate the base configuration with an implicit TLS listener using the files.
+func validateTLSListener(t *testing.T, tlsCfg TLSConfig) (*Config, error) {
+	t.Helper()
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Listeners[0].Type = ListenerSMTPS
+	cfg.Recv.Listeners[0].TLS = &tlsCfg
+	return cfg, cfg.Validate()
+}
+
+func TestValidateListenerCertificate(t *testing.T) {
+	now := time.Now()
+	valid := issueTestCert(t, "relay.example.com", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	other := issueTestCert(t, "other.example.com", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	expired := issueTestCert(t, "expired.example.com", nil, now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+	future := issueTestCert(t, "future.example.com", nil, now.Add(24*time.Hour), now.Add(48*time.Hour))
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []struct {
+		name    string
+		tls     TLSConfig
+		wantErr string
+	}{
+		{"valid", TLSConfig{CertFile: valid.certFile, KeyFile: valid.keyFile}, ""},
+		{"unreadable certificate", TLSConfig{CertFile: missing, KeyFile: valid.keyFile}, "recv.listeners[0]: tls.cert_file: failed to read certificate"},
+		{"unreadable key", TLSConfig{CertFile: valid.certFile, KeyFile: missing}, "recv.listeners[0]: tls.key_file: failed to read private key"},
+		{"mismatched key", TLSConfig{CertFile: valid.certFile, KeyFile: other.keyFile}, "recv.listeners[0]: tls.key_file: private key does not match the certificate of '" + valid.certFile + "'"},
+		{"invalid certificate", TLSConfig{CertFile: valid.keyFile, KeyFile: valid.keyFile}, "recv.listeners[0]: tls.cert_file: failed to load TLS certificate/key"},
+		{"expired", TLSConfig{CertFile: expired.certFile, KeyFile: expired.keyFile}, "recv.listeners[0]: tls.cert_file: certificate of 'expired.example.com' expired on "},
+		{"not yet valid", TLSConfig{CertFile: future.certFile, KeyFile: future.keyFile}, "recv.listeners[0]: tls.cert_file: certificate of 'future.example.com' is not valid before "},
+		{"server name", TLSConfig{CertFile: valid.certFile, KeyFile: valid.keyFile, ServerName: "relay.example.com"}, ""},
+		{"invalid server name", TLSConfig{CertFile: valid.certFile, KeyFile: valid.keyFile, ServerName: "relay example"}, "recv.listeners[0]: tls.server_name: invalid domain 'relay example'"},
+		{"ocsp stapling without issuer", TLSConfig{CertFile: valid.certFile, KeyFile: valid.keyFile, OCSPStapling: true}, "recv.listeners[0]: tls.ocsp_stapling: the issuer of the certificate is required to request its OCSP response, set chain_file"},
+		{"server name not in certificate", TLSConfig{CertFile: valid.certFile, KeyFile: valid.keyFile, ServerName: "other.example.com"}, "recv.listeners[0]: tls.server_name: certificate of 'relay.example.com' is not valid for 'other.example.com'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := validateTLSListener(t, tt.tls)
+			if tt.wantErr == "" {
+				if err != nil || cfg.Recv.Listeners[0].TLSConfig == nil {
+					t.Fatalf("Validate: %v, TLS config = %v", err, cfg.Recv.Listeners[0].TLSConfig)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateListenerCertificateChain(t *testing.T) {
+	now := time.Now()
+	root := issueTestCert(t, "Root CA", nil, now.Add(-time.Hour), now.Add(365*24*time.Hour))
+	intermediate := issueTestCert(t, "Intermediate CA", root, now.Add(-time.Hour), now.Add(365*24*time.Hour))
+	leaf := issueTestCert(t, "relay.example.com", intermediate, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	cfg, err := validateTLSListener(t, TLSConfig{CertFile: leaf.certFile, KeyFile: leaf.keyFile, ChainFile: intermediate.certFile})
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	chain := cfg.Recv.Listeners[0].TLSConfig.Certificates[0].Certificate
+	if len(chain) != 2 || !bytes.Equal(chain[1], intermediate.cert.Raw) {
+		t.Errorf("served chain has %d certificates, want the leaf and the intermediate", len(chain))
+	}
+
+	// The chain must contain the issuer of the certificate
+	_, err = validateTLSListener(t, TLSConfig{CertFile: leaf.certFile, KeyFile: leaf.keyFile, ChainFile: root.certFile})
+	if err == nil || !strings.Contains(err.Error(), "recv.listeners[0]: tls.chain_file: certificate of 'relay.example.com' is not issued by 'Root CA'") {
+		t.Errorf("Validate with the root as chain: got %v, want a chain_file error", err)
+	}
+	_, err = validateTLSListener(t, TLSConfig{CertFile: leaf.certFile, KeyFile: leaf.keyFile, ChainFile: intermediate.certFile, OCSPStapling: true})
+	if err == nil || !strings.Contains(err.Error(), "recv.listeners[0]: tls.ocsp_stapling: certificate of 'relay.example.com' names no OCSP responder") {
+		t.Errorf("Validate with OCSP stapling: got %v, want an ocsp_stapling error", err)
+	}
+	_, err = validateTLSListener(t, TLSConfig{CertFile: leaf.certFile, KeyFile: leaf.keyFile, ChainFile: leaf.keyFile})
+	if err == nil || !strings.Contains(err.Error(), "recv.listeners[0]: tls.chain_file: no PEM certificate found") {
+		t.Errorf("Validate with a chain without certificates: got %v, want a chain_file error", err)
+	}
+}
+
+// Clients connecting to the server name verify the certificate of the listener.
+func TestListenerServerName(t *testing.T) {
+	now := time.Now()
+	cert := issueTestCert(t, "mail.example.com", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	cfg, err := validateTLSListener(t, TLSConfig{CertFile: cert.certFile, KeyFile: cert.keyFile, ServerName: "mail.example.com"})
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	serverTLS := cfg.Recv.Listeners[0].TLSConfig
+	if serverTLS.ServerName != "mail.example.com" {
+		t.Errorf("ServerName = %q, want mail.example.com", serverTLS.ServerName)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.cert)
+	state, err := tlsHandshake(t, serverTLS, &tls.Config{RootCAs: roots, ServerName: "mail.example.com"})
+	if err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if got := state.PeerCertificates[0].Subject.CommonName; got != "mail.example.com" {
+		t.Errorf("peer certificate = %q, want mail.example.com", got)
+	}
+}
+
+// Complete a handshake between the listener's TLS configuration and the client's, returning the client's state.
+func tlsHandshake(t *testing.T, serverTLS, clientTLS *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		tls.Server(serverConn, serverTLS).Handshake()
+	}()
+	client := tls.Client(clientConn, clientTLS)
+	err := client.Handshake()
+	return client.ConnectionState(), err
+}
+
+// Clients below the minimum version or offering only suites outside cipher_suites are refused.
+func TestListenerTLSVersionAndCipherSuites(t *testing.T) {
+	now := time.Now()
+	cert := issueTestCert(t, "mail.example.com", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	cfg, err := validateTLSListener(t, TLSConfig{CertFile: cert.certFile, KeyFile: cert.keyFile, MinVersion: "1.3"})
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	serverTLS := cfg.Recv.Listeners[0].TLSConfig
+	if _, err := tlsHandshake(t, serverTLS, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("TLS 1.2 client accepted with min_version 1.3")
+	}
+	state, err := tlsHandshake(t, serverTLS, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS 1.3 handshake: %v", err)
+	}
+	if state.Version != tls.VersionTLS13 {
+		t.Errorf("negotiated %s, want TLS 1.3", tls.VersionName(state.Version))
+	}
+
+	cfg, err = validateTLSListener(t, TLSConfig{CertFile: cert.certFile, KeyFile: cert.keyFile,
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}})
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	serverTLS = cfg.Recv.Listeners[0].TLSConfig
+	if _, err := tlsHandshake(t, serverTLS, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}}); err == nil {
+		t.Error("client offering only a disallowed cipher suite was accepted")
+	}
+	state, err = tlsHandshake(t, serverTLS, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}})
+	if err != nil {
+		t.Fatalf("TLS 1.2 handshake: %v", err)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("negotiated %s, want TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", tls.CipherSuiteName(state.CipherSuite))
+	}
+}
+
+func TestValidateListenerCertificateExpiresSoon(t *testing.T) {
+	var logs bytes.Buffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	now := time.Now()
+	soon := issueTestCert(t, "relay.example.com", nil, now.Add(-80*24*time.Hour), now.Add(10*24*time.Hour))
+	if _, err := validateTLSListener(t, TLSConfig{CertFile: soon.certFile, KeyFile: soon.keyFile}); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if !strings.Contains(logs.String(), "TLS certificate expires soon") {
+		t.Errorf("logs = %q, want an expiry warning", logs.String())
+	}
+
+	// Certificates expiring later are not reported
+	logs.Reset()
+	certNow = func() time.Time { return now.Add(-30 * 24 * time.Hour) }
+	t.Cleanup(func() { certNow = time.Now })
+	if _, err := validateTLSListener(t, TLSConfig{CertFile: soon.certFile, KeyFile: soon.keyFile}); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("logs = %q, want no warning 40 days before the expiry", logs.String())
+	}
+}
+
+// Clients requesting the name of an additional certificate are served that certificate, other clients the default one.
+func TestListenerSNICertificates(t *testing.T) {
+	now := time.Now()
+	def := issueTestCert(t, "relay.example.com", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	alpha := issueTestCert(t, "mail.alpha.example", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	beta := issueTestCert(t, "mail.beta.example", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	cfg, err := validateTLSListener(t, TLSConfig{CertFile: def.certFile, KeyFile: def.keyFile, Certificates: []CertificatePair{
+		{CertFile: alpha.certFile, KeyFile: alpha.keyFile},
+		{CertFile: beta.certFile, KeyFile: beta.keyFile},
+	}})
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	for _, tt := range []struct{ serverName, want string }{
+		{"mail.alpha.example", "mail.alpha.example"},
+		{"MAIL.BETA.EXAMPLE.", "mail.beta.example"},
+		{"relay.example.com", "relay.example.com"},
+		{"other.example.com", "relay.example.com"},
+		{"", "relay.example.com"},
+	} {
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			tls.Server(serverConn, cfg.Recv.Listeners[0].TLSConfig).Handshake()
+		}()
+		client := tls.Client(clientConn, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("Handshake with SNI %q: %v", tt.serverName, err)
+		}
+		if got := client.ConnectionState().PeerCertificates[0].Subject.CommonName; got != tt.want {
+			t.Errorf("SNI %q served the certificate of %q, want %q", tt.serverName, got, tt.want)
+		}
+		clientConn.Close()
+	}
+}
+
+func TestValidateListenerSNICertificates(t *testing.T) {
+	now := time.Now()
+	def := issueTestCert(t, "relay.example.com", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	alpha := issueTestCert(t, "mail.alpha.example", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	noName := issueTestCert(t, "Relay", nil, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []struct {
+		name    string
+		pairs   []CertificatePair
+		ocsp    bool
+		wantErr string
+	}{
+		{"missing key", []CertificatePair{{CertFile: alpha.certFile}}, false, "recv.listeners[0]: tls.certificates[0]: cert_file and key_file must be defined"},
+		{"unreadable", []CertificatePair{{CertFile: missing, KeyFile: alpha.keyFile}}, false, "recv.listeners[0]: tls.certificates[0].cert_file: failed to read certificate"},
+		{"no names", []CertificatePair{{CertFile: noName.certFile, KeyFile: noName.keyFile}}, false, "recv.listeners[0]: tls.certificates[0].cert_file: certificate of '" + noName.certFile + "' has no DNS names to select it by"},
+		{"name of the default", []CertificatePair{{CertFile: def.certFile, KeyFile: def.keyFile}}, false, "recv.listeners[0]: tls.certificates[0].cert_file: name 'relay.example.com' is already claimed by the certificate of cert_file"},
+		{"duplicate", []CertificatePair{{CertFile: alpha.certFile, KeyFile: alpha.keyFile}, {CertFile: alpha.certFile, KeyFile: alpha.keyFile}}, false, "recv.listeners[0]: tls.certificates[1].cert_file: name 'mail.alpha.example' is already claimed by the certificate of certificates[0]"},
+		{"ocsp stapling", []CertificatePair{{CertFile: alpha.certFile, KeyFile: alpha.keyFile}}, true, "recv.listeners[0]: tls.ocsp_stapling: cannot be combined with certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateTLSListener(t, TLSConfig{CertFile: def.certFile, KeyFile: def.keyFile, Certificates: tt.pairs, OCSPStapling: tt.ocsp})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
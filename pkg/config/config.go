@@ -1,16 +1,32 @@
 package config
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/goodieshq/gopostal/pkg/auth"
+	"github.com/goodieshq/gopostal/pkg/ban"
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/greylist"
+	"github.com/goodieshq/gopostal/pkg/hooks"
+	"github.com/goodieshq/gopostal/pkg/logging"
+	"github.com/goodieshq/gopostal/pkg/quota"
+	"github.com/goodieshq/gopostal/pkg/secrets"
 	"github.com/goodieshq/gopostal/pkg/sender"
-	"gopkg.in/yaml.v3"
+	"github.com/goodieshq/gopostal/pkg/utils"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 // Listener service can either listen in plaintext or explicit/implicit TLS modes
@@ -20,6 +36,7 @@ const (
 	ListenerSMTP     ListenerType = "smtp"     // plaintext (optionally upgradeable if you enable STARTTLS here)
 	ListenerSMTPS    ListenerType = "smtps"    // implicit TLS (465-style)
 	ListenerSTARTTLS ListenerType = "starttls" // explicit TLS (587-style)
+	ListenerLMTP     ListenerType = "lmtp"     // plaintext LMTP (RFC 2033) for local delivery agents, replying for each recipient
 )
 
 type AuthMode string
@@ -32,82 +49,387 @@ const (
 )
 
 type Config struct {
-	Recv RecvConfig `yaml:"recv"`
-	Send SendConfig `yaml:"send"`
+	Recv       RecvConfig       `yaml:"recv"`
+	Send       SendConfig       `yaml:"send"`
+	Metrics    MetricsConfig    `yaml:"metrics,omitempty"`
+	Monitoring MonitoringConfig `yaml:"monitoring,omitempty"`
+	System     SystemConfig     `yaml:"system,omitempty"`
+	Log        LogConfig        `yaml:"log,omitempty"`
 }
 
-func LoadConfig(path string) (*Config, error) {
+// Load and validate a configuration file. If strict is true, unknown keys are rejected.
+func LoadConfig(path string, strict bool) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return LoadConfigBytes(data)
+	return LoadConfigBytes(data, strict)
 }
 
-func LoadConfigBytes(data []byte) (*Config, error) {
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+func LoadConfigBytes(data []byte, strict bool) (*Config, error) {
+	cfg, err := ParseConfigBytes(data, strict)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load a configuration file and merge the override file over it (see MergeConfigs) before validating the result.
+func LoadConfigWithOverride(path, overridePath string, strict bool) (*Config, error) {
+	base, err := ParseConfig(path, strict)
+	if err != nil {
+		return nil, err
+	}
+	override, err := ParseConfig(overridePath, strict)
+	if err != nil {
 		return nil, err
 	}
+
+	cfg := MergeConfigs(base, override)
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
+	return cfg, nil
+}
+
+// Read a configuration file without validating it.
+func ParseConfig(path string, strict bool) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := ParseConfigBytes(data, strict)
+	if err != nil {
+		return nil, fmt.Errorf("%s:\n%w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse a configuration without validating it.
+func ParseConfigBytes(data []byte, strict bool) (*Config, error) {
+	var cfg Config
+	if err := decodeConfig(data, &cfg, strict); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
+// Validate the configuration, apply defaults and create the runtime objects it describes. Every section is checked
+// so all problems are reported at once; the sender is only created (and its client secret resolved) once the rest of
+// the configuration is valid.
 func (c *Config) Validate() error {
-	// Validate SendConfig
+	ApplyDefaults(c)
+
+	var errs []error
+	for _, validate := range []func() error{
+		c.validateListeners,
+		c.validatePrivilegedPorts,
+		c.validateReloadDrain,
+		c.validateAuth,
+		c.validateMailPolicy,
+		c.validateAllowedIPs,
+		c.validateLimits,
+		c.validateAutoBlock,
+		c.validateNOOP,
+		c.validateReadBuffer,
+		c.validateServer,
+		c.validatePartialFailure,
+		c.validateGreylist,
+		c.validateTrace,
+		c.validateFailureSpill,
+		c.validateFilters,
+		c.validateAttachmentPolicy,
+		c.validateCustomErrors,
+		c.validateDSN,
+		c.validateInjectMessageID,
+		c.validateHooks,
+		c.validateSideEffects,
+		c.validateQuotas,
+		c.validateLogLevels,
+		c.validateHTTP,
+		c.validateSend,
+		c.validateFooter,
+		c.validateMIMEPassthrough,
+		c.validateMonitoring,
+		c.validateMetrics,
+		c.validateLog,
+	} {
+		if err := validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return c.buildSender()
+}
+
+// Carry the runtime state of the previous configuration over to this reloaded one, so a reload does not lift the bans
+// or reset the DSN rate limits, the greylisted triplets or the quota usage, and the messages received across the reload
+// share one memory budget. The state objects of prev are kept with the settings of this configuration; those of the
+// greylist and quotas only if both configurations keep them in the same state file.
+func (c *Config) KeepState(prev *Config) {
+	if ab := &c.Recv.AutoBlock; c.Recv.BanList != nil && prev.Recv.BanList != nil {
+		prev.Recv.BanList.SetLimits(ab.ErrorThreshold, ab.Window, ab.BlockDuration)
+		c.Recv.BanList = prev.Recv.BanList
+	}
+	if l := &c.Recv.Limits; l.DataMemory != nil && prev.Recv.Limits.DataMemory != nil {
+		prev.Recv.Limits.DataMemory.SetSize(l.MaxDataMemory)
+		l.DataMemory = prev.Recv.Limits.DataMemory
+	}
+	if dsn := &c.Recv.DSN; dsn.Limiter != nil && prev.Recv.DSN.Limiter != nil {
+		prev.Recv.DSN.Limiter.SetLimit(dsn.RateLimit, time.Hour)
+		dsn.Limiter = prev.Recv.DSN.Limiter
+	}
+	if g, pg := &c.Recv.Greylist, &prev.Recv.Greylist; g.Store != nil && pg.Store != nil && g.StateFile == pg.StateFile {
+		pg.Store.SetLimits(g.Delay, g.Retention, g.MaxEntries)
+		g.Store = pg.Store
+	}
+	if q, pq := c.Recv.Quotas, prev.Recv.Quotas; q != nil && pq != nil && q.Tracker != nil && pq.Tracker != nil && q.StateFile == pq.StateFile {
+		pq.Tracker.Reconfigure(q.Tracker)
+		q.Tracker = pq.Tracker
+	}
+}
+
+// Validate the listeners, loading their TLS configuration and socket permissions.
+func (c *Config) validateListeners() error {
 	if len(c.Recv.Listeners) == 0 {
 		return errors.New("recv.listeners: at least one listener must be defined")
 	}
 
 	seenNames := make(map[string]int)
-	seenPorts := make(map[uint16]string)
+	seenAddrs := make(map[int][]boundAddr)
+	seenSockets := make(map[string]string)
 
+	var errs []error
 	for i := range c.Recv.Listeners {
-		listener := &c.Recv.Listeners[i]
-		prefix := fmt.Sprintf("recv.listeners[%d]: ", i)
-		// validate name is valid and unique
-		if listener.Name == "" {
-			return errors.New(prefix + "name: must be defined")
+		if err := validateListener(&c.Recv.Listeners[i], i, seenNames, seenAddrs, seenSockets); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the user ID of the process (-1 on Windows), replaced in tests
+var getuid = os.Getuid
+
+// Ports below this one can only be bound by root on Linux, unless the process has the CAP_NET_BIND_SERVICE capability
+// or net.ipv4.ip_unprivileged_port_start is lowered
+const firstUnprivilegedPort = 1024
+
+// Check the listener ports can be bound by the user the process is running as, so a relay started as a non-root user
+// does not fail once some of its servers are running. Privileged ports are logged, or refused with
+// system.strict_port_check.
+func (c *Config) validatePrivilegedPorts() error {
+	uid := getuid()
+	if uid <= 0 {
+		return nil
+	}
+	var errs []error
+	for i, listener := range c.Recv.Listeners {
+		port := listener.TCPPort()
+		if port == 0 || port >= firstUnprivilegedPort {
+			continue
 		}
-		if other, exists := seenNames[listener.Name]; exists {
-			return fmt.Errorf(prefix+"name: duplicate listener name '%s' (used by recv.listeners[%d])", listener.Name, other)
+		if c.System.StrictPortCheck {
+			errs = append(errs, fmt.Errorf("recv.listeners[%d]: addr: port %d is privileged and the process is not running as root (uid %d)", i, port, uid))
+		} else if c.System.WarnPrivilegedPorts() {
+			log.Warn().Str("listener", listener.Name).Int("port", port).Int("uid", uid).Msg("Listener port below 1024 may fail to bind when not running as root")
 		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the time the sessions in progress are given to end when the configuration is reloaded.
+func (c *Config) validateReloadDrain() error {
+	if c.System.ReloadDrainTimeout < 0 {
+		return fmt.Errorf("system.reload_drain_timeout: must be a non-negative duration, got %s", c.System.ReloadDrainTimeout)
+	}
+	return nil
+}
+
+// A TCP address bound by a listener
+type boundAddr struct {
+	name string
+	ip   net.IP // nil for every interface
+}
+
+// Returns true if the addresses, bound to the same port, cannot both be bound: binding every interface conflicts with
+// any address.
+func (a boundAddr) conflicts(ip net.IP) bool {
+	return a.ip == nil || a.ip.IsUnspecified() || ip == nil || ip.IsUnspecified() || a.ip.Equal(ip)
+}
+
+// Validate a single listener. Names, addresses and socket paths must be unique across listeners. The address is
+// normalized to a numeric port, a plain port number (or the older port setting) binding every interface.
+func validateListener(listener *ListenerConfig, i int, seenNames map[string]int, seenAddrs map[int][]boundAddr, seenSockets map[string]string) error {
+	prefix := fmt.Sprintf("recv.listeners[%d]: ", i)
+	var errs []error
+	// validate name is valid and unique
+	if listener.Name == "" {
+		errs = append(errs, errors.New(prefix+"name: must be defined"))
+	} else if other, exists := seenNames[listener.Name]; exists {
+		errs = append(errs, fmt.Errorf(prefix+"name: duplicate listener name '%s' (used by recv.listeners[%d])", listener.Name, other))
+	} else {
 		seenNames[listener.Name] = i
+	}
 
-		// validte port is valid and unique
-		if listener.Port == 0 {
-			return fmt.Errorf(prefix+"port: must be a valid TCP port (1-65535), got %d", listener.Port)
+	if listener.DeprecatedPort != 0 {
+		if listener.Addr != "" {
+			errs = append(errs, errors.New(prefix+"port: cannot be combined with addr"))
+		} else {
+			listener.Addr, listener.DeprecatedPort = strconv.Itoa(int(listener.DeprecatedPort)), 0
 		}
-		if other, exists := seenPorts[listener.Port]; exists {
-			return fmt.Errorf(prefix+"port: duplicate port %d used by '%s'", listener.Port, other)
+	}
+
+	if listener.IsUnix() {
+		// validate the socket path is unique and not combined with a TCP address
+		if listener.Addr != "" {
+			errs = append(errs, errors.New(prefix+"socket_path: cannot be combined with addr"))
+		}
+		if other, exists := seenSockets[listener.SocketPath]; exists {
+			errs = append(errs, fmt.Errorf(prefix+"socket_path: duplicate socket path '%s' used by '%s'", listener.SocketPath, other))
+		} else {
+			seenSockets[listener.SocketPath] = listener.Name
+		}
+		if err := validateSocket(listener, prefix); err != nil {
+			errs = append(errs, err)
 		}
-		seenPorts[listener.Port] = listener.Name
+	} else if err := validateListenerAddr(listener, seenAddrs); err != nil {
+		errs = append(errs, errors.New(prefix+err.Error()))
+	}
 
-		// validate listener type and TLS config
-		switch listener.Type {
-		case ListenerSMTP:
-			// no TLS config required
-		case ListenerSMTPS, ListenerSTARTTLS:
-			if listener.TLS == nil || listener.TLS.CertFile == "" || listener.TLS.KeyFile == "" {
-				return fmt.Errorf(prefix+"tls: TLS configuration must be provided for listener type '%s'", listener.Type)
-			}
-			cert, err := tls.LoadX509KeyPair(listener.TLS.CertFile, listener.TLS.KeyFile)
-			if err != nil {
-				return fmt.Errorf(prefix+"tls: failed to load TLS certificate/key: %v", err)
-			}
-			listener.TLSConfig = &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				MinVersion:   tls.VersionTLS12,
-			}
-		default:
-			return fmt.Errorf(prefix+"type: invalid listener type '%s', must be one of: 'smtp', 'smtps', or 'starttls'", listener.Type)
+	// validate forced recipients
+	for j, addr := range listener.ForceRecipients {
+		if !isValidEmail(addr) {
+			errs = append(errs, fmt.Errorf(prefix+"force_recipients[%d]: invalid email address '%s'", j, addr))
+		}
+	}
+
+	if _, err := sender.ParsePriority(listener.Priority); err != nil {
+		errs = append(errs, fmt.Errorf(prefix+"priority: %v", err))
+	}
+
+	// validate listener type and TLS config
+	switch listener.Type {
+	case ListenerSMTP, ListenerLMTP:
+		// no TLS config required
+	case ListenerSMTPS, ListenerSTARTTLS:
+		if err := validateListenerTLS(listener, prefix); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf(prefix+"type: invalid listener type '%s', must be one of: 'smtp', 'smtps', 'starttls', or 'lmtp'", listener.Type))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the TCP address of a listener is valid and not bound by another listener, normalizing it to a numeric
+// port.
+func validateListenerAddr(listener *ListenerConfig, seenAddrs map[int][]boundAddr) error {
+	if listener.Addr == "" {
+		return errors.New("addr: must be defined (e.g. \":587\")")
+	}
+	if _, err := strconv.ParseUint(listener.Addr, 10, 16); err == nil {
+		listener.Addr = ":" + listener.Addr
+	}
+	host, _, err := net.SplitHostPort(listener.Addr)
+	if err != nil {
+		return fmt.Errorf("addr: invalid address '%s': %v", listener.Addr, err)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", listener.Addr)
+	if err != nil {
+		return fmt.Errorf("addr: invalid address '%s': %v", listener.Addr, err)
+	}
+	if tcpAddr.Port == 0 {
+		return fmt.Errorf("addr: must include a valid TCP port (1-65535), got '%s'", listener.Addr)
+	}
+	for _, other := range seenAddrs[tcpAddr.Port] {
+		if other.conflicts(tcpAddr.IP) {
+			return fmt.Errorf("addr: port %d already bound by '%s'", tcpAddr.Port, other.name)
+		}
+	}
+	seenAddrs[tcpAddr.Port] = append(seenAddrs[tcpAddr.Port], boundAddr{name: listener.Name, ip: tcpAddr.IP})
+	listener.Addr = net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port))
+	return nil
+}
+
+// Load the certificates of a TLS listener and create its TLS configuration, reporting errors with the given prefix.
+func validateListenerTLS(listener *ListenerConfig, prefix string) error {
+	if listener.TLS == nil || listener.TLS.CertFile == "" || listener.TLS.KeyFile == "" {
+		return fmt.Errorf(prefix+"tls: TLS configuration must be provided for listener type '%s'", listener.Type)
+	}
+	cert, err := loadListenerCertificate(listener.TLS)
+	if err != nil {
+		return fmt.Errorf(prefix+"tls.%v", err)
+	}
+	listener.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   listener.TLS.ALPN,
+		ServerName:   listener.TLS.ServerName,
+	}
+
+	var errs []error
+	if listener.TLS.MinVersion != "" {
+		if listener.TLSConfig.MinVersion, err = ParseTLSVersion(listener.TLS.MinVersion); err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"tls.min_version: %v", err))
+		}
+	}
+	if listener.TLS.MaxVersion != "" {
+		if listener.TLSConfig.MaxVersion, err = ParseTLSVersion(listener.TLS.MaxVersion); err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"tls.max_version: %v", err))
+		} else if listener.TLSConfig.MaxVersion < listener.TLSConfig.MinVersion {
+			errs = append(errs, fmt.Errorf(prefix+"tls.max_version: '%s' is lower than the minimum version", listener.TLS.MaxVersion))
+		}
+	}
+	if len(listener.TLS.CipherSuites) > 0 {
+		if listener.TLSConfig.CipherSuites, err = ParseCipherSuites(listener.TLS.CipherSuites); err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"tls.cipher_suites: %v", err))
+		}
+	}
+	if len(listener.TLS.Certificates) > 0 {
+		if sni, err := loadSNICertificates(cert, listener.TLS); err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"tls.%v", err))
+		} else {
+			listener.TLSConfig.GetCertificate = sni.GetCertificate
+		}
+	}
+	switch {
+	case listener.TLS.OCSPStapling && len(listener.TLS.Certificates) > 0:
+		// The stapler only staples the response of the default certificate
+		errs = append(errs, errors.New(prefix+"tls.ocsp_stapling: cannot be combined with certificates"))
+	case listener.TLS.OCSPStapling:
+		if listener.OCSPStapler, err = newListenerStapler(cert); err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"tls.ocsp_stapling: %v", err))
+		} else {
+			listener.TLSConfig.GetConfigForClient = listener.OCSPStapler.GetConfigForClient(listener.TLSConfig)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the authentication mode and credentials and create the authenticator.
+func (c *Config) validateAuth() error {
+	var errs []error
+	nets, err := ParseCIDRList(c.Recv.Auth.TrustedNetworks)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("recv.auth.trusted_networks: %v", err))
+	}
+	c.Recv.Auth.TrustedNets = nets
+
+	// LMTP clients do not authenticate, so LMTP listeners on a TCP port only accept the trusted networks by default
+	for i, listener := range c.Recv.Listeners {
+		if listener.Type == ListenerLMTP && !listener.IsUnix() && !listener.AllowUntrusted && len(c.Recv.Auth.TrustedNetworks) == 0 {
+			errs = append(errs, fmt.Errorf("recv.listeners[%d]: type: 'lmtp' listeners on a TCP port require recv.auth.trusted_networks, unless allow_untrusted is set", i))
 		}
 	}
 
-	// Validate Authentication mode and users if required
 	switch c.Recv.Auth.Mode {
 	case AuthDisabled, AuthAnonymous, AuthPlainAny:
 		c.Recv.Authenticator = auth.NewAuthenticatorAlwaysAllow()
@@ -115,147 +437,1219 @@ func (c *Config) Validate() error {
 	case AuthPlain:
 		creds := make(map[string]string, len(c.Recv.Auth.Credentials))
 		if len(c.Recv.Auth.Credentials) == 0 {
-			return errors.New("recv.auth.credentials: at least one credential must be defined for 'plain' authentication mode")
+			errs = append(errs, errors.New("recv.auth.credentials: at least one credential must be defined for 'plain' authentication mode"))
 		}
-		for i, cred := range c.Recv.Auth.Credentials {
-			if cred.Username == "" || cred.Password == "" {
-				return fmt.Errorf("recv.auth.credentials[%d]: username and password must be defined", i)
+		for i := range c.Recv.Auth.Credentials {
+			cred := &c.Recv.Auth.Credentials[i]
+			if err := resolveSecret(&cred.Password, "", cred.PasswordFile, fmt.Sprintf("recv.auth.credentials[%d].password", i)); err != nil {
+				errs = append(errs, err)
+			} else if cred.Username == "" || cred.Password == "" {
+				errs = append(errs, fmt.Errorf("recv.auth.credentials[%d]: username and password must be defined", i))
 			}
 			creds[cred.Username] = cred.Password
+			for j, entry := range cred.AllowedFrom {
+				if strings.Contains(entry, "@") && !isValidEmail(entry) {
+					errs = append(errs, fmt.Errorf("recv.auth.credentials[%d].allowed_from[%d]: invalid email address '%s'", i, j, entry))
+				}
+				if !strings.Contains(entry, "@") && !isValidDomain(entry) {
+					errs = append(errs, fmt.Errorf("recv.auth.credentials[%d].allowed_from[%d]: invalid domain '%s'", i, j, entry))
+				}
+			}
 		}
 		c.Recv.Authenticator = auth.NewAuthenticatorPlaintext(creds)
 	default:
-		return fmt.Errorf("recv.auth.mode: invalid authentication mode '%s', must be one of: 'disabled', 'anonymous', 'plain', or 'plain-any'", c.Recv.Auth.Mode)
+		errs = append(errs, fmt.Errorf("recv.auth.mode: invalid authentication mode '%s', must be one of: 'disabled', 'anonymous', 'plain', or 'plain-any'", c.Recv.Auth.Mode))
 	}
 
-	// Validate Mail Policy (senders and recipients)
-	if len(c.Recv.ValidFrom.Addresses) > 0 {
-		for i, addr := range c.Recv.ValidFrom.Addresses {
+	// Only the credentials of the 'plain' mode name the addresses of their users
+	if c.Recv.Auth.BindSender && c.Recv.Auth.Mode != AuthPlain {
+		errs = append(errs, fmt.Errorf("recv.auth.bind_sender: requires the 'plain' authentication mode, not '%s'", c.Recv.Auth.Mode))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the sender and recipient address policies.
+func (c *Config) validateMailPolicy() error {
+	return errors.Join(
+		validateMailPolicy(&c.Recv.ValidFrom, "recv.valid_from"),
+		validateMailPolicy(&c.Recv.ValidTo, "recv.valid_to"),
+	)
+}
+
+// Validate the allowed and denied addresses and domains of a policy, reporting errors under the given key.
+func validateMailPolicy(p *MailPolicy, key string) error {
+	var errs []error
+	for _, list := range []struct {
+		name      string
+		addresses []string
+	}{{"addresses", p.Addresses}, {"denied_addresses", p.DeniedAddresses}} {
+		for i, addr := range list.addresses {
 			if addr == "" {
-				return fmt.Errorf("recv.valid_from.addresses[%d]: address must be defined", i)
-			}
-			if !isValidEmail(addr) {
-				return fmt.Errorf("recv.valid_from.addresses[%d]: invalid email address '%s'", i, addr)
+				errs = append(errs, fmt.Errorf("%s.%s[%d]: address must be defined", key, list.name, i))
+			} else if !isValidEmail(addr) {
+				errs = append(errs, fmt.Errorf("%s.%s[%d]: invalid email address '%s'", key, list.name, i, addr))
 			}
 		}
 	}
-	if len(c.Recv.ValidFrom.Domains) > 0 {
-		for i, dom := range c.Recv.ValidFrom.Domains {
+	for _, list := range []struct {
+		name    string
+		domains []string
+	}{{"domains", p.Domains}, {"denied_domains", p.DeniedDomains}} {
+		for i, dom := range list.domains {
 			if dom == "" {
-				return fmt.Errorf("recv.valid_from.domains[%d]: domain must be defined", i)
-			}
-			if !isValidDomain(dom) {
-				return fmt.Errorf("recv.valid_from.domains[%d]: invalid domain '%s'", i, dom)
+				errs = append(errs, fmt.Errorf("%s.%s[%d]: domain must be defined", key, list.name, i))
+			} else if !isValidDomain(dom) {
+				errs = append(errs, fmt.Errorf("%s.%s[%d]: invalid domain '%s'", key, list.name, i, dom))
 			}
 		}
 	}
-	if len(c.Recv.ValidTo.Addresses) > 0 {
-		for i, addr := range c.Recv.ValidTo.Addresses {
-			if addr == "" {
-				return fmt.Errorf("recv.valid_to.addresses[%d]: address must be defined", i)
-			}
-			if !isValidEmail(addr) {
-				return fmt.Errorf("recv.valid_to.addresses[%d]: invalid email address '%s'", i, addr)
-			}
-		}
+	if err := validateEnforcement(p.Enforcement, key+".enforcement: "); err != nil {
+		errs = append(errs, err)
 	}
-	if len(c.Recv.ValidTo.Domains) > 0 {
-		for i, dom := range c.Recv.ValidTo.Domains {
-			if dom == "" {
-				return fmt.Errorf("recv.valid_to.domains[%d]: domain must be defined", i)
-			}
-			if !isValidDomain(dom) {
-				return fmt.Errorf("recv.valid_to.domains[%d]: invalid domain '%s'", i, dom)
-			}
-		}
+	return errors.Join(errs...)
+}
+
+// Validate the enforcement mode of a policy rule, reporting errors with the given prefix.
+func validateEnforcement(e Enforcement, prefix string) error {
+	switch e {
+	case EnforcementEnforce, EnforcementMonitor:
+		return nil
 	}
+	return fmt.Errorf(prefix+"must be one of '%s' or '%s'", EnforcementEnforce, EnforcementMonitor)
+}
 
-	// Validate AllowedIPs
+// Parse the allowed IP addresses and networks, allowing all addresses if none are configured.
+func (c *Config) validateAllowedIPs() error {
 	if len(c.Recv.AllowedIPs) > 0 {
-		for i, ip := range c.Recv.AllowedIPs {
-			if ip == "" {
-				return fmt.Errorf("recv.allowed_ips[%d]: IP address or CIDR must be defined", i)
-			}
-			net, err := ParseNet(ip)
-			if err != nil {
-				return fmt.Errorf("recv.allowed_ips[%d]: invalid IP address or CIDR '%s': %v", i, ip, err)
-			}
-			c.Recv.AllowedNets = append(c.Recv.AllowedNets, *net)
+		nets, err := ParseCIDRList(c.Recv.AllowedIPs)
+		if err != nil {
+			return fmt.Errorf("recv.allowed_ips: %v", err)
 		}
+		c.Recv.AllowedNets = nets
 	} else {
 		c.Recv.AllowedNets = []net.IPNet{
 			{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},  // allow all IPv4
 			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, // allow all IPv6
 		}
 	}
+	return nil
+}
 
-	// Validate Limits
+// Validate the message limits.
+func (c *Config) validateLimits() error {
+	var errs []error
 	if c.Recv.Limits.MaxSize < 0 {
-		return fmt.Errorf("recv.limits.max_size: must be a non-negative integer, got %d", c.Recv.Limits.MaxSize)
-	}
-	if c.Recv.Limits.MaxSize == 0 {
-		c.Recv.Limits.MaxSize = 25 * 1024 * 1024 // default to 25 MiB
+		errs = append(errs, fmt.Errorf("recv.limits.max_size: must be a non-negative integer, got %d", c.Recv.Limits.MaxSize))
 	}
 
 	if c.Recv.Limits.MaxRecipients < 0 {
-		return fmt.Errorf("recv.limits.max_recipients: must be a non-negative integer, got %d", c.Recv.Limits.MaxRecipients)
+		errs = append(errs, fmt.Errorf("recv.limits.max_recipients: must be a non-negative integer, got %d", c.Recv.Limits.MaxRecipients))
 	}
-	if c.Recv.Limits.MaxRecipients == 0 {
-		c.Recv.Limits.MaxRecipients = 100 // default to 100 recipients
+
+	if c.Recv.Limits.MaxSubjectLength < 0 {
+		errs = append(errs, fmt.Errorf("recv.limits.max_subject_length: must be a non-negative integer, got %d", c.Recv.Limits.MaxSubjectLength))
 	}
 
 	if c.Recv.Limits.Timeout < 0 {
-		return fmt.Errorf("recv.limits.read_timeout: must be a non-negative duration, got %s", c.Recv.Limits.Timeout.String())
+		errs = append(errs, fmt.Errorf("recv.limits.read_timeout: must be a non-negative duration, got %s", c.Recv.Limits.Timeout.String()))
+	}
+
+	if c.Recv.Limits.MaxMessagesPerConnection < 0 {
+		errs = append(errs, fmt.Errorf("recv.limits.max_messages_per_connection: must be a non-negative integer, got %d", c.Recv.Limits.MaxMessagesPerConnection))
+	}
+
+	if c.Recv.Limits.MaxBytesPerConnection < 0 {
+		errs = append(errs, fmt.Errorf("recv.limits.max_bytes_per_connection: must be a non-negative integer, got %d", c.Recv.Limits.MaxBytesPerConnection))
+	}
+
+	if c.Recv.Limits.MaxDataMemory < int64(c.Recv.Limits.MaxSize) {
+		errs = append(errs, fmt.Errorf("recv.limits.max_data_memory: must be at least max_size (%d), got %d", c.Recv.Limits.MaxSize, c.Recv.Limits.MaxDataMemory))
+	}
+
+	if c.Recv.Limits.DataMemoryWait < 0 {
+		errs = append(errs, fmt.Errorf("recv.limits.data_memory_wait: must be a non-negative duration, got %s", c.Recv.Limits.DataMemoryWait.String()))
+	}
+
+	if c.Recv.Limits.MemorySpoolThreshold < 0 {
+		errs = append(errs, fmt.Errorf("recv.limits.memory_spool_threshold: must be a non-negative integer, got %d", c.Recv.Limits.MemorySpoolThreshold))
+	} else if c.Recv.Limits.MemorySpoolThreshold > 0 {
+		if err := checkWritableDir(c.Recv.SpoolDir); err != nil {
+			errs = append(errs, fmt.Errorf("recv.spool_dir: %w", err))
+		}
+	}
+
+	if c.Recv.Limits.MaxBodySize < 0 {
+		errs = append(errs, fmt.Errorf("recv.limits.max_body_size: must be a non-negative integer, got %d", c.Recv.Limits.MaxBodySize))
+	}
+
+	if c.Recv.Limits.MaxHTMLElements < 0 {
+		errs = append(errs, fmt.Errorf("recv.limits.max_html_elements: must be a non-negative integer, got %d", c.Recv.Limits.MaxHTMLElements))
+	}
+
+	switch c.Recv.Limits.BodyLimitAction {
+	case BodyLimitReject, BodyLimitTruncate:
+	default:
+		errs = append(errs, fmt.Errorf("recv.limits.body_limit_action: must be one of '%s' or '%s', got '%s'", BodyLimitReject, BodyLimitTruncate, c.Recv.Limits.BodyLimitAction))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	c.Recv.Limits.DataMemory = utils.NewSemaphore(c.Recv.Limits.MaxDataMemory)
+	return nil
+}
+
+// Validate the auto-block settings and create the ban list.
+func (c *Config) validateAutoBlock() error {
+	var errs []error
+	if c.Recv.AutoBlock.ErrorThreshold < 0 {
+		errs = append(errs, fmt.Errorf("recv.auto_block.error_threshold: must be a non-negative integer, got %d", c.Recv.AutoBlock.ErrorThreshold))
+	}
+	if c.Recv.AutoBlock.Window < 0 {
+		errs = append(errs, fmt.Errorf("recv.auto_block.window: must be a non-negative duration, got %s", c.Recv.AutoBlock.Window.String()))
+	}
+	if c.Recv.AutoBlock.BlockDuration < 0 {
+		errs = append(errs, fmt.Errorf("recv.auto_block.block_duration: must be a non-negative duration, got %s", c.Recv.AutoBlock.BlockDuration.String()))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	c.Recv.BanList = ban.NewBanList(
+		c.Recv.AutoBlock.ErrorThreshold,
+		c.Recv.AutoBlock.Window,
+		c.Recv.AutoBlock.BlockDuration,
+	)
+	return nil
+}
+
+// Validate NOOP rate limiting.
+func (c *Config) validateNOOP() error {
+	var errs []error
+	if c.Recv.NOOPRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("recv.noop_rate_limit: must be a non-negative integer, got %d", c.Recv.NOOPRateLimit))
+	}
+	if c.Recv.NOOPDelay < 0 {
+		errs = append(errs, fmt.Errorf("recv.noop_delay: must be a non-negative duration, got %s", c.Recv.NOOPDelay.String()))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the command length limits. The deprecated recv.read_buffer_size is applied as recv.server.max_line_length
+// by ApplyDefaults, and may only be combined with it if both are the same.
+func (c *Config) validateReadBuffer() error {
+	var errs []error
+	if size := c.Recv.ReadBufferSize; size != 0 {
+		switch {
+		case size < 0:
+			errs = append(errs, fmt.Errorf("recv.read_buffer_size: must be a non-negative integer, got %d", size))
+		case size != c.Recv.Server.MaxLineLength:
+			errs = append(errs, fmt.Errorf("recv.read_buffer_size: must be the same as recv.server.max_line_length (%d) when both are set, got %d", c.Recv.Server.MaxLineLength, size))
+		default:
+			log.Warn().Int("read_buffer_size", size).Msg("recv.read_buffer_size is deprecated, use recv.server.max_line_length instead")
+			c.Recv.ReadBufferSize = 0
+		}
+	}
+	if c.Recv.MaxEHLOLength < 0 {
+		errs = append(errs, fmt.Errorf("recv.max_ehlo_length: must be a non-negative integer, got %d", c.Recv.MaxEHLOLength))
+	}
+	return errors.Join(errs...)
+}
+
+// Bounds of recv.server.max_line_length: RFC 5321 requires lines of 1000 bytes including CRLF
+const (
+	minMaxLineLength = 1000
+	maxMaxLineLength = 16 * 1024 * 1024
+)
+
+// Validate the advanced settings of the SMTP servers.
+func (c *Config) validateServer() error {
+	server := &c.Recv.Server
+	var errs []error
+	if server.MaxLineLength < minMaxLineLength || server.MaxLineLength > maxMaxLineLength {
+		errs = append(errs, fmt.Errorf("recv.server.max_line_length: must be between %d and %d bytes, got %d", minMaxLineLength, maxMaxLineLength, server.MaxLineLength))
+	}
+	if server.MaxRecipients < 0 {
+		errs = append(errs, fmt.Errorf("recv.server.max_recipients: must be a non-negative integer, got %d", server.MaxRecipients))
 	}
-	if c.Recv.Limits.Timeout == 0 {
-		c.Recv.Limits.Timeout = 10 * time.Second // default to 10 seconds
+	if server.ReadTimeout < 0 || server.ReadTimeout > 0 && server.ReadTimeout < time.Second {
+		errs = append(errs, fmt.Errorf("recv.server.read_timeout: must be at least 1s, got %s", server.ReadTimeout))
 	}
+	if server.WriteTimeout < 0 || server.WriteTimeout > 0 && server.WriteTimeout < time.Second {
+		errs = append(errs, fmt.Errorf("recv.server.write_timeout: must be at least 1s, got %s", server.WriteTimeout))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the reply to messages sent to some of their recipients only.
+func (c *Config) validatePartialFailure() error {
+	switch c.Recv.PartialFailure {
+	case PartialFailureFailIfAny, PartialFailureSucceedIfAny:
+		return nil
+	default:
+		return fmt.Errorf("recv.partial_failure: must be one of '%s' or '%s'", PartialFailureFailIfAny, PartialFailureSucceedIfAny)
+	}
+}
 
-	// Validate SendConfig
-	if c.Send.Graph.TenantID == "" {
-		return errors.New("send.tenant_id: must be defined")
+// Validate the session trace settings.
+func (c *Config) validateTrace() error {
+	var errs []error
+	for i, listener := range c.Recv.Listeners {
+		// Transcripts are recorded from the network connection, which is encrypted from the start with implicit TLS
+		if listener.DebugTrace && listener.Type == ListenerSMTPS {
+			errs = append(errs, fmt.Errorf("recv.listeners[%d]: debug_trace: sessions of '%s' listeners cannot be traced", i, ListenerSMTPS))
+		}
 	}
 
-	if c.Send.Graph.ClientID == "" {
-		return errors.New("send.client_id: must be defined")
+	trace := &c.Recv.Trace
+	if trace.MaxFileSize < 0 {
+		errs = append(errs, fmt.Errorf("recv.trace.max_file_size: must be a non-negative integer, got %d", trace.MaxFileSize))
+	}
+	if trace.MaxFiles < 0 {
+		errs = append(errs, fmt.Errorf("recv.trace.max_files: must be a non-negative integer, got %d", trace.MaxFiles))
 	}
+	if trace.MaxDataBytes < 0 {
+		errs = append(errs, fmt.Errorf("recv.trace.max_data_bytes: must be a non-negative integer, got %d", trace.MaxDataBytes))
+	}
+	return errors.Join(errs...)
+}
 
-	if c.Send.Graph.ClientSecretEnv == "" {
-		return errors.New("send.client_secret_env: must be defined")
+// Validate the storage of the messages which failed to send.
+func (c *Config) validateFailureSpill() error {
+	if c.Recv.FailureSpillMaxSize < 0 {
+		return fmt.Errorf("recv.failure_spill_max_size: must be a non-negative integer, got %d", c.Recv.FailureSpillMaxSize)
 	}
+	return nil
+}
 
-	clientSecret := os.Getenv(c.Send.Graph.ClientSecretEnv)
-	if clientSecret == "" {
-		return fmt.Errorf("send.client_secret_env: environment variable '%s' is not set or empty", c.Send.Graph.ClientSecretEnv)
+// Validate the custom reply messages of the policy errors.
+func (c *Config) validateCustomErrors() error {
+	var problems []error
+	for _, name := range slices.Sorted(maps.Keys(c.Recv.CustomErrors)) {
+		msg := c.Recv.CustomErrors[name]
+		switch {
+		case !errs.IsName(name):
+			problems = append(problems, fmt.Errorf("recv.custom_errors.%s: unknown error name", name))
+		case strings.TrimSpace(msg) == "":
+			problems = append(problems, fmt.Errorf("recv.custom_errors.%s: message must be defined", name))
+		case strings.ContainsAny(msg, "\r\n"):
+			problems = append(problems, fmt.Errorf("recv.custom_errors.%s: message must be a single line", name))
+		}
 	}
-	c.Send.Graph.ClientSecret = clientSecret
+	return errors.Join(problems...)
+}
+
+// Validate the delivery status notification settings.
+func (c *Config) validateDSN() error {
+	dsn := &c.Recv.DSN
+	if !dsn.Enabled {
+		return nil
+	}
+	var errs []error
+	if dsn.From == "" {
+		errs = append(errs, errors.New("recv.dsn.from: must be defined when delivery status notifications are enabled"))
+	} else if !isValidEmail(dsn.From) {
+		errs = append(errs, fmt.Errorf("recv.dsn.from: invalid email address '%s'", dsn.From))
+	}
+	if dsn.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("recv.dsn.rate_limit: must be a non-negative integer, got %d", dsn.RateLimit))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	dsn.Limiter = utils.NewRateLimiter(dsn.RateLimit, time.Hour)
+	return nil
+}
+
+// Validate the greylisting settings and create the store of the triplets.
+func (c *Config) validateGreylist() error {
+	g := &c.Recv.Greylist
+	if !g.Enabled {
+		return nil
+	}
+	var errs []error
+	if g.Delay < 0 {
+		errs = append(errs, fmt.Errorf("recv.greylist.delay: must be a non-negative duration, got %s", g.Delay))
+	}
+	if g.Retention <= g.Delay {
+		errs = append(errs, fmt.Errorf("recv.greylist.retention: must be longer than the delay (%s), got %s", g.Delay, g.Retention))
+	}
+	if g.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("recv.greylist.max_entries: must be a non-negative integer, got %d", g.MaxEntries))
+	}
+	for i, name := range g.Listeners {
+		if !slices.ContainsFunc(c.Recv.Listeners, func(l ListenerConfig) bool { return l.Name == name }) {
+			errs = append(errs, fmt.Errorf("recv.greylist.listeners[%d]: unknown listener '%s'", i, name))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	store, err := greylist.NewStore(g.Delay, g.Retention, g.MaxEntries, g.StateFile)
+	if err != nil {
+		return fmt.Errorf("recv.greylist.state_file: %w", err)
+	}
+	g.Store = store
+	return nil
+}
+
+// Validate the settings of the Message-ID and Received headers added to messages.
+func (c *Config) validateInjectMessageID() error {
+	var errs []error
+	if c.Recv.InjectMessageID && c.Recv.Domain == "" {
+		errs = append(errs, errors.New("recv.domain: must be defined when inject_message_id is enabled"))
+	}
+	if c.Recv.InjectReceived && c.Recv.Domain == "" {
+		errs = append(errs, errors.New("recv.domain: must be defined when inject_received is enabled"))
+	}
+	return errors.Join(errs...)
+}
+
+// Create the configured hooks.
+func (c *Config) validateHooks() error {
+	var errs []error
+	for i := range c.Recv.Hooks {
+		hc := &c.Recv.Hooks[i]
+		if hc.Name == "" {
+			errs = append(errs, fmt.Errorf("recv.hooks[%d].name: must be one of: %s", i, strings.Join(hooks.Names(), ", ")))
+			continue
+		}
+		hook, err := hooks.New(hc.Name, hc.Options)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("recv.hooks[%d] (%s): %w", i, hc.Name, err))
+			continue
+		}
+		hc.Hook = hook
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the names of the configured side effects.
+func (c *Config) validateSideEffects() error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(c.Recv.SideEffects)) {
+		if !slices.Contains(SideEffects, name) {
+			errs = append(errs, fmt.Errorf("recv.side_effects.%s: unknown side effect, must be one of: %s", name, strings.Join(SideEffects, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the quotas and create their tracker, loading the usage persisted by a previous run.
+func (c *Config) validateQuotas() error {
+	q := c.Recv.Quotas
+	if q == nil {
+		return nil
+	}
+	var errs []error
+	if q.ResetHour < 0 || q.ResetHour > 23 {
+		errs = append(errs, fmt.Errorf("recv.quotas.reset_hour: must be between 0 and 23, got %d", q.ResetHour))
+	}
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("recv.quotas.timezone: unknown time zone '%s'", q.Timezone))
+	}
+
+	overrides := make(map[string]quota.Limit, len(q.Users))
+	for _, name := range slices.Sorted(maps.Keys(q.Users)) {
+		if strings.TrimSpace(name) == "" {
+			errs = append(errs, errors.New("recv.quotas.users: username or source IP must be defined"))
+			continue
+		}
+		if err := validateQuotaLimit("recv.quotas.users."+name, q.Users[name]); err != nil {
+			errs = append(errs, err)
+		}
+		overrides[name] = quota.Limit(q.Users[name])
+	}
+	if err := validateQuotaLimit("recv.quotas.default", q.Default); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	tracker, err := quota.NewTracker(quota.Limit(q.Default), overrides, q.ResetHour, loc, q.StateFile)
+	if err != nil {
+		return fmt.Errorf("recv.quotas.state_file: %w", err)
+	}
+	q.Tracker = tracker
+	return nil
+}
+
+func validateQuotaLimit(field string, limit QuotaLimit) error {
+	var errs []error
+	if limit.Messages < 0 {
+		errs = append(errs, fmt.Errorf("%s.messages: must be a non-negative integer, got %d", field, limit.Messages))
+	}
+	if limit.Bytes < 0 {
+		errs = append(errs, fmt.Errorf("%s.bytes: must be a non-negative integer, got %d", field, limit.Bytes))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the log settings and create the session log sampler.
+func (c *Config) validateLog() error {
+	sampling := &c.Log.LogSampling
+	if !sampling.Enabled {
+		c.Recv.LogSampler = nil
+		return nil
+	}
+	if sampling.Rate < 0 || sampling.Rate > 1 {
+		return fmt.Errorf("log.sampling.rate: must be between 0.0 and 1.0, got %g", sampling.Rate)
+	}
+	c.Recv.LogSampler = logging.NewSampler(sampling.Rate, sampling.AlwaysLogErrors)
+	return nil
+}
+
+// Levels accepted by recv.log_levels
+var logLevels = []string{"trace", "debug", "info", "warn", "error", "disabled"}
+
+// Parse the levels of the logged rejections and failures.
+func (c *Config) validateLogLevels() error {
+	levels := &c.Recv.LogLevels
+	var errs []error
+	for _, l := range []struct {
+		name   string
+		value  string
+		parsed *zerolog.Level
+	}{
+		{"auth_failure", levels.AuthFailure, &levels.AuthFailureLevel},
+		{"policy_rejection", levels.PolicyRejection, &levels.PolicyRejectionLevel},
+		{"ip_rejection", levels.IPRejection, &levels.IPRejectionLevel},
+		{"delivery_failure", levels.DeliveryFailure, &levels.DeliveryFailureLevel},
+	} {
+		value := strings.ToLower(strings.TrimSpace(l.value))
+		if !slices.Contains(logLevels, value) {
+			errs = append(errs, fmt.Errorf("recv.log_levels.%s: must be one of: %s, got '%s'", l.name, strings.Join(logLevels, ", "), l.value))
+			continue
+		}
+		*l.parsed, _ = zerolog.ParseLevel(value)
+	}
+	return errors.Join(errs...)
+}
+
+// Validate and compile the content filter rules.
+func (c *Config) validateFilters() error {
+	var errs []error
+	for i := range c.Recv.Filters {
+		if err := validateFilter(&c.Recv.Filters[i], i); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate a content filter rule and compile its patterns.
+func validateFilter(rule *FilterRule, i int) error {
+	prefix := fmt.Sprintf("recv.filters[%d]: ", i)
+	var errs []error
+	if rule.Name == "" {
+		errs = append(errs, errors.New(prefix+"name: must be defined"))
+	}
+	if rule.MatchSubject == "" && rule.MatchBody == "" && rule.MatchFrom == "" {
+		errs = append(errs, errors.New(prefix+"at least one of match_subject, match_body or match_from must be defined"))
+	}
+	for _, m := range []struct {
+		field   string
+		pattern string
+		re      **regexp.Regexp
+	}{
+		{"match_subject", rule.MatchSubject, &rule.SubjectRe},
+		{"match_body", rule.MatchBody, &rule.BodyRe},
+		{"match_from", rule.MatchFrom, &rule.FromRe},
+	} {
+		if m.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(m.pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"%s: invalid regular expression: %v", m.field, err))
+			continue
+		}
+		*m.re = re
+	}
+	switch rule.Action {
+	case FilterReject, FilterDiscard, FilterTag:
+	default:
+		errs = append(errs, fmt.Errorf(prefix+"action: must be one of '%s', '%s' or '%s'", FilterReject, FilterDiscard, FilterTag))
+	}
+	if err := validateEnforcement(rule.Enforcement, prefix+"enforcement: "); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the attachment policy, normalizing its extensions and content types.
+func (c *Config) validateAttachmentPolicy() error {
+	ap := c.Recv.AttachmentPolicy
+	if ap == nil {
+		return nil
+	}
+	var errs []error
+	if ap.MaxCount < 0 {
+		errs = append(errs, fmt.Errorf("recv.attachment_policy.max_count: must be a non-negative integer, got %d", ap.MaxCount))
+	}
+	if ap.MaxEach < 0 {
+		errs = append(errs, fmt.Errorf("recv.attachment_policy.max_each: must be a non-negative integer, got %d", ap.MaxEach))
+	}
+
+	for _, list := range []struct {
+		field string
+		items []string
+	}{
+		{"blocked_extensions", ap.BlockedExtensions},
+		{"allowed_extensions", ap.AllowedExtensions},
+	} {
+		for i, ext := range list.items {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" || ext == "." {
+				errs = append(errs, fmt.Errorf("recv.attachment_policy.%s[%d]: invalid extension '%s'", list.field, i, list.items[i]))
+				continue
+			}
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			list.items[i] = ext
+		}
+	}
+	for _, list := range []struct {
+		field string
+		items []string
+	}{
+		{"blocked_types", ap.BlockedTypes},
+		{"allowed_types", ap.AllowedTypes},
+	} {
+		for i, t := range list.items {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if mediaType, subtype, ok := strings.Cut(t, "/"); !ok || mediaType == "" || subtype == "" {
+				errs = append(errs, fmt.Errorf("recv.attachment_policy.%s[%d]: invalid content type '%s'", list.field, i, list.items[i]))
+				continue
+			}
+			list.items[i] = t
+		}
+	}
+
+	switch ap.Action {
+	case AttachmentReject:
+	case AttachmentStrip:
+		if c.Send.MIMEPassthrough {
+			errs = append(errs, errors.New("recv.attachment_policy.action: 'strip' cannot be used with send.mime_passthrough"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("recv.attachment_policy.action: must be one of '%s' or '%s'", AttachmentReject, AttachmentStrip))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the HTTP submission API.
+func (c *Config) validateHTTP() error {
+	// The HTTP server binds every interface, so it cannot share the port of a listener
+	seenPorts := make(map[int]string)
+	for _, listener := range c.Recv.Listeners {
+		if port := listener.TCPPort(); port != 0 {
+			seenPorts[port] = listener.Name
+		}
+	}
+
+	h := c.Recv.HTTP
+	if h == nil {
+		return nil
+	}
+	var errs []error
+	if h.Port == 0 {
+		errs = append(errs, errors.New("recv.http.port: must be defined"))
+	} else if other, exists := seenPorts[int(h.Port)]; exists {
+		errs = append(errs, fmt.Errorf("recv.http.port: duplicate port %d used by '%s'", h.Port, other))
+	}
+	if h.BasicAuth && c.Recv.Auth.Mode != AuthPlain {
+		errs = append(errs, errors.New("recv.http.basic_auth: requires recv.auth.mode 'plain'"))
+	}
+	if err := resolveSecret(&h.AuthToken, h.AuthTokenEnv, h.AuthTokenFile, "recv.http.auth_token"); err != nil {
+		errs = append(errs, err)
+	} else if h.AuthToken == "" && !h.BasicAuth {
+		errs = append(errs, errors.New("recv.http: either auth_token, auth_token_env, auth_token_file or basic_auth must be defined"))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the heartbeat configuration.
+func (c *Config) validateMonitoring() error {
+	hb := c.Monitoring.Heartbeat
+	if hb == nil {
+		return nil
+	}
+
+	var errs []error
+	if hb.Interval < 0 {
+		errs = append(errs, fmt.Errorf("monitoring.heartbeat.interval: must be a non-negative duration, got %s", hb.Interval))
+	}
+	if !isValidEmail(hb.From) {
+		errs = append(errs, fmt.Errorf("monitoring.heartbeat.from: invalid email address '%s'", hb.From))
+	}
+	if !isValidEmail(hb.To) {
+		errs = append(errs, fmt.Errorf("monitoring.heartbeat.to: invalid email address '%s'", hb.To))
+	}
+	if hb.FailureThreshold < 0 {
+		errs = append(errs, fmt.Errorf("monitoring.heartbeat.failure_threshold: must be a non-negative integer, got %d", hb.FailureThreshold))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the metrics configuration.
+func (c *Config) validateMetrics() error {
+	if c.Metrics.MaxDomainLabels < 0 {
+		return fmt.Errorf("metrics.max_domain_labels: must be a non-negative integer, got %d", c.Metrics.MaxDomainLabels)
+	}
+	return nil
+}
+
+// Validate no rewrite of the message is combined with MIME passthrough, which sends the message as received: the
+// recipients of its headers would still get it and its subject would be left unchanged.
+func (c *Config) validateMIMEPassthrough() error {
+	if !c.Send.MIMEPassthrough {
+		return nil
+	}
+	var errs []error
+	for i, listener := range c.Recv.Listeners {
+		if len(listener.ForceRecipients) > 0 {
+			errs = append(errs, fmt.Errorf("recv.listeners[%d]: force_recipients: cannot be used with send.mime_passthrough", i))
+		}
+		if listener.SubjectPrefix != "" {
+			errs = append(errs, fmt.Errorf("recv.listeners[%d]: subject_prefix: cannot be used with send.mime_passthrough", i))
+		}
+	}
+	for i, cred := range c.Recv.Auth.Credentials {
+		if cred.SubjectPrefix != "" {
+			errs = append(errs, fmt.Errorf("recv.auth.credentials[%d].subject_prefix: cannot be used with send.mime_passthrough", i))
+		}
+	}
+	for i, rule := range c.Recv.Filters {
+		if rule.Action == FilterTag {
+			errs = append(errs, fmt.Errorf("recv.filters[%d]: action: '%s' cannot be used with send.mime_passthrough", i, FilterTag))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the footer appended to outbound messages.
+func (c *Config) validateFooter() error {
+	footer := c.Send.Footer
+	if footer == nil {
+		return nil
+	}
+	var errs []error
+	if strings.TrimSpace(footer.Text) == "" && strings.TrimSpace(footer.HTML) == "" {
+		errs = append(errs, errors.New("send.footer: text or html must be defined"))
+	}
+	if c.Send.MIMEPassthrough {
+		errs = append(errs, errors.New("send.footer: cannot be used with send.mime_passthrough"))
+	}
+	if strings.Contains(footer.Marker, "--") || strings.ContainsAny(footer.Marker, "<>") {
+		errs = append(errs, fmt.Errorf("send.footer.marker: must not contain '--', '<' or '>', got '%s'", footer.Marker))
+	}
+	for i, domain := range footer.InternalDomains {
+		if !isValidDomain(domain) {
+			errs = append(errs, fmt.Errorf("send.footer.internal_domains[%d]: invalid domain '%s'", i, domain))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the sender configuration and load the DKIM key.
+func (c *Config) validateSend() error {
+	var errs []error
+	switch c.Send.Type {
+	case SenderGraph:
+		errs = append(errs, c.validateGraph())
+	case SenderSendGrid:
+		errs = append(errs, c.validateSendGrid())
+	case SenderSES:
+		errs = append(errs, c.validateSES())
+	case SenderWebhook:
+		errs = append(errs, c.validateWebhook())
+	default:
+		errs = append(errs, fmt.Errorf("send.type: must be one of '%s', '%s', '%s' or '%s'", SenderGraph, SenderSendGrid, SenderSES, SenderWebhook))
+	}
+	errs = append(errs, c.validateUserRoutes(), c.validateNamedSenders())
 
 	if c.Send.Timeout < 0 {
-		return errors.New("send.timeout: must be a non-negative duration")
-	} else if c.Send.Timeout == 0 {
-		c.Send.Timeout = 10 * time.Second
+		errs = append(errs, errors.New("send.timeout: must be a non-negative duration"))
 	}
 
 	if c.Send.Retries < 0 {
-		return errors.New("send.retries: must be a non-negative integer")
-	} else if c.Send.Retries == 0 {
-		c.Send.Retries = 3
+		errs = append(errs, errors.New("send.retries: must be a non-negative integer"))
 	}
 
 	if c.Send.Backoff < 0 {
-		return errors.New("send.backoff: must be a non-negative duration")
-	} else if c.Send.Backoff == 0 {
-		c.Send.Backoff = 5 * time.Second
+		errs = append(errs, errors.New("send.backoff: must be a non-negative duration"))
+	}
+
+	strategy, err := utils.NewRetryStrategy(c.Send.BackoffStrategy, c.Send.Backoff)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("send.backoff_strategy: must be one of '%s', '%s' or '%s'", utils.StrategyExponential, utils.StrategyLinear, utils.StrategyFixed))
+	}
+	limits := c.Send.BackoffLimits
+	if limits.InitialBackoff < 0 {
+		errs = append(errs, errors.New("send.backoff_limits.initial_backoff: must be a non-negative duration"))
 	}
+	if limits.MaxBackoff < 0 {
+		errs = append(errs, errors.New("send.backoff_limits.max_backoff: must be a non-negative duration"))
+	}
+	if limits.MaxBackoff > 0 && limits.InitialBackoff > limits.MaxBackoff {
+		errs = append(errs, fmt.Errorf("send.backoff_limits.initial_backoff: must not exceed max_backoff (%s), got %s", limits.MaxBackoff, limits.InitialBackoff))
+	}
+	if limits != (BackoffConfig{}) {
+		strategy = utils.BoundedBackoff{Strategy: strategy, Initial: limits.InitialBackoff, Max: limits.MaxBackoff}
+	}
+	c.Send.RetryStrategy = strategy
+
+	if c.Send.AuthFailureThreshold < 0 {
+		errs = append(errs, errors.New("send.auth_failure_threshold: must be a non-negative integer"))
+	}
+
+	if c.Send.AuthProbeInterval < 0 {
+		errs = append(errs, errors.New("send.auth_probe_interval: must be a non-negative duration"))
+	}
+
+	if c.Send.CircuitBreaker.FailureThreshold < 0 {
+		errs = append(errs, errors.New("send.circuit_breaker.failure_threshold: must be a non-negative integer"))
+	}
+	if c.Send.CircuitBreaker.OpenTimeout < 0 {
+		errs = append(errs, errors.New("send.circuit_breaker.open_timeout: must be a non-negative duration"))
+	}
+
+	switch c.Send.PreferBody {
+	case email.PreferHTML, email.PreferText:
+	default:
+		errs = append(errs, fmt.Errorf("send.prefer_body: must be one of '%s' or '%s'", email.PreferHTML, email.PreferText))
+	}
+
+	switch c.Send.ForceBodyType {
+	case ForceBodyHTML, ForceBodyText, ForceBodyBoth:
+	default:
+		errs = append(errs, fmt.Errorf("send.force_body_type: must be one of '%s', '%s' or '%s'", ForceBodyHTML, ForceBodyText, ForceBodyBoth))
+	}
+	if c.Send.ForceBodyType != ForceBodyHTML && c.Send.MIMEPassthrough {
+		errs = append(errs, errors.New("send.force_body_type: cannot be used with send.mime_passthrough"))
+	}
+	if c.Send.MIMEPassthrough && (c.Send.Type == SenderSendGrid || c.Send.Type == SenderWebhook) {
+		errs = append(errs, fmt.Errorf("send.mime_passthrough: not supported by the %s sender", c.Send.Type))
+	}
+
+	for i, name := range c.Send.PreserveHeaders {
+		if !isValidHeaderName(name) {
+			errs = append(errs, fmt.Errorf("send.preserve_headers[%d]: invalid header name '%s'", i, name))
+		} else if slices.ContainsFunc(managedHeaders, func(h string) bool { return strings.EqualFold(h, name) }) {
+			errs = append(errs, fmt.Errorf("send.preserve_headers[%d]: '%s' is set by the sender and cannot be preserved", i, name))
+		}
+	}
+
+	sanitizer, err := email.NewSanitizer(c.Send.SanitizePolicy)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("send.sanitize_policy: %v, must be one of '%s', '%s' or '%s'", err, email.SanitizeUGC, email.SanitizeStrict, email.SanitizeRelaxed))
+	} else if c.Send.SanitizeHTML {
+		c.Send.Sanitizer = sanitizer
+	}
+
+	if c.Send.ArchiveBCC != "" {
+		if !isValidEmail(c.Send.ArchiveBCC) {
+			errs = append(errs, fmt.Errorf("send.archive_bcc: invalid email address '%s'", c.Send.ArchiveBCC))
+		}
+	}
+
+	if dk := c.Send.DKIM; dk != nil {
+		errs = append(errs, validateDKIM(dk, c.Send.MIMEPassthrough))
+	}
+	return errors.Join(errs...)
+}
 
-	c.Send.Sender = sender.NewGraphSender(
-		c.Send.Graph.TenantID,
-		c.Send.Graph.ClientID,
-		c.Send.Graph.ClientSecret,
+// Validate the DKIM settings and load the signing key once the other settings are valid.
+func validateDKIM(dk *DKIMConfig, mimePassthrough bool) error {
+	var errs []error
+	if !mimePassthrough {
+		errs = append(errs, errors.New("send.dkim: requires send.mime_passthrough"))
+	}
+	if !isValidDomain(dk.Domain) {
+		errs = append(errs, fmt.Errorf("send.dkim.domain: invalid domain '%s'", dk.Domain))
+	}
+	if dk.Selector == "" {
+		errs = append(errs, errors.New("send.dkim.selector: must be defined"))
+	}
+	if dk.KeyFile == "" {
+		errs = append(errs, errors.New("send.dkim.key_file: must be defined"))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	key, err := email.LoadDKIMKey(dk.KeyFile)
+	if err != nil {
+		return fmt.Errorf("send.dkim.key_file: failed to load key '%s': %v", dk.KeyFile, err)
+	}
+	signer, err := email.NewDKIMSigner(dk.Domain, dk.Selector, key, dk.Headers)
+	if err != nil {
+		return fmt.Errorf("send.dkim.key_file: %v", err)
+	}
+	dk.Signer = signer
+	return nil
+}
+
+// Validate the Microsoft Graph sender configuration.
+func (c *Config) validateGraph() error {
+	return validateGraphSender(&c.Send.Graph, "send.graph")
+}
+
+// Validate the configuration of a Graph application, whose key prefixes the errors.
+func validateGraphSender(g *GraphSenderConfig, key string) error {
+	var errs []error
+	if g.TenantID == "" {
+		errs = append(errs, fmt.Errorf("%s.tenant_id: must be defined", key))
+	}
+
+	if g.ClientID == "" {
+		errs = append(errs, fmt.Errorf("%s.client_id: must be defined", key))
+	}
+
+	if err := applySecretShorthands(&g.ClientSecretRef, g.ClientSecretEnv, g.ClientSecretFile, key+".client_secret"); err != nil {
+		errs = append(errs, err)
+	}
+
+	if g.LoginEndpoint != "" && !isValidURL(g.LoginEndpoint) {
+		errs = append(errs, fmt.Errorf("%s.login_endpoint: invalid URL '%s'", key, g.LoginEndpoint))
+	}
+	if g.GraphEndpoint != "" && !isValidURL(g.GraphEndpoint) {
+		errs = append(errs, fmt.Errorf("%s.graph_endpoint: invalid URL '%s'", key, g.GraphEndpoint))
+	}
+
+	if g.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_concurrent: must be a non-negative integer", key))
+	}
+	if g.MaxConcurrentSends < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_concurrent_sends: must be a non-negative integer", key))
+	}
+	if g.TokenRefreshBuffer < 0 {
+		errs = append(errs, fmt.Errorf("%s.token_refresh_buffer: must be a non-negative duration", key))
+	}
+	if g.TokenCooldown < 0 {
+		errs = append(errs, fmt.Errorf("%s.token_cooldown: must be a non-negative duration", key))
+	}
+
+	if g.InsecureSkipVerify && os.Getenv(AllowInsecureTLSEnv) == "" {
+		errs = append(errs, fmt.Errorf("%s.insecure_skip_verify: only allowed in tests (%s)", key, AllowInsecureTLSEnv))
+	}
+	g.TLSConfig = nil
+	if g.TLS != nil || g.InsecureSkipVerify {
+		var caFile string
+		var pins []string
+		if g.TLS != nil {
+			caFile, pins = g.TLS.CAFile, g.TLS.PinnedSPKI
+		}
+		tlsConfig, err := sender.NewTLSConfig(caFile, pins, g.InsecureSkipVerify)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.tls: %v", key, err))
+		}
+		g.TLSConfig = tlsConfig
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the Graph applications of the authenticated users' routes.
+func (c *Config) validateUserRoutes() error {
+	seen := make(map[string]bool, len(c.Send.UserRoutes))
+	var errs []error
+	for i := range c.Send.UserRoutes {
+		route := &c.Send.UserRoutes[i]
+		if route.Username == "" {
+			errs = append(errs, fmt.Errorf("send.user_routes[%d].username: must be defined", i))
+		} else if seen[route.Username] {
+			errs = append(errs, fmt.Errorf("send.user_routes[%d].username: duplicate route for user '%s'", i, route.Username))
+		}
+		seen[route.Username] = true
+		errs = append(errs, validateGraphSender(&route.Graph, fmt.Sprintf("send.user_routes[%d].graph", i)))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the named Graph applications and resolve the sender referenced by each listener.
+func (c *Config) validateNamedSenders() error {
+	seen := make(map[string]bool, len(c.Send.Senders))
+	var errs []error
+	for i := range c.Send.Senders {
+		ns := &c.Send.Senders[i]
+		if ns.Name == "" {
+			errs = append(errs, fmt.Errorf("send.senders[%d].name: must be defined", i))
+		} else if seen[ns.Name] {
+			errs = append(errs, fmt.Errorf("send.senders[%d].name: duplicate sender name '%s'", i, ns.Name))
+		}
+		seen[ns.Name] = true
+		errs = append(errs, validateGraphSender(&ns.Graph, fmt.Sprintf("send.senders[%d].graph", i)))
+	}
+	for i, listener := range c.Recv.Listeners {
+		if listener.Sender != "" && !seen[listener.Sender] {
+			errs = append(errs, fmt.Errorf("recv.listeners[%d].sender: unknown sender '%s', must be defined in send.senders", i, listener.Sender))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the SendGrid sender configuration.
+func (c *Config) validateSendGrid() error {
+	sg := &c.Send.SendGrid
+	var errs []error
+	if err := applySecretShorthands(&sg.APIKeyRef, sg.APIKeyEnv, sg.APIKeyFile, "send.sendgrid.api_key"); err != nil {
+		errs = append(errs, err)
+	}
+
+	if !isValidURL(c.Send.SendGrid.Endpoint) {
+		errs = append(errs, fmt.Errorf("send.sendgrid.endpoint: invalid URL '%s'", c.Send.SendGrid.Endpoint))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the Amazon SES sender configuration.
+func (c *Config) validateSES() error {
+	var errs []error
+	if c.Send.SES.Region == "" {
+		errs = append(errs, errors.New("send.ses.region: must be defined"))
+	}
+
+	if !isValidURL(c.Send.SES.Endpoint) {
+		errs = append(errs, fmt.Errorf("send.ses.endpoint: invalid URL '%s'", c.Send.SES.Endpoint))
+	}
+
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		errs = append(errs, errors.New("send.ses: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set"))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the webhook sender configuration and read its secrets from the environment or their files.
+func (c *Config) validateWebhook() error {
+	wh := &c.Send.Webhook
+	var errs []error
+	if wh.URL == "" {
+		errs = append(errs, errors.New("send.webhook.url: must be defined"))
+	} else if !isValidURL(wh.URL) {
+		errs = append(errs, fmt.Errorf("send.webhook.url: invalid URL '%s'", wh.URL))
+	}
+
+	if err := resolveSecret(&wh.Secret, wh.SecretEnv, wh.SecretFile, "send.webhook.secret"); err != nil {
+		errs = append(errs, err)
+	}
+	if wh.SignatureHeader != "" && !isValidHeaderName(wh.SignatureHeader) {
+		errs = append(errs, fmt.Errorf("send.webhook.signature_header: invalid header name '%s'", wh.SignatureHeader))
+	}
+
+	if err := resolveSecret(&wh.BearerToken, wh.BearerTokenEnv, wh.BearerTokenFile, "send.webhook.bearer_token"); err != nil {
+		errs = append(errs, err)
+	}
+	if ba := wh.BasicAuth; ba != nil {
+		if wh.BearerToken != "" {
+			errs = append(errs, errors.New("send.webhook.basic_auth: cannot be combined with send.webhook.bearer_token"))
+		}
+		if ba.Username == "" {
+			errs = append(errs, errors.New("send.webhook.basic_auth.username: must be defined"))
+		}
+		if err := resolveSecret(&ba.Password, ba.PasswordEnv, ba.PasswordFile, "send.webhook.basic_auth.password"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Set the value from the environment variable or the file if one is named. key is the value's key, whose "_env" and
+// "_file" variants name the variable and the file; at most one of the three may be defined.
+func resolveSecret(value *string, env, file, key string) error {
+	if env != "" && file != "" {
+		return fmt.Errorf("%s_file: cannot be combined with %s_env", key, key)
+	}
+	switch {
+	case env != "":
+		if *value != "" {
+			return fmt.Errorf("%s_env: cannot be combined with %s", key, key)
+		}
+		*value = os.Getenv(env)
+		if *value == "" {
+			return fmt.Errorf("%s_env: environment variable '%s' is not set or empty", key, env)
+		}
+	case file != "":
+		if *value != "" {
+			return fmt.Errorf("%s_file: cannot be combined with %s", key, key)
+		}
+		secret, err := secrets.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("%s_file: %v", key, err)
+		}
+		*value = secret
+	}
+	return nil
+}
+
+// Set the reference from its "_env" or "_file" shorthand if one is defined. key is the secret's key, e.g.
+// "send.graph.client_secret", whose "_ref" variant is the reference; exactly one of the three must be defined.
+func applySecretShorthands(ref *secrets.SecretRef, env, file, key string) error {
+	switch {
+	case env != "" && file != "":
+		return fmt.Errorf("%s_file: cannot be combined with %s_env", key, key)
+	case (env != "" || file != "") && !ref.IsEmpty():
+		shorthand := "_env"
+		if file != "" {
+			shorthand = "_file"
+		}
+		return fmt.Errorf("%s%s: cannot be combined with %s_ref", key, shorthand, key)
+	case env != "":
+		ref.Env = env
+	case file != "":
+		ref.File = file
+	case ref.IsEmpty():
+		dot := strings.LastIndex(key, ".")
+		return fmt.Errorf("%s: one of %s_env, %s_file or %s_ref must be defined", key[:dot], key[dot+1:], key[dot+1:], key[dot+1:])
+	}
+	return nil
+}
+
+// Resolve the client secret or API key and create the sender and the senders of the user routes.
+func (c *Config) buildSender() error {
+	for i := range c.Send.UserRoutes {
+		route := &c.Send.UserRoutes[i]
+		graphSender, err := c.buildGraphSender(&route.Graph, fmt.Sprintf("send.user_routes[%d].graph", i))
+		if err != nil {
+			return err
+		}
+		route.Sender = graphSender
+	}
+	for i := range c.Send.Senders {
+		ns := &c.Send.Senders[i]
+		graphSender, err := c.buildGraphSender(&ns.Graph, fmt.Sprintf("send.senders[%d].graph", i))
+		if err != nil {
+			return err
+		}
+		ns.Sender = graphSender
+	}
+
+	switch c.Send.Type {
+	case SenderSendGrid:
+		return c.buildSendGridSender()
+	case SenderWebhook:
+		wh := c.Send.Webhook
+		webhookSender := sender.NewWebhookSender(wh.URL, c.Send.Timeout, c.Send.Retries, c.Send.Backoff)
+		webhookSender.SetRetryStrategy(c.Send.RetryStrategy)
+		if wh.Secret != "" {
+			webhookSender.SetSigningSecret(wh.Secret, wh.SignatureHeader)
+		}
+		if wh.BearerToken != "" {
+			webhookSender.SetBearerToken(wh.BearerToken)
+		}
+		if wh.BasicAuth != nil {
+			webhookSender.SetBasicAuth(wh.BasicAuth.Username, wh.BasicAuth.Password)
+		}
+		c.Send.Sender = webhookSender
+		return nil
+	case SenderSES:
+		sesSender := sender.NewSESSender(c.Send.SES.Region, c.Send.Timeout, c.Send.Retries, c.Send.Backoff)
+		sesSender.SetEndpoint(c.Send.SES.Endpoint)
+		sesSender.SetConfigurationSet(c.Send.SES.ConfigurationSet)
+		sesSender.SetRetryStrategy(c.Send.RetryStrategy)
+		c.Send.Sender = sesSender
+		return nil
+	}
+
+	graphSender, err := c.buildGraphSender(&c.Send.Graph, "send.graph")
+	if err != nil {
+		return err
+	}
+	c.Send.Health = sender.NewHealth(c.Send.AuthFailureThreshold)
+	graphSender.SetHealth(c.Send.Health)
+	c.Send.Sender = graphSender
+
+	return nil
+}
+
+// Resolve the client secret of the Graph application, whose key prefixes the errors, and create its sender.
+func (c *Config) buildGraphSender(g *GraphSenderConfig, key string) (*sender.GraphSender, error) {
+	resolver, err := g.ClientSecretRef.Resolver()
+	if err != nil {
+		return nil, fmt.Errorf("%s.client_secret_ref: %v", key, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	clientSecret, err := resolver.Resolve(ctx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("%s.client_secret_ref: %v", key, err)
+	}
+	g.ClientSecret = clientSecret
+	g.ClientSecretResolver = resolver
+
+	graphSender := sender.NewGraphSender(
+		g.TenantID,
+		g.ClientID,
+		g.ClientSecret,
 		c.Send.Timeout,
 		c.Send.Retries,
 		c.Send.Backoff,
 	)
+	graphSender.SetEndpoints(g.LoginEndpoint, g.GraphEndpoint)
+	graphSender.SetClientSecretResolver(g.ClientSecretResolver)
+	graphSender.SetRetryStrategy(c.Send.RetryStrategy)
+	graphSender.SetMaxConcurrent(g.MaxConcurrent)
+	graphSender.SetMaxConcurrentSends(g.MaxConcurrentSends)
+	graphSender.SetTokenRefreshBuffer(g.TokenRefreshBuffer)
+	graphSender.SetTokenCooldown(g.TokenCooldown)
+	if cb := c.Send.CircuitBreaker; cb.FailureThreshold > 0 {
+		graphSender.SetCircuitBreaker(utils.NewCircuitBreaker(cb.FailureThreshold, cb.OpenTimeout))
+	}
+	if g.TLSConfig != nil {
+		graphSender.SetTLSConfig(g.TLSConfig)
+	}
+	return graphSender, nil
+}
+
+func (c *Config) buildSendGridSender() error {
+	resolver, err := c.Send.SendGrid.APIKeyRef.Resolver()
+	if err != nil {
+		return fmt.Errorf("send.sendgrid.api_key_ref: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	apiKey, err := resolver.Resolve(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("send.sendgrid.api_key_ref: %v", err)
+	}
+	c.Send.SendGrid.APIKeyResolver = resolver
+
+	sgSender := sender.NewSendGridSender(apiKey, c.Send.Timeout, c.Send.Retries, c.Send.Backoff)
+	sgSender.SetEndpoint(c.Send.SendGrid.Endpoint)
+	sgSender.SetAPIKeyResolver(resolver)
+	sgSender.SetRetryStrategy(c.Send.RetryStrategy)
+	c.Send.Sender = sgSender
 
 	return nil
 }
+
+// Resolve the permissions and ownership of a Unix domain socket listener, reporting errors with the given prefix.
+func validateSocket(listener *ListenerConfig, prefix string) error {
+	var errs []error
+	listener.SocketFileMode = 0660
+	if listener.SocketMode != "" {
+		mode, err := ParseFileMode(listener.SocketMode)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"socket_mode: invalid file mode '%s': %v", listener.SocketMode, err))
+		}
+		listener.SocketFileMode = mode
+	}
+
+	// -1 leaves the owner or group unchanged
+	listener.SocketUID, listener.SocketGID = -1, -1
+	if listener.SocketOwner != "" {
+		uid, err := LookupUID(listener.SocketOwner)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"socket_owner: %v", err))
+		}
+		listener.SocketUID = uid
+	}
+	if listener.SocketGroup != "" {
+		gid, err := LookupGID(listener.SocketGroup)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(prefix+"socket_group: %v", err))
+		}
+		listener.SocketGID = gid
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,308 @@
+package config
+
+import (
+	"os"
+	"slices"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+// Default values of the settings left unset in the configuration
+const (
+	DefaultMaxSize          = 25 * 1024 * 1024 // 25 MiB
+	DefaultDataBuffers      = 16               // messages of max_size allowed in memory at once
+	DefaultDataMemoryWait   = time.Minute
+	DefaultMaxRecipients    = 100
+	DefaultReadTimeout      = 10 * time.Second
+	DefaultAutoBlockWindow  = 10 * time.Minute
+	DefaultBlockDuration    = time.Hour
+	DefaultNOOPDelay        = 5 * time.Second
+	DefaultMaxLineLength    = 64 * 1024 // 64 KiB
+	DefaultMaxEHLOLength    = 253       // longest domain name
+	DefaultTraceDir         = "traces"
+	DefaultTraceMaxFileSize = 1024 * 1024 // 1 MiB
+	DefaultTraceMaxFiles    = 100
+	DefaultTraceMaxData     = 1024 // 1 KiB
+	DefaultDSNRateLimit     = 10   // notifications per hour and recipient
+	DefaultFilterTag        = "[FILTERED]"
+	DefaultQuotaTimezone    = "UTC"
+	DefaultFailureSpillSize = 100 * 1024 * 1024 // 100 MiB
+
+	DefaultGreylistDelay      = 5 * time.Minute
+	DefaultGreylistRetention  = 30 * 24 * time.Hour
+	DefaultGreylistMaxEntries = 100000
+
+	DefaultLogLevelAuthFailure     = "info"
+	DefaultLogLevelPolicyRejection = "warn"
+	DefaultLogLevelIPRejection     = "warn"
+	DefaultLogLevelDeliveryFailure = "error"
+
+	DefaultSendTimeout          = 10 * time.Second
+	DefaultRetries              = 3
+	DefaultBackoff              = 5 * time.Second
+	DefaultAuthFailureThreshold = 3
+	DefaultAuthProbeInterval    = 30 * time.Second
+	DefaultCircuitOpenTimeout   = 30 * time.Second
+	DefaultFooterMarker         = "gopostal-footer"
+	DefaultArchiveBCCLabel      = "[ARCHIVED]"
+
+	DefaultHeartbeatInterval         = time.Hour
+	DefaultHeartbeatSubjectPrefix    = "[GoPostal heartbeat]"
+	DefaultHeartbeatFailureThreshold = 3
+
+	DefaultReloadDrainTimeout = time.Minute
+)
+
+// Fill in the default value of every setting left unset. Settings which are already set are kept, so applying the
+// defaults more than once has no further effect. Negative values are left for Validate to report.
+func ApplyDefaults(c *Config) {
+	applyRecvDefaults(&c.Recv)
+
+	if hb := c.Monitoring.Heartbeat; hb != nil {
+		if hb.Interval == 0 {
+			hb.Interval = DefaultHeartbeatInterval
+		}
+		if hb.From == "" {
+			hb.From = c.Send.Graph.Mailbox // default to the configured mailbox
+		}
+		if hb.SubjectPrefix == "" {
+			hb.SubjectPrefix = DefaultHeartbeatSubjectPrefix
+		}
+		if hb.FailureThreshold == 0 {
+			hb.FailureThreshold = DefaultHeartbeatFailureThreshold
+		}
+	}
+
+	if c.System.ReloadDrainTimeout == 0 {
+		c.System.ReloadDrainTimeout = DefaultReloadDrainTimeout
+	}
+
+	if c.Metrics.MaxDomainLabels == 0 {
+		c.Metrics.MaxDomainLabels = metrics.DefaultMaxDomainLabels
+	}
+
+	applySendDefaults(&c.Send)
+}
+
+func applyRecvDefaults(r *RecvConfig) {
+	limits := &r.Limits
+	if limits.MaxSize == 0 {
+		limits.MaxSize = DefaultMaxSize
+	}
+	if limits.MaxDataMemory == 0 && limits.MaxSize > 0 {
+		limits.MaxDataMemory = DefaultDataBuffers * int64(limits.MaxSize)
+	}
+	if limits.DataMemoryWait == 0 {
+		limits.DataMemoryWait = DefaultDataMemoryWait
+	}
+	if limits.MaxRecipients == 0 {
+		limits.MaxRecipients = DefaultMaxRecipients
+	}
+	if limits.MaxSubjectLength == 0 {
+		limits.MaxSubjectLength = email.DefaultMaxSubjectLength // 998 bytes (RFC 5322)
+	}
+	if limits.Timeout == 0 {
+		limits.Timeout = DefaultReadTimeout
+	}
+	if limits.BodyLimitAction == "" {
+		limits.BodyLimitAction = BodyLimitReject
+	}
+	if r.SpoolDir == "" {
+		r.SpoolDir = os.TempDir()
+	}
+
+	if r.AutoBlock.Window == 0 {
+		r.AutoBlock.Window = DefaultAutoBlockWindow
+	}
+	if r.AutoBlock.BlockDuration == 0 {
+		r.AutoBlock.BlockDuration = DefaultBlockDuration
+	}
+
+	if r.NOOPDelay == 0 {
+		r.NOOPDelay = DefaultNOOPDelay
+	}
+	if r.MaxEHLOLength == 0 {
+		r.MaxEHLOLength = DefaultMaxEHLOLength
+	}
+
+	if r.PartialFailure == "" {
+		r.PartialFailure = PartialFailureFailIfAny
+	}
+
+	server := &r.Server
+	if server.MaxLineLength == 0 && r.ReadBufferSize > 0 {
+		server.MaxLineLength = r.ReadBufferSize
+	}
+	if server.MaxLineLength == 0 {
+		server.MaxLineLength = DefaultMaxLineLength
+	}
+	if server.ReadTimeout == 0 {
+		server.ReadTimeout = limits.Timeout
+	}
+	if server.WriteTimeout == 0 {
+		server.WriteTimeout = limits.Timeout
+	}
+
+	levels := &r.LogLevels
+	if levels.AuthFailure == "" {
+		levels.AuthFailure = DefaultLogLevelAuthFailure
+	}
+	if levels.PolicyRejection == "" {
+		levels.PolicyRejection = DefaultLogLevelPolicyRejection
+	}
+	if levels.IPRejection == "" {
+		levels.IPRejection = DefaultLogLevelIPRejection
+	}
+	if levels.DeliveryFailure == "" {
+		levels.DeliveryFailure = DefaultLogLevelDeliveryFailure
+	}
+
+	trace := &r.Trace
+	if trace.Dir == "" {
+		trace.Dir = DefaultTraceDir
+	}
+	if trace.MaxFileSize == 0 {
+		trace.MaxFileSize = DefaultTraceMaxFileSize
+	}
+	if trace.MaxFiles == 0 {
+		trace.MaxFiles = DefaultTraceMaxFiles
+	}
+	if trace.MaxDataBytes == 0 {
+		trace.MaxDataBytes = DefaultTraceMaxData
+	}
+	if r.FailureSpillDir != "" && r.FailureSpillMaxSize == 0 {
+		r.FailureSpillMaxSize = DefaultFailureSpillSize
+	}
+
+	if r.DSN.RateLimit == 0 {
+		r.DSN.RateLimit = DefaultDSNRateLimit
+	}
+
+	greylist := &r.Greylist
+	if greylist.Delay == 0 {
+		greylist.Delay = DefaultGreylistDelay
+	}
+	if greylist.Retention == 0 {
+		greylist.Retention = DefaultGreylistRetention
+	}
+	if greylist.MaxEntries == 0 {
+		greylist.MaxEntries = DefaultGreylistMaxEntries
+	}
+
+	for _, policy := range []*MailPolicy{&r.ValidFrom, &r.ValidTo} {
+		if policy.Enforcement == "" {
+			policy.Enforcement = EnforcementEnforce
+		}
+	}
+	for i := range r.Filters {
+		rule := &r.Filters[i]
+		if rule.Action == FilterTag && rule.Tag == "" {
+			rule.Tag = DefaultFilterTag
+		}
+		if rule.Enforcement == "" {
+			rule.Enforcement = EnforcementEnforce
+		}
+	}
+
+	if q := r.Quotas; q != nil && q.Timezone == "" {
+		q.Timezone = DefaultQuotaTimezone
+	}
+
+	if ap := r.AttachmentPolicy; ap != nil {
+		if len(ap.BlockedExtensions) == 0 && len(ap.BlockedTypes) == 0 && len(ap.AllowedExtensions) == 0 && len(ap.AllowedTypes) == 0 {
+			ap.BlockedExtensions = slices.Clone(DefaultBlockedExtensions) // default to blocking executables and scripts
+		}
+		if ap.Action == "" {
+			ap.Action = AttachmentReject
+		}
+	}
+}
+
+func applySendDefaults(s *SendConfig) {
+	if s.Type == "" {
+		s.Type = SenderGraph
+	}
+	if s.Timeout == 0 {
+		s.Timeout = DefaultSendTimeout
+	}
+	if s.Retries == 0 {
+		s.Retries = DefaultRetries
+	}
+	if s.Backoff == 0 {
+		s.Backoff = DefaultBackoff
+	}
+	if s.BackoffStrategy == "" {
+		s.BackoffStrategy = utils.StrategyExponential
+	}
+	if s.AuthFailureThreshold == 0 {
+		s.AuthFailureThreshold = DefaultAuthFailureThreshold
+	}
+	if s.AuthProbeInterval == 0 {
+		s.AuthProbeInterval = DefaultAuthProbeInterval
+	}
+	if s.CircuitBreaker.OpenTimeout == 0 {
+		s.CircuitBreaker.OpenTimeout = DefaultCircuitOpenTimeout
+	}
+	if s.PreferBody == "" {
+		s.PreferBody = email.PreferHTML
+	}
+	if s.ForceBodyType == "" {
+		s.ForceBodyType = ForceBodyHTML // send HTML as received
+	}
+	if s.PreserveHeaders == nil {
+		s.PreserveHeaders = DefaultPreserveHeaders // an empty list preserves no headers
+	}
+	if s.ArchiveBCC != "" && s.ArchiveBCCLabel == "" {
+		s.ArchiveBCCLabel = DefaultArchiveBCCLabel
+	}
+	if s.Footer != nil && s.Footer.Marker == "" {
+		s.Footer.Marker = DefaultFooterMarker
+	}
+	if s.SanitizePolicy == "" {
+		s.SanitizePolicy = email.SanitizeUGC
+	}
+
+	graphs := []*GraphSenderConfig{&s.Graph}
+	for i := range s.UserRoutes {
+		graphs = append(graphs, &s.UserRoutes[i].Graph)
+	}
+	for i := range s.Senders {
+		graphs = append(graphs, &s.Senders[i].Graph)
+	}
+	for _, g := range graphs {
+		if g.MaxConcurrent == 0 {
+			g.MaxConcurrent = sender.DefaultMaxConcurrent
+		}
+		if g.TokenRefreshBuffer == 0 {
+			g.TokenRefreshBuffer = sender.DefaultTokenRefreshBuffer
+		}
+		if g.TokenCooldown == 0 {
+			g.TokenCooldown = sender.DefaultTokenCooldown
+		}
+	}
+	if s.SendGrid.Endpoint == "" {
+		s.SendGrid.Endpoint = sender.DefaultSendGridEndpoint
+	}
+	if s.Type == SenderSES {
+		if s.SES.Region == "" {
+			s.SES.Region = os.Getenv("AWS_REGION") // default to the region of the environment
+		}
+		if s.SES.Endpoint == "" && s.SES.Region != "" {
+			s.SES.Endpoint = sender.DefaultSESEndpoint(s.SES.Region)
+		}
+	}
+}
+
+// Returns a configuration with every default applied and a plaintext SMTP listener on port 25 without
+// authentication. The sender's credentials must still be filled in before it validates.
+func GetDefaultConfig() *Config {
+	c := &Config{}
+	c.Recv.Listeners = []ListenerConfig{{Name: "smtp", Addr: ":25", Type: ListenerSMTP}}
+	c.Recv.Auth.Mode = AuthDisabled
+	ApplyDefaults(c)
+	return c
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+func TestApplyDefaults(t *testing.T) {
+	var cfg Config
+	ApplyDefaults(&cfg)
+
+	if cfg.Recv.Limits.MaxSize != DefaultMaxSize || cfg.Recv.Limits.MaxRecipients != DefaultMaxRecipients ||
+		cfg.Recv.Limits.MaxSubjectLength != email.DefaultMaxSubjectLength || cfg.Recv.Limits.Timeout != DefaultReadTimeout ||
+		cfg.Recv.Limits.BodyLimitAction != BodyLimitReject || cfg.Recv.Limits.MaxDataMemory != DefaultDataBuffers*DefaultMaxSize ||
+		cfg.Recv.Limits.DataMemoryWait != DefaultDataMemoryWait {
+		t.Errorf("limits = %+v", cfg.Recv.Limits)
+	}
+	if cfg.Recv.Server.MaxLineLength != DefaultMaxLineLength || cfg.Recv.Trace.Dir != DefaultTraceDir || cfg.Recv.DSN.RateLimit != DefaultDSNRateLimit {
+		t.Errorf("max line length = %d, trace dir = %q, dsn rate limit = %d", cfg.Recv.Server.MaxLineLength, cfg.Recv.Trace.Dir, cfg.Recv.DSN.RateLimit)
+	}
+	if cfg.System.ReloadDrainTimeout != DefaultReloadDrainTimeout {
+		t.Errorf("reload drain timeout = %s", cfg.System.ReloadDrainTimeout)
+	}
+	if cfg.Send.Type != SenderGraph || cfg.Send.Retries != DefaultRetries || cfg.Send.BackoffStrategy != utils.StrategyExponential ||
+		cfg.Send.ForceBodyType != ForceBodyHTML || !slices.Equal(cfg.Send.PreserveHeaders, DefaultPreserveHeaders) ||
+		cfg.Send.Graph.MaxConcurrent != sender.DefaultMaxConcurrent {
+		t.Errorf("send = %+v", cfg.Send)
+	}
+
+	// Settings which are already set are kept
+	cfg = Config{}
+	cfg.Recv.Limits.MaxRecipients = 5
+	cfg.Send.PreserveHeaders = []string{}
+	ApplyDefaults(&cfg)
+	ApplyDefaults(&cfg)
+	if cfg.Recv.Limits.MaxRecipients != 5 || len(cfg.Send.PreserveHeaders) != 0 {
+		t.Errorf("max recipients = %d, preserve headers = %v", cfg.Recv.Limits.MaxRecipients, cfg.Send.PreserveHeaders)
+	}
+}
+
+func TestGetDefaultConfigValidates(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := GetDefaultConfig()
+	cfg.Send.Graph.TenantID = "tenant"
+	cfg.Send.Graph.ClientID = "client"
+	cfg.Send.Graph.ClientSecretEnv = "TEST_GRAPH_SECRET"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if cfg.Send.Sender == nil {
+		t.Error("no sender created")
+	}
+}
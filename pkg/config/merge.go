@@ -0,0 +1,76 @@
+package config
+
+import "reflect"
+
+// Merge an override configuration over a base configuration and return the result; neither input is modified. Non-zero
+// fields in override replace those in base and nested structs are merged field by field. Slices are concatenated,
+// except for the listeners which are replaced as a whole. Because zero values are ignored, an override cannot reset a
+// field to its zero value (e.g. a boolean back to false). Both configurations must be unvalidated.
+func MergeConfigs(base, override *Config) *Config {
+	merged := deepCopy(reflect.ValueOf(base).Elem())
+	if override == nil {
+		return merged.Interface().(*Config)
+	}
+
+	mergeValue(merged.Elem(), reflect.ValueOf(override).Elem())
+	cfg := merged.Interface().(*Config)
+	if len(override.Recv.Listeners) > 0 {
+		cfg.Recv.Listeners = append([]ListenerConfig(nil), override.Recv.Listeners...)
+	}
+	return cfg
+}
+
+// Returns a pointer to a copy of v which shares no slices, maps or pointers with it.
+func deepCopy(v reflect.Value) reflect.Value {
+	dst := reflect.New(v.Type())
+	mergeValue(dst.Elem(), v)
+	return dst
+}
+
+// Merge src into dst, which must be settable.
+func mergeValue(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			if !dst.Field(i).CanSet() {
+				continue
+			}
+			mergeValue(dst.Field(i), src.Field(i))
+		}
+	case reflect.Pointer:
+		if src.IsNil() {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(deepCopy(src.Elem()))
+			return
+		}
+		merged := deepCopy(dst.Elem())
+		mergeValue(merged.Elem(), src.Elem())
+		dst.Set(merged)
+	case reflect.Slice:
+		if src.Len() == 0 {
+			return
+		}
+		out := reflect.MakeSlice(src.Type(), 0, dst.Len()+src.Len())
+		out = reflect.AppendSlice(out, dst)
+		out = reflect.AppendSlice(out, src)
+		dst.Set(out)
+	case reflect.Map:
+		if src.Len() == 0 {
+			return
+		}
+		out := reflect.MakeMapWithSize(src.Type(), dst.Len()+src.Len())
+		for _, key := range dst.MapKeys() {
+			out.SetMapIndex(key, dst.MapIndex(key))
+		}
+		for _, key := range src.MapKeys() {
+			out.SetMapIndex(key, src.MapIndex(key))
+		}
+		dst.Set(out)
+	default:
+		if !src.IsZero() {
+			dst.Set(src)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+const mergeBase = `
+recv:
+  domain: relay.example.com
+  auth:
+    mode: disabled
+  allowed_ips: ["10.0.0.0/8"]
+  valid_from:
+    domains: ["example.com"]
+  listeners:
+    - name: internal
+      addr: ":2525"
+      type: smtp
+send:
+  retries: 3
+  graph:
+    tenant_id: tenant
+    client_id: client
+    client_secret_env: TEST_GRAPH_SECRET
+`
+
+func parseTestConfig(t *testing.T, data string) *Config {
+	t.Helper()
+	cfg, err := ParseConfigBytes([]byte(data), true)
+	if err != nil {
+		t.Fatalf("ParseConfigBytes: %v", err)
+	}
+	return cfg
+}
+
+func TestMergeConfigsOverridesFields(t *testing.T) {
+	base := parseTestConfig(t, mergeBase)
+	merged := MergeConfigs(base, parseTestConfig(t, `
+recv:
+  domain: relay.prod.example.com
+send:
+  graph:
+    tenant_id: prod-tenant
+`))
+
+	if merged.Recv.Domain != "relay.prod.example.com" || merged.Send.Graph.TenantID != "prod-tenant" {
+		t.Errorf("domain = %q, tenant = %q, want the override's", merged.Recv.Domain, merged.Send.Graph.TenantID)
+	}
+	// Fields the override leaves unset keep the base value
+	if merged.Send.Retries != 3 || merged.Send.Graph.ClientID != "client" {
+		t.Errorf("retries = %d, client = %q, want the base's", merged.Send.Retries, merged.Send.Graph.ClientID)
+	}
+	if base.Recv.Domain != "relay.example.com" || base.Send.Graph.TenantID != "tenant" {
+		t.Error("merging modified the base config")
+	}
+}
+
+func TestMergeConfigsConcatenatesSlices(t *testing.T) {
+	base := parseTestConfig(t, mergeBase)
+	merged := MergeConfigs(base, parseTestConfig(t, `
+recv:
+  allowed_ips: ["192.168.0.0/16"]
+  valid_from:
+    domains: ["example.net"]
+  listeners:
+    - name: external
+      port: 587
+      type: starttls
+`))
+
+	if want := []string{"10.0.0.0/8", "192.168.0.0/16"}; !slices.Equal(merged.Recv.AllowedIPs, want) {
+		t.Errorf("allowed_ips = %q, want %q", merged.Recv.AllowedIPs, want)
+	}
+	if want := []string{"example.com", "example.net"}; !slices.Equal(merged.Recv.ValidFrom.Domains, want) {
+		t.Errorf("valid_from.domains = %q, want %q", merged.Recv.ValidFrom.Domains, want)
+	}
+	// The listeners are replaced rather than concatenated
+	if len(merged.Recv.Listeners) != 1 || merged.Recv.Listeners[0].Name != "external" {
+		t.Errorf("listeners = %+v, want the override's only", merged.Recv.Listeners)
+	}
+	if len(base.Recv.AllowedIPs) != 1 || base.Recv.Listeners[0].Name != "internal" {
+		t.Error("merging modified the base config")
+	}
+}
+
+func TestMergeConfigsEmptyOverride(t *testing.T) {
+	base := parseTestConfig(t, mergeBase)
+	for name, override := range map[string]*Config{"nil": nil, "empty": {}} {
+		merged := MergeConfigs(base, override)
+		if merged == base {
+			t.Errorf("%s override: MergeConfigs returned the base config instead of a copy", name)
+		}
+		if !reflect.DeepEqual(merged, base) {
+			t.Errorf("%s override: merged = %+v, want %+v", name, merged, base)
+		}
+	}
+}
+
+func TestLoadConfigWithOverride(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	dir := t.TempDir()
+	basePath, overridePath := filepath.Join(dir, "config.yaml"), filepath.Join(dir, "prod.yaml")
+	os.WriteFile(basePath, []byte(mergeBase), 0o600)
+	os.WriteFile(overridePath, []byte("recv:\n  domain: relay.prod.example.com\n"), 0o600)
+
+	cfg, err := LoadConfigWithOverride(basePath, overridePath, true)
+	if err != nil {
+		t.Fatalf("LoadConfigWithOverride: %v", err)
+	}
+	if cfg.Recv.Domain != "relay.prod.example.com" || cfg.Recv.Listeners[0].Name != "internal" {
+		t.Errorf("domain = %q, listeners = %+v", cfg.Recv.Domain, cfg.Recv.Listeners)
+	}
+}
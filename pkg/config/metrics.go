@@ -0,0 +1,6 @@
+package config
+
+type MetricsConfig struct {
+	Addr            string `yaml:"addr,omitempty"`              // Address to serve Prometheus metrics on (e.g. ":9090"), disabled if empty
+	MaxDomainLabels int    `yaml:"max_domain_labels,omitempty"` // Distinct sender domains labeled before others are collapsed into "other" (default 100)
+}
@@ -0,0 +1,18 @@
+package config
+
+import "time"
+
+type MonitoringConfig struct {
+	Heartbeat *HeartbeatConfig `yaml:"heartbeat,omitempty"` // Optional periodic synthetic message sent through the sender
+}
+
+// Periodic synthetic message sent through the sender to detect delivery failures (e.g. an expired client secret)
+// before real messages are lost. Repeated failures report the service as not ready.
+type HeartbeatConfig struct {
+	Interval         time.Duration `yaml:"interval,omitempty"`          // Time between heartbeats (default 1h)
+	From             string        `yaml:"from,omitempty"`              // Sender address (default: send.graph.mailbox)
+	To               string        `yaml:"to"`                          // Recipient address
+	SubjectPrefix    string        `yaml:"subject_prefix,omitempty"`    // Subject prefix (default "[GoPostal heartbeat]")
+	FailureThreshold int           `yaml:"failure_threshold,omitempty"` // Consecutive failures before reporting not ready (default 3)
+	AllowDryRun      bool          `yaml:"allow_dry_run,omitempty"`     // Also run if the sender does not deliver messages
+}
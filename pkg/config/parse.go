@@ -1,11 +1,20 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
 	"strings"
+
+	"golang.org/x/net/idna"
 )
 
+// Parse an IP address or CIDR into a network, plain addresses becoming /32 or /128 networks.
 func ParseNet(s string) (*net.IPNet, error) {
 	s = strings.TrimSpace(s)
 	if s == "" {
@@ -28,30 +37,162 @@ func ParseNet(s string) (*net.IPNet, error) {
 		return nil, err
 	}
 	ipnet.IP = ip.Mask(ipnet.Mask)
+
+	// IPv4-mapped IPv6 networks (e.g. "::ffff:10.0.0.0/104") are converted to IPv4 networks, which the IPv4 clients are
+	// matched against
+	if ones, bits := ipnet.Mask.Size(); bits == 128 && ones >= 96 && ipnet.IP.To4() != nil {
+		ipnet = &net.IPNet{IP: ipnet.IP.To4(), Mask: net.CIDRMask(ones-96, 32)}
+	}
 	return ipnet, nil
 }
 
-// A very basic email validation. In production, consider using a more robust library.
+// Parse a list of IP addresses and CIDRs into networks. Every invalid entry is reported in the error, by index.
+func ParseCIDRList(items []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(items))
+	var invalid []string
+	for i, item := range items {
+		n, err := ParseNet(item)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("[%d] '%s'", i, item))
+			continue
+		}
+		nets = append(nets, *n)
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid IP address or CIDR: %s", strings.Join(invalid, ", "))
+	}
+	return nets, nil
+}
+
+// Returns true if the string is a bare RFC 5322 address (e.g. "user+tag@example.com", without a display name).
 func isValidEmail(email string) bool {
-	if len(email) < 3 || len(email) > 254 {
+	if len(email) > 254 {
 		return false
 	}
-	// Check for the presence of an '@' symbol and a domain
-	at := strings.Index(email, "@")
-	if at == -1 || at == 0 || at == len(email)-1 {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" {
 		return false
 	}
-	return true
+	at := strings.LastIndex(addr.Address, "@")
+	return at > 0
 }
 
-// A very basic domain validation. In production, consider using a more robust library.
+// Returns true if the string is a fully qualified domain name (e.g. "example.com"). Internationalized names are
+// checked in their punycode form, whose labels must be 1-63 letters, digits or hyphens, not starting or ending with a
+// hyphen.
 func isValidDomain(domain string) bool {
-	if len(domain) < 1 || len(domain) > 253 {
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil || len(ascii) > 253 {
+		return false
+	}
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) < 1 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns true if the string is an absolute http(s) URL.
+func isValidURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
 		return false
 	}
-	// Check for the presence of a top-level domain
-	if !strings.Contains(domain, ".") {
+	return (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// Returns true if the string is a valid header field name: printable ASCII characters except colon (RFC 5322).
+func isValidHeaderName(name string) bool {
+	if name == "" {
 		return false
 	}
+	for _, c := range name {
+		if c < '!' || c > '~' || c == ':' {
+			return false
+		}
+	}
 	return true
-}
\ No newline at end of file
+}
+
+// Parse an octal permission string such as "0660" into a file mode.
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("mode must be between 0000 and 0777")
+	}
+	return os.FileMode(mode), nil
+}
+
+// Resolve a user name or numeric uid to a uid.
+func LookupUID(s string) (int, error) {
+	if uid, err := strconv.Atoi(s); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// Resolve a group name or numeric gid to a gid.
+func LookupGID(s string) (int, error) {
+	if gid, err := strconv.Atoi(s); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Parse a TLS version string such as "1.2" into its crypto/tls constant.
+func ParseTLSVersion(s string) (uint16, error) {
+	if v, found := tlsVersions[strings.TrimSpace(s)]; found {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version '%s', must be one of: '1.0', '1.1', '1.2', or '1.3'", s)
+}
+
+// Parse cipher suite names (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") into their crypto/tls IDs. TLS 1.3 suites
+// are rejected since they are not configurable.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		cs, found := known[strings.TrimSpace(name)]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite '%s'", name)
+		}
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suite '%s' is TLS 1.3 only and cannot be configured", name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
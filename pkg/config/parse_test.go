@@ -0,0 +1,89 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValidEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		valid bool
+	}{
+		{"alerts@example.com", true},
+		{"alerts+disk@example.com", true},
+		{`"disk alerts"@example.com`, true},
+		{"alerts@", false},
+		{"alerts", false},
+		{"@example.com", false},
+		{"Alerts <alerts@example.com>", false},
+		{"alerts@example.com\r\nBcc: victim@example.net", false},
+		{"alerts@example.com\nBcc: victim@example.net", false},
+	}
+	for _, tt := range tests {
+		if got := isValidEmail(tt.email); got != tt.valid {
+			t.Errorf("isValidEmail(%q) = %v, want %v", tt.email, got, tt.valid)
+		}
+	}
+}
+
+func TestIsValidDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		valid  bool
+	}{
+		{"example.com", true},
+		{"mail-relay.example.co.uk", true},
+		{"bücher.example", true},
+		{"xn--bcher-kva.example", true},
+		{"example", false},
+		{"mail_relay.example.com", false},
+		{strings.Repeat("a", 64) + ".example.com", false},
+		{strings.Repeat("a", 63) + ".example.com", true},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"example..com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isValidDomain(tt.domain); got != tt.valid {
+			t.Errorf("isValidDomain(%q) = %v, want %v", tt.domain, got, tt.valid)
+		}
+	}
+}
+
+func TestParseCIDRList(t *testing.T) {
+	tests := []struct {
+		name    string
+		items   []string
+		want    []string
+		wantErr string
+	}{
+		{"empty", nil, []string{}, ""},
+		{"cidrs", []string{"10.0.0.0/8", "192.168.1.7/24", "2001:db8::/32"}, []string{"10.0.0.0/8", "192.168.1.0/24", "2001:db8::/32"}, ""},
+		{"plain addresses", []string{"127.0.0.1", " ::1 "}, []string{"127.0.0.1/32", "::1/128"}, ""},
+		{"ipv4-mapped", []string{"::ffff:10.0.0.1", "::ffff:10.0.0.0/104"}, []string{"10.0.0.1/32", "10.0.0.0/8"}, ""},
+		{"invalid entries", []string{"10.0.0.0/8", "10.0.0.0/33", "", "relay.example.com"}, nil, "invalid IP address or CIDR: [1] '10.0.0.0/33', [2] '', [3] 'relay.example.com'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := ParseCIDRList(tt.items)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("ParseCIDRList: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCIDRList: %v", err)
+			}
+			got := make([]string, len(nets))
+			for i, n := range nets {
+				got[i] = n.String()
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("ParseCIDRList = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variable selecting the configuration file when the -config flag is not set
+const ConfigPathEnv = "GOPOSTAL_CONFIG"
+
+// Configuration files searched in order when neither the flag nor the environment variable is set
+var DefaultConfigPaths = []string{"config.yaml", "/etc/gopostal/config.yaml"}
+
+// Resolve the configuration file to load: the flag, then $GOPOSTAL_CONFIG, then the first existing default path.
+// Returns the path and where it came from ("flag", "env" or "default"). An explicit path is returned even if it does
+// not exist, so loading it reports the missing file instead of silently falling back to a default.
+func ResolveConfigPath(flagPath string) (path, source string, err error) {
+	return resolveConfigPath(flagPath, os.Getenv(ConfigPathEnv), DefaultConfigPaths)
+}
+
+func resolveConfigPath(flagPath, envPath string, defaults []string) (string, string, error) {
+	if flagPath != "" {
+		return flagPath, "flag", nil
+	}
+	if envPath != "" {
+		return envPath, "env", nil
+	}
+	for _, path := range defaults {
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() {
+			return path, "default", nil
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", "", fmt.Errorf("failed to access configuration file: %w", err)
+		}
+	}
+	return "", "", fmt.Errorf("no configuration file found (searched %s), set -config or $%s", strings.Join(defaults, ", "), ConfigPathEnv)
+}
+
+// Check the directory exists and a file can be created in it.
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".gopostal-check-*")
+	if err != nil {
+		return fmt.Errorf("'%s' is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveConfigPath(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "config.yaml")
+	system := filepath.Join(dir, "etc", "config.yaml")
+	if err := os.MkdirAll(filepath.Dir(system), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defaults := []string{local, system}
+
+	tests := []struct {
+		name       string
+		flag, env  string
+		files      []string // default files which exist
+		wantPath   string
+		wantSource string
+	}{
+		{"flag over env", "flag.yaml", "env.yaml", []string{local}, "flag.yaml", "flag"},
+		{"env over defaults", "", "env.yaml", []string{local}, "env.yaml", "env"},
+		{"explicit path is not checked", "", filepath.Join(dir, "missing.yaml"), nil, filepath.Join(dir, "missing.yaml"), "env"},
+		{"working directory first", "", "", []string{local, system}, local, "default"},
+		{"system path", "", "", []string{system}, system, "default"},
+		{"none found", "", "", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range defaults {
+				os.Remove(path)
+			}
+			for _, path := range tt.files {
+				if err := os.WriteFile(path, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			path, source, err := resolveConfigPath(tt.flag, tt.env, defaults)
+			if tt.wantPath == "" {
+				if err == nil || !strings.Contains(err.Error(), ConfigPathEnv) {
+					t.Errorf("got %q (%s), want an error naming $%s", path, source, ConfigPathEnv)
+				}
+				return
+			}
+			if err != nil || path != tt.wantPath || source != tt.wantSource {
+				t.Errorf("got %q (%s), %v, want %q (%s)", path, source, err, tt.wantPath, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestResolveConfigPathEnv(t *testing.T) {
+	t.Setenv(ConfigPathEnv, "/srv/gopostal.yaml")
+	if path, source, err := ResolveConfigPath(""); err != nil || path != "/srv/gopostal.yaml" || source != "env" {
+		t.Errorf("got %q (%s), %v, want $%s", path, source, err, ConfigPathEnv)
+	}
+}
@@ -3,59 +3,473 @@ package config
 import (
 	"crypto/tls"
 	"net"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/goodieshq/gopostal/pkg/auth"
+	"github.com/goodieshq/gopostal/pkg/ban"
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/greylist"
+	"github.com/goodieshq/gopostal/pkg/hooks"
+	"github.com/goodieshq/gopostal/pkg/logging"
+	"github.com/goodieshq/gopostal/pkg/quota"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/stapling"
+	"github.com/goodieshq/gopostal/pkg/utils"
+	"github.com/rs/zerolog"
 )
 
 type RecvConfig struct {
 	RecvGlobalConfig `yaml:",inline"`
 	Listeners        []ListenerConfig `yaml:"listeners"`
+	HTTP             *HTTPConfig      `yaml:"http,omitempty"` // Optional HTTP submission API
+}
+
+// HTTP submission API accepting JSON messages at POST /v1/messages
+type HTTPConfig struct {
+	Port          uint16 `yaml:"port"`
+	AuthToken     string `yaml:"auth_token,omitempty"`      // Bearer token required in the Authorization header
+	AuthTokenEnv  string `yaml:"auth_token_env,omitempty"`  // Environment variable holding the bearer token
+	AuthTokenFile string `yaml:"auth_token_file,omitempty"` // File holding the bearer token
+	BasicAuth     bool   `yaml:"basic_auth,omitempty"`      // Accept HTTP basic auth against recv.auth credentials ('plain' mode)
 }
 
 type RecvGlobalConfig struct {
-	Domain        string             `yaml:"domain,omitempty"`
-	AllowedIPs    []string           `yaml:"allowed_ips"`
-	AllowedNets   []net.IPNet        `yaml:"-"`
-	Auth          AuthRule           `yaml:"auth"`
-	Authenticator auth.Authenticator `yaml:"-"`
-	ValidFrom     MailPolicy         `yaml:"valid_from"`
-	ValidTo       MailPolicy         `yaml:"valid_to"`
-	Limits        RecvLimits         `yaml:"limits,omitempty"`
+	Domain           string                      `yaml:"domain,omitempty"`
+	AllowedIPs       []string                    `yaml:"allowed_ips"`
+	AllowedNets      []net.IPNet                 `yaml:"-"`
+	Auth             AuthRule                    `yaml:"auth"`
+	Authenticator    auth.Authenticator          `yaml:"-"`
+	ValidFrom        MailPolicy                  `yaml:"valid_from"`
+	ValidTo          MailPolicy                  `yaml:"valid_to"`
+	StripPlusTags    bool                        `yaml:"strip_plus_tags,omitempty"`   // Ignore "+tag" suffixes of local parts when comparing addresses
+	AllowNullSender  *bool                       `yaml:"allow_null_sender,omitempty"` // Accept MAIL FROM:<> from every session (true) or none (false); unset accepts it from authenticated sessions only
+	Limits           RecvLimits                  `yaml:"limits,omitempty"`
+	SpoolDir         string                      `yaml:"spool_dir,omitempty"` // Directory of the messages received into temporary files (default: the system temporary directory)
+	AutoBlock        AutoBlockConfig             `yaml:"auto_block,omitempty"`
+	NOOPRateLimit    int                         `yaml:"noop_rate_limit,omitempty"`   // NOOP commands allowed per minute before replies are delayed (0 disables)
+	NOOPDelay        time.Duration               `yaml:"noop_delay,omitempty"`        // Delay applied to NOOP replies beyond the rate limit (e.g., "5s")
+	ReadBufferSize   int                         `yaml:"read_buffer_size,omitempty"`  // Deprecated alias of server.max_line_length, kept for older configurations
+	MaxEHLOLength    int                         `yaml:"max_ehlo_length,omitempty"`   // Maximum length in bytes of the hostname sent with EHLO/HELO
+	InjectMessageID  bool                        `yaml:"inject_message_id,omitempty"` // Add a Message-ID header to messages received without one
+	InjectReceived   bool                        `yaml:"inject_received,omitempty"`   // Prepend a Received header documenting the relay hop
+	Filters          []FilterRule                `yaml:"filters,omitempty"`           // Content filter rules, evaluated in order; the first match applies
+	AttachmentPolicy *AttachmentPolicy           `yaml:"attachment_policy,omitempty"` // Optional limits on the attachments of messages
+	Trace            TraceConfig                 `yaml:"trace,omitempty"`             // Storage of the session transcripts of listeners with debug_trace
+	CustomErrors     map[string]string           `yaml:"custom_errors,omitempty"`     // Reply messages replacing the defaults of policy errors, by error name
+	DSN              DSNConfig                   `yaml:"dsn,omitempty"`               // Delivery status notifications requested by the submitting systems
+	Hooks            []HookConfig                `yaml:"hooks,omitempty"`             // Hooks called in order on every message before it is sent
+	SideEffects      map[string]SideEffectConfig `yaml:"side_effects,omitempty"`      // Criticality of the steps run after a message was sent, by name
+	PartialFailure   string                      `yaml:"partial_failure,omitempty"`   // Reply to a message sent to some of its recipients only (default: fail_if_any)
+	Quotas           *QuotaConfig                `yaml:"quotas,omitempty"`            // Optional daily quotas of the messages sent per user or source IP
+	LogLevels        LogLevelConfig              `yaml:"log_levels,omitempty"`        // Levels of the logged rejections and failures, by category
+	Server           ServerConfig                `yaml:"server,omitempty"`            // Advanced settings of the SMTP servers
+	Greylist         GreylistConfig              `yaml:"greylist,omitempty"`          // Greylisting of unauthenticated sessions
+	BanList          *ban.BanList                `yaml:"-"`
+	LogSampler       *logging.Sampler            `yaml:"-"` // Sampler of the session logs, nil to log every session
+
+	// Copies of the messages the sender failed to send, for diagnosis only
+	FailureSpillDir     string `yaml:"failure_spill_dir,omitempty"`      // Directory of the copies (disabled if empty)
+	FailureSpillMaxSize int64  `yaml:"failure_spill_max_size,omitempty"` // Total size of the copies kept, the oldest removed first (default 100 MiB)
 }
 
 type ListenerConfig struct {
-	Name        string       `yaml:"name"`
-	Port        uint16       `yaml:"port"`
-	Type        ListenerType `yaml:"type"`
-	RequireAuth bool         `yaml:"require_auth"`
-	TLS         *TLSConfig   `yaml:"tls,omitempty"`
-	TLSConfig   *tls.Config  `yaml:"-"`
+	Name            string       `yaml:"name"`
+	Addr            string       `yaml:"addr,omitempty"`         // TCP address to bind: ":587" (every interface), "192.168.1.1:587" or "[::1]:587"
+	DeprecatedPort  uint16       `yaml:"port,omitempty"`         // Shorthand for addr ":<port>", kept for older configurations
+	SocketPath      string       `yaml:"socket_path,omitempty"`  // Unix domain socket path (mutually exclusive with addr)
+	SocketMode      string       `yaml:"socket_mode,omitempty"`  // Octal permissions of the socket file (e.g. "0660")
+	SocketOwner     string       `yaml:"socket_owner,omitempty"` // User name or numeric uid owning the socket file
+	SocketGroup     string       `yaml:"socket_group,omitempty"` // Group name or numeric gid owning the socket file
+	SocketFileMode  os.FileMode  `yaml:"-"`
+	SocketUID       int          `yaml:"-"`
+	SocketGID       int          `yaml:"-"`
+	Type            ListenerType `yaml:"type"`
+	RequireAuth     bool         `yaml:"require_auth"`
+	ProxyProtocol   bool         `yaml:"proxy_protocol,omitempty"`   // Require a PROXY protocol (v1/v2) header from a load balancer
+	ForceRecipients []string     `yaml:"force_recipients,omitempty"` // Deliver all mail to these addresses instead of the envelope recipients
+	AllowUntrusted  bool         `yaml:"allow_untrusted,omitempty"`  // Accept LMTP sessions from outside recv.auth.trusted_networks
+	DebugTrace      bool         `yaml:"debug_trace,omitempty"`      // Record the SMTP transcript of each session under recv.trace.dir
+	SubjectPrefix   string       `yaml:"subject_prefix,omitempty"`   // Prepended to the subject of each message (e.g. "[SCANNER-ROOM-A]")
+	Sender          string       `yaml:"sender,omitempty"`           // Name of the send.senders entry sending the listener's messages
+	SkipFooter      bool         `yaml:"skip_footer,omitempty"`      // Do not append send.footer to the listener's messages
+	Priority        string       `yaml:"priority,omitempty"`         // "high", "normal" (default) or "low": share of the sender's capacity under load
+	TLS             *TLSConfig   `yaml:"tls,omitempty"`
+	TLSConfig       *tls.Config  `yaml:"-"`
+
+	// Refreshes the OCSP response stapled to the handshakes of TLSConfig, nil unless tls.ocsp_stapling is set
+	OCSPStapler *stapling.Stapler `yaml:"-"`
+}
+
+// Returns the priority of the listener's messages when they wait for the capacity of their sender.
+func (l *ListenerConfig) SendPriority() sender.Priority {
+	priority, _ := sender.ParsePriority(l.Priority) // validated
+	return priority
+}
+
+// Returns true if the listener is bound to a Unix domain socket rather than a TCP port.
+func (l *ListenerConfig) IsUnix() bool {
+	return l.SocketPath != ""
+}
+
+// Returns the TCP port of the listener's address, or 0 for Unix domain sockets and invalid addresses.
+func (l *ListenerConfig) TCPPort() int {
+	if l.IsUnix() {
+		return 0
+	}
+	_, port, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
 }
 
 type TLSConfig struct {
-	CertFile string `yaml:"cert_file"`
-	KeyFile  string `yaml:"key_file"`
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	ChainFile    string   `yaml:"chain_file,omitempty"`    // PEM intermediates sent after the certificate, the issuer first
+	MinVersion   string   `yaml:"min_version,omitempty"`   // Minimum TLS version: "1.0", "1.1", "1.2" (default), or "1.3"
+	MaxVersion   string   `yaml:"max_version,omitempty"`   // Maximum TLS version (default: highest supported)
+	CipherSuites []string `yaml:"cipher_suites,omitempty"` // Allowed TLS 1.0-1.2 cipher suites by name (default: Go's secure defaults)
+	ALPN         []string `yaml:"alpn,omitempty"`          // Supported application protocols for ALPN negotiation
+	ServerName   string   `yaml:"server_name,omitempty"`   // Host name clients connect to, which the certificate must be valid for
+	OCSPStapling bool     `yaml:"ocsp_stapling,omitempty"` // Staple the OCSP response of the certificate to the handshakes
+
+	// Additional certificates served to the clients requesting one of their DNS names (SNI). The certificate of
+	// cert_file is served to the other clients.
+	Certificates []CertificatePair `yaml:"certificates,omitempty"`
+}
+
+// A certificate with its key, selected by the server name requested by the client
+type CertificatePair struct {
+	CertFile  string `yaml:"cert_file"`
+	KeyFile   string `yaml:"key_file"`
+	ChainFile string `yaml:"chain_file,omitempty"` // PEM intermediates sent after the certificate, the issuer first
 }
 
 type AuthRule struct {
-	Mode        AuthMode     `yaml:"mode"`
-	Credentials []Credential `yaml:"credentials,omitempty"`
+	Mode            AuthMode     `yaml:"mode"`
+	Credentials     []Credential `yaml:"credentials,omitempty"`
+	TrustedNetworks []string     `yaml:"trusted_networks,omitempty"` // Source IPs/CIDRs treated as authenticated (must also be allowed by allowed_ips)
+	TrustedNets     []net.IPNet  `yaml:"-"`
+	BindSender      bool         `yaml:"bind_sender,omitempty"` // Authenticated users may only send from the addresses and domains of their allowed_from
 }
 
 // Represents a username and a BCrypt hashed password for authentication.
 type Credential struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Username      string   `yaml:"username"`
+	Password      string   `yaml:"password,omitempty"`
+	PasswordFile  string   `yaml:"password_file,omitempty"`  // File holding the BCrypt hash, instead of password
+	SubjectPrefix string   `yaml:"subject_prefix,omitempty"` // Prepended to the subject of the user's messages, after the listener's prefix
+	AllowedFrom   []string `yaml:"allowed_from,omitempty"`   // Addresses and domains the user may send from when bind_sender is set
+}
+
+// Returns the subject prefix of the user's credential, if any.
+func (a *AuthRule) SubjectPrefix(username string) string {
+	for _, cred := range a.Credentials {
+		if cred.Username == username {
+			return cred.SubjectPrefix
+		}
+	}
+	return ""
+}
+
+// Returns the addresses and domains of the user's allowed_from, which are told apart by the "@" of the addresses.
+func (a *AuthRule) AllowedFrom(username string) (addresses, domains []string) {
+	for _, cred := range a.Credentials {
+		if cred.Username != username {
+			continue
+		}
+		for _, entry := range cred.AllowedFrom {
+			if strings.Contains(entry, "@") {
+				addresses = append(addresses, entry)
+			} else {
+				domains = append(domains, entry)
+			}
+		}
+	}
+	return addresses, domains
 }
 
+// Addresses and domains allowed and denied by a sender or recipient policy. The deny lists are evaluated first and win
+// over the allow lists; empty allow lists allow every address which is not denied.
 type MailPolicy struct {
-	Addresses []string `yaml:"addresses,omitempty"`
-	Domains   []string `yaml:"domains,omitempty"`
+	Addresses       []string `yaml:"addresses,omitempty"`
+	Domains         []string `yaml:"domains,omitempty"`
+	DeniedAddresses []string `yaml:"denied_addresses,omitempty"`
+	DeniedDomains   []string `yaml:"denied_domains,omitempty"`
+
+	// Whether the rejections of the policy are enforced or only logged and counted (default enforce)
+	Enforcement Enforcement `yaml:"enforcement,omitempty"`
+}
+
+// Whether a policy rule rejects the messages it matches or only reports them
+type Enforcement string
+
+const (
+	EnforcementEnforce Enforcement = "enforce" // apply the rule
+	EnforcementMonitor Enforcement = "monitor" // log and count what the rule would have done, but accept the message
+)
+
+// Returns true if the rule only reports the messages it would reject.
+func (e Enforcement) Monitored() bool {
+	return e == EnforcementMonitor
 }
 
 type RecvLimits struct {
-	MaxSize       int           `yaml:"max_size,omitempty"`       // Maximum message size in bytes
-	MaxRecipients int           `yaml:"max_recipients,omitempty"` // Maximum number of recipients per message
-	Timeout       time.Duration `yaml:"timeout,omitempty"`        // Read timeout duration (e.g., "10s")
+	MaxSize          int           `yaml:"max_size,omitempty"`           // Maximum message size in bytes
+	MaxRecipients    int           `yaml:"max_recipients,omitempty"`     // Maximum number of recipients per message
+	MaxSubjectLength int           `yaml:"max_subject_length,omitempty"` // Longer subjects are truncated (in bytes)
+	Timeout          time.Duration `yaml:"timeout,omitempty"`            // Read timeout duration (e.g., "10s")
+
+	MaxMessagesPerConnection int   `yaml:"max_messages_per_connection,omitempty"` // Messages accepted on one connection before MAIL is refused (0 for no limit)
+	MaxBytesPerConnection    int64 `yaml:"max_bytes_per_connection,omitempty"`    // Bytes of messages accepted on one connection before MAIL is refused (0 for no limit)
+
+	// Memory of the messages being received and processed at once. Each message reserves max_size of it while its data
+	// is read, or memory_spool_threshold if it is lower, then its own size once it was read, so DATA commands wait
+	// while the memory of the messages in flight reaches max_data_memory. Spooling only bounds the memory of the
+	// transfer, as a spooled message is read back whole to be processed
+	MaxDataMemory        int64            `yaml:"max_data_memory,omitempty"`        // Bytes reserved by all messages at once (default 16 times max_size)
+	DataMemoryWait       time.Duration    `yaml:"data_memory_wait,omitempty"`       // Wait of a DATA command for its reservation before it is deferred (default 1m)
+	MemorySpoolThreshold int              `yaml:"memory_spool_threshold,omitempty"` // Messages larger than this many bytes are received into a temporary file (0 to buffer every message in memory)
+	DataMemory           *utils.Semaphore `yaml:"-"`
+
+	// Limits of the extracted body, distinct from max_size which limits the whole message with its attachments
+	MaxBodySize     int             `yaml:"max_body_size,omitempty"`     // Maximum body size in bytes (0 for no limit)
+	MaxHTMLElements int             `yaml:"max_html_elements,omitempty"` // Maximum number of elements of an HTML body (0 for no limit)
+	BodyLimitAction BodyLimitAction `yaml:"body_limit_action,omitempty"` // What happens to a body over the limits (default "reject")
+}
+
+// What happens to a message whose body exceeds recv.limits.max_body_size or max_html_elements
+type BodyLimitAction string
+
+const (
+	BodyLimitReject   BodyLimitAction = "reject"   // reply 552 to the message
+	BodyLimitTruncate BodyLimitAction = "truncate" // cut the body at the limit and append a notice
+)
+
+// Steps run after a message was sent. A failing side effect is logged, and defers the message only if it is required.
+const (
+	SideEffectQuota   = "quota"   // count the sent message against the quota of its user or source IP
+	SideEffectMetrics = "metrics" // record the sent message in the metrics
+	SideEffectDSN     = "dsn"     // send the requested delivery status notification
+	SideEffectArchive = "archive" // send the blind copy of send.archive_bcc
+)
+
+// Names of the side effects, in the order they run
+var SideEffects = []string{SideEffectQuota, SideEffectMetrics, SideEffectDSN, SideEffectArchive}
+
+// Replies to a message the sender delivered to some of its recipients only (recv.partial_failure)
+const (
+	PartialFailureFailIfAny    = "fail_if_any"    // reject the message, so the client retries it for every recipient
+	PartialFailureSucceedIfAny = "succeed_if_any" // accept the message, the failed recipients are only logged
+)
+
+type SideEffectConfig struct {
+	Required bool `yaml:"required"` // Reply 451 instead of 250 if the side effect fails, so the client retries the message
+}
+
+// Returns the normalization applied to addresses before they are compared against the mail policies.
+func (r *RecvGlobalConfig) NormalizeOptions() email.NormalizeOptions {
+	return email.NormalizeOptions{StripPlusTags: r.StripPlusTags}
+}
+
+// Returns true if the null reverse-path (MAIL FROM:<>) is accepted from the session. Unless configured, only
+// authenticated sessions may submit bounces.
+func (r *RecvGlobalConfig) NullSenderAllowed(authenticated bool) bool {
+	if r.AllowNullSender == nil {
+		return authenticated
+	}
+	return *r.AllowNullSender
+}
+
+// Returns true if the named side effect must succeed for the message to be accepted.
+func (r *RecvGlobalConfig) SideEffectRequired(name string) bool {
+	return r.SideEffects[name].Required
+}
+
+// A hook called on every message before it is sent, created by the factory registered under its name
+type HookConfig struct {
+	Name     string            `yaml:"name"`
+	Options  map[string]string `yaml:"options,omitempty"`
+	FailOpen bool              `yaml:"fail_open,omitempty"` // Send the message without the hook's changes if it fails, instead of deferring it
+	Hook     hooks.Hook        `yaml:"-"`
+}
+
+// Delivery status notifications (RFC 3461) sent back to the envelope sender of messages whose recipients were
+// submitted with NOTIFY=SUCCESS or NOTIFY=FAILURE.
+type DSNConfig struct {
+	Enabled   bool               `yaml:"enabled"`              // Advertise DSN and send the requested notifications
+	From      string             `yaml:"from,omitempty"`       // Sender address of the notifications
+	RateLimit int                `yaml:"rate_limit,omitempty"` // Notifications sent to an envelope sender per hour (default 10)
+	Limiter   *utils.RateLimiter `yaml:"-"`
+}
+
+// Greylisting of the recipients of unauthenticated sessions: the first attempt of an unseen (source IP, sender,
+// recipient) triplet is refused with 450, and retries are accepted once the delay has elapsed. Authenticated sessions,
+// including those of trusted networks, are exempt.
+type GreylistConfig struct {
+	Enabled    bool            `yaml:"enabled"`
+	Delay      time.Duration   `yaml:"delay,omitempty"`       // Time before a retry of a new triplet is accepted (default 5m)
+	Retention  time.Duration   `yaml:"retention,omitempty"`   // Time a triplet is remembered once unused (default 720h)
+	Listeners  []string        `yaml:"listeners,omitempty"`   // Names of the listeners greylisting applies to (default all)
+	MaxEntries int             `yaml:"max_entries,omitempty"` // Triplets remembered, the least recently seen are evicted beyond (default 100000)
+	StateFile  string          `yaml:"state_file,omitempty"`  // File persisting the triplets across restarts (default in memory only)
+	Store      *greylist.Store `yaml:"-"`
+}
+
+// Returns true if greylisting applies to the sessions of the listener.
+func (g *GreylistConfig) AppliesTo(listener string) bool {
+	return g.Enabled && (len(g.Listeners) == 0 || slices.Contains(g.Listeners, listener))
+}
+
+// Daily quotas of the messages sent by each authenticated user, or by each source IP of unauthenticated sessions.
+// Messages beyond the quota are deferred with 452 until the quotas reset.
+type QuotaConfig struct {
+	Default   QuotaLimit            `yaml:"default,omitempty"`    // Limit of the users and source IPs without an override
+	Users     map[string]QuotaLimit `yaml:"users,omitempty"`      // Limits replacing the default, by username or source IP
+	ResetHour int                   `yaml:"reset_hour,omitempty"` // Hour of the day (0-23) the quotas reset at (default 0)
+	Timezone  string                `yaml:"timezone,omitempty"`   // IANA time zone of the reset hour (default "UTC")
+	StateFile string                `yaml:"state_file,omitempty"` // File persisting the usage across restarts (default in memory only)
+	Tracker   *quota.Tracker        `yaml:"-"`
+}
+
+type QuotaLimit struct {
+	Messages int   `yaml:"messages,omitempty"` // Messages per day (0 for no limit)
+	Bytes    int64 `yaml:"bytes,omitempty"`    // Bytes of messages per day (0 for no limit)
+}
+
+// Storage of SMTP session transcripts. Each traced session is written to its own file, and the oldest files are
+// removed beyond the maximum count.
+type TraceConfig struct {
+	Dir          string `yaml:"dir,omitempty"`            // Directory of the transcript files (default "traces")
+	MaxFileSize  int    `yaml:"max_file_size,omitempty"`  // Maximum size of a transcript file in bytes (default 1 MiB)
+	MaxFiles     int    `yaml:"max_files,omitempty"`      // Maximum number of transcript files kept (default 100)
+	MaxDataBytes int    `yaml:"max_data_bytes,omitempty"` // Bytes of each message (DATA) recorded before it is truncated (default 1024)
+}
+
+// Advanced settings of the SMTP servers of the listeners, applied by the SMTP library before the session sees the
+// commands. DSN is advertised when recv.dsn is enabled.
+type ServerConfig struct {
+	MaxLineLength    int           `yaml:"max_line_length,omitempty"`   // Longest command or message line in bytes (default 64 KiB)
+	MaxRecipients    int           `yaml:"max_recipients,omitempty"`    // Recipients accepted per message by the SMTP library (0: only limits.max_recipients applies)
+	ReadTimeout      time.Duration `yaml:"read_timeout,omitempty"`      // Time to wait for each command or data read (default: limits.timeout)
+	WriteTimeout     time.Duration `yaml:"write_timeout,omitempty"`     // Time to wait for each reply to be written (default: limits.timeout)
+	EnableREQUIRETLS bool          `yaml:"enable_requiretls,omitempty"` // Advertise REQUIRETLS (RFC 8689) on TLS connections
+}
+
+// Levels at which the rejections and failures of each category are logged, as zerolog level names ("trace", "debug",
+// "info", "warn", "error" or "disabled"), so expected noise such as a scanner retrying wrong credentials can be demoted.
+type LogLevelConfig struct {
+	AuthFailure     string `yaml:"auth_failure,omitempty"`     // Failed AUTH attempts (default: info)
+	PolicyRejection string `yaml:"policy_rejection,omitempty"` // Commands and messages rejected by policy (default: warn)
+	IPRejection     string `yaml:"ip_rejection,omitempty"`     // Connections refused by allowed_ips or auto_block (default: warn)
+	DeliveryFailure string `yaml:"delivery_failure,omitempty"` // Messages the sender failed to deliver (default: error)
+
+	AuthFailureLevel     zerolog.Level `yaml:"-"`
+	PolicyRejectionLevel zerolog.Level `yaml:"-"`
+	IPRejectionLevel     zerolog.Level `yaml:"-"`
+	DeliveryFailureLevel zerolog.Level `yaml:"-"`
+}
+
+// Automatically block source IPs which repeatedly trigger sender/recipient policy errors
+type AutoBlockConfig struct {
+	ErrorThreshold int           `yaml:"error_threshold,omitempty"` // Number of policy errors before blocking (0 disables)
+	Window         time.Duration `yaml:"window,omitempty"`          // Window in which policy errors are counted (e.g., "10m")
+	BlockDuration  time.Duration `yaml:"block_duration,omitempty"`  // Duration of the block (e.g., "1h")
+}
+
+// Action taken when a content filter rule matches
+type FilterAction string
+
+const (
+	FilterReject  FilterAction = "reject"  // reject the message with 550
+	FilterDiscard FilterAction = "discard" // accept the message with 250 but do not send it
+	FilterTag     FilterAction = "tag"     // prefix the subject with the rule's tag and send it
+)
+
+// Content filter rule. All configured patterns must match for the rule to apply.
+type FilterRule struct {
+	Name         string         `yaml:"name"`
+	MatchSubject string         `yaml:"match_subject,omitempty"` // Regular expression matched against the decoded subject
+	MatchBody    string         `yaml:"match_body,omitempty"`    // Regular expression matched against the message body
+	MatchFrom    string         `yaml:"match_from,omitempty"`    // Regular expression matched against the envelope sender
+	Action       FilterAction   `yaml:"action"`
+	Tag          string         `yaml:"tag,omitempty"`         // Subject prefix for the tag action (default "[FILTERED]")
+	Enforcement  Enforcement    `yaml:"enforcement,omitempty"` // "monitor" logs the matches without applying the action (default "enforce")
+	SubjectRe    *regexp.Regexp `yaml:"-"`
+	BodyRe       *regexp.Regexp `yaml:"-"`
+	FromRe       *regexp.Regexp `yaml:"-"`
+}
+
+// Returns true if every configured pattern of the rule matches the message.
+func (r *FilterRule) Matches(subject, from string, body []byte) bool {
+	if r.SubjectRe != nil && !r.SubjectRe.MatchString(subject) {
+		return false
+	}
+	if r.FromRe != nil && !r.FromRe.MatchString(from) {
+		return false
+	}
+	if r.BodyRe != nil && !r.BodyRe.Match(body) {
+		return false
+	}
+	return true
+}
+
+// Action taken when an attachment violates the attachment policy
+type AttachmentAction string
+
+const (
+	AttachmentReject AttachmentAction = "reject" // reject the message with 552 (too large or too many) or 550 (blocked)
+	AttachmentStrip  AttachmentAction = "strip"  // remove the offending attachments and append a note to the body
+)
+
+// Extensions blocked when neither a blocklist nor an allowlist is configured
+var DefaultBlockedExtensions = []string{".exe", ".js", ".vbs", ".bat", ".cmd", ".com", ".scr", ".pif", ".msi", ".jar", ".ps1", ".wsf", ".hta"}
+
+// Limits on the attachments of messages. An attachment is blocked if its filename extension or declared content type
+// is blocklisted, or if an allowlist is configured and it does not match it. Content types may end in "/*" to match
+// every subtype.
+type AttachmentPolicy struct {
+	BlockedExtensions []string         `yaml:"blocked_extensions,omitempty"` // e.g. ".exe"
+	BlockedTypes      []string         `yaml:"blocked_types,omitempty"`      // e.g. "application/x-msdownload"
+	AllowedExtensions []string         `yaml:"allowed_extensions,omitempty"` // If set, only these extensions are allowed
+	AllowedTypes      []string         `yaml:"allowed_types,omitempty"`      // If set, only these content types are allowed (e.g. "image/*")
+	MaxCount          int              `yaml:"max_count,omitempty"`          // Maximum number of attachments per message (0 for no limit)
+	MaxEach           int              `yaml:"max_each,omitempty"`           // Maximum size of a single attachment in bytes (0 for no limit)
+	Action            AttachmentAction `yaml:"action,omitempty"`             // "reject" (default) or "strip"
+}
+
+// Returns true if the attachment is blocked by its filename extension or content type.
+func (p *AttachmentPolicy) Blocks(name, contentType string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+
+	if ext != "" && slices.Contains(p.BlockedExtensions, ext) {
+		return true
+	}
+	if slices.ContainsFunc(p.BlockedTypes, func(t string) bool { return matchesMediaType(t, mediaType) }) {
+		return true
+	}
+	if len(p.AllowedExtensions) > 0 && !slices.Contains(p.AllowedExtensions, ext) {
+		return true
+	}
+	if len(p.AllowedTypes) > 0 && !slices.ContainsFunc(p.AllowedTypes, func(t string) bool { return matchesMediaType(t, mediaType) }) {
+		return true
+	}
+	return false
+}
+
+// Returns true if the media type matches the pattern, which may end in "/*" to match every subtype.
+func matchesMediaType(pattern, mediaType string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return pattern == mediaType
 }
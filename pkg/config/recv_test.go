@@ -0,0 +1,767 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestValidateFilters(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	tests := []struct {
+		name    string
+		rules   []FilterRule
+		wantErr string
+	}{
+		{"valid", []FilterRule{{Name: "a", MatchSubject: "^Disk", Action: FilterReject}}, ""},
+		{"no name", []FilterRule{{MatchSubject: "^Disk", Action: FilterReject}}, "recv.filters[0]: name"},
+		{"no pattern", []FilterRule{{Name: "a", Action: FilterReject}}, "recv.filters[0]: at least one of"},
+		{"invalid pattern", []FilterRule{
+			{Name: "a", MatchSubject: "^Disk", Action: FilterReject},
+			{Name: "b", MatchBody: "(", Action: FilterDiscard},
+		}, "recv.filters[1]: match_body: invalid regular expression"},
+		{"invalid action", []FilterRule{{Name: "a", MatchFrom: "@example", Action: "drop"}}, "recv.filters[0]: action"},
+		{"monitored", []FilterRule{{Name: "a", MatchFrom: "@example", Action: FilterReject, Enforcement: EnforcementMonitor}}, ""},
+		{"invalid enforcement", []FilterRule{{Name: "a", MatchFrom: "@example", Action: FilterReject, Enforcement: "warn"}}, "recv.filters[0]: enforcement: must be one of"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.Filters = tt.rules
+			err := cfg.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilterRuleMatches(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Filters = []FilterRule{{Name: "tag", MatchSubject: "^Disk", MatchFrom: "@example\\.com$", Action: FilterTag}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	rule := &cfg.Recv.Filters[0]
+	if rule.Tag != "[FILTERED]" {
+		t.Errorf("tag = %q, want the default [FILTERED]", rule.Tag)
+	}
+
+	// Every configured pattern must match
+	if !rule.Matches("Disk usage", "alerts@example.com", nil) {
+		t.Error("rule does not match a message matching every pattern")
+	}
+	if rule.Matches("Disk usage", "alerts@example.net", nil) || rule.Matches("CPU usage", "alerts@example.com", nil) {
+		t.Error("rule matches a message matching only some patterns")
+	}
+}
+
+func TestAttachmentPolicyBlocks(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.AttachmentPolicy = &AttachmentPolicy{
+		BlockedTypes: []string{"Application/X-Msdownload"},
+		AllowedTypes: []string{"image/*", "application/pdf", "application/x-msdownload"},
+		Action:       AttachmentStrip,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	ap := cfg.Recv.AttachmentPolicy
+	tests := []struct {
+		name, contentType string
+		want              bool
+	}{
+		{"logo.png", "image/png", false},
+		{"report.pdf", "application/pdf; name=report.pdf", false},
+		{"setup.exe", "application/x-msdownload", true}, // blocklist applies before the allowlist
+		{"notes.txt", "text/plain", true},               // not allowlisted
+	}
+	for _, tt := range tests {
+		if got := ap.Blocks(tt.name, tt.contentType); got != tt.want {
+			t.Errorf("Blocks(%q, %q) = %v, want %v", tt.name, tt.contentType, got, tt.want)
+		}
+	}
+
+	// Without lists, executables and scripts are blocked by extension whatever their declared type
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.AttachmentPolicy = &AttachmentPolicy{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if ap := cfg.Recv.AttachmentPolicy; ap.Action != AttachmentReject || !ap.Blocks("invoice.PDF.js", "application/pdf") || ap.Blocks("invoice.pdf", "application/pdf") {
+		t.Errorf("default policy = %+v", ap)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.AttachmentPolicy = &AttachmentPolicy{BlockedTypes: []string{"executable"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.attachment_policy.blocked_types[0]: invalid content type") {
+		t.Errorf("Validate: got %v, want an invalid content type error", err)
+	}
+}
+
+func TestValidateMailPolicy(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.ValidFrom = MailPolicy{DeniedDomains: []string{"example.org"}, DeniedAddresses: []string{"abuser@example.com"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.ValidTo = MailPolicy{DeniedAddresses: []string{"not-an-address"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.valid_to.denied_addresses[0]: invalid email address") {
+		t.Fatalf("Validate: got %v, want an invalid denied address error", err)
+	}
+}
+
+func TestValidateMailPolicyEnforcement(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.ValidTo = MailPolicy{Domains: []string{"example.org"}, Enforcement: EnforcementMonitor}
+	cfg.Recv.Filters = []FilterRule{{Name: "a", MatchFrom: "@example", Action: FilterReject}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if !cfg.Recv.ValidTo.Enforcement.Monitored() || cfg.Recv.ValidFrom.Enforcement != EnforcementEnforce || cfg.Recv.Filters[0].Enforcement != EnforcementEnforce {
+		t.Errorf("enforcement = %q, %q, %q, want monitor for valid_to and the enforce default otherwise",
+			cfg.Recv.ValidTo.Enforcement, cfg.Recv.ValidFrom.Enforcement, cfg.Recv.Filters[0].Enforcement)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.ValidFrom = MailPolicy{Enforcement: "shadow"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.valid_from.enforcement: must be one of 'enforce' or 'monitor'") {
+		t.Fatalf("Validate: got %v, want an invalid enforcement error", err)
+	}
+}
+
+func TestValidateCustomErrors(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	tests := []struct {
+		name    string
+		errors  map[string]string
+		wantErr string
+	}{
+		{"valid", map[string]string{"from_disallowed": "This relay only accepts mail from @example.com"}, ""},
+		{"unknown name", map[string]string{"from_denied": "Go away"}, "recv.custom_errors.from_denied: unknown error name"},
+		{"empty message", map[string]string{"to_disallowed": " "}, "recv.custom_errors.to_disallowed: message must be defined"},
+		{"multiple lines", map[string]string{"to_disallowed": "Go\r\naway"}, "recv.custom_errors.to_disallowed: message must be a single line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.CustomErrors = tt.errors
+			err := cfg.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateHooks(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Hooks = []HookConfig{{Name: "header-injector", Options: map[string]string{"name": "X-Relay-Site", "value": "room-a"}}}
+	if err := cfg.Validate(); err != nil || cfg.Recv.Hooks[0].Hook == nil {
+		t.Fatalf("Validate: %v, hook = %v", err, cfg.Recv.Hooks[0].Hook)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.Hooks = []HookConfig{{Name: "footer-appender"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.hooks[0] (footer-appender): text: must be defined") {
+		t.Fatalf("Validate: got %v, want a missing option error", err)
+	}
+}
+
+func TestValidateListenerSender(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	graph := GraphSenderConfig{TenantID: "tenant-a", ClientID: "client-a", ClientSecretEnv: "TEST_GRAPH_SECRET"}
+	tests := []struct {
+		name    string
+		sender  string
+		senders []NamedSender
+		wantErr string
+	}{
+		{"default sender", "", nil, ""},
+		{"named sender", "customer-a", []NamedSender{{Name: "customer-a", Graph: graph}}, ""},
+		{"unknown sender", "customer-b", []NamedSender{{Name: "customer-a", Graph: graph}}, "recv.listeners[0].sender: unknown sender 'customer-b'"},
+		{"duplicate name", "", []NamedSender{{Name: "customer-a", Graph: graph}, {Name: "customer-a", Graph: graph}}, "send.senders[1].name: duplicate sender name"},
+		{"no credentials", "", []NamedSender{{Name: "customer-a"}}, "send.senders[0].graph.tenant_id: must be defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.Listeners[0].Sender = tt.sender
+			cfg.Send.Senders = tt.senders
+			err := cfg.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+			if tt.wantErr == "" && cfg.Send.NamedSender(tt.sender) == nil {
+				t.Errorf("no sender named %q", tt.sender)
+			}
+		})
+	}
+}
+
+func TestValidateSideEffects(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.SideEffects = map[string]SideEffectConfig{SideEffectDSN: {Required: true}}
+	if err := cfg.Validate(); err != nil || !cfg.Recv.SideEffectRequired(SideEffectDSN) || cfg.Recv.SideEffectRequired(SideEffectMetrics) {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.SideEffects = map[string]SideEffectConfig{"webhook": {Required: true}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.side_effects.webhook: unknown side effect") {
+		t.Fatalf("Validate: got %v, want an unknown side effect error", err)
+	}
+}
+
+func TestValidateQuotas(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	tests := []struct {
+		name    string
+		quotas  QuotaConfig
+		wantErr string
+	}{
+		{"valid", QuotaConfig{Default: QuotaLimit{Messages: 10}, Users: map[string]QuotaLimit{"alice": {Bytes: 1024}}, ResetHour: 6, Timezone: "Europe/Paris"}, ""},
+		{"reset hour", QuotaConfig{ResetHour: 24}, "recv.quotas.reset_hour: must be between 0 and 23, got 24"},
+		{"time zone", QuotaConfig{Timezone: "Mars/Olympus"}, "recv.quotas.timezone: unknown time zone 'Mars/Olympus'"},
+		{"negative default", QuotaConfig{Default: QuotaLimit{Messages: -1}}, "recv.quotas.default.messages: must be a non-negative integer"},
+		{"negative override", QuotaConfig{Users: map[string]QuotaLimit{"alice": {Bytes: -1}}}, "recv.quotas.users.alice.bytes: must be a non-negative integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.Quotas = &tt.quotas
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil || cfg.Recv.Quotas.Tracker == nil {
+					t.Fatalf("Validate: %v, tracker = %v", err, cfg.Recv.Quotas.Tracker)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateLogLevels(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.LogLevels = LogLevelConfig{AuthFailure: "DEBUG", IPRejection: "disabled"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	levels := cfg.Recv.LogLevels
+	if levels.AuthFailureLevel != zerolog.DebugLevel || levels.IPRejectionLevel != zerolog.Disabled ||
+		levels.PolicyRejectionLevel != zerolog.WarnLevel || levels.DeliveryFailureLevel != zerolog.ErrorLevel {
+		t.Errorf("levels = %+v, want the configured levels and the defaults", levels)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.LogLevels = LogLevelConfig{DeliveryFailure: "verbose"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.log_levels.delivery_failure: must be one of") {
+		t.Errorf("Validate: got %v, want an error naming recv.log_levels.delivery_failure", err)
+	}
+}
+
+func TestValidateServer(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	server := cfg.Recv.Server
+	if server.MaxLineLength != DefaultMaxLineLength || server.ReadTimeout != cfg.Recv.Limits.Timeout || server.WriteTimeout != cfg.Recv.Limits.Timeout {
+		t.Errorf("server = %+v, want the default line length and the session timeout as defaults", server)
+	}
+
+	tests := []struct {
+		name    string
+		server  ServerConfig
+		wantErr string
+	}{
+		{"line length", ServerConfig{MaxLineLength: 512}, "recv.server.max_line_length: must be between 1000 and 16777216 bytes, got 512"},
+		{"recipients", ServerConfig{MaxRecipients: -1}, "recv.server.max_recipients: must be a non-negative integer, got -1"},
+		{"read timeout", ServerConfig{ReadTimeout: 500 * time.Millisecond}, "recv.server.read_timeout: must be at least 1s, got 500ms"},
+		{"write timeout", ServerConfig{WriteTimeout: -time.Second}, "recv.server.write_timeout: must be at least 1s, got -1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.Server = tt.server
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The deprecated read_buffer_size sets max_line_length, with a warning, unless both are set to different values.
+func TestValidateReadBufferSize(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	var logs bytes.Buffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	tests := []struct {
+		name           string
+		readBufferSize int
+		maxLineLength  int
+		want           int
+		wantErr        string
+	}{
+		{"deprecated only", 4096, 0, 4096, ""},
+		{"both the same", 4096, 4096, 4096, ""},
+		{"max line length only", 0, 4096, 4096, ""},
+		{"both different", 4096, 8192, 0, "recv.read_buffer_size: must be the same as recv.server.max_line_length (8192) when both are set, got 4096"},
+		{"negative", -1, 0, 0, "recv.read_buffer_size: must be a non-negative integer, got -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.ReadBufferSize = tt.readBufferSize
+			cfg.Recv.Server.MaxLineLength = tt.maxLineLength
+			err := cfg.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if cfg.Recv.Server.MaxLineLength != tt.want {
+				t.Errorf("max_line_length = %d, want %d", cfg.Recv.Server.MaxLineLength, tt.want)
+			}
+			if warned := strings.Contains(logs.String(), "recv.read_buffer_size is deprecated"); warned != (tt.readBufferSize != 0) {
+				t.Errorf("logs = %q, want a deprecation warning only when read_buffer_size is set", logs.String())
+			}
+		})
+	}
+}
+
+func TestValidatePartialFailure(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	if err := cfg.Validate(); err != nil || cfg.Recv.PartialFailure != PartialFailureFailIfAny {
+		t.Fatalf("Validate: %v, partial_failure = %q", err, cfg.Recv.PartialFailure)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.PartialFailure = "retry"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.partial_failure: must be one of 'fail_if_any' or 'succeed_if_any'") {
+		t.Errorf("Validate: got %v, want an error naming recv.partial_failure", err)
+	}
+}
+
+func TestValidateGreylist(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Greylist = GreylistConfig{Enabled: true, Listeners: []string{cfg.Recv.Listeners[0].Name}}
+	if err := cfg.Validate(); err != nil || cfg.Recv.Greylist.Store == nil {
+		t.Fatalf("Validate: %v, store = %v", err, cfg.Recv.Greylist.Store)
+	}
+	if g := &cfg.Recv.Greylist; g.Delay != DefaultGreylistDelay || !g.AppliesTo(cfg.Recv.Listeners[0].Name) || g.AppliesTo("internet") {
+		t.Errorf("greylist = %+v, want the default delay applied to the listed listener only", g)
+	}
+
+	tests := []struct {
+		name     string
+		greylist GreylistConfig
+		wantErr  string
+	}{
+		{"retention", GreylistConfig{Enabled: true, Delay: time.Hour, Retention: time.Minute}, "recv.greylist.retention: must be longer than the delay (1h0m0s), got 1m0s"},
+		{"max entries", GreylistConfig{Enabled: true, MaxEntries: -1}, "recv.greylist.max_entries: must be a non-negative integer, got -1"},
+		{"listener", GreylistConfig{Enabled: true, Listeners: []string{"internet"}}, "recv.greylist.listeners[0]: unknown listener 'internet'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.Greylist = tt.greylist
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateBindSender(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	plain := func(allowedFrom ...string) AuthRule {
+		return AuthRule{Mode: AuthPlain, BindSender: true, Credentials: []Credential{{Username: "relay", Password: "secret", AllowedFrom: allowedFrom}}}
+	}
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Auth = plain("example.com", "backup@example.net")
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if addresses, domains := cfg.Recv.Auth.AllowedFrom("relay"); len(addresses) != 1 || len(domains) != 1 {
+		t.Errorf("AllowedFrom = %v, %v, want one address and one domain", addresses, domains)
+	}
+
+	tests := []struct {
+		name    string
+		auth    AuthRule
+		wantErr string
+	}{
+		{"mode", AuthRule{Mode: AuthPlainAny, BindSender: true}, "recv.auth.bind_sender: requires the 'plain' authentication mode, not 'plain-any'"},
+		{"address", plain("backup@"), "recv.auth.credentials[0].allowed_from[0]: invalid email address 'backup@'"},
+		{"domain", plain("example.com", "localhost"), "recv.auth.credentials[0].allowed_from[1]: invalid domain 'localhost'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.Auth = tt.auth
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateListenerPriority(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Listeners[0].Priority = "high"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if got := cfg.Recv.Listeners[0].SendPriority(); got != sender.PriorityHigh {
+		t.Errorf("SendPriority = %v, want high", got)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.Listeners[0].Priority = "urgent"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.listeners[0]: priority: must be one of 'high', 'normal' or 'low', got 'urgent'") {
+		t.Fatalf("Validate: got %v, want an invalid priority error", err)
+	}
+}
+
+func TestValidateBodyLimits(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Limits.MaxBodySize = 1 << 20
+	cfg.Recv.Limits.MaxHTMLElements = 10000
+	cfg.Recv.Limits.BodyLimitAction = BodyLimitTruncate
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.Limits.MaxHTMLElements = -1
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.limits.max_html_elements: must be a non-negative integer") {
+		t.Fatalf("Validate: got %v, want a negative limit error", err)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.Limits.BodyLimitAction = "drop"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.limits.body_limit_action: must be one of 'reject' or 'truncate', got 'drop'") {
+		t.Fatalf("Validate: got %v, want an invalid action error", err)
+	}
+}
+
+func TestValidateMaxDataMemory(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Limits.MaxSize = 1 << 20
+	cfg.Recv.Limits.MaxDataMemory = 0
+	ApplyDefaults(cfg)
+	if err := cfg.Validate(); err != nil || cfg.Recv.Limits.DataMemory == nil {
+		t.Fatalf("Validate: %v, memory budget = %v", err, cfg.Recv.Limits.DataMemory)
+	}
+	if cfg.Recv.Limits.MaxDataMemory != DefaultDataBuffers<<20 {
+		t.Errorf("max_data_memory = %d, want %d times max_size", cfg.Recv.Limits.MaxDataMemory, DefaultDataBuffers)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.Limits.MaxDataMemory = int64(cfg.Recv.Limits.MaxSize) - 1
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.limits.max_data_memory: must be at least max_size") {
+		t.Fatalf("Validate: got %v, want a budget smaller than max_size error", err)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.Limits.MemorySpoolThreshold = -1
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.limits.memory_spool_threshold: must be a non-negative integer") {
+		t.Fatalf("Validate: got %v, want a negative threshold error", err)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.Limits.MemorySpoolThreshold = 4096
+	if err := cfg.Validate(); err != nil || cfg.Recv.SpoolDir != os.TempDir() {
+		t.Fatalf("Validate: %v, spool_dir = %q, want the system temporary directory", err, cfg.Recv.SpoolDir)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.Limits.MemorySpoolThreshold = 4096
+	cfg.Recv.SpoolDir = filepath.Join(t.TempDir(), "missing")
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.spool_dir:") {
+		t.Fatalf("Validate: got %v, want a missing spool directory error", err)
+	}
+
+	// The directory is not used, so it is not checked, while messages are never spooled
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.SpoolDir = filepath.Join(t.TempDir(), "missing")
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v, want the unused spool directory to be accepted", err)
+	}
+}
+
+func TestValidateLMTPListener(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Listeners[0].Type = ListenerLMTP
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.listeners[0]: type: 'lmtp' listeners on a TCP port require recv.auth.trusted_networks") {
+		t.Fatalf("Validate: got %v, want an untrusted LMTP listener error", err)
+	}
+
+	for _, configure := range []func(cfg *Config){
+		func(cfg *Config) { cfg.Recv.Auth.TrustedNetworks = []string{"127.0.0.0/8"} },
+		func(cfg *Config) { cfg.Recv.Listeners[0].AllowUntrusted = true },
+		func(cfg *Config) {
+			cfg.Recv.Listeners[0].Addr = ""
+			cfg.Recv.Listeners[0].SocketPath = filepath.Join(t.TempDir(), "lmtp.sock")
+		},
+	} {
+		cfg = parseTestConfig(t, mergeBase)
+		cfg.Recv.Listeners[0].Type = ListenerLMTP
+		configure(cfg)
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Validate: %v", err)
+		}
+	}
+}
+
+func TestValidateListenerAddr(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	tests := []struct {
+		name     string
+		listener string // settings of the listener, indented by six spaces
+		other    string // address of a second listener, if any
+		wantAddr string
+		wantErr  string
+	}{
+		{"every interface", `addr: ":587"`, "", ":587", ""},
+		{"plain port", `addr: 587`, "", ":587", ""},
+		{"older port setting", `port: 587`, "", ":587", ""},
+		{"IPv4 address", `addr: "192.168.1.1:587"`, "", "192.168.1.1:587", ""},
+		{"IPv6 address", `addr: "[::1]:587"`, "", "[::1]:587", ""},
+		{"service name", `addr: "127.0.0.1:smtp"`, "", "127.0.0.1:25", ""},
+		{"other interface", `addr: "127.0.0.1:2525"`, "127.0.0.2:2525", "127.0.0.1:2525", ""},
+		{"missing", ``, "", "", "recv.listeners[0]: addr: must be defined"},
+		{"port and addr", "port: 587\n      addr: \":587\"", "", "", "recv.listeners[0]: port: cannot be combined with addr"},
+		{"no port", `addr: "127.0.0.1"`, "", "", "recv.listeners[0]: addr: invalid address '127.0.0.1'"},
+		{"port 0", `addr: ":0"`, "", "", "recv.listeners[0]: addr: must include a valid TCP port (1-65535), got ':0'"},
+		{"port out of range", `addr: ":70000"`, "", "", "recv.listeners[0]: addr: invalid address ':70000'"},
+		{"same address", `addr: "127.0.0.1:2525"`, "127.0.0.1:2525", "", "recv.listeners[1]: addr: port 2525 already bound by 'test'"},
+		{"every interface taken", `addr: ":2525"`, "127.0.0.1:2525", "", "recv.listeners[1]: addr: port 2525 already bound by 'test'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listeners := "    - name: test\n      type: smtp\n      " + tt.listener + "\n"
+			if tt.other != "" {
+				listeners += "    - name: other\n      type: smtp\n      addr: \"" + tt.other + "\"\n"
+			}
+			cfg := parseTestConfig(t, strings.Replace(mergeBase, "    - name: internal\n      addr: \":2525\"\n      type: smtp\n", listeners, 1))
+			err := cfg.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate: got %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if l := cfg.Recv.Listeners[0]; l.Addr != tt.wantAddr || l.DeprecatedPort != 0 {
+				t.Errorf("addr = %q (port %d), want %q", l.Addr, l.DeprecatedPort, tt.wantAddr)
+			}
+		})
+	}
+
+	// The address of a Unix domain socket listener is its path
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Listeners[0].SocketPath = filepath.Join(t.TempDir(), "smtp.sock")
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.listeners[0]: socket_path: cannot be combined with addr") {
+		t.Fatalf("Validate: got %v, want socket_path and addr to be refused together", err)
+	}
+}
+
+func TestValidatePrivilegedPorts(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	var logs bytes.Buffer
+	prevLogger, prevUID := log.Logger, getuid
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger, getuid = prevLogger, prevUID })
+	const warning = "Listener port below 1024 may fail to bind when not running as root"
+
+	tests := []struct {
+		name     string
+		uid      int
+		addr     string
+		system   SystemConfig
+		wantWarn bool
+		wantErr  string
+	}{
+		{"root", 0, ":25", SystemConfig{StrictPortCheck: true}, false, ""},
+		{"windows", -1, ":25", SystemConfig{StrictPortCheck: true}, false, ""},
+		{"unprivileged port", 1000, ":2525", SystemConfig{StrictPortCheck: true}, false, ""},
+		{"privileged port", 1000, "127.0.0.1:25", SystemConfig{}, true, ""},
+		{"warning disabled", 1000, ":25", SystemConfig{PrivilegedPortWarning: new(bool)}, false, ""},
+		{"strict", 1000, ":25", SystemConfig{StrictPortCheck: true}, false, "recv.listeners[0]: addr: port 25 is privileged and the process is not running as root (uid 1000)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			getuid = func() int { return tt.uid }
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.Listeners[0].Addr = tt.addr
+			cfg.System = tt.system
+			err := cfg.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate: got %v, want %q", err, tt.wantErr)
+			}
+			if warned := strings.Contains(logs.String(), warning); warned != tt.wantWarn {
+				t.Errorf("logs = %q, want warning %v", logs.String(), tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestValidateFailureSpill(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	if err := cfg.Validate(); err != nil || cfg.Recv.FailureSpillMaxSize != 0 {
+		t.Fatalf("Validate: %v, failure_spill_max_size = %d, want 0 while disabled", err, cfg.Recv.FailureSpillMaxSize)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.FailureSpillDir = t.TempDir()
+	if err := cfg.Validate(); err != nil || cfg.Recv.FailureSpillMaxSize != DefaultFailureSpillSize {
+		t.Fatalf("Validate: %v, failure_spill_max_size = %d, want the default", err, cfg.Recv.FailureSpillMaxSize)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Recv.FailureSpillDir = t.TempDir()
+	cfg.Recv.FailureSpillMaxSize = -1
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "recv.failure_spill_max_size: must be a non-negative integer") {
+		t.Fatalf("Validate: got %v, want a negative size to be refused", err)
+	}
+}
+
+func TestValidateCredentialPasswordFile(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	hashFile := filepath.Join(t.TempDir(), "relay_password")
+	if err := os.WriteFile(hashFile, []byte("$2a$10$hash\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Recv.Auth = AuthRule{Mode: AuthPlain, Credentials: []Credential{{Username: "relay", PasswordFile: hashFile}}}
+	if err := cfg.Validate(); err != nil || cfg.Recv.Auth.Credentials[0].Password != "$2a$10$hash" {
+		t.Fatalf("Validate: %v, password = %q", err, cfg.Recv.Auth.Credentials[0].Password)
+	}
+
+	tests := []struct {
+		name    string
+		cred    Credential
+		wantErr string
+	}{
+		{"password and file", Credential{Username: "relay", Password: "$2a$10$inline", PasswordFile: hashFile}, "recv.auth.credentials[0].password_file: cannot be combined with recv.auth.credentials[0].password"},
+		{"missing file", Credential{Username: "relay", PasswordFile: hashFile + ".missing"}, "recv.auth.credentials[0].password_file: cannot read secret file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Recv.Auth = AuthRule{Mode: AuthPlain, Credentials: []Credential{tt.cred}}
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The bans, rate limits, greylisted triplets, quota usage and memory budget survive a reload, with the settings of the
+// new configuration.
+func TestKeepState(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	load := func(messages int, stateDir string) *Config {
+		t.Helper()
+		cfg := parseTestConfig(t, mergeBase)
+		cfg.Recv.DSN = DSNConfig{Enabled: true, From: "postmaster@example.com", RateLimit: messages}
+		cfg.Recv.Greylist = GreylistConfig{Enabled: true}
+		cfg.Recv.Quotas = &QuotaConfig{Default: QuotaLimit{Messages: messages}}
+		if stateDir != "" {
+			cfg.Recv.Greylist.StateFile = filepath.Join(stateDir, "greylist.json")
+			cfg.Recv.Quotas.StateFile = filepath.Join(stateDir, "quotas.json")
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+		return cfg
+	}
+
+	prev := load(1, "")
+	prev.Recv.BanList.Ban("192.0.2.66", time.Now().Add(time.Hour))
+	prev.Recv.DSN.Limiter.Allow("alerts@example.com")
+	prev.Recv.Greylist.Store.Check("192.0.2.10", "alerts@example.com", "ops@example.net")
+	if err := prev.Recv.Quotas.Tracker.Record("alice", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	next := load(2, "")
+	next.KeepState(prev)
+	if !next.Recv.BanList.IsBanned("192.0.2.66") {
+		t.Error("the ban was lifted by the reload")
+	}
+	if next.Recv.DSN.Limiter != prev.Recv.DSN.Limiter || next.Recv.Greylist.Store != prev.Recv.Greylist.Store || next.Recv.Quotas.Tracker != prev.Recv.Quotas.Tracker {
+		t.Fatal("the state of the previous configuration was not kept")
+	}
+	if next.Recv.Limits.DataMemory != prev.Recv.Limits.DataMemory {
+		t.Error("the reloaded configuration has its own memory budget")
+	}
+	if got := next.Recv.Greylist.Store.Len(); got != 1 {
+		t.Errorf("greylist entries = %d, want 1", got)
+	}
+	// One of the two notifications and messages allowed by the new configuration was already sent
+	if !next.Recv.DSN.Limiter.Allow("alerts@example.com") || next.Recv.DSN.Limiter.Allow("alerts@example.com") {
+		t.Error("DSN rate limit does not count the earlier notification against the new limit")
+	}
+	if usage := next.Recv.Quotas.Tracker.Usage("alice"); usage.Messages != 1 || !next.Recv.Quotas.Tracker.Allow("alice", 100) {
+		t.Errorf("quota usage = %+v, want 1 message with one more allowed", usage)
+	}
+
+	// State kept in other state files is loaded from those files instead
+	moved := load(2, t.TempDir())
+	tracker := moved.Recv.Quotas.Tracker
+	moved.KeepState(next)
+	if moved.Recv.Quotas.Tracker != tracker || moved.Recv.Quotas.Tracker.Usage("alice").Messages != 0 || moved.Recv.Greylist.Store.Len() != 0 {
+		t.Error("greylist and quota state was kept although the state files changed")
+	}
+}
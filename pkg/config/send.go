@@ -1,24 +1,229 @@
 package config
 
 import (
+	"crypto/tls"
 	"time"
 
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/hooks"
+	"github.com/goodieshq/gopostal/pkg/secrets"
 	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/utils"
+	"github.com/microcosm-cc/bluemonday"
 )
 
+// Circuit breaker of the Graph senders. After the threshold of consecutive failed messages, new messages are deferred
+// (421 4.4.1) without calling the API until the open timeout has elapsed; a test message then closes the circuit if it
+// is sent, or opens it again. Messages rejected permanently (e.g. an unknown mailbox) do not count as failures.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold,omitempty"` // Consecutive failed messages opening the circuit (0 disables)
+	OpenTimeout      time.Duration `yaml:"open_timeout,omitempty"`      // Time the circuit stays open before a test message (default 30s)
+}
+
+// Bounds of the delays between the attempts of a send, applied to any backoff strategy
+type BackoffConfig struct {
+	InitialBackoff time.Duration `yaml:"initial_backoff,omitempty"` // Delay after the first failed attempt (default: the strategy's first delay)
+	MaxBackoff     time.Duration `yaml:"max_backoff,omitempty"`     // Longest delay between attempts, jitter included (0 for no limit)
+}
+
 type SendConfig struct {
-	Graph                  GraphSenderConfig `yaml:"graph"`
-	Sender                 sender.Sender     `yaml:"-"`
-	AllowStartWithoutGraph bool              `yaml:"allow_start_without_graph,omitempty"`
-	Timeout                time.Duration     `yaml:"timeout"`
-	Retries                int               `yaml:"retries"`
-	Backoff                time.Duration     `yaml:"backoff"`
+	Type                   string               `yaml:"type,omitempty"` // Delivery API: "graph" (default), "sendgrid", "ses" or "webhook"
+	Graph                  GraphSenderConfig    `yaml:"graph"`
+	SendGrid               SendGridConfig       `yaml:"sendgrid,omitempty"`
+	SES                    SESConfig            `yaml:"ses,omitempty"`
+	Webhook                WebhookConfig        `yaml:"webhook,omitempty"`
+	Sender                 sender.Sender        `yaml:"-"`
+	UserRoutes             []UserRoute          `yaml:"user_routes,omitempty"` // Graph applications used for the messages of authenticated users
+	Senders                []NamedSender        `yaml:"senders,omitempty"`     // Graph applications referenced by name from the listeners
+	AllowStartWithoutGraph bool                 `yaml:"allow_start_without_graph,omitempty"`
+	Timeout                time.Duration        `yaml:"timeout"`
+	Retries                int                  `yaml:"retries"`
+	Backoff                time.Duration        `yaml:"backoff"`
+	BackoffStrategy        string               `yaml:"backoff_strategy,omitempty"` // Delay between retries: "exponential" (default), "linear" or "fixed"
+	BackoffLimits          BackoffConfig        `yaml:"backoff_limits,omitempty"`   // Bounds of the delays of the backoff strategy
+	RetryStrategy          utils.RetryStrategy  `yaml:"-"`
+	AuthFailureThreshold   int                  `yaml:"auth_failure_threshold,omitempty"` // Consecutive authentication failures before new sessions are deferred (default 3)
+	AuthProbeInterval      time.Duration        `yaml:"auth_probe_interval,omitempty"`    // Time between authentication attempts while deferring sessions (default 30s)
+	CircuitBreaker         CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`        // Stop calling the Graph API while it is failing
+	Health                 *sender.Health       `yaml:"-"`
+	PreferBody             string               `yaml:"prefer_body,omitempty"`      // Alternative used as the body of multipart messages: "html" (default) or "text"
+	ForceBodyType          string               `yaml:"force_body_type,omitempty"`  // Body sent for HTML messages: "html" (default), "text" or "both"
+	PreserveHeaders        []string             `yaml:"preserve_headers,omitempty"` // Headers of received messages carried over to the sent message
+	MIMEPassthrough        bool                 `yaml:"mime_passthrough,omitempty"` // Send the raw MIME message to Graph instead of a JSON message
+	DKIM                   *DKIMConfig          `yaml:"dkim,omitempty"`             // Sign outbound messages (requires mime_passthrough)
+	SanitizeHTML           bool                 `yaml:"sanitize_html,omitempty"`    // Strip dangerous markup from HTML bodies
+	SanitizePolicy         string               `yaml:"sanitize_policy,omitempty"`  // Sanitizer policy: "ugc" (default), "strict" or "relaxed"
+	Sanitizer              *bluemonday.Policy   `yaml:"-"`
+	Footer                 *FooterConfig        `yaml:"footer,omitempty"`            // Disclaimer appended to the body of outbound messages
+	ArchiveBCC             string               `yaml:"archive_bcc,omitempty"`       // Archive mailbox receiving a blind copy of every sent message
+	ArchiveBCCLabel        string               `yaml:"archive_bcc_label,omitempty"` // Prepended to the subject of the archive copies (default "[ARCHIVED]")
+	PreSendHooks           []hooks.PreSendHook  `yaml:"-"`                           // Called in order before each message received by a listener is sent
+	PostSendHooks          []hooks.PostSendHook `yaml:"-"`                           // Called in order once each message received by a listener was sent
+}
+
+// Disclaimer appended to the body of the messages sent to external recipients. HTML bodies receive the HTML variant
+// and text bodies the text variant; a missing variant is derived from the other one. The HTML footer is preceded by a
+// marker comment, and messages already containing the marker or the text footer (e.g. relayed twice) are left as is.
+type FooterConfig struct {
+	Text            string   `yaml:"text,omitempty"`             // Footer of text bodies
+	HTML            string   `yaml:"html,omitempty"`             // Footer of HTML bodies
+	Marker          string   `yaml:"marker,omitempty"`           // Name of the marker comment (default "gopostal-footer")
+	InternalDomains []string `yaml:"internal_domains,omitempty"` // Messages whose recipients are all in these domains get no footer
+}
+
+// Delivery APIs
+const (
+	SenderGraph    = "graph"    // Microsoft Graph sendMail
+	SenderSendGrid = "sendgrid" // SendGrid v3 mail send
+	SenderSES      = "ses"      // Amazon SES v2 SendEmail
+	SenderWebhook  = "webhook"  // JSON posted to an HTTP endpoint
+)
+
+// Headers carried over to the sent message by default, preserving the thread context of replies
+var DefaultPreserveHeaders = []string{"Message-ID", "In-Reply-To", "References", "Date"}
+
+// Headers set by the sender which cannot be preserved from the received message
+var managedHeaders = []string{"From", "To", "Cc", "Bcc", "Subject", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// Body types sent for HTML messages
+const (
+	ForceBodyHTML = "html" // send the HTML body as received
+	ForceBodyText = "text" // convert the HTML body to plain text
+	ForceBodyBoth = "both" // send the HTML body with a plain text alternative
+)
+
+// Messages submitted by the authenticated user are sent through the route's Graph application instead of the default
+// sender, e.g. to send the messages of each team from its own tenant.
+type UserRoute struct {
+	Username   string            `yaml:"username"`
+	Graph      GraphSenderConfig `yaml:"graph"`
+	SkipFooter bool              `yaml:"skip_footer,omitempty"` // Do not append send.footer to the user's messages
+	Sender     sender.Sender     `yaml:"-"`
+}
+
+// Returns the sender of the authenticated user's route, or nil if the user has no route.
+func (c *SendConfig) SenderFor(username string) sender.Sender {
+	if route := c.RouteFor(username); route != nil {
+		return route.Sender
+	}
+	return nil
+}
+
+// Returns the route of the authenticated user, or nil if the user has no route.
+func (c *SendConfig) RouteFor(username string) *UserRoute {
+	if username != "" {
+		for i := range c.UserRoutes {
+			if c.UserRoutes[i].Username == username {
+				return &c.UserRoutes[i]
+			}
+		}
+	}
+	return nil
+}
+
+// A Graph application which listeners reference by name to send their messages through it instead of the default
+// sender, e.g. to keep the messages of each customer in their own tenant.
+type NamedSender struct {
+	Name   string            `yaml:"name"`
+	Graph  GraphSenderConfig `yaml:"graph"`
+	Sender sender.Sender     `yaml:"-"`
+}
+
+// Returns the named sender, or the default sender if the name is empty. Returns nil if no sender has the name.
+func (c *SendConfig) NamedSender(name string) sender.Sender {
+	if name == "" {
+		return c.Sender
+	}
+	for _, ns := range c.Senders {
+		if ns.Name == name {
+			return ns.Sender
+		}
+	}
+	return nil
+}
+
+// Returns the Graph mailbox sending the messages of the listener's named sender or of the user's route, falling back
+// to send.graph.mailbox. Returns an empty string if no mailbox is configured.
+func (c *SendConfig) MailboxFor(senderName, username string) string {
+	if route := c.RouteFor(username); route != nil && route.Graph.Mailbox != "" {
+		return route.Graph.Mailbox
+	}
+	for _, ns := range c.Senders {
+		if senderName != "" && ns.Name == senderName && ns.Graph.Mailbox != "" {
+			return ns.Graph.Mailbox
+		}
+	}
+	return c.Graph.Mailbox
+}
+
+type DKIMConfig struct {
+	Domain   string            `yaml:"domain"`
+	Selector string            `yaml:"selector"`
+	KeyFile  string            `yaml:"key_file"`          // PEM encoded RSA or Ed25519 private key
+	Headers  []string          `yaml:"headers,omitempty"` // Header fields to sign (default: common originator and content headers)
+	Signer   *email.DKIMSigner `yaml:"-"`
 }
 
 type GraphSenderConfig struct {
-	Mailbox         string `yaml:"mailbox,omitempty"`
-	TenantID        string `yaml:"tenant_id"`
-	ClientID        string `yaml:"client_id"`
-	ClientSecretEnv string `yaml:"client_secret_env"`
-	ClientSecret    string `yaml:"-"`
+	Mailbox              string            `yaml:"mailbox,omitempty"`
+	TenantID             string            `yaml:"tenant_id"`
+	ClientID             string            `yaml:"client_id"`
+	ClientSecretEnv      string            `yaml:"client_secret_env,omitempty"`  // Shorthand for client_secret_ref.env
+	ClientSecretFile     string            `yaml:"client_secret_file,omitempty"` // Shorthand for client_secret_ref.file
+	ClientSecretRef      secrets.SecretRef `yaml:"client_secret_ref,omitempty"`
+	ClientSecretResolver secrets.Resolver  `yaml:"-"`
+	ClientSecret         string            `yaml:"-"`
+	LoginEndpoint        string            `yaml:"login_endpoint,omitempty"`       // Override for national clouds (default https://login.microsoftonline.com)
+	GraphEndpoint        string            `yaml:"graph_endpoint,omitempty"`       // Override for national clouds (default https://graph.microsoft.com)
+	MaxConcurrent        int               `yaml:"max_concurrent,omitempty"`       // sendMail calls in flight per mailbox (default 4)
+	MaxConcurrentSends   int               `yaml:"max_concurrent_sends,omitempty"` // sendMail calls in flight across mailboxes (default 0, unlimited)
+	TokenRefreshBuffer   time.Duration     `yaml:"token_refresh_buffer,omitempty"` // Token lifetime left when it is refreshed before sending (default 1m), twice that in the background
+	TokenCooldown        time.Duration     `yaml:"token_cooldown,omitempty"`       // Time the token endpoint is not called again after a failure (default 5s)
+	TLS                  *GraphTLSConfig   `yaml:"tls,omitempty"`                  // Verification of the certificates of the login and Graph endpoints
+	InsecureSkipVerify   bool              `yaml:"insecure_skip_verify,omitempty"` // Do not verify the certificates (only allowed with GOPOSTAL_TEST_ALLOW_INSECURE_TLS set)
+	TLSConfig            *tls.Config       `yaml:"-"`
+}
+
+// Verification of the certificates of the login and Graph endpoints, e.g. against a DNS hijack on the egress path
+type GraphTLSConfig struct {
+	CAFile     string   `yaml:"ca_file,omitempty"`     // PEM bundle of the trusted CAs (default: the system roots)
+	PinnedSPKI []string `yaml:"pinned_spki,omitempty"` // Base64 SHA-256 hashes of public keys, one of which the chain must contain
+}
+
+// Environment variable which must be set for insecure_skip_verify to be accepted, so it cannot be enabled by mistake
+// outside of tests
+const AllowInsecureTLSEnv = "GOPOSTAL_TEST_ALLOW_INSECURE_TLS"
+
+type SendGridConfig struct {
+	APIKeyEnv      string            `yaml:"api_key_env,omitempty"`  // Shorthand for api_key_ref.env
+	APIKeyFile     string            `yaml:"api_key_file,omitempty"` // Shorthand for api_key_ref.file
+	APIKeyRef      secrets.SecretRef `yaml:"api_key_ref,omitempty"`
+	APIKeyResolver secrets.Resolver  `yaml:"-"`
+	Endpoint       string            `yaml:"endpoint,omitempty"` // Override for the EU region or testing (default https://api.sendgrid.com)
+}
+
+// Credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+type SESConfig struct {
+	Region           string `yaml:"region,omitempty"`            // AWS region (defaults to AWS_REGION)
+	Endpoint         string `yaml:"endpoint,omitempty"`          // Override the service endpoint (default https://email.<region>.amazonaws.com)
+	ConfigurationSet string `yaml:"configuration_set,omitempty"` // Configuration set applied to sent messages
+}
+
+type WebhookConfig struct {
+	URL             string            `yaml:"url"`
+	Secret          string            `yaml:"secret,omitempty"`            // Shared secret signing each request with HMAC-SHA256
+	SecretEnv       string            `yaml:"secret_env,omitempty"`        // Environment variable holding the shared secret
+	SecretFile      string            `yaml:"secret_file,omitempty"`       // File holding the shared secret
+	SignatureHeader string            `yaml:"signature_header,omitempty"`  // Header carrying the signature (default X-GoPostal-Signature)
+	BearerToken     string            `yaml:"bearer_token,omitempty"`      // Bearer token sent in the Authorization header
+	BearerTokenEnv  string            `yaml:"bearer_token_env,omitempty"`  // Environment variable holding the bearer token
+	BearerTokenFile string            `yaml:"bearer_token_file,omitempty"` // File holding the bearer token
+	BasicAuth       *WebhookBasicAuth `yaml:"basic_auth,omitempty"`
+}
+
+type WebhookBasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordEnv  string `yaml:"password_env,omitempty"`  // Environment variable holding the password
+	PasswordFile string `yaml:"password_file,omitempty"` // File holding the password
 }
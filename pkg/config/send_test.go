@@ -0,0 +1,313 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/secrets"
+)
+
+func TestValidateGraphTLS(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	const pin = "sha256/YLh1dUR9y6Kja30RrAn7JKnbQG/uEtLMkBgFF2Fuihg="
+
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Send.Graph.TLS = &GraphTLSConfig{PinnedSPKI: []string{pin}}
+	if err := cfg.Validate(); err != nil || cfg.Send.Graph.TLSConfig == nil || cfg.Send.Graph.TLSConfig.VerifyPeerCertificate == nil {
+		t.Fatalf("Validate: %v, TLS config = %v", err, cfg.Send.Graph.TLSConfig)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Send.Graph.TLS = &GraphTLSConfig{PinnedSPKI: []string{"sha256/short"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "send.graph.tls: invalid pin 'sha256/short'") {
+		t.Fatalf("Validate: got %v, want an invalid pin error", err)
+	}
+
+	// Certificate verification can only be disabled in tests
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Send.Graph.InsecureSkipVerify = true
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "send.graph.insecure_skip_verify: only allowed in tests") {
+		t.Fatalf("Validate: got %v, want insecure_skip_verify to be refused", err)
+	}
+	t.Setenv(AllowInsecureTLSEnv, "1")
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Send.Graph.InsecureSkipVerify = true
+	if err := cfg.Validate(); err != nil || !cfg.Send.Graph.TLSConfig.InsecureSkipVerify {
+		t.Fatalf("Validate: %v, TLS config = %v", err, cfg.Send.Graph.TLSConfig)
+	}
+}
+
+func TestValidateTokenRefreshBuffer(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+
+	cfg := parseTestConfig(t, mergeBase)
+	if err := cfg.Validate(); err != nil || cfg.Send.Graph.TokenRefreshBuffer != time.Minute {
+		t.Fatalf("Validate: %v, token_refresh_buffer = %s, want the default 1m", err, cfg.Send.Graph.TokenRefreshBuffer)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Send.Graph.TokenRefreshBuffer = -time.Second
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "send.graph.token_refresh_buffer: must be a non-negative duration") {
+		t.Fatalf("Validate: got %v, want a negative buffer to be refused", err)
+	}
+}
+
+func TestValidateTokenCooldown(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+
+	cfg := parseTestConfig(t, mergeBase)
+	if err := cfg.Validate(); err != nil || cfg.Send.Graph.TokenCooldown != 5*time.Second {
+		t.Fatalf("Validate: %v, token_cooldown = %s, want the default 5s", err, cfg.Send.Graph.TokenCooldown)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Send.Graph.TokenCooldown = -time.Second
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "send.graph.token_cooldown: must be a non-negative duration") {
+		t.Fatalf("Validate: got %v, want a negative cool-down to be refused", err)
+	}
+}
+
+func TestValidateFooter(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	tests := []struct {
+		name    string
+		footer  FooterConfig
+		mime    bool
+		wantErr string
+	}{
+		{"valid", FooterConfig{Text: "Confidential", InternalDomains: []string{"example.com"}}, false, ""},
+		{"empty", FooterConfig{Text: " "}, false, "send.footer: text or html must be defined"},
+		{"mime passthrough", FooterConfig{HTML: "<p>Confidential</p>"}, true, "send.footer: cannot be used with send.mime_passthrough"},
+		{"marker", FooterConfig{Text: "Confidential", Marker: "end-->"}, false, "send.footer.marker: must not contain"},
+		{"internal domain", FooterConfig{Text: "Confidential", InternalDomains: []string{"localhost"}}, false, "send.footer.internal_domains[0]: invalid domain 'localhost'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Send.Footer = &tt.footer
+			cfg.Send.MIMEPassthrough = tt.mime
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil || cfg.Send.Footer.Marker != DefaultFooterMarker {
+					t.Fatalf("Validate: %v, marker = %q", err, cfg.Send.Footer.Marker)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePreserveHeaders(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	tests := []struct {
+		name    string
+		headers []string
+		wantErr string
+	}{
+		{"custom", []string{"In-Reply-To", "X-Ticket-ID"}, ""},
+		{"none", []string{}, ""},
+		{"invalid name", []string{"References", "X Ticket"}, "send.preserve_headers[1]: invalid header name 'X Ticket'"},
+		{"colon", []string{"X-Ticket:"}, "send.preserve_headers[0]: invalid header name 'X-Ticket:'"},
+		{"managed", []string{"content-type"}, "send.preserve_headers[0]: 'content-type' is set by the sender and cannot be preserved"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Send.PreserveHeaders = tt.headers
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil || !slices.Equal(cfg.Send.PreserveHeaders, tt.headers) {
+					t.Fatalf("Validate: %v, preserve_headers = %q", err, cfg.Send.PreserveHeaders)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMIMEPassthrough(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Send.MIMEPassthrough = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		configure func(cfg *Config)
+		wantErr   string
+	}{
+		{"forced recipients", func(cfg *Config) { cfg.Recv.Listeners[0].ForceRecipients = []string{"noc@example.net"} },
+			"recv.listeners[0]: force_recipients: cannot be used with send.mime_passthrough"},
+		{"listener prefix", func(cfg *Config) { cfg.Recv.Listeners[0].SubjectPrefix = "[SCANNER]" },
+			"recv.listeners[0]: subject_prefix: cannot be used with send.mime_passthrough"},
+		{"user prefix", func(cfg *Config) {
+			cfg.Recv.Auth = AuthRule{Mode: AuthPlain, Credentials: []Credential{{Username: "relay", Password: "secret", SubjectPrefix: "[relay]"}}}
+		}, "recv.auth.credentials[0].subject_prefix: cannot be used with send.mime_passthrough"},
+		{"filter tag", func(cfg *Config) {
+			cfg.Recv.Filters = []FilterRule{{Name: "alerts", MatchSubject: "ALERT", Action: FilterTag, Tag: "[ALERT]"}}
+		}, "recv.filters[0]: action: 'tag' cannot be used with send.mime_passthrough"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Send.MIMEPassthrough = true
+			tt.configure(cfg)
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateArchiveBCC(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Send.ArchiveBCC = "archive@example.com"
+	if err := cfg.Validate(); err != nil || cfg.Send.ArchiveBCCLabel != DefaultArchiveBCCLabel {
+		t.Fatalf("Validate: %v, label = %q", err, cfg.Send.ArchiveBCCLabel)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Send.ArchiveBCC = "archive"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "send.archive_bcc: invalid email address 'archive'") {
+		t.Errorf("Validate: got %v, want an invalid address error", err)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Send.ArchiveBCC = "archive@example.com"
+	cfg.Send.MIMEPassthrough = true
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate with mime_passthrough: %v", err)
+	}
+}
+
+func TestValidateBackoffLimits(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Send.BackoffStrategy = "fixed"
+	cfg.Send.Backoff = time.Minute
+	cfg.Send.BackoffLimits = BackoffConfig{InitialBackoff: 500 * time.Millisecond, MaxBackoff: 30 * time.Second}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if first, second := cfg.Send.RetryStrategy.Wait(0), cfg.Send.RetryStrategy.Wait(1); first != 500*time.Millisecond || second != 30*time.Second {
+		t.Errorf("delays = %s, %s, want 500ms then 30s", first, second)
+	}
+
+	cfg = parseTestConfig(t, mergeBase)
+	cfg.Send.BackoffLimits = BackoffConfig{InitialBackoff: time.Minute, MaxBackoff: time.Second}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "send.backoff_limits.initial_backoff: must not exceed max_backoff (1s), got 1m0s") {
+		t.Fatalf("Validate: got %v, want an initial backoff above the maximum error", err)
+	}
+}
+
+func TestValidateClientSecretFile(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "graph_client_secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trailing newline is not part of the secret
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Send.Graph.ClientSecretEnv = ""
+	cfg.Send.Graph.ClientSecretFile = secretFile
+	if err := cfg.Validate(); err != nil || cfg.Send.Graph.ClientSecret != "file-secret" {
+		t.Fatalf("Validate: %v, client secret = %q, want %q", err, cfg.Send.Graph.ClientSecret, "file-secret")
+	}
+
+	tests := []struct {
+		name    string
+		env     string
+		file    string
+		ref     secrets.SecretRef
+		wantErr string
+	}{
+		{"env and file", "TEST_GRAPH_SECRET", secretFile, secrets.SecretRef{}, "send.graph.client_secret_file: cannot be combined with send.graph.client_secret_env"},
+		{"file and ref", "", secretFile, secrets.SecretRef{Env: "TEST_GRAPH_SECRET"}, "send.graph.client_secret_file: cannot be combined with send.graph.client_secret_ref"},
+		{"none", "", "", secrets.SecretRef{}, "send.graph: one of client_secret_env, client_secret_file or client_secret_ref must be defined"},
+		{"missing file", "", filepath.Join(dir, "missing"), secrets.SecretRef{}, "send.graph.client_secret_ref: cannot read secret file"},
+		{"empty file", "", emptyFile, secrets.SecretRef{}, "send.graph.client_secret_ref: secret file '" + emptyFile + "' is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Send.Graph.ClientSecretEnv = tt.env
+			cfg.Send.Graph.ClientSecretFile = tt.file
+			cfg.Send.Graph.ClientSecretRef = tt.ref
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDKIM(t *testing.T) {
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	dir := t.TempDir()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "dkim.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	badFile := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(badFile, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := parseTestConfig(t, mergeBase)
+	cfg.Send.MIMEPassthrough = true
+	cfg.Send.DKIM = &DKIMConfig{Domain: "example.com", Selector: "gopostal", KeyFile: keyFile}
+	if err := cfg.Validate(); err != nil || cfg.Send.DKIM.Signer == nil || cfg.Send.DKIM.Signer.Domain() != "example.com" {
+		t.Fatalf("Validate: %v, signer = %v", err, cfg.Send.DKIM.Signer)
+	}
+
+	tests := []struct {
+		name        string
+		keyFile     string
+		passthrough bool
+		wantErr     string
+	}{
+		{"missing key", filepath.Join(dir, "missing.pem"), true, "send.dkim.key_file: failed to load key"},
+		{"invalid key", badFile, true, "send.dkim.key_file: failed to load key '" + badFile + "': no PEM data found"},
+		{"without passthrough", keyFile, false, "send.dkim: requires send.mime_passthrough"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, mergeBase)
+			cfg.Send.MIMEPassthrough = tt.passthrough
+			cfg.Send.DKIM = &DKIMConfig{Domain: "example.com", Selector: "gopostal", KeyFile: tt.keyFile}
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
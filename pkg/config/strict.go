@@ -0,0 +1,160 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldError is a configuration problem located at a key path and position in the YAML document.
+type FieldError struct {
+	Path   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s (line %d, column %d)", e.Path, e.Msg, e.Line, e.Column)
+}
+
+var yamlUnmarshalerType = reflect.TypeFor[yaml.Unmarshaler]()
+
+// Decode the YAML document into cfg. Type mismatches are reported with their key path and position, as are unknown
+// keys if strict is true. All problems are reported together.
+func decodeConfig(data []byte, cfg *Config, strict bool) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if root.Kind == 0 {
+		return nil // empty document
+	}
+
+	// Record the key path of every value node by line so type errors can be located
+	positions := make(map[int]*FieldError)
+	var errs []error
+	walkNode(&root, reflect.TypeFor[Config](), "", strict, positions, &errs)
+
+	if err := root.Decode(cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return err
+		}
+		for _, msg := range typeErr.Errors {
+			errs = append(errs, locateTypeError(msg, positions))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var reLinePrefix = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// Attach the key path to a yaml.v3 type error message of the form "line N: ...".
+func locateTypeError(msg string, positions map[int]*FieldError) error {
+	m := reLinePrefix.FindStringSubmatch(msg)
+	if m == nil {
+		return errors.New(msg)
+	}
+	line, _ := strconv.Atoi(m[1])
+	pos, ok := positions[line]
+	if !ok {
+		return errors.New(msg)
+	}
+	return &FieldError{Path: pos.Path, Line: pos.Line, Column: pos.Column, Msg: m[2]}
+}
+
+// Walk a YAML node alongside the Go type it decodes into, recording value positions and reporting unknown keys.
+func walkNode(node *yaml.Node, t reflect.Type, path string, strict bool, positions map[int]*FieldError, errs *[]error) {
+	for node.Kind == yaml.DocumentNode || node.Kind == yaml.AliasNode {
+		if node.Kind == yaml.DocumentNode {
+			if len(node.Content) == 0 {
+				return
+			}
+			node = node.Content[0]
+		} else {
+			node = node.Alias
+		}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if _, exists := positions[node.Line]; !exists || node.Kind == yaml.ScalarNode {
+		positions[node.Line] = &FieldError{Path: path, Line: node.Line, Column: node.Column}
+	}
+
+	// Types decoding themselves are opaque
+	if reflect.PointerTo(t).Implements(yamlUnmarshalerType) || t.Kind() == reflect.Interface {
+		return
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := yamlFields(t)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				childPath := joinPath(path, key.Value)
+				field, ok := fields[key.Value]
+				if !ok {
+					if strict {
+						*errs = append(*errs, &FieldError{Path: childPath, Line: key.Line, Column: key.Column, Msg: "unknown field"})
+					}
+					continue
+				}
+				walkNode(value, field, childPath, strict, positions, errs)
+			}
+		case reflect.Map:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				walkNode(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value), strict, positions, errs)
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, item := range node.Content {
+				walkNode(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), strict, positions, errs)
+			}
+		}
+	}
+}
+
+// Returns the field types of a struct by YAML key, including the fields of inlined structs.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
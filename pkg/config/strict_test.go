@@ -0,0 +1,119 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const strictConfig = `
+recv:
+  auth:
+    mode: disabled
+  limtis:
+    max_size: 1024
+  listeners:
+    - name: test
+      prot: 2525
+      type: smtp
+send:
+  retries: many
+`
+
+// Returns the field errors joined in err.
+func fieldErrors(t *testing.T, err error) []*FieldError {
+	t.Helper()
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("error %v does not join the problems", err)
+	}
+	var out []*FieldError
+	for _, err := range joined.Unwrap() {
+		var fe *FieldError
+		if !errors.As(err, &fe) {
+			t.Fatalf("error %v is not a FieldError", err)
+		}
+		out = append(out, fe)
+	}
+	return out
+}
+
+func TestParseConfigBytesStrict(t *testing.T) {
+	_, err := ParseConfigBytes([]byte(strictConfig), true)
+	want := []FieldError{
+		{Path: "recv.limtis", Line: 5, Column: 3, Msg: "unknown field"},
+		{Path: "recv.listeners[0].prot", Line: 9, Column: 7, Msg: "unknown field"},
+		{Path: "send.retries", Line: 12, Column: 12},
+	}
+	got := fieldErrors(t, err)
+	if len(got) != len(want) {
+		t.Fatalf("errors = %v, want %d problems", err, len(want))
+	}
+	for i, fe := range got {
+		if fe.Path != want[i].Path || fe.Line != want[i].Line || fe.Column != want[i].Column ||
+			(want[i].Msg != "" && fe.Msg != want[i].Msg) {
+			t.Errorf("error %d = %+v, want %+v", i, *fe, want[i])
+		}
+	}
+	if !strings.Contains(err.Error(), "recv.limtis: unknown field (line 5, column 3)") {
+		t.Errorf("error message = %q", err)
+	}
+}
+
+func TestParseConfigBytesNotStrict(t *testing.T) {
+	// Unknown keys are ignored, type mismatches are still reported
+	_, err := ParseConfigBytes([]byte(strictConfig), false)
+	if got := fieldErrors(t, err); len(got) != 1 || got[0].Path != "send.retries" {
+		t.Errorf("errors = %v, want the type mismatch of send.retries only", err)
+	}
+
+	cfg, err := ParseConfigBytes([]byte(strings.Replace(strictConfig, "many", "3", 1)), false)
+	if err != nil || cfg.Send.Retries != 3 {
+		t.Errorf("ParseConfigBytes() = %+v, %v", cfg, err)
+	}
+}
+
+func TestValidateAggregatesErrors(t *testing.T) {
+	cfg, err := ParseConfigBytes([]byte(`
+recv:
+  auth:
+    mode: sometimes
+    bind_sender: true
+  listeners:
+    - name: test
+      type: smtp
+      force_recipients: [ops]
+  filters:
+    - name: bad
+      match_subject: "("
+      action: explode
+send:
+  timeout: -1s
+  graph:
+    client_id: client
+`), true)
+	if err != nil {
+		t.Fatalf("ParseConfigBytes: %v", err)
+	}
+
+	// Each section reports all of its problems, not only the first one
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate succeeded")
+	}
+	for _, want := range []string{
+		"recv.listeners[0]: addr",
+		"recv.listeners[0]: force_recipients[0]",
+		"recv.auth.mode",
+		"recv.auth.bind_sender",
+		"recv.filters[0]: match_subject",
+		"recv.filters[0]: action",
+		"send.graph.tenant_id",
+		"send.graph: one of client_secret_env",
+		"send.timeout",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %q, want it to report %s", err, want)
+		}
+	}
+}
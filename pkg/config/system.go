@@ -0,0 +1,26 @@
+package config
+
+import "time"
+
+type SystemConfig struct {
+	ConfigWatch           bool          `yaml:"config_watch,omitempty"`            // Reload the configuration when its files change (e.g. an updated Kubernetes ConfigMap)
+	ReloadDrainTimeout    time.Duration `yaml:"reload_drain_timeout,omitempty"`    // Time the sessions in progress are given to end on reload (default 1m)
+	PrivilegedPortWarning *bool         `yaml:"privileged_port_warning,omitempty"` // Warn about listener ports below 1024 when not running as root (default true)
+	StrictPortCheck       bool          `yaml:"strict_port_check,omitempty"`       // Refuse listener ports below 1024 when not running as root
+}
+
+// Returns true if listener ports below 1024 are reported when not running as root. Unless disabled, they are.
+func (s *SystemConfig) WarnPrivilegedPorts() bool {
+	return s.PrivilegedPortWarning == nil || *s.PrivilegedPortWarning
+}
+
+type LogConfig struct {
+	LogSampling LogSamplingConfig `yaml:"sampling,omitempty"` // Log only a fraction of the sessions in full under heavy load
+}
+
+// Sampling of the session logs. Sessions which are sampled out only log errors (and warnings with always_log_errors).
+type LogSamplingConfig struct {
+	Enabled         bool    `yaml:"enabled"`
+	Rate            float64 `yaml:"rate"`                        // Fraction of the sessions logged in full (0.0-1.0)
+	AlwaysLogErrors bool    `yaml:"always_log_errors,omitempty"` // Log the warnings of sampled out sessions too, e.g. rejected commands
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// Time to wait for further events before reporting a change, so a file written in several steps is reported once
+const DefaultWatchDebounce = 250 * time.Millisecond
+
+// ConfigWatcher reports changes of configuration files. The directory of each file is watched rather than the file
+// itself, so files replaced by a rename or a symlink swap (as Kubernetes does when a mounted ConfigMap is updated) are
+// still followed.
+type ConfigWatcher struct {
+	paths    []string
+	debounce time.Duration
+
+	mu       sync.Mutex
+	onChange []func()
+}
+
+// Create a watcher of the configuration files.
+func NewConfigWatcher(paths ...string) *ConfigWatcher {
+	return &ConfigWatcher{
+		paths:    paths,
+		debounce: DefaultWatchDebounce,
+	}
+}
+
+// Register a callback called each time a watched file changes.
+func (w *ConfigWatcher) OnChange(fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onChange = append(w.onChange, fn)
+}
+
+// Start watching the files until the context is cancelled. Returns an error if a file's directory cannot be watched.
+func (w *ConfigWatcher) Start(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// The resolved path of each file, which changes when a symlink in its path is swapped
+	files := make(map[string]string, len(w.paths))
+	for _, path := range w.paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			fw.Close()
+			return err
+		}
+		if err := fw.Add(filepath.Dir(abs)); err != nil {
+			fw.Close()
+			return err
+		}
+		real, _ := filepath.EvalSymlinks(abs)
+		files[abs] = real
+	}
+
+	go w.run(ctx, fw, files)
+	return nil
+}
+
+func (w *ConfigWatcher) run(ctx context.Context, fw *fsnotify.Watcher, files map[string]string) {
+	defer fw.Close()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return
+			}
+			log.Warn().Err(err).Msg("Configuration file watcher error")
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return
+			}
+			if w.changed(ev, files) {
+				timer = time.After(w.debounce)
+			}
+		case <-timer:
+			timer = nil
+			log.Info().Strs("files", w.paths).Msg("Configuration file changed")
+			w.mu.Lock()
+			callbacks := w.onChange
+			w.mu.Unlock()
+			for _, fn := range callbacks {
+				fn()
+			}
+		}
+	}
+}
+
+// Returns true if the event changed one of the files, either directly or by swapping a symlink to it.
+func (w *ConfigWatcher) changed(ev fsnotify.Event, files map[string]string) bool {
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return false
+	}
+	changed := false
+	for file, real := range files {
+		if ev.Name == file {
+			changed = true
+		}
+		// A missing file (e.g. in the middle of a swap) keeps its last resolved path
+		if current, err := filepath.EvalSymlinks(file); err == nil && current != real {
+			files[file] = current
+			changed = true
+		}
+	}
+	return changed
+}
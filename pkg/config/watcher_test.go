@@ -0,0 +1,95 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Start a watcher of the file, returning a channel receiving a value each time the callback fires.
+func startTestWatcher(t *testing.T, path string) <-chan struct{} {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	changes := make(chan struct{}, 10)
+	w := NewConfigWatcher(path)
+	w.debounce = 10 * time.Millisecond
+	w.OnChange(func() { changes <- struct{}{} })
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return changes
+}
+
+func expectChange(t *testing.T, changes <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("callback not called after %s", what)
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("system:\n  config_watch: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changes := startTestWatcher(t, path)
+
+	// Other files in the directory are ignored
+	if err := os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("x: 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Fatal("callback called after another file changed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(path, []byte("system:\n  config_watch: false\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes, "overwriting the file")
+
+	// Several writes in quick succession are reported once
+	select {
+	case <-changes:
+		t.Fatal("callback called twice for a single overwrite")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConfigWatcherSymlinkSwap(t *testing.T) {
+	// Lay out the directory like a mounted ConfigMap: config.yaml -> ..data/config.yaml, ..data -> a timestamped dir
+	dir := t.TempDir()
+	for _, version := range []string{"v1", "v2"} {
+		if err := os.MkdirAll(filepath.Join(dir, version), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "config.yaml"), []byte("# "+version+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+	changes := startTestWatcher(t, path)
+
+	// Swap the data symlink atomically
+	if err := os.Symlink("v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes, "swapping the data symlink")
+}
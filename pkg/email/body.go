@@ -0,0 +1,67 @@
+package email
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Returns the number of elements of an HTML body, counted as its start and self-closing tags by a single tokenizer
+// pass, without building the document tree.
+func CountHTMLElements(body []byte) int {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	count := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return count
+		case html.StartTagToken, html.SelfClosingTagToken:
+			count++
+		}
+	}
+}
+
+// Returns the length to which an HTML body must be cut to keep at most maxElements elements and maxBytes bytes, or the
+// length of the body if it fits. The body is cut between tokens, or within text at a character boundary, so no tag is
+// split. A limit of 0 or less does not apply.
+func HTMLCutOffset(body []byte, maxElements, maxBytes int) int {
+	if (maxElements <= 0 || bytes.IndexByte(body, '<') < 0) && (maxBytes <= 0 || len(body) <= maxBytes) {
+		return len(body)
+	}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	offset, elements := 0, 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return len(body)
+		}
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			elements++
+			if maxElements > 0 && elements > maxElements {
+				return offset
+			}
+		}
+		size := len(z.Raw())
+		if maxBytes > 0 && offset+size > maxBytes {
+			if tt == html.TextToken {
+				return TextCutOffset(body, maxBytes)
+			}
+			return offset
+		}
+		offset += size
+	}
+}
+
+// Returns the length to which a text body must be cut to keep at most maxBytes bytes without splitting a character,
+// or the length of the body if it fits. A limit of 0 or less does not apply.
+func TextCutOffset(body []byte, maxBytes int) int {
+	if maxBytes <= 0 || len(body) <= maxBytes {
+		return len(body)
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return cut
+}
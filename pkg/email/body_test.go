@@ -0,0 +1,63 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCountHTMLElements(t *testing.T) {
+	tests := []struct {
+		body string
+		want int
+	}{
+		{"", 0},
+		{"plain text, 1 < 2", 0},
+		{"<p>Disk usage</p>", 1},
+		{"<table><tr><td>a</td><td>b</td></tr></table>", 4},
+		{"<p>line<br/>break<img src=x></p><!-- <b>comment</b> -->", 3},
+		{"<script>var s = '<b>not a tag</b>';</script>", 1},
+	}
+	for _, tt := range tests {
+		if got := CountHTMLElements([]byte(tt.body)); got != tt.want {
+			t.Errorf("CountHTMLElements(%q) = %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestHTMLCutOffset(t *testing.T) {
+	const body = "<table><tr><td>a</td><td>b</td></tr></table>"
+	tests := []struct {
+		name        string
+		body        string
+		maxElements int
+		maxBytes    int
+		want        string
+	}{
+		{"no limits", body, 0, 0, body},
+		{"fits", body, 4, len(body), body},
+		{"elements", body, 3, 0, "<table><tr><td>a</td>"},
+		{"bytes between tags", body, 0, 20, "<table><tr><td>a"},
+		{"bytes within a tag", body, 0, 17, "<table><tr><td>a"},
+		{"bytes within text", "<p>Disk usage is high</p>", 0, 12, "<p>Disk usag"},
+		{"bytes within a character", "<p>Température</p>", 0, 9, "<p>Tempé"},
+		{"both, elements first", body, 2, 40, "<table><tr>"},
+		{"text without tags", "Disk usage", 1, 0, "Disk usage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.body[:HTMLCutOffset([]byte(tt.body), tt.maxElements, tt.maxBytes)]; got != tt.want {
+				t.Errorf("cut to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextCutOffset(t *testing.T) {
+	body := []byte(strings.Repeat("é", 4)) // 2 bytes each
+	if got := TextCutOffset(body, 5); got != 4 {
+		t.Errorf("TextCutOffset = %d, want 4 at a character boundary", got)
+	}
+	if got := TextCutOffset(body, 0); got != len(body) {
+		t.Errorf("TextCutOffset without limit = %d, want %d", got, len(body))
+	}
+}
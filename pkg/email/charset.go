@@ -0,0 +1,44 @@
+package email
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Transcode data in the named charset to UTF-8. Data which is already UTF-8 (or US-ASCII, or has no charset) is
+// returned unchanged. If the charset is not recognized the data is returned unchanged along with an error.
+func ToUTF8(data []byte, charset string) ([]byte, error) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return data, nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return data, fmt.Errorf("unsupported charset '%s'", charset)
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return data, fmt.Errorf("failed to decode charset '%s': %w", charset, err)
+	}
+	return decoded, nil
+}
+
+// Transcode a single-part message body to UTF-8 according to the charset parameter of its Content-Type header. If the
+// charset is not recognized the body is returned unchanged along with an error.
+func BodyToUTF8(header mail.Header, body []byte) ([]byte, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return body, nil
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, fmt.Errorf("invalid Content-Type '%s': %w", contentType, err)
+	}
+	return ToUTF8(body, params["charset"])
+}
@@ -0,0 +1,108 @@
+package email
+
+import (
+	"bytes"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Text encoded in a legacy charset, then optionally quoted-printable, decodes back to the original UTF-8.
+func TestToUTF8RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		charset string
+		enc     *charmap.Charmap
+		qp      bool
+	}{
+		{"latin-1", "Café à Zürich, 25°C", "ISO-8859-1", charmap.ISO8859_1, false},
+		{"windows-1252", "“Disk full” – 91% on /var… €", "windows-1252", charmap.Windows1252, false},
+		{"latin-1 quoted-printable", "Déjà vu: naïve façade", "iso-8859-1", charmap.ISO8859_1, true},
+		{"windows-1252 quoted-printable", "Backup failed – “srv01” ‰ €", "Windows-1252", charmap.Windows1252, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.enc.NewEncoder().Bytes([]byte(tt.text))
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			encoding := "8bit"
+			if tt.qp {
+				var buf bytes.Buffer
+				w := quotedprintable.NewWriter(&buf)
+				w.Write(data)
+				w.Close()
+				data, encoding = buf.Bytes(), "quoted-printable"
+				if bytes.ContainsFunc(data, func(r rune) bool { return r > 0x7f }) {
+					t.Fatalf("quoted-printable data %q is not 7-bit", data)
+				}
+			}
+
+			decoded, err := ToUTF8(DecodeTransferEncoding(data, encoding), tt.charset)
+			if err != nil {
+				t.Fatalf("ToUTF8: %v", err)
+			}
+			if string(decoded) != tt.text {
+				t.Errorf("ToUTF8 = %q, want %q", decoded, tt.text)
+			}
+		})
+	}
+}
+
+func TestToUTF8(t *testing.T) {
+	// UTF-8, US-ASCII and unlabelled data is returned unchanged, even if it is not valid UTF-8
+	for _, charset := range []string{"", "UTF-8", " utf8 ", "us-ascii"} {
+		if got, err := ToUTF8([]byte("caf\xe9"), charset); err != nil || string(got) != "caf\xe9" {
+			t.Errorf("ToUTF8(%q) = %q, %v, want the data unchanged", charset, got, err)
+		}
+	}
+
+	// Latin-1 is decoded as its Windows-1252 superset, as browsers do
+	if got, err := ToUTF8([]byte("\x93quoted\x94"), "latin1"); err != nil || string(got) != "“quoted”" {
+		t.Errorf("ToUTF8(latin1) = %q, %v", got, err)
+	}
+
+	got, err := ToUTF8([]byte("caf\xe9"), "x-unknown")
+	if err == nil || !strings.Contains(err.Error(), "unsupported charset 'x-unknown'") {
+		t.Errorf("ToUTF8 with an unknown charset: got %v, want an unsupported charset error", err)
+	}
+	if string(got) != "caf\xe9" {
+		t.Errorf("ToUTF8 with an unknown charset = %q, want the data unchanged", got)
+	}
+}
+
+func TestBodyToUTF8(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+		wantErr     string
+	}{
+		{`text/plain; charset="windows-1252"`, "Caf\xe9 \x80", "Café €", ""},
+		{"text/html; charset=ISO-8859-1", "<p>Caf\xe9</p>", "<p>Café</p>", ""},
+		{"text/plain", "Caf\xc3\xa9", "Café", ""},
+		{"", "Caf\xc3\xa9", "Café", ""},
+		{"text/plain; charset", "Caf\xe9", "Caf\xe9", "invalid Content-Type"},
+	}
+	for _, tt := range tests {
+		header := mail.Header{}
+		if tt.contentType != "" {
+			header["Content-Type"] = []string{tt.contentType}
+		}
+		got, err := BodyToUTF8(header, []byte(tt.body))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("BodyToUTF8(%q): got %v, want an error containing %q", tt.contentType, err, tt.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("BodyToUTF8(%q): %v", tt.contentType, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("BodyToUTF8(%q) = %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers signed when none are configured
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner signs raw messages with a domain key (RFC 6376) using relaxed/relaxed canonicalization.
+type DKIMSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+	headers  []string
+
+	// Look up DNS TXT records when verifying existing signatures
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// Create a new DKIM signer. If headers is empty DefaultDKIMHeaders are signed; From is always signed.
+func NewDKIMSigner(domain, selector string, key crypto.Signer, headers []string) (*DKIMSigner, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+	hasFrom := false
+	for _, h := range headers {
+		if strings.EqualFold(h, "From") {
+			hasFrom = true
+		}
+	}
+	if !hasFrom {
+		headers = append([]string{"From"}, headers...)
+	}
+	return &DKIMSigner{
+		domain:    strings.ToLower(domain),
+		selector:  selector,
+		key:       key,
+		headers:   headers,
+		lookupTXT: net.DefaultResolver.LookupTXT,
+	}, nil
+}
+
+// Load an RSA or Ed25519 private key from a PEM file (PKCS#1 or PKCS#8).
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type '%s'", block.Type)
+	}
+}
+
+// Returns the signer's domain.
+func (d *DKIMSigner) Domain() string {
+	return d.domain
+}
+
+// Sign the message and return it with a DKIM-Signature header prepended. Messages which already carry a valid
+// signature for the signer's domain are returned unchanged.
+func (d *DKIMSigner) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	msg = toCRLF(msg)
+	fields, body := splitMessage(msg)
+
+	if d.hasValidSignature(ctx, fields, body) {
+		return msg, nil
+	}
+
+	algorithm := "rsa-sha256"
+	if _, ok := d.key.(ed25519.PrivateKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+
+	bodyHash := sha256.Sum256(canonicalBodyRelaxed(body))
+
+	// Only headers present in the message are listed, once per occurrence
+	var signed []string
+	counts := map[string]int{}
+	for _, f := range fields {
+		counts[strings.ToLower(f.name)]++
+	}
+	for _, h := range d.headers {
+		for i := 0; i < counts[strings.ToLower(h)]; i++ {
+			signed = append(signed, h)
+		}
+	}
+
+	value := fmt.Sprintf(" v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, d.domain, d.selector, time.Now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	sigField := headerField{name: "DKIM-Signature", raw: "DKIM-Signature:" + value + "\r\n"}
+
+	sig, err := signDKIM(d.key, headerHashInput(fields, signed, sigField, true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("DKIM-Signature:" + value + base64.StdEncoding.EncodeToString(sig) + "\r\n")
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// Returns true if the message carries a DKIM signature for the signer's domain which verifies.
+func (d *DKIMSigner) hasValidSignature(ctx context.Context, fields []headerField, body []byte) bool {
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		tags := parseTags(f.value())
+		if !strings.EqualFold(tags["d"], d.domain) {
+			continue
+		}
+		if err := d.verify(ctx, fields, body, f, tags); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify a single DKIM-Signature header field.
+func (d *DKIMSigner) verify(ctx context.Context, fields []headerField, body []byte, sigField headerField, tags map[string]string) error {
+	if tags["v"] != "1" {
+		return errors.New("unsupported version")
+	}
+
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") || (bodyCanon != "simple" && bodyCanon != "relaxed") {
+		return errors.New("unsupported canonicalization")
+	}
+
+	canonBody := canonicalBodySimple(body)
+	if bodyCanon == "relaxed" {
+		canonBody = canonicalBodyRelaxed(body)
+	}
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(canonBody) {
+			return errors.New("invalid body length")
+		}
+		canonBody = canonBody[:n]
+	}
+	bodyHash := sha256.Sum256(canonBody)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != stripWSP(tags["bh"]) {
+		return errors.New("body hash mismatch")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	records, err := d.lookupTXT(lookupCtx, tags["s"]+"._domainkey."+tags["d"])
+	if err != nil || len(records) == 0 {
+		return fmt.Errorf("failed to look up public key: %w", err)
+	}
+	keyTags := parseTags(strings.Join(records, ""))
+	keyData, err := base64.StdEncoding.DecodeString(stripWSP(keyTags["p"]))
+	if err != nil || len(keyData) == 0 {
+		return errors.New("invalid or revoked public key")
+	}
+
+	// Remove the value of the b= tag from the signature header itself
+	unsigned := sigField
+	unsigned.raw = removeSignatureValue(sigField.raw)
+
+	var signed []string
+	for _, h := range strings.Split(tags["h"], ":") {
+		signed = append(signed, strings.TrimSpace(h))
+	}
+	hash := sha256.Sum256(headerHashInput(fields, signed, unsigned, headerCanon == "relaxed"))
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		pub, err := x509.ParsePKIXPublicKey(keyData)
+		if err != nil {
+			if pub, err = x509.ParsePKCS1PublicKey(keyData); err != nil {
+				return errors.New("invalid RSA public key")
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("public key is not RSA")
+		}
+		return rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hash[:], sig)
+	case "ed25519-sha256":
+		if len(keyData) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(keyData), hash[:], sig) {
+			return errors.New("ed25519 signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", tags["a"])
+	}
+}
+
+func signDKIM(key crypto.Signer, data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		// ed25519-sha256 signs the SHA-256 hash with PureEdDSA (RFC 8463)
+		return ed25519.Sign(k, hash[:]), nil
+	}
+	return key.Sign(nil, hash[:], crypto.SHA256)
+}
+
+// A header field including its folded continuation lines and trailing CRLF
+type headerField struct {
+	name string
+	raw  string
+}
+
+// Returns the unparsed field value after the colon.
+func (f headerField) value() string {
+	_, v, _ := strings.Cut(f.raw, ":")
+	return v
+}
+
+// Build the data hashed for the signature: the signed header fields, selected bottom-up for repeated names, followed
+// by the signature header without its trailing CRLF.
+func headerHashInput(fields []headerField, signed []string, sigField headerField, relaxed bool) []byte {
+	canon := func(f headerField) string {
+		if relaxed {
+			return canonicalHeaderRelaxed(f)
+		}
+		return f.raw
+	}
+
+	var buf bytes.Buffer
+	used := map[string]int{}
+	for _, name := range signed {
+		key := strings.ToLower(name)
+		seen := 0
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.ToLower(fields[i].name) != key {
+				continue
+			}
+			if seen == used[key] {
+				buf.WriteString(canon(fields[i]))
+				break
+			}
+			seen++
+		}
+		used[key]++
+	}
+	buf.WriteString(strings.TrimSuffix(canon(sigField), "\r\n"))
+	return buf.Bytes()
+}
+
+func canonicalHeaderRelaxed(f headerField) string {
+	value := strings.NewReplacer("\r\n", "", "\t", " ").Replace(f.value())
+	value = strings.Join(strings.Fields(value), " ")
+	return strings.ToLower(strings.TrimSpace(f.name)) + ":" + value + "\r\n"
+}
+
+func canonicalBodyRelaxed(body []byte) []byte {
+	lines := bytes.Split(body, []byte("\r\n"))
+	var buf bytes.Buffer
+	for _, line := range lines {
+		line = bytes.ReplaceAll(line, []byte("\t"), []byte(" "))
+		fields := bytes.Fields(line)
+		if len(line) > 0 && (line[0] == ' ') && len(fields) > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.Write(bytes.Join(fields, []byte(" ")))
+		buf.WriteString("\r\n")
+	}
+	out := bytes.TrimRight(buf.Bytes(), "\r\n")
+	if len(out) == 0 {
+		return nil
+	}
+	return append(out, '\r', '\n')
+}
+
+func canonicalBodySimple(body []byte) []byte {
+	out := bytes.TrimRight(body, "\r\n")
+	return append(out, '\r', '\n')
+}
+
+// Split a CRLF message into its header fields and body.
+func splitMessage(msg []byte) ([]headerField, []byte) {
+	var fields []headerField
+	rest := msg
+	for len(rest) > 0 {
+		line, next, found := bytes.Cut(rest, []byte("\r\n"))
+		if len(line) == 0 && found {
+			return fields, next
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += string(line) + "\r\n"
+		} else {
+			name, _, _ := strings.Cut(string(line), ":")
+			fields = append(fields, headerField{name: strings.TrimSpace(name), raw: string(line) + "\r\n"})
+		}
+		rest = next
+	}
+	return fields, nil
+}
+
+// Parse a tag=value list (RFC 6376 section 3.2).
+func parseTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(strings.NewReplacer("\r\n", "", "\t", " ").Replace(value))
+	}
+	return tags
+}
+
+// Remove the value of the b= tag, keeping everything else in the header untouched.
+func removeSignatureValue(raw string) string {
+	idx := 0
+	for {
+		i := strings.Index(raw[idx:], "b=")
+		if i < 0 {
+			return raw
+		}
+		i += idx
+		// the tag name must be preceded by the start of the value, a semicolon or whitespace
+		j := i - 1
+		for j >= 0 && strings.ContainsRune(" \t\r\n", rune(raw[j])) {
+			j--
+		}
+		if j >= 0 && (raw[j] == ';' || raw[j] == ':') {
+			end := strings.IndexByte(raw[i:], ';')
+			if end < 0 {
+				// value runs to the end of the field, before the trailing CRLF
+				return raw[:i+2] + "\r\n"
+			}
+			return raw[:i+2] + raw[i+end:]
+		}
+		idx = i + 2
+	}
+}
+
+func stripWSP(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// Convert bare LF line endings to CRLF.
+func toCRLF(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte("\n")) {
+		return msg
+	}
+	var buf bytes.Buffer
+	for i, c := range msg {
+		if c == '\n' && (i == 0 || msg[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,196 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const dkimMessage = "From: Alerts <alerts@example.com>\r\n" +
+	"To: ops@example.net\r\n" +
+	"Subject: Disk usage\r\n" +
+	"Date: Mon, 02 Mar 2026 10:00:00 +0000\r\n" +
+	"Message-ID: <42@example.com>\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Disk usage is at 91%.  \r\n" +
+	"\r\n" +
+	"\r\n"
+
+// Returns the DNS TXT record publishing the public key of the signer.
+func dkimRecord(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	switch pub := key.Public().(type) {
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+}
+
+// Verify the signatures of the message with go-msgauth, looking up the key of selector._domainkey.example.com only.
+func verifyDKIM(t *testing.T, msg []byte, record string) []*dkim.Verification {
+	t.Helper()
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "gopostal._domainkey.example.com" {
+				return nil, errors.New("no such record " + domain)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	return verifications
+}
+
+func newTestSigner(t *testing.T, key crypto.Signer, record string) *DKIMSigner {
+	t.Helper()
+	signer, err := NewDKIMSigner("Example.com", "gopostal", key, nil)
+	if err != nil {
+		t.Fatalf("NewDKIMSigner: %v", err)
+	}
+	signer.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if name != "gopostal._domainkey.example.com" {
+			return nil, errors.New("no such record " + name)
+		}
+		return []string{record}, nil
+	}
+	return signer
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ed25519": edKey} {
+		t.Run(name, func(t *testing.T) {
+			record := dkimRecord(t, key)
+			// LF line endings are converted to CRLF before signing
+			signed, err := newTestSigner(t, key, record).Sign(context.Background(), []byte(strings.ReplaceAll(dkimMessage, "\r\n", "\n")))
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			if !strings.HasPrefix(string(signed), "DKIM-Signature:") || !strings.HasSuffix(string(signed), dkimMessage) {
+				t.Fatalf("signed message =\n%s", signed)
+			}
+
+			verifications := verifyDKIM(t, signed, record)
+			if len(verifications) != 1 || verifications[0].Err != nil || verifications[0].Domain != "example.com" {
+				t.Fatalf("verifications = %+v", verifications)
+			}
+			for _, h := range []string{"from", "to", "subject", "date", "message-id", "content-type"} {
+				found := false
+				for _, signedHeader := range verifications[0].HeaderKeys {
+					found = found || strings.EqualFold(signedHeader, h)
+				}
+				if !found {
+					t.Errorf("header %s is not signed: %v", h, verifications[0].HeaderKeys)
+				}
+			}
+
+			// Changing a signed header breaks the signature
+			tampered := bytes.Replace(signed, []byte("Subject: Disk usage"), []byte("Subject: Disk full"), 1)
+			if v := verifyDKIM(t, tampered, record); len(v) != 1 || v[0].Err == nil {
+				t.Errorf("tampered message verified: %+v", v)
+			}
+		})
+	}
+}
+
+func TestDKIMSignAlreadySigned(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := dkimRecord(t, key)
+	signer := newTestSigner(t, key, record)
+
+	// A message signed upstream for the domain is sent unchanged
+	var upstream bytes.Buffer
+	if err := dkim.Sign(&upstream, strings.NewReader(dkimMessage), &dkim.SignOptions{
+		Domain: "example.com", Selector: "gopostal", Signer: key,
+	}); err != nil {
+		t.Fatalf("dkim.Sign: %v", err)
+	}
+	signed, err := signer.Sign(context.Background(), upstream.Bytes())
+	if err != nil || !bytes.Equal(signed, upstream.Bytes()) {
+		t.Fatalf("Sign: %v, message was signed again:\n%s", err, signed)
+	}
+
+	// A signature which no longer verifies, or one of another domain, does not prevent signing
+	for name, msg := range map[string]string{
+		"broken":       strings.Replace(upstream.String(), "91%", "92%", 1),
+		"other domain": strings.Replace(upstream.String(), "d=example.com", "d=example.org", 1),
+	} {
+		signed, err := signer.Sign(context.Background(), []byte(msg))
+		if err != nil {
+			t.Fatalf("%s: Sign: %v", name, err)
+		}
+		if signed = bytes.TrimSuffix(signed, []byte(msg)); !bytes.HasPrefix(signed, []byte("DKIM-Signature:")) || bytes.Count(signed, []byte("DKIM-Signature:")) != 1 {
+			t.Errorf("%s: added headers = %q, want a new signature", name, signed)
+		}
+	}
+}
+
+func TestLoadDKIMKey(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"pkcs1.pem": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		"pkcs8.pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+		"cert.pem":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a key")}),
+		"text.pem":  []byte("not PEM"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"pkcs1.pem", "pkcs8.pem"} {
+		if loaded, err := LoadDKIMKey(filepath.Join(dir, name)); err != nil || !key.Equal(loaded) {
+			t.Errorf("%s: LoadDKIMKey = %v, %v", name, loaded, err)
+		}
+	}
+	for name, want := range map[string]string{
+		"cert.pem":    "unsupported PEM block type 'CERTIFICATE'",
+		"text.pem":    "no PEM data found",
+		"missing.pem": "no such file",
+	} {
+		if _, err := LoadDKIMKey(filepath.Join(dir, name)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: LoadDKIMKey error = %v, want %q", name, err, want)
+		}
+	}
+}
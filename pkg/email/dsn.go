@@ -0,0 +1,81 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Actions of the recipients of a delivery status notification
+const (
+	DSNDelivered = "delivered"
+	DSNFailed    = "failed"
+)
+
+// A recipient reported in a delivery status notification
+type DSNRecipient struct {
+	Address           string
+	OriginalRecipient string // ORCPT parameter as "<type>; <address>", if any
+	Action            string // DSNDelivered or DSNFailed
+	Status            string // Enhanced status code, e.g. "2.0.0"
+	Diagnostic        string // Diagnostic-Code of failed recipients, e.g. "smtp; 554 5.0.0 Message could not be delivered"
+}
+
+// A delivery status notification (RFC 3464) about a message
+type DSN struct {
+	ReportingMTA string // Domain name of the relay
+	EnvelopeID   string // ENVID parameter of the message, if any
+	ArrivalDate  time.Time
+	Recipients   []DSNRecipient
+}
+
+// Render the message/delivery-status part of the notification.
+func (d *DSN) DeliveryStatus() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", d.ReportingMTA)
+	if d.EnvelopeID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", d.EnvelopeID)
+	}
+	if !d.ArrivalDate.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\r\n", d.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, r := range d.Recipients {
+		b.WriteString("\r\n")
+		if r.OriginalRecipient != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", r.OriginalRecipient)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", r.Address)
+		fmt.Fprintf(&b, "Action: %s\r\n", r.Action)
+		fmt.Fprintf(&b, "Status: %s\r\n", r.Status)
+		if r.Diagnostic != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: %s\r\n", r.Diagnostic)
+		}
+	}
+	return b.Bytes()
+}
+
+// Returns true if the message is a delivery status notification or another automatic message (RFC 3834), or asks
+// not to receive delivery reports. Such messages must never trigger a notification themselves.
+func IsAutoMessage(h mail.Header) bool {
+	if v := strings.TrimSpace(h.Get("Auto-Submitted")); v != "" && !strings.EqualFold(v, "no") {
+		return true
+	}
+	if h.Get("X-Auto-Response-Suppress") != "" {
+		return true
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status")
+}
+
+// Returns the header section of a message, up to and including the blank line terminating it.
+func HeaderSection(data []byte) []byte {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(data, []byte(sep)); i >= 0 {
+			return data[:i+len(sep)]
+		}
+	}
+	return data
+}
@@ -0,0 +1,65 @@
+package email
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+)
+
+// Rewrite the header section of a raw message for a copy sent to other recipients, e.g. an archive copy. APIs sending
+// raw messages take the recipients from the To and Cc fields, which are renamed X-Original-To and X-Original-Cc so
+// the copy keeps them for reference only; Bcc fields are dropped and the Subject field is replaced with subject,
+// encoded if it is not ASCII. The body is kept untouched.
+func RewriteCopyHeaders(data []byte, subject string) []byte {
+	var out bytes.Buffer
+	out.Grow(len(data) + len(subject))
+	subjectField := "Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n"
+
+	rest := data
+	skip, wroteSubject := false, false
+	for len(rest) > 0 {
+		line, next, found := bytes.Cut(rest, []byte("\n"))
+		if found {
+			line = rest[:len(line)+1]
+		}
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			break // blank line terminating the header section
+		}
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			// Continuation of the previous field
+			if !skip {
+				out.Write(line)
+			}
+			rest = next
+			continue
+		}
+
+		name, value, _ := bytes.Cut(line, []byte(":"))
+		skip = false
+		switch strings.ToLower(strings.TrimSpace(string(name))) {
+		case "to":
+			out.WriteString("X-Original-To:")
+			out.Write(value)
+		case "cc":
+			out.WriteString("X-Original-Cc:")
+			out.Write(value)
+		case "bcc":
+			skip = true
+		case "subject":
+			skip = true
+			if !wroteSubject {
+				out.WriteString(subjectField)
+				wroteSubject = true
+			}
+		default:
+			out.Write(line)
+		}
+		rest = next
+	}
+	if !wroteSubject {
+		out.WriteString(subjectField)
+	}
+	out.Write(rest)
+	return out.Bytes()
+}
@@ -0,0 +1,46 @@
+package email
+
+import "testing"
+
+func TestRewriteCopyHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		subject string
+		want    string
+	}{
+		{
+			"recipients and subject",
+			"From: alerts@example.com\r\nTo: ops@example.net,\r\n dev@example.net\r\nCc: boss@example.net\r\n" +
+				"Bcc: audit@example.net\r\nSubject: Disk usage\r\n\r\nTo: not a header\r\n",
+			"[ARCHIVED] Disk usage",
+			"From: alerts@example.com\r\nX-Original-To: ops@example.net,\r\n dev@example.net\r\nX-Original-Cc: boss@example.net\r\n" +
+				"Subject: [ARCHIVED] Disk usage\r\n\r\nTo: not a header\r\n",
+		},
+		{
+			"folded subject",
+			"subject: Disk\r\n usage\r\nto: ops@example.net\r\n\r\nBody\r\n",
+			"[ARCHIVED] Disk usage",
+			"Subject: [ARCHIVED] Disk usage\r\nX-Original-To: ops@example.net\r\n\r\nBody\r\n",
+		},
+		{
+			"missing subject",
+			"To: ops@example.net\r\n\r\nBody\r\n",
+			"[ARCHIVED]",
+			"X-Original-To: ops@example.net\r\nSubject: [ARCHIVED]\r\n\r\nBody\r\n",
+		},
+		{
+			"non-ASCII subject",
+			"Subject: =?utf-8?q?Caf=C3=A9?=\r\n\r\nBody\r\n",
+			"[ARCHIVED] Café",
+			"Subject: =?utf-8?q?[ARCHIVED]_Caf=C3=A9?=\r\n\r\nBody\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(RewriteCopyHeaders([]byte(tt.data), tt.subject)); got != tt.want {
+				t.Errorf("RewriteCopyHeaders = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	PreferHTML = "html"
+	PreferText = "text"
+)
+
+// Maximum depth of nested multipart entities which are walked
+const maxDepth = 10
+
+// Attachment is a non-body MIME part carried alongside the message body. Inline attachments are referenced from an
+// HTML body by their content ID (e.g. <img src="cid:logo">).
+type Attachment struct {
+	Name        string
+	ContentType string
+	ContentID   string // without angle brackets
+	Inline      bool
+	Data        []byte // decoded content
+}
+
+// Body is the result of walking a MIME message: the part selected as the message body, decoded and converted to
+// UTF-8, and the remaining parts as attachments.
+type Body struct {
+	Content     []byte
+	HTML        bool
+	Attachments []Attachment
+}
+
+// A decoded MIME part
+type part struct {
+	header    textproto.MIMEHeader
+	mediaType string
+	params    map[string]string
+	data      []byte // raw content for multipart entities, decoded content otherwise
+}
+
+// Returns true if the media type is multipart.
+func IsMultipart(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// Returns true if the media type is text/html.
+func IsHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/html"
+}
+
+// Walk a multipart message and select its body. Within multipart/alternative the HTML or plain text alternative is
+// chosen according to prefer, falling back to the other if the preferred one is absent. The HTML alternative may be a
+// multipart/related entity, in which case its related parts are carried as inline attachments. Transfer encodings are
+// decoded and text is converted to UTF-8.
+func ParseMultipart(contentType string, body []byte, prefer string) (*Body, error) {
+	header := textproto.MIMEHeader{"Content-Type": {contentType}}
+	root := newPart(header, body)
+	if !strings.HasPrefix(root.mediaType, "multipart/") {
+		return nil, fmt.Errorf("not a multipart message: %s", root.mediaType)
+	}
+
+	var b Body
+	if err := walk(&b, root, prefer, 0); err != nil {
+		return nil, err
+	}
+
+	// Some senders attach the images of the HTML body to a multipart/mixed entity without an inline disposition, which
+	// are inline images nonetheless if the HTML references their content ID
+	if b.HTML {
+		for i := range b.Attachments {
+			if a := &b.Attachments[i]; !a.Inline && a.ContentID != "" && bytes.Contains(b.Content, []byte("cid:"+a.ContentID)) {
+				a.Inline = true
+			}
+		}
+	}
+	return &b, nil
+}
+
+// Returns the inline images of the body: the attachments which its HTML references by content ID (e.g. <img
+// src="cid:logo">), which are the related parts of a multipart/related HTML body, the parts with an inline
+// disposition and a content ID, and the parts whose content ID the HTML body references.
+func ExtractInlineImages(b *Body) []Attachment {
+	var inline []Attachment
+	for _, a := range b.Attachments {
+		if a.Inline {
+			inline = append(inline, a)
+		}
+	}
+	return inline
+}
+
+func walk(b *Body, p *part, prefer string, depth int) error {
+	if depth > maxDepth {
+		return errors.New("multipart nesting too deep")
+	}
+
+	if !strings.HasPrefix(p.mediaType, "multipart/") {
+		if b.Content == nil && isBodyCandidate(p) {
+			setBody(b, p)
+			return nil
+		}
+		b.Attachments = append(b.Attachments, newAttachment(p, len(b.Attachments)))
+		return nil
+	}
+
+	children, err := readParts(p)
+	if err != nil {
+		return err
+	}
+
+	switch p.mediaType {
+	case "multipart/alternative":
+		if chosen := chooseAlternative(children, prefer); chosen != nil {
+			return walk(b, chosen, prefer, depth+1)
+		}
+		return nil
+	case "multipart/related":
+		// The root part is the one named by the start parameter, or the first part
+		rootIdx := 0
+		if start := strings.Trim(p.params["start"], "<>"); start != "" {
+			for i, c := range children {
+				if contentID(c) == start {
+					rootIdx = i
+					break
+				}
+			}
+		}
+		for i, c := range children {
+			if i == rootIdx {
+				if err := walk(b, c, prefer, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			att := newAttachment(c, len(b.Attachments))
+			att.Inline = true
+			b.Attachments = append(b.Attachments, att)
+		}
+		return nil
+	default:
+		// multipart/mixed and unknown multipart subtypes: the first body candidate is the body, everything else is
+		// carried as an attachment
+		for _, c := range children {
+			if err := walk(b, c, prefer, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Choose the alternative to use as the body. Later alternatives are preferred by the sender (RFC 2046), so the last
+// match wins.
+func chooseAlternative(children []*part, prefer string) *part {
+	var html, text *part
+	for _, c := range children {
+		switch {
+		case c.mediaType == "text/html", c.mediaType == "multipart/related":
+			html = c
+		case c.mediaType == "text/plain":
+			text = c
+		}
+	}
+	if prefer == PreferText {
+		if text != nil {
+			return text
+		}
+		return html
+	}
+	if html != nil {
+		return html
+	}
+	if text != nil {
+		return text
+	}
+	if len(children) > 0 {
+		return children[len(children)-1]
+	}
+	return nil
+}
+
+// Returns true if the part can be used as the message body.
+func isBodyCandidate(p *part) bool {
+	if disposition, _, _ := mime.ParseMediaType(p.header.Get("Content-Disposition")); disposition == "attachment" {
+		return false
+	}
+	return p.mediaType == "text/plain" || p.mediaType == "text/html"
+}
+
+func setBody(b *Body, p *part) {
+	content, err := ToUTF8(p.data, p.params["charset"])
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to convert message body to UTF-8, using it as-is")
+	}
+	b.Content = content
+	b.HTML = p.mediaType == "text/html"
+}
+
+func newAttachment(p *part, index int) Attachment {
+	name := ""
+	if _, params, err := mime.ParseMediaType(p.header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = p.params["name"]
+	}
+	if decoded, err := (&mime.WordDecoder{}).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	if name == "" {
+		name = fmt.Sprintf("attachment-%d", index+1)
+		if exts, _ := mime.ExtensionsByType(p.mediaType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+
+	disposition, _, _ := mime.ParseMediaType(p.header.Get("Content-Disposition"))
+	return Attachment{
+		Name:        name,
+		ContentType: p.mediaType,
+		ContentID:   contentID(p),
+		Inline:      disposition == "inline" && contentID(p) != "",
+		Data:        p.data,
+	}
+}
+
+func contentID(p *part) string {
+	return strings.TrimSpace(strings.Trim(strings.TrimSpace(p.header.Get("Content-Id")), "<>"))
+}
+
+func readParts(p *part) ([]*part, error) {
+	boundary := p.params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("%s without boundary", p.mediaType)
+	}
+
+	var parts []*part
+	mr := multipart.NewReader(bytes.NewReader(p.data), boundary)
+	for {
+		// NextRawPart leaves quoted-printable decoding to decodeTransferEncoding
+		mp, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s part: %w", p.mediaType, err)
+		}
+		data, err := io.ReadAll(mp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s part: %w", p.mediaType, err)
+		}
+		parts = append(parts, newPart(mp.Header, data))
+	}
+}
+
+func newPart(header textproto.MIMEHeader, data []byte) *part {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain; charset=us-ascii"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// an unparseable content type is treated as opaque data
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+
+	p := &part{header: header, mediaType: mediaType, params: params, data: data}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		p.data = DecodeTransferEncoding(data, header.Get("Content-Transfer-Encoding"))
+	}
+	return p
+}
+
+// Decode quoted-printable and base64 content. Other encodings (7bit, 8bit, binary) are returned as-is, as is content
+// which fails to decode or uses an unknown encoding.
+func DecodeTransferEncoding(data []byte, encoding string) []byte {
+	switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+	case "", "7bit", "8bit", "binary":
+		return data
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to decode quoted-printable content, using it as-is")
+			return data
+		}
+		return decoded
+	case "base64":
+		// strip line breaks and other whitespace before decoding
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, data)
+		decoded, err := base64.StdEncoding.DecodeString(string(clean))
+		if err != nil {
+			if decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(string(clean), "=")); err != nil {
+				log.Warn().Err(err).Msg("Failed to decode base64 content, using it as-is")
+				return data
+			}
+		}
+		return decoded
+	default:
+		log.Warn().Str("encoding", encoding).Msg("Unknown content transfer encoding, using the content as-is")
+		return data
+	}
+}
@@ -0,0 +1,165 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 1x1 transparent PNG
+const pngBase64 = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg=="
+
+// Report with an HTML body embedding a logo as a related part, and a PDF attached to it
+const relatedMessage = "--mixed\r\n" +
+	"Content-Type: multipart/related; boundary=related\r\n" +
+	"\r\n" +
+	"--related\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p><img src=\"cid:logo\"> Disk usage is at 91%.</p>\r\n" +
+	"--related\r\n" +
+	"Content-Type: image/png; name=\"logo.png\"\r\n" +
+	"Content-ID: <logo>\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	pngBase64 + "\r\n" +
+	"--related--\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"\r\n" +
+	"%PDF-1.4\r\n" +
+	"--mixed--\r\n"
+
+func TestExtractInlineImages(t *testing.T) {
+	body, err := ParseMultipart("multipart/mixed; boundary=mixed", []byte(relatedMessage), PreferHTML)
+	if err != nil {
+		t.Fatalf("ParseMultipart: %v", err)
+	}
+	if !body.HTML || !strings.Contains(string(body.Content), `src="cid:logo"`) {
+		t.Errorf("body = %q, want the HTML part", body.Content)
+	}
+	if len(body.Attachments) != 2 {
+		t.Fatalf("attachments = %+v, want the logo and the report", body.Attachments)
+	}
+
+	inline := ExtractInlineImages(body)
+	if len(inline) != 1 {
+		t.Fatalf("inline images = %+v, want the logo only", inline)
+	}
+	png, _ := base64.StdEncoding.DecodeString(pngBase64)
+	logo := inline[0]
+	if logo.Name != "logo.png" || logo.ContentType != "image/png" || logo.ContentID != "logo" || !bytes.Equal(logo.Data, png) {
+		t.Errorf("inline image = %+v", logo)
+	}
+}
+
+func TestReferencedImagesAreInline(t *testing.T) {
+	// An image attached to multipart/mixed without a disposition, referenced by the HTML body, and a PDF which is not
+	msg := "--mixed\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p><img src=\"cid:chart@monitoring\"> CPU usage is at 97%.</p>\r\n" +
+		"--mixed\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: < chart@monitoring >\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		pngBase64 + "\r\n" +
+		"--mixed\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-ID: <report@monitoring>\r\n" +
+		"\r\n" +
+		"%PDF-1.4\r\n" +
+		"--mixed--\r\n"
+	body, err := ParseMultipart("multipart/mixed; boundary=mixed", []byte(msg), PreferHTML)
+	if err != nil {
+		t.Fatalf("ParseMultipart: %v", err)
+	}
+	inline := ExtractInlineImages(body)
+	if len(body.Attachments) != 2 || len(inline) != 1 || inline[0].ContentID != "chart@monitoring" {
+		t.Errorf("attachments = %+v, want the chart inline", body.Attachments)
+	}
+}
+
+// Read a message from testdata and select its body.
+func parseFixture(t *testing.T, name, prefer string) *Body {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	data, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ParseMultipart(msg.Header.Get("Content-Type"), data, prefer)
+	if err != nil {
+		t.Fatalf("ParseMultipart: %v", err)
+	}
+	return body
+}
+
+// The preferred alternative is selected from the structures which Outlook and Thunderbird send, with the related
+// parts of the HTML alternative carried as inline images and the other parts as attachments.
+func TestParseMultipartPreferBody(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		prefer      string
+		html        bool
+		content     string
+		attachments []string
+		inline      []string
+	}{
+		// Outlook: multipart/mixed holding the alternatives and the attachment
+		{"outlook_alternative.eml", PreferHTML, true, "The nightly backup completed \u2013 <b>3 of 3</b> jobs succeeded.",
+			[]string{"backup-report.pdf"}, nil},
+		{"outlook_alternative.eml", PreferText, false, "The nightly backup completed \u2013 3 of 3 jobs succeeded.",
+			[]string{"backup-report.pdf"}, nil},
+		// Outlook: multipart/related whose root part holds the alternatives
+		{"outlook_related.eml", PreferHTML, true, `src="cid:image001.png@01DCB0A1.5E3F2C40"`,
+			[]string{"image001.png"}, []string{"image001.png@01DCB0A1.5E3F2C40"}},
+		{"outlook_related.eml", PreferText, false, "[cid:image001.png@01DCB0A1.5E3F2C40]\r\nAll backups succeeded.",
+			[]string{"image001.png"}, []string{"image001.png@01DCB0A1.5E3F2C40"}},
+		// Thunderbird: multipart/alternative whose HTML alternative is a multipart/related entity
+		{"thunderbird_related.eml", PreferHTML, true, "The certificate for <i>mail.example.com</i> expires in 14 days \u2013 renew it soon.",
+			[]string{"warning.png"}, []string{"part1.Hs2kT9aB.Qw3eR7yU@example.com"}},
+		{"thunderbird_related.eml", PreferText, false, "The certificate for mail.example.com expires in 14 days \u2013 renew it \r\nsoon.",
+			nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(strings.TrimSuffix(tt.fixture, ".eml")+"/"+tt.prefer, func(t *testing.T) {
+			body := parseFixture(t, tt.fixture, tt.prefer)
+			if body.HTML != tt.html {
+				t.Errorf("HTML = %v, want %v", body.HTML, tt.html)
+			}
+			if !strings.Contains(string(body.Content), tt.content) {
+				t.Errorf("body = %q, want it to contain %q", body.Content, tt.content)
+			}
+
+			var attachments, inline []string
+			for _, a := range body.Attachments {
+				attachments = append(attachments, a.Name)
+			}
+			for _, a := range ExtractInlineImages(body) {
+				inline = append(inline, a.ContentID)
+			}
+			if strings.Join(attachments, ",") != strings.Join(tt.attachments, ",") {
+				t.Errorf("attachments = %q, want %q", attachments, tt.attachments)
+			}
+			if strings.Join(inline, ",") != strings.Join(tt.inline, ",") {
+				t.Errorf("inline images = %q, want %q", inline, tt.inline)
+			}
+		})
+	}
+}
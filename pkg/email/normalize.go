@@ -0,0 +1,24 @@
+package email
+
+import "strings"
+
+// Changes made to addresses before they are compared against the policies
+type NormalizeOptions struct {
+	StripPlusTags bool // remove the "+tag" suffix of the local part (e.g. "user+tag@example.com" becomes "user@example.com")
+}
+
+// Returns the normalized form of the address, used to compare it against other addresses. Surrounding whitespace is
+// always removed and the address is always lowercased, as the policies compare addresses case-insensitively.
+func Normalize(addr string, opts NormalizeOptions) string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || !opts.StripPlusTags {
+		return addr
+	}
+	local, domain := addr[:at], addr[at:]
+	// A local part starting with "+" is kept whole rather than left empty
+	if plus := strings.Index(local, "+"); plus > 0 {
+		local = local[:plus]
+	}
+	return local + domain
+}
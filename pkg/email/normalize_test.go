@@ -0,0 +1,24 @@
+package email
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	strip := NormalizeOptions{StripPlusTags: true}
+	tests := []struct {
+		addr string
+		opts NormalizeOptions
+		want string
+	}{
+		{" Alerts@Example.COM ", NormalizeOptions{}, "alerts@example.com"},
+		{"Alerts+Disk@Example.COM", NormalizeOptions{}, "alerts+disk@example.com"},
+		{"alerts+disk@example.com", strip, "alerts@example.com"},
+		{"Alerts+Disk+Full@Example.com", strip, "alerts@example.com"},
+		{"+alerts@example.com", strip, "+alerts@example.com"},
+		{"Alerts+Disk", strip, "alerts+disk"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.addr, tt.opts); got != tt.want {
+			t.Errorf("Normalize(%q, %+v) = %q, want %q", tt.addr, tt.opts, got, tt.want)
+		}
+	}
+}
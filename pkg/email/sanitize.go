@@ -0,0 +1,50 @@
+package email
+
+import (
+	"fmt"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+const (
+	SanitizeUGC     = "ugc"     // user generated content: common formatting, links and images
+	SanitizeStrict  = "strict"  // strip all HTML
+	SanitizeRelaxed = "relaxed" // ugc plus inline styles and embedded (data:) images, as used by most HTML email
+)
+
+// Inline style properties kept by the relaxed policy. Properties taking a URL (background, background-image, ...) are
+// left out so that styles cannot load remote content or javascript: URLs.
+var relaxedStyles = []string{
+	"color", "background-color", "font-family", "font-size", "font-style", "font-weight", "line-height", "letter-spacing",
+	"text-align", "text-decoration", "text-transform", "vertical-align", "white-space", "display",
+	"width", "height", "min-width", "max-width", "min-height", "max-height",
+	"margin", "margin-top", "margin-right", "margin-bottom", "margin-left",
+	"padding", "padding-top", "padding-right", "padding-bottom", "padding-left",
+	"border", "border-top", "border-right", "border-bottom", "border-left", "border-color", "border-style",
+	"border-width", "border-radius", "border-collapse", "border-spacing",
+}
+
+// Create an HTML sanitizer for the named policy. Inline images referenced by content ID (cid:) are kept by the ugc
+// and relaxed policies.
+func NewSanitizer(policy string) (*bluemonday.Policy, error) {
+	switch policy {
+	case SanitizeUGC:
+		p := bluemonday.UGCPolicy()
+		p.AllowURLSchemes("cid")
+		return p, nil
+	case SanitizeStrict:
+		return bluemonday.StrictPolicy(), nil
+	case SanitizeRelaxed:
+		p := bluemonday.UGCPolicy()
+		p.AllowURLSchemes("cid")
+		p.AllowStyling()
+		p.AllowStyles(relaxedStyles...).Globally()
+		p.AllowAttrs("align", "valign", "bgcolor", "width", "height", "border", "cellpadding", "cellspacing").Globally()
+		p.AllowDataURIImages()
+		p.AllowElements("center", "font")
+		p.AllowAttrs("color", "face", "size").OnElements("font")
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown policy '%s'", policy)
+	}
+}
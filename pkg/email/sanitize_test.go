@@ -0,0 +1,68 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+// Scripts, event handlers and javascript: URLs are removed by every policy, while the formatting each policy allows is
+// kept.
+func TestNewSanitizer(t *testing.T) {
+	const html = `<p class="note" onclick="steal()">Disk <b>full</b> on <i>srv01</i></p>` +
+		`<script>alert(1)</script>` +
+		`<a href="javascript:alert(1)">fix</a> <a href=" JaVaScRiPt:alert(1)">now</a> ` +
+		`<a href="https://grafana.example.com/d/1">dashboard</a>` +
+		`<img src="cid:logo" onerror="steal()"><img src="data:image/png;base64,iVBORw0KGgo=">` +
+		`<div style="background-image: url(javascript:alert(1)); color: red; padding: 4px 8px">details</div>` +
+		`<table width="100%" border="1"><tr><td bgcolor="#eeeeee" style="text-align: center">91%</td></tr></table>` +
+		`<font color="red">critical</font>`
+
+	tests := []struct {
+		policy  string
+		keep    []string
+		removed []string
+	}{
+		{
+			policy: SanitizeUGC,
+			keep: []string{"<p>Disk <b>full</b> on <i>srv01</i></p>", `<a href="https://grafana.example.com/d/1" rel="nofollow">dashboard</a>`,
+				`<img src="cid:logo">`, `<table width="100%"><tr><td>91%</td></tr></table>`, "critical"},
+			removed: []string{"data:", "style=", "bgcolor", "<font"},
+		},
+		{
+			policy:  SanitizeStrict,
+			keep:    []string{"Disk full on srv01", "fix now dashboard", "details91%critical"},
+			removed: []string{"<", "cid:"},
+		},
+		{
+			policy: SanitizeRelaxed,
+			keep: []string{`<p class="note">Disk <b>full</b> on <i>srv01</i></p>`, `<img src="cid:logo">`,
+				`<img src="data:image/png;base64,iVBORw0KGgo=">`, `<div style="color: red; padding: 4px 8px">details</div>`,
+				`<table width="100%" border="1"><tr><td bgcolor="#eeeeee" style="text-align: center">91%</td></tr></table>`,
+				`<font color="red">critical</font>`},
+			removed: []string{"background-image"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			p, err := NewSanitizer(tt.policy)
+			if err != nil {
+				t.Fatalf("NewSanitizer: %v", err)
+			}
+			got := p.Sanitize(html)
+			for _, s := range append([]string{"<script", "alert(", "onclick", "onerror", "steal", "javascript:"}, tt.removed...) {
+				if strings.Contains(strings.ToLower(got), strings.ToLower(s)) {
+					t.Errorf("sanitized HTML contains %q: %s", s, got)
+				}
+			}
+			for _, s := range tt.keep {
+				if !strings.Contains(got, s) {
+					t.Errorf("sanitized HTML lost %q: %s", s, got)
+				}
+			}
+		})
+	}
+
+	if _, err := NewSanitizer("permissive"); err == nil || err.Error() != "unknown policy 'permissive'" {
+		t.Errorf("NewSanitizer with an unknown policy: got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package email
+
+import (
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Default maximum subject length in bytes, the RFC 5322 line length limit
+const DefaultMaxSubjectLength = 998
+
+// Decodes RFC 2047 encoded-words in any charset known to htmlindex
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// Decode a raw Subject header to UTF-8. Encoded-words are decoded first. The headers of a message submitted with
+// SMTPUTF8 (utf8Header) are UTF-8 (RFC 6532); otherwise 8-bit data which is not UTF-8 is assumed to be Windows-1252 (a
+// superset of ISO-8859-1 used by most legacy clients). Anything which still is not valid UTF-8 has its invalid bytes
+// replaced.
+func DecodeSubject(raw string, utf8Header bool) string {
+	if decoded, err := wordDecoder.DecodeHeader(raw); err == nil {
+		raw = decoded
+	} else {
+		log.Debug().Err(err).Str("subject", raw).Msg("Failed to decode subject encoded-words")
+	}
+	if utf8.ValidString(raw) {
+		return raw
+	}
+
+	if !utf8Header {
+		if decoded, err := charmap.Windows1252.NewDecoder().String(raw); err == nil && utf8.ValidString(decoded) {
+			return decoded
+		}
+	}
+
+	log.Warn().Msg("Subject is not valid UTF-8, replacing invalid bytes")
+	return strings.ToValidUTF8(raw, "\uFFFD")
+}
+
+// Truncate a subject to at most max bytes without splitting a UTF-8 sequence. A max of zero or less disables
+// truncation.
+func TruncateSubject(subject string, max int) string {
+	if max <= 0 || len(subject) <= max {
+		return subject
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(subject[cut]) {
+		cut--
+	}
+	return subject[:cut]
+}
+
+// Prepend the non-empty prefixes to the subject, separated by spaces, and truncate the result to the RFC 5322 line
+// length limit.
+func PrefixSubject(subject string, prefixes ...string) string {
+	var parts []string
+	for _, p := range prefixes {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return subject
+	}
+	return TruncateSubject(strings.Join(append(parts, subject), " "), DefaultMaxSubjectLength)
+}
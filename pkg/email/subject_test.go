@@ -0,0 +1,68 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeSubject(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		utf8Header bool
+		want       string
+	}{
+		{"plain", "Disk usage at 91%", false, "Disk usage at 91%"},
+		{"Q encoding", "=?utf-8?q?Caf=C3=A9_ouvert?=", false, "Café ouvert"},
+		{"B encoding", "=?UTF-8?B?4pyFIEJhY2t1cCBkb25l?=", false, "✅ Backup done"},
+		{"mixed charsets and encodings", "=?iso-8859-1?q?Caf=E9?= =?windows-1252?B?gA==?= =?utf-8?b?wqM=?=", false, "Café€£"},
+		{"encoded-words and text", "[ALERT] =?utf-8?q?Caf=C3=A9?= is down", false, "[ALERT] Café is down"},
+		{"whitespace between adjacent encoded-words", "=?utf-8?q?a?= \r\n\t =?utf-8?q?b?=", false, "ab"},
+		{"whitespace between encoded-words and text", "=?utf-8?q?a?= plain =?utf-8?q?b?=", false, "a plain b"},
+		{"encoded space", "=?utf-8?q?a_?= =?utf-8?q?b?=", false, "a b"},
+		{"unknown charset", "=?x-unknown?q?Caf=E9?= is down", false, "=?x-unknown?q?Caf=E9?= is down"},
+		{"malformed encoded-word", "=?utf-8?x?abc?=", false, "=?utf-8?x?abc?="},
+		{"raw UTF-8", "Café ouvert", false, "Café ouvert"},
+		{"raw Windows-1252", "\x93Caf\xe9\x94", false, "“Café”"},
+		{"raw 8-bit with SMTPUTF8", "Caf\xe9", true, "Caf�"},
+		{"invalid UTF-8 in an encoded-word", "=?utf-8?q?Caf=E9?=", true, "Caf�"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DecodeSubject(tt.raw, tt.utf8Header); got != tt.want {
+				t.Errorf("DecodeSubject(%q, %v) = %q, want %q", tt.raw, tt.utf8Header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		max     int
+		want    string
+	}{
+		{"Disk full", 0, "Disk full"},
+		{"Disk full", 9, "Disk full"},
+		{"Disk full", 4, "Disk"},
+		{"Café", 4, "Caf"}, // the é is not split
+		{"Café", 5, "Café"},
+	}
+	for _, tt := range tests {
+		if got := TruncateSubject(tt.subject, tt.max); got != tt.want {
+			t.Errorf("TruncateSubject(%q, %d) = %q, want %q", tt.subject, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixSubject(t *testing.T) {
+	if got := PrefixSubject("Disk full", "", " [EXT] ", "[relay]"); got != "[EXT] [relay] Disk full" {
+		t.Errorf("PrefixSubject = %q", got)
+	}
+	if got := PrefixSubject("Disk full", " "); got != "Disk full" {
+		t.Errorf("PrefixSubject without prefixes = %q", got)
+	}
+	if got := PrefixSubject(strings.Repeat("x", DefaultMaxSubjectLength), "[EXT]"); len(got) != DefaultMaxSubjectLength {
+		t.Errorf("PrefixSubject is %d bytes long, want it truncated to %d", len(got), DefaultMaxSubjectLength)
+	}
+}
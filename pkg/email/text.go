@@ -0,0 +1,133 @@
+package email
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	reSpace      = regexp.MustCompile(`\s+`)
+	reBlankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// Convert an HTML body to plain text. Block elements become line breaks, list items are bulleted, and link targets
+// are written after the link text. Scripts, styles and the document head are dropped.
+func HTMLToText(body []byte) []byte {
+	var (
+		out   strings.Builder
+		line  strings.Builder // pending text of the current line
+		skip  int             // depth of elements whose content is dropped
+		hrefs []string        // targets of the open links
+	)
+
+	// End the current line, if any
+	flush := func() {
+		if l := strings.TrimSpace(line.String()); l != "" {
+			out.WriteString(l + "\n")
+		}
+		line.Reset()
+	}
+	// End the current line and separate the next paragraph with a blank line
+	paragraph := func() {
+		flush()
+		out.WriteByte('\n')
+	}
+	// Append text, collapsing runs of whitespace to a single space
+	text := func(s string) {
+		s = reSpace.ReplaceAllString(s, " ")
+		if l := line.String(); l == "" || strings.HasSuffix(l, " ") || strings.HasSuffix(l, "\n") {
+			s = strings.TrimLeft(s, " ")
+		}
+		line.WriteString(s)
+	}
+	// Append a word separated from the preceding text
+	word := func(s string) {
+		if s != "" {
+			text(" " + s)
+		}
+	}
+
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+
+		switch tt {
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text(tok.Data)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch tok.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Title:
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case atom.Br:
+				line.WriteByte('\n')
+			case atom.Hr:
+				flush()
+				out.WriteString("--------\n")
+			case atom.Li:
+				flush()
+				line.WriteString("- ")
+			case atom.P, atom.Table, atom.Ul, atom.Ol, atom.Blockquote, atom.Pre,
+				atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				paragraph()
+			case atom.Div, atom.Tr:
+				flush()
+			case atom.Td, atom.Th:
+				text(" ")
+			case atom.A:
+				hrefs = append(hrefs, attr(tok, "href"))
+			case atom.Img:
+				word(attr(tok, "alt"))
+			}
+		case html.EndTagToken:
+			switch tok.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Title:
+				if skip > 0 {
+					skip--
+				}
+			case atom.P, atom.Table, atom.Ul, atom.Ol, atom.Blockquote, atom.Pre,
+				atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				paragraph()
+			case atom.Div, atom.Tr, atom.Li:
+				flush()
+			case atom.A:
+				if len(hrefs) == 0 {
+					continue
+				}
+				href := strings.TrimPrefix(hrefs[len(hrefs)-1], "mailto:")
+				hrefs = hrefs[:len(hrefs)-1]
+				// Omit targets which add nothing for the reader
+				if href != "" && !strings.HasPrefix(href, "#") && !strings.HasPrefix(href, "cid:") &&
+					!strings.Contains(line.String(), href) {
+					word("(" + href + ")")
+				}
+			}
+		}
+	}
+	flush()
+
+	result := reBlankLines.ReplaceAllString(out.String(), "\n\n")
+	return []byte(strings.TrimSpace(result))
+}
+
+// Returns the value of the named attribute of a token.
+func attr(tok html.Token, name string) string {
+	for _, a := range tok.Attr {
+		if a.Key == name {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
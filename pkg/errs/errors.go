@@ -23,6 +23,20 @@ var (
 		Message:      "Recipient address is not allowed",
 	}
 
+	// Replies to addresses matching a deny list are identical to those of addresses missing from the allow lists, so
+	// clients cannot probe the deny lists. Only the logs tell them apart.
+	ErrFromDenied = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 8},
+		Message:      "Sender address is not allowed",
+	}
+
+	ErrToDenied = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Recipient address is not allowed",
+	}
+
 	ErrTooManyRecipients = &smtp.SMTPError{
 		Code:         452,
 		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
@@ -35,9 +49,172 @@ var (
 		Message:      "Access denied by IP policy",
 	}
 
+	ErrSourceIPBlocked = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Access denied due to repeated policy violations",
+	}
+
+	ErrMessageRejected = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected by content filter",
+	}
+
+	ErrServiceUnavailable = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Service temporarily unavailable",
+	}
+
+	ErrCircuitOpen = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+		Message:      "Delivery service is failing, try again later",
+	}
+
+	ErrAttachmentBlocked = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Attachment type is not allowed",
+	}
+
+	ErrAttachmentTooLarge = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Attachment exceeds maximum allowed size",
+	}
+
+	ErrTooManyAttachments = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Too many attachments",
+	}
+
+	ErrBodyTooLarge = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Message body exceeds the configured limits",
+	}
+
+	ErrShuttingDown = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Service shutting down, try again later",
+	}
+
+	ErrHookFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Message could not be processed, try again later",
+	}
+
+	ErrSideEffectFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Requested action aborted: error in processing",
+	}
+
+	ErrInvalidEHLO = &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+		Message:      "Invalid EHLO hostname",
+	}
+
+	ErrConnectionLimit = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Connection limit reached, reconnect to send more messages",
+	}
+
+	ErrQuotaExceeded = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+		Message:      "Daily quota exceeded, try again later",
+	}
+
+	ErrInsufficientMemory = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+		Message:      "Insufficient system resources, try again later",
+	}
+
+	ErrSpoolFailed = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+		Message:      "Insufficient system storage, try again later",
+	}
+
+	ErrGreylisted = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Greylisted, try again later",
+	}
+
+	ErrNullSender = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Null sender is not allowed",
+	}
+
+	ErrSenderNotPermitted = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address not permitted for this user",
+	}
+
+	// Addresses with non-ASCII characters can only be submitted with the SMTPUTF8 parameter (RFC 6531 section 3.4)
+	ErrUTF8Required = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+		Message:      "Non-ASCII addresses require SMTPUTF8",
+	}
+
 	ErrSourceIPInvalid = &smtp.SMTPError{
 		Code:         421,
 		EnhancedCode: smtp.EnhancedCode{4, 4, 0},
 		Message:      "Source IP address is invalid",
 	}
 )
+
+// Names of the policy errors whose reply messages can be customized (recv.custom_errors). Denied addresses share the
+// names of disallowed addresses so their replies stay identical.
+var names = map[*smtp.SMTPError]string{
+	ErrInvalidEmail:       "invalid_email",
+	ErrFromDisallowed:     "from_disallowed",
+	ErrFromDenied:         "from_disallowed",
+	ErrToDisallowed:       "to_disallowed",
+	ErrToDenied:           "to_disallowed",
+	ErrTooManyRecipients:  "too_many_recipients",
+	ErrSourceIPDisallowed: "source_ip_disallowed",
+	ErrSourceIPBlocked:    "source_ip_blocked",
+	ErrMessageRejected:    "message_rejected",
+	ErrAttachmentBlocked:  "attachment_blocked",
+	ErrAttachmentTooLarge: "attachment_too_large",
+	ErrTooManyAttachments: "too_many_attachments",
+	ErrBodyTooLarge:       "body_too_large",
+	ErrHookFailed:         "hook_failed",
+	ErrQuotaExceeded:      "quota_exceeded",
+	ErrInvalidEHLO:        "invalid_ehlo",
+	ErrGreylisted:         "greylisted",
+	ErrNullSender:         "null_sender_disallowed",
+	ErrSenderNotPermitted: "sender_not_permitted",
+}
+
+// Returns the name of the policy error, or an empty string if its message cannot be customized.
+func Name(err error) string {
+	if e, ok := err.(*smtp.SMTPError); ok {
+		return names[e]
+	}
+	return ""
+}
+
+// Returns true if the name is the name of a policy error.
+func IsName(name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package greylist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry of a (source IP, sender, recipient) triplet
+type Entry struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Passed    bool      `json:"passed"` // a retry was accepted, so the triplet is no longer delayed
+}
+
+// Store greylists the (source IP, sender, recipient) triplets: the first attempt of an unseen triplet is refused, and
+// retries are accepted once the delay has elapsed. Triplets are forgotten once unused for the retention, and the
+// least recently seen are evicted beyond the maximum number of entries. The entries are optionally persisted to a
+// file so they survive restarts.
+type Store struct {
+	mu         sync.Mutex
+	delay      time.Duration
+	retention  time.Duration
+	maxEntries int
+	path       string
+	entries    map[string]Entry
+	now        func() time.Time
+}
+
+// Create a new store accepting triplets retried `delay` after their first attempt and forgetting them once unused for
+// `retention`. If `path` is set, the entries are loaded from it and saved to it on every change.
+func NewStore(delay, retention time.Duration, maxEntries int, path string) (*Store, error) {
+	s := &Store{
+		delay:      delay,
+		retention:  retention,
+		maxEntries: maxEntries,
+		path:       path,
+		entries:    make(map[string]Entry),
+		now:        time.Now,
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read greylist state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse greylist state %s: %w", path, err)
+	}
+	now := s.now()
+	for k, e := range s.entries {
+		if now.Sub(e.LastSeen) > s.retention {
+			delete(s.entries, k)
+		}
+	}
+	return s, nil
+}
+
+// Returns the key of a triplet. Addresses are compared case-insensitively.
+func Key(ip, from, to string) string {
+	return ip + "|" + strings.ToLower(from) + "|" + strings.ToLower(to)
+}
+
+// Check the triplet, recording the attempt. Returns true if it is accepted, and the time a retry of a refused triplet
+// will be accepted. The error is only set if the entries could not be persisted; the attempt is recorded regardless.
+func (s *Store) Check(ip, from, to string) (bool, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	key := Key(ip, from, to)
+	entry, ok := s.entries[key]
+	if !ok {
+		s.evict(now)
+	}
+	if !ok || now.Sub(entry.LastSeen) > s.retention {
+		entry = Entry{FirstSeen: now}
+	}
+	entry.LastSeen = now
+	retryAt := entry.FirstSeen.Add(s.delay)
+	if !entry.Passed && !now.Before(retryAt) {
+		entry.Passed = true
+	}
+	s.entries[key] = entry
+	return entry.Passed, retryAt, s.save()
+}
+
+// Returns the number of triplets in the store.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Change the delay, retention and maximum number of entries, keeping the recorded triplets.
+func (s *Store) SetLimits(delay, retention time.Duration, maxEntries int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+	s.retention = retention
+	s.maxEntries = maxEntries
+}
+
+// Make room for a new entry: forget the expired entries once the store is full, then the least recently seen entry if
+// it is still full.
+func (s *Store) evict(now time.Time) {
+	if s.maxEntries <= 0 || len(s.entries) < s.maxEntries {
+		return
+	}
+	for k, e := range s.entries {
+		if now.Sub(e.LastSeen) > s.retention {
+			delete(s.entries, k)
+		}
+	}
+	for len(s.entries) >= s.maxEntries {
+		var oldest string
+		for k, e := range s.entries {
+			if oldest == "" || e.LastSeen.Before(s.entries[oldest].LastSeen) {
+				oldest = k
+			}
+		}
+		delete(s.entries, oldest)
+	}
+}
+
+// Write the entries to the state file, replacing it atomically.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode greylist state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write greylist state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write greylist state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write greylist state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write greylist state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package greylist
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Set the store's clock to the time, returning a function moving it forward.
+func setClock(s *Store, now time.Time) func(d time.Duration) {
+	s.now = func() time.Time { return now }
+	return func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func TestStoreCheck(t *testing.T) {
+	s, err := NewStore(5*time.Minute, 24*time.Hour, 0, "")
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	advance := setClock(s, start)
+
+	// The first attempt and early retries are refused
+	if ok, retryAt, _ := s.Check("192.0.2.10", "alerts@example.com", "ops@example.net"); ok || !retryAt.Equal(start.Add(5*time.Minute)) {
+		t.Fatalf("first attempt: accepted = %v, retry at %s", ok, retryAt)
+	}
+	advance(time.Minute)
+	if ok, _, _ := s.Check("192.0.2.10", "alerts@example.com", "ops@example.net"); ok {
+		t.Fatal("retry before the delay was accepted")
+	}
+
+	// Retries after the delay are accepted, and so are later messages of the triplet
+	advance(4 * time.Minute)
+	if ok, _, _ := s.Check("192.0.2.10", "Alerts@Example.com", "ops@example.net"); !ok {
+		t.Fatal("retry after the delay was refused")
+	}
+	advance(23 * time.Hour)
+	if ok, _, _ := s.Check("192.0.2.10", "alerts@example.com", "ops@example.net"); !ok {
+		t.Fatal("triplet which passed was refused")
+	}
+
+	// Other triplets are greylisted separately
+	if ok, _, _ := s.Check("192.0.2.11", "alerts@example.com", "ops@example.net"); ok {
+		t.Fatal("unseen source IP was accepted")
+	}
+
+	// Triplets unused for the retention are forgotten
+	advance(25 * time.Hour)
+	if ok, _, _ := s.Check("192.0.2.10", "alerts@example.com", "ops@example.net"); ok {
+		t.Fatal("expired triplet was accepted")
+	}
+}
+
+func TestStoreBounded(t *testing.T) {
+	s, err := NewStore(time.Minute, time.Hour, 2, "")
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	advance := setClock(s, time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		s.Check(ip, "alerts@example.com", "ops@example.net")
+		advance(time.Second)
+	}
+	if n := s.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+
+	// The least recently seen triplet was evicted, so it starts over
+	advance(time.Minute)
+	if ok, _, _ := s.Check("192.0.2.1", "alerts@example.com", "ops@example.net"); ok {
+		t.Error("evicted triplet was accepted")
+	}
+	if ok, _, _ := s.Check("192.0.2.3", "alerts@example.com", "ops@example.net"); !ok {
+		t.Error("retained triplet was refused")
+	}
+}
+
+func TestStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	s, err := NewStore(time.Minute, time.Hour, 0, path)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	now := time.Now()
+	setClock(s, now.Add(-2*time.Minute))
+	if _, _, err := s.Check("192.0.2.10", "alerts@example.com", "ops@example.net"); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	// A restarted relay accepts the retry of the triplet
+	s, err = NewStore(time.Minute, time.Hour, 0, path)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if ok, _, _ := s.Check("192.0.2.10", "alerts@example.com", "ops@example.net"); !ok {
+		t.Error("retry after a restart was refused")
+	}
+}
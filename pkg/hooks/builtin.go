@@ -0,0 +1,67 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"html"
+	"strings"
+
+	"github.com/goodieshq/gopostal/pkg/sender"
+)
+
+// Names of the built-in hooks
+const (
+	HookFooterAppender = "footer-appender"
+	HookHeaderInjector = "header-injector"
+)
+
+func init() {
+	Register(HookFooterAppender, newFooterAppender)
+	Register(HookHeaderInjector, newHeaderInjector)
+}
+
+// Appends a footer (option "text") to the body of every message.
+type footerAppender struct {
+	text string
+}
+
+func newFooterAppender(options map[string]string) (Hook, error) {
+	text := options["text"]
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("text: must be defined")
+	}
+	return &footerAppender{text: text}, nil
+}
+
+func (f *footerAppender) OnMessage(ctx context.Context, msg *Message) (*Message, error) {
+	if strings.EqualFold(msg.BodyType, "Text") {
+		msg.Body = append(msg.Body, []byte("\r\n\r\n"+f.text+"\r\n")...)
+		return msg, nil
+	}
+	msg.Body = append(msg.Body, []byte("<p>"+html.EscapeString(f.text)+"</p>")...)
+	if msg.TextBody != "" {
+		msg.TextBody += "\r\n\r\n" + f.text + "\r\n"
+	}
+	return msg, nil
+}
+
+// Adds a header (options "name" and "value") to every message.
+type headerInjector struct {
+	header sender.InternetMessageHeader
+}
+
+func newHeaderInjector(options map[string]string) (Hook, error) {
+	name, value := options["name"], options["value"]
+	if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+		return nil, errors.New("name: must be a valid header name")
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return nil, errors.New("value: must be a single line")
+	}
+	return &headerInjector{header: sender.InternetMessageHeader{Name: name, Value: value}}, nil
+}
+
+func (h *headerInjector) OnMessage(ctx context.Context, msg *Message) (*Message, error) {
+	msg.Headers = append(msg.Headers, h.header)
+	return msg, nil
+}
@@ -0,0 +1,133 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/rs/zerolog/log"
+)
+
+// Message is the message passed through the hooks once it has been parsed, before it is sent. Changes to the body
+// have no effect in MIME passthrough mode, where the message is sent as received with the headers prepended.
+type Message struct {
+	From     string
+	To       []string
+	Subject  string
+	Body     []byte
+	BodyType string // "HTML" (default) or "Text"
+	TextBody string // Plain text alternative of an HTML body, if any
+	Headers  []sender.InternetMessageHeader
+	Username string // Authenticated user who submitted the message, if any
+}
+
+// Hook transforms, or rejects, a message before it is sent. Hooks are called in the order they are configured, each
+// receiving the message returned by the previous hook.
+type Hook interface {
+	OnMessage(ctx context.Context, msg *Message) (*Message, error)
+}
+
+// EmailEnvelope describes a message being sent to the send hooks.
+type EmailEnvelope struct {
+	From      string
+	To        []string
+	Subject   string
+	Size      int    // Size in bytes of the message as received
+	Username  string // Authenticated user who submitted the message, if any
+	Listener  string // Name of the listener which received the message
+	SessionID string // ID of the SMTP session which received the message
+}
+
+// PreSendHook is called right before a message is sent, once it passed every policy. An error aborts the transaction:
+// a Rejection is replied to the client, other errors defer the message.
+type PreSendHook interface {
+	PreSend(ctx context.Context, env *EmailEnvelope) error
+}
+
+// PostSendHook is called once a message was sent, or failed to be, with the error of the sender.
+type PostSendHook interface {
+	PostSend(ctx context.Context, env *EmailEnvelope, err error)
+}
+
+// LoggingPostSendHook logs the outcome of every send with its envelope.
+type LoggingPostSendHook struct{}
+
+func (LoggingPostSendHook) PostSend(ctx context.Context, env *EmailEnvelope, err error) {
+	event, msg := log.Info(), "Email sent"
+	if err != nil {
+		event, msg = log.Error().Err(err), "Email failed to send"
+	}
+	event.Str("session_id", env.SessionID).Str("listener", env.Listener).Str("from", env.From).Strs("to", env.To).
+		Str("subject", env.Subject).Int("size", env.Size).Msg(msg)
+}
+
+// Rejection is returned by a hook to abort the transaction with an SMTP reply.
+type Rejection struct {
+	Code         int
+	EnhancedCode smtp.EnhancedCode
+	Message      string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("message rejected by hook: %d %d.%d.%d %s", r.Code, r.EnhancedCode[0], r.EnhancedCode[1], r.EnhancedCode[2], r.Message)
+}
+
+// Returns the SMTP reply of the rejection.
+func (r *Rejection) SMTPError() *smtp.SMTPError {
+	return &smtp.SMTPError{Code: r.Code, EnhancedCode: r.EnhancedCode, Message: r.Message}
+}
+
+// Reject the message with the SMTP reply.
+func Reject(code int, enhancedCode smtp.EnhancedCode, message string) error {
+	return &Rejection{Code: code, EnhancedCode: enhancedCode, Message: message}
+}
+
+// Factory creates a hook from the options configured for it.
+type Factory func(options map[string]string) (Hook, error)
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Factory{}
+)
+
+// Register the factory of a hook under the name used to configure it. Registering a name again replaces its factory.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[name] = factory
+}
+
+// Create the hook registered under the name with the options.
+func New(name string, options map[string]string) (Hook, error) {
+	mu.RLock()
+	factory, ok := registry[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown hook '%s'", name)
+	}
+	return factory(options)
+}
+
+// Returns the names of the registered hooks, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Returns a copy of the message which hooks can modify without affecting the original.
+func (m *Message) Clone() *Message {
+	c := *m
+	c.To = slices.Clone(m.To)
+	c.Body = slices.Clone(m.Body)
+	c.Headers = slices.Clone(m.Headers)
+	return &c
+}
@@ -0,0 +1,81 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestBuiltinHooksChain(t *testing.T) {
+	footer, err := New(HookFooterAppender, map[string]string{"text": "Sent by <scanner>"})
+	if err != nil {
+		t.Fatalf("New(%s): %v", HookFooterAppender, err)
+	}
+	header, err := New(HookHeaderInjector, map[string]string{"name": "X-Relay-Site", "value": "room-a"})
+	if err != nil {
+		t.Fatalf("New(%s): %v", HookHeaderInjector, err)
+	}
+
+	msg := &Message{Body: []byte("<p>Scan attached</p>"), BodyType: "HTML", TextBody: "Scan attached"}
+	for _, h := range []Hook{footer, header} {
+		if msg, err = h.OnMessage(context.Background(), msg); err != nil {
+			t.Fatalf("OnMessage: %v", err)
+		}
+	}
+	if string(msg.Body) != "<p>Scan attached</p><p>Sent by &lt;scanner&gt;</p>" || !strings.HasSuffix(msg.TextBody, "Sent by <scanner>\r\n") {
+		t.Errorf("body = %q, text body = %q", msg.Body, msg.TextBody)
+	}
+	if len(msg.Headers) != 1 || msg.Headers[0].Name != "X-Relay-Site" || msg.Headers[0].Value != "room-a" {
+		t.Errorf("headers = %+v", msg.Headers)
+	}
+}
+
+func TestNewHookOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		wantErr string
+	}{
+		{HookFooterAppender, nil, "text: must be defined"},
+		{HookHeaderInjector, map[string]string{"name": "X-Bad: name"}, "name: must be a valid header name"},
+		{HookHeaderInjector, map[string]string{"name": "X-Site", "value": "a\r\nBcc: victim@example.com"}, "value: must be a single line"},
+		{"ticketing", nil, "unknown hook 'ticketing'"},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.name, tt.options); err == nil || err.Error() != tt.wantErr {
+			t.Errorf("New(%s, %v): got %v, want %q", tt.name, tt.options, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRejection(t *testing.T) {
+	err := Reject(554, smtp.EnhancedCode{5, 7, 1}, "Ticket queue closed")
+	rejection, ok := err.(*Rejection)
+	if !ok {
+		t.Fatalf("Reject returned %T", err)
+	}
+	if reply := rejection.SMTPError(); reply.Code != 554 || reply.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) || reply.Message != "Ticket queue closed" {
+		t.Errorf("reply = %+v", reply)
+	}
+}
+
+func TestLoggingPostSendHook(t *testing.T) {
+	var logs strings.Builder
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	env := &EmailEnvelope{From: "alerts@example.com", To: []string{"ops@example.net"}, Subject: "Disk usage", Listener: "internal"}
+	LoggingPostSendHook{}.PostSend(context.Background(), env, nil)
+	LoggingPostSendHook{}.PostSend(context.Background(), env, errors.New("503 Service Unavailable"))
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"level":"info"`) || !strings.Contains(lines[0], `"to":["ops@example.net"]`) ||
+		!strings.Contains(lines[1], `"level":"error"`) || !strings.Contains(lines[1], `"error":"503 Service Unavailable"`) {
+		t.Errorf("logs = %s, want the envelope logged with the outcome", logs.String())
+	}
+}
@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"math/rand"
+
+	"github.com/rs/zerolog"
+)
+
+// Sampler decides, once per session, whether the session is logged in full. Sessions which are sampled out only log
+// errors, and warnings if alwaysLogErrors is set (rejected commands and other SMTP errors are logged as warnings).
+type Sampler struct {
+	rate            float64
+	alwaysLogErrors bool
+}
+
+// Create a sampler logging the given fraction (0.0-1.0) of sessions in full.
+func NewSampler(rate float64, alwaysLogErrors bool) *Sampler {
+	return &Sampler{rate: rate, alwaysLogErrors: alwaysLogErrors}
+}
+
+// Returns the logger of a new session: the logger itself if the session is sampled in, or a logger suppressing the
+// events below the minimum level otherwise. A nil sampler logs every session.
+func (s *Sampler) SessionLogger(logger zerolog.Logger) zerolog.Logger {
+	if s == nil || rand.Float64() < s.rate {
+		return logger
+	}
+	min := zerolog.ErrorLevel
+	if s.alwaysLogErrors {
+		min = zerolog.WarnLevel
+	}
+	return logger.Hook(suppressHook{min: min})
+}
+
+// Discards the events below the minimum level
+type suppressHook struct {
+	min zerolog.Level
+}
+
+func (h suppressHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level < h.min {
+		e.Discard()
+	}
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSampler(t *testing.T) {
+	tests := []struct {
+		name            string
+		rate            float64
+		alwaysLogErrors bool
+		minInfo         int
+		maxInfo         int
+	}{
+		{"none", 0, false, 0, 0},
+		{"all", 1, false, 100, 100},
+		{"some", 0.3, false, 10, 50},
+		{"some with warnings", 0.3, true, 10, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			sampler := NewSampler(tt.rate, tt.alwaysLogErrors)
+			for i := 0; i < 100; i++ {
+				logger := sampler.SessionLogger(zerolog.New(&buf)).With().Int("session", i).Logger()
+				logger.Debug().Msg("debug")
+				logger.Info().Msg("info")
+				logger.Warn().Msg("warn")
+				logger.Error().Msg("error")
+			}
+
+			out := buf.String()
+			info := strings.Count(out, `"message":"info"`)
+			if info < tt.minInfo || info > tt.maxInfo {
+				t.Errorf("%d sessions logged at INFO level, want %d to %d", info, tt.minInfo, tt.maxInfo)
+			}
+			if debug := strings.Count(out, `"message":"debug"`); debug != info {
+				t.Errorf("%d sessions logged at DEBUG level, want the %d sampled in sessions", debug, info)
+			}
+			if errors := strings.Count(out, `"message":"error"`); errors != 100 {
+				t.Errorf("%d sessions logged errors, want every session", errors)
+			}
+			wantWarn := info
+			if tt.alwaysLogErrors {
+				wantWarn = 100
+			}
+			if warn := strings.Count(out, `"message":"warn"`); warn != wantWarn {
+				t.Errorf("%d sessions logged warnings, want %d", warn, wantWarn)
+			}
+		})
+	}
+}
+
+func TestNilSampler(t *testing.T) {
+	var buf bytes.Buffer
+	var sampler *Sampler
+	logger := sampler.SessionLogger(zerolog.New(&buf))
+	logger.Info().Msg("info")
+	if !strings.Contains(buf.String(), `"message":"info"`) {
+		t.Error("a nil sampler suppressed an INFO event")
+	}
+}
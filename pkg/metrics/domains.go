@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+)
+
+// Default number of distinct sender domains used as label values
+const DefaultMaxDomainLabels = 100
+
+// Label value of the sender domains beyond the limit
+const OtherDomain = "other"
+
+// Sender domains used as label values so far. The first domains seen are labeled individually and later ones are
+// collapsed into OtherDomain, bounding the cardinality of the labeled metrics.
+var senderDomains = struct {
+	mu      sync.Mutex
+	max     int
+	domains map[string]struct{}
+}{
+	max:     DefaultMaxDomainLabels,
+	domains: map[string]struct{}{},
+}
+
+// Set the number of distinct sender domains used as label values, forgetting the domains seen so far.
+func SetMaxDomainLabels(n int) {
+	senderDomains.mu.Lock()
+	defer senderDomains.mu.Unlock()
+	senderDomains.max = n
+	senderDomains.domains = map[string]struct{}{}
+}
+
+// Returns the sender domain label value of the address: the lowercased part after the last '@', "unknown" for
+// addresses without a domain (e.g. the null sender), or OtherDomain once the limit of distinct domains is reached.
+func SenderDomain(from string) string {
+	at := strings.LastIndexByte(from, '@')
+	if at < 0 || at == len(from)-1 {
+		return "unknown"
+	}
+	domain := strings.ToLower(strings.TrimRight(from[at+1:], ">"))
+
+	senderDomains.mu.Lock()
+	defer senderDomains.mu.Unlock()
+	if _, ok := senderDomains.domains[domain]; ok {
+		return domain
+	}
+	if len(senderDomains.domains) >= senderDomains.max {
+		return OtherDomain
+	}
+	senderDomains.domains[domain] = struct{}{}
+	return domain
+}
+
+// Record a message of the given size sent from the address.
+func ObserveSent(from string, size int) {
+	domain := SenderDomain(from)
+	EmailsSentTotal.WithLabelValues(domain).Inc()
+	EmailSizeBytes.WithLabelValues(domain).Observe(float64(size))
+}
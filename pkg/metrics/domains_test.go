@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"testing"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveSentLabelsSenderDomain(t *testing.T) {
+	SetMaxDomainLabels(2)
+	t.Cleanup(func() { SetMaxDomainLabels(DefaultMaxDomainLabels) })
+	EmailsSentTotal.Reset()
+	EmailSizeBytes.Reset()
+
+	ObserveSent("alerts@example.com", 2048)
+	ObserveSent("reports@Example.NET", 512*1024)
+	ObserveSent("backup@example.com", 4096)
+
+	if n := promtest.CollectAndCount(EmailsSentTotal); n != 2 {
+		t.Errorf("gopostal_emails_sent_total has %d series, want 2", n)
+	}
+	if n := promtest.CollectAndCount(EmailSizeBytes); n != 2 {
+		t.Errorf("gopostal_email_size_bytes has %d series, want 2", n)
+	}
+	if v := promtest.ToFloat64(EmailsSentTotal.WithLabelValues("example.com")); v != 2 {
+		t.Errorf("example.com sent %v messages, want 2", v)
+	}
+	if v := promtest.ToFloat64(EmailsSentTotal.WithLabelValues("example.net")); v != 1 {
+		t.Errorf("example.net sent %v messages, want 1", v)
+	}
+
+	// Domains beyond the limit are collapsed
+	ObserveSent("noreply@example.org", 1024)
+	ObserveSent("noreply@example.io", 1024)
+	if v := promtest.ToFloat64(EmailsSentTotal.WithLabelValues(OtherDomain)); v != 2 {
+		t.Errorf("other sent %v messages, want 2", v)
+	}
+	if n := promtest.CollectAndCount(EmailsSentTotal); n != 3 {
+		t.Errorf("gopostal_emails_sent_total has %d series, want 3", n)
+	}
+}
+
+func TestSenderDomain(t *testing.T) {
+	SetMaxDomainLabels(DefaultMaxDomainLabels)
+	for from, want := range map[string]string{
+		"alerts@Example.com": "example.com",
+		"<ops@example.net>":  "example.net",
+		"":                   "unknown",
+		"postmaster":         "unknown",
+	} {
+		if got := SenderDomain(from); got != want {
+			t.Errorf("SenderDomain(%q) = %q, want %q", from, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Number of source IPs automatically banned after repeated policy violations
+	AutoBlockTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gopostal_auto_block_total",
+		Help: "Total number of source IPs automatically blocked after repeated SMTP policy errors",
+	})
+
+	// Number of NOOP commands received, labeled by whether the reply was delayed
+	NOOPTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopostal_noop_total",
+		Help: "Total number of SMTP NOOP commands received",
+	}, []string{"rate_limited"})
+
+	// Number of messages deferred because the quota of their user or source IP was exhausted, labeled by listener
+	QuotaExceededTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopostal_quota_exceeded_total",
+		Help: "Total number of messages deferred because the daily quota of their sender was exhausted",
+	}, []string{"listener"})
+
+	// Number of recipients refused by greylisting, labeled by listener
+	GreylistedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopostal_greylisted_total",
+		Help: "Total number of recipients temporarily refused by greylisting",
+	}, []string{"listener"})
+
+	// Number of addresses and messages which policy rules in monitor mode would have rejected, labeled by policy
+	// ("valid_from", "valid_to" or "filters") and rule (the verdict of the address policies, the filter name)
+	PolicyWouldRejectTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopostal_policy_would_reject_total",
+		Help: "Total number of addresses and messages which policy rules in monitor mode would have rejected",
+	}, []string{"policy", "rule"})
+
+	// Number of heartbeat messages sent, labeled by result ("success" or "failure")
+	HeartbeatTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopostal_heartbeat_total",
+		Help: "Total number of heartbeat messages sent through the sender",
+	}, []string{"result"})
+
+	// Number of messages received over SMTP, labeled by listener
+	EmailsReceivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopostal_emails_received_total",
+		Help: "Total number of messages received by the SMTP listeners",
+	}, []string{"listener"})
+
+	// Number of SMTP authentication attempts, labeled by listener and result ("success" or "failure")
+	AuthAttemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopostal_auth_attempts_total",
+		Help: "Total number of SMTP authentication attempts",
+	}, []string{"listener", "result"})
+
+	// Number of open SMTP sessions, labeled by listener
+	ActiveSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gopostal_active_sessions",
+		Help: "Number of open SMTP sessions",
+	}, []string{"listener"})
+
+	// Duration of SMTP sessions from the greeting to the disconnection, labeled by listener
+	SessionDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gopostal_session_duration_seconds",
+		Help:    "Duration of SMTP sessions in seconds",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10), // 10ms to ~43m
+	}, []string{"listener"})
+
+	// Number of messages sent, labeled by sender domain
+	EmailsSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopostal_emails_sent_total",
+		Help: "Total number of messages sent through the sender",
+	}, []string{"sender_domain"})
+
+	// Size of the messages sent, labeled by sender domain
+	EmailSizeBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gopostal_email_size_bytes",
+		Help:    "Size of the messages sent through the sender in bytes",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10), // 1 KiB to 256 MiB
+	}, []string{"sender_domain"})
+
+	// Number of sends which waited longer than sender.SlowSlotWait for a mailbox concurrency slot
+	MailboxSlowWaitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gopostal_mailbox_slow_waits_total",
+		Help: "Total number of sends which waited long for one of the concurrency slots of their mailbox",
+	})
+
+	// Number of sendMail calls to Graph in flight
+	GraphConcurrentSends = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gopostal_graph_concurrent_sends",
+		Help: "Number of sendMail calls to the Graph API in flight",
+	})
+
+	// Number of sends waiting for the capacity of their sender, e.g. the concurrency slots of a Graph mailbox, labeled
+	// by the priority of their listener ("high", "normal" or "low")
+	SendQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gopostal_send_queue_depth",
+		Help: "Number of sends waiting for the capacity of their sender",
+	}, []string{"priority"})
+
+	// Time of the last successful heartbeat
+	HeartbeatLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gopostal_heartbeat_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful heartbeat message",
+	})
+)
+
+// Returns the HTTP handler which exposes the registered metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
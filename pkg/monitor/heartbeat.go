@@ -0,0 +1,120 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/rs/zerolog/log"
+)
+
+// Heartbeat periodically sends a synthetic message through the sender and tracks whether delivery works. The service
+// is reported as not ready once the configured number of consecutive heartbeats fail.
+type Heartbeat struct {
+	config *config.HeartbeatConfig
+	sender sender.Sender
+	now    func() time.Time
+
+	mu          sync.Mutex
+	failures    int // consecutive failures
+	lastSuccess time.Time
+}
+
+// Create a new heartbeat sending through the provided sender.
+func NewHeartbeat(cfg *config.HeartbeatConfig, s sender.Sender) *Heartbeat {
+	return &Heartbeat{
+		config: cfg,
+		sender: s,
+		now:    time.Now,
+	}
+}
+
+// Send a heartbeat immediately and then at every interval until the context is cancelled.
+func (h *Heartbeat) Run(ctx context.Context) {
+	log.Info().Dur("interval", h.config.Interval).Str("to", h.config.To).Msg("Starting heartbeat")
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+	for {
+		h.Beat(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send a single heartbeat message and record the result.
+func (h *Heartbeat) Beat(ctx context.Context) error {
+	now := h.now()
+	subject := fmt.Sprintf("%s %s", h.config.SubjectPrefix, now.UTC().Format(time.RFC3339))
+	body := fmt.Sprintf("Heartbeat sent by GoPostal at %s to verify that messages are delivered.", now.UTC().Format(time.RFC1123Z))
+
+	_, err := h.sender.Send(ctx, &sender.Message{
+		From:        h.config.From,
+		To:          []string{h.config.To},
+		Subject:     subject,
+		Body:        []byte(body),
+		SendOptions: sender.SendOptions{BodyType: "Text"},
+	})
+	if ctx.Err() != nil {
+		return ctx.Err() // shutting down, not a delivery failure
+	}
+	h.record(err)
+	return err
+}
+
+func (h *Heartbeat) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		if h.failures >= h.config.FailureThreshold {
+			log.Info().Int("failures", h.failures).Msg("Heartbeat recovered, reporting ready")
+		} else {
+			log.Debug().Msg("Heartbeat sent successfully")
+		}
+		h.failures = 0
+		h.lastSuccess = h.now()
+		metrics.HeartbeatTotal.WithLabelValues("success").Inc()
+		metrics.HeartbeatLastSuccess.Set(float64(h.lastSuccess.Unix()))
+		return
+	}
+
+	h.failures++
+	metrics.HeartbeatTotal.WithLabelValues("failure").Inc()
+	if h.failures >= h.config.FailureThreshold {
+		log.Error().Err(err).Int("failures", h.failures).Time("last_success", h.lastSuccess).Msg("Heartbeat failed repeatedly, reporting not ready")
+	} else {
+		log.Warn().Err(err).Int("failures", h.failures).Msg("Heartbeat failed")
+	}
+}
+
+// Returns true unless the failure threshold of consecutive failed heartbeats has been reached.
+func (h *Heartbeat) Ready() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures < h.config.FailureThreshold
+}
+
+// Returns a readiness handler replying 200 when ready and 503 otherwise: when the heartbeat failed repeatedly or the
+// sender cannot authenticate. A nil heartbeat or sender health is always ready.
+func ReadyHandler(h *Heartbeat, health *sender.Health) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h != nil && !h.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		if !health.Available() {
+			http.Error(w, "not ready: sender authentication failing", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ready\n"))
+	})
+}
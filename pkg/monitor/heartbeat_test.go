@@ -0,0 +1,108 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+)
+
+// Returns a heartbeat sending through the capturing sender, whose clock advances by a minute at every reading.
+func newTestHeartbeat(cs *testutil.CapturingSender, threshold int) *Heartbeat {
+	h := NewHeartbeat(&config.HeartbeatConfig{
+		Interval:         time.Hour,
+		From:             "gopostal@example.com",
+		To:               "ops@example.net",
+		SubjectPrefix:    "[heartbeat]",
+		FailureThreshold: threshold,
+	}, cs)
+	clock := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	h.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+	return h
+}
+
+func readyStatus(h *Heartbeat) int {
+	rec := httptest.NewRecorder()
+	ReadyHandler(h, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return rec.Code
+}
+
+func TestHeartbeatStateTransitions(t *testing.T) {
+	cs := testutil.NewCapturingSender()
+	h := newTestHeartbeat(cs, 2)
+	ctx := context.Background()
+
+	if err := h.Beat(ctx); err != nil {
+		t.Fatalf("Beat: %v", err)
+	}
+	emails := cs.Emails()
+	if len(emails) != 1 || emails[0].Subject != "[heartbeat] 2026-10-16T12:01:00Z" || emails[0].To[0] != "ops@example.net" {
+		t.Fatalf("sent %+v", emails)
+	}
+	if !h.Ready() || !h.lastSuccess.Equal(time.Date(2026, 10, 16, 12, 2, 0, 0, time.UTC)) {
+		t.Errorf("ready = %v, last success = %s after a successful heartbeat", h.Ready(), h.lastSuccess)
+	}
+
+	// Failures below the threshold keep the service ready
+	cs.Err = errors.New("invalid client secret")
+	if err := h.Beat(ctx); err == nil {
+		t.Fatal("Beat succeeded with a failing sender")
+	}
+	if !h.Ready() || readyStatus(h) != http.StatusOK {
+		t.Error("not ready after a single failure")
+	}
+	h.Beat(ctx)
+	if h.Ready() || readyStatus(h) != http.StatusServiceUnavailable {
+		t.Error("ready after reaching the failure threshold")
+	}
+
+	// A single success recovers
+	cs.Err = nil
+	if err := h.Beat(ctx); err != nil {
+		t.Fatalf("Beat: %v", err)
+	}
+	if !h.Ready() || readyStatus(h) != http.StatusOK {
+		t.Error("not ready after the heartbeat recovered")
+	}
+}
+
+func TestHeartbeatCancelled(t *testing.T) {
+	cs := testutil.NewCapturingSender()
+	cs.Err = context.Canceled
+	h := newTestHeartbeat(cs, 1)
+
+	// Heartbeats interrupted by the shutdown are not delivery failures
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h.Beat(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Beat() = %v, want context.Canceled", err)
+	}
+	if !h.Ready() {
+		t.Error("not ready after a heartbeat interrupted by the shutdown")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return once the context was cancelled")
+	}
+}
+
+func TestReadyHandlerWithoutHeartbeat(t *testing.T) {
+	if code := readyStatus(nil); code != http.StatusOK {
+		t.Errorf("status %d without a heartbeat, want 200", code)
+	}
+}
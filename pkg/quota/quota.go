@@ -0,0 +1,194 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Limit on the usage of a key within a window. Zero values do not limit.
+type Limit struct {
+	Messages int
+	Bytes    int64
+}
+
+// Usage of a key within the window starting at Window
+type Usage struct {
+	Window   time.Time `json:"window"`
+	Messages int       `json:"messages"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// Tracker counts the messages and bytes sent per key (an authenticated user or a source IP) within daily windows,
+// which reset every day at the same hour of a time zone. The usage is optionally persisted to a file so it survives
+// restarts.
+type Tracker struct {
+	mu        sync.Mutex
+	limit     Limit
+	overrides map[string]Limit
+	resetHour int
+	location  *time.Location
+	path      string
+	usage     map[string]Usage
+	now       func() time.Time
+}
+
+// Create a new tracker limiting every key to `limit` unless it has an override. The windows reset at `resetHour` in
+// `location`. If `path` is set, the usage of the current windows is loaded from it and saved to it on every change.
+func NewTracker(limit Limit, overrides map[string]Limit, resetHour int, location *time.Location, path string) (*Tracker, error) {
+	t := &Tracker{
+		limit:     limit,
+		overrides: overrides,
+		resetHour: resetHour,
+		location:  location,
+		path:      path,
+		usage:     make(map[string]Usage),
+		now:       time.Now,
+	}
+	if path == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota state: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.usage); err != nil {
+		return nil, fmt.Errorf("failed to parse quota state %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// Returns the limit of the key.
+func (t *Tracker) Limit(key string) Limit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limitOf(key)
+}
+
+func (t *Tracker) limitOf(key string) Limit {
+	if limit, ok := t.overrides[key]; ok {
+		return limit
+	}
+	return t.limit
+}
+
+// Returns true if a message of `size` bytes fits within the remaining quota of the key. The usage is not changed.
+func (t *Tracker) Allow(key string, size int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limit := t.limitOf(key)
+	usage := t.current(key, t.now())
+	if limit.Messages > 0 && usage.Messages+1 > limit.Messages {
+		return false
+	}
+	if limit.Bytes > 0 && usage.Bytes+size > limit.Bytes {
+		return false
+	}
+	return true
+}
+
+// Record a sent message of `size` bytes against the quota of the key. Returns an error only if the usage could not be
+// persisted; it is counted regardless.
+func (t *Tracker) Record(key string, size int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	usage := t.current(key, now)
+	usage.Messages++
+	usage.Bytes += size
+	t.usage[key] = usage
+
+	// Forget the keys of past windows so the tracked keys stay bounded
+	window := t.windowStart(now)
+	for k, u := range t.usage {
+		if u.Window.Before(window) {
+			delete(t.usage, k)
+		}
+	}
+	return t.save()
+}
+
+// Returns the usage of the key within the current window.
+func (t *Tracker) Usage(key string) Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current(key, t.now())
+}
+
+// Returns the time the current window of the tracker ends.
+func (t *Tracker) ResetsAt() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.windowStart(t.now()).AddDate(0, 0, 1)
+}
+
+// Take the limits and the reset time of another tracker, such as the one of a reloaded configuration, keeping the
+// recorded usage.
+func (t *Tracker) Reconfigure(from *Tracker) {
+	from.mu.Lock()
+	limit, overrides, resetHour, location := from.limit, from.overrides, from.resetHour, from.location
+	from.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limit = limit
+	t.overrides = overrides
+	t.resetHour = resetHour
+	t.location = location
+}
+
+// Returns the usage of the key within the window containing now, which is empty once the window has reset.
+func (t *Tracker) current(key string, now time.Time) Usage {
+	window := t.windowStart(now)
+	usage, ok := t.usage[key]
+	if !ok || !usage.Window.Equal(window) {
+		return Usage{Window: window}
+	}
+	return usage
+}
+
+// Returns the start of the window containing the time: the latest reset hour at or before it.
+func (t *Tracker) windowStart(now time.Time) time.Time {
+	local := now.In(t.location)
+	start := time.Date(local.Year(), local.Month(), local.Day(), t.resetHour, 0, 0, 0, t.location)
+	if start.After(local) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// Write the usage to the state file, replacing it atomically.
+func (t *Tracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(t.usage)
+	if err != nil {
+		return fmt.Errorf("failed to encode quota state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write quota state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write quota state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write quota state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return fmt.Errorf("failed to write quota state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package quota
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Set the tracker's clock to the time, returning a function moving it forward.
+func setClock(t *Tracker, now time.Time) func(d time.Duration) {
+	t.now = func() time.Time { return now }
+	return func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func TestTrackerResetBoundary(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	tr, err := NewTracker(Limit{Messages: 2, Bytes: 1000}, nil, 6, loc, "")
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	advance := setClock(tr, time.Date(2026, 3, 10, 5, 58, 0, 0, loc))
+
+	for i := 0; i < 2; i++ {
+		if !tr.Allow("alice", 100) {
+			t.Fatalf("message %d refused", i+1)
+		}
+		tr.Record("alice", 100)
+	}
+	if tr.Allow("alice", 100) {
+		t.Error("third message allowed with a quota of 2 messages")
+	}
+	if !tr.Allow("bob", 100) {
+		t.Error("quota of another key exhausted")
+	}
+	if want := time.Date(2026, 3, 10, 6, 0, 0, 0, loc); !tr.ResetsAt().Equal(want) {
+		t.Errorf("resets at %s, want %s", tr.ResetsAt(), want)
+	}
+
+	// One minute before the reset hour the quota is still exhausted, and restored once it passed
+	advance(time.Minute)
+	if tr.Allow("alice", 100) {
+		t.Error("message allowed before the window reset")
+	}
+	advance(time.Minute)
+	if !tr.Allow("alice", 100) {
+		t.Error("message refused after the window reset")
+	}
+	if u := tr.Usage("alice"); u.Messages != 0 || u.Bytes != 0 {
+		t.Errorf("usage after the reset = %+v, want none", u)
+	}
+}
+
+func TestTrackerBytes(t *testing.T) {
+	tr, err := NewTracker(Limit{Bytes: 1000}, map[string]Limit{"192.0.2.10": {Messages: 1}}, 0, time.UTC, "")
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	setClock(tr, time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+
+	tr.Record("alice", 900)
+	if !tr.Allow("alice", 100) || tr.Allow("alice", 101) {
+		t.Error("byte quota not enforced at its limit")
+	}
+
+	// Overrides replace the default limit
+	if !tr.Allow("192.0.2.10", 5000) {
+		t.Error("override without a byte limit refused a large message")
+	}
+	tr.Record("192.0.2.10", 5000)
+	if tr.Allow("192.0.2.10", 1) {
+		t.Error("override's message limit not enforced")
+	}
+}
+
+func TestTrackerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	now := time.Date(2026, 3, 10, 23, 30, 0, 0, time.UTC)
+
+	tr, err := NewTracker(Limit{Messages: 1}, nil, 0, time.UTC, path)
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	setClock(tr, now)
+	if err := tr.Record("alice", 100); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	// The usage survives a restart within the window
+	restarted, err := NewTracker(Limit{Messages: 1}, nil, 0, time.UTC, path)
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	advance := setClock(restarted, now)
+	if u := restarted.Usage("alice"); u.Messages != 1 || u.Bytes != 100 {
+		t.Errorf("usage after restart = %+v", u)
+	}
+	if restarted.Allow("alice", 1) {
+		t.Error("quota restored by the restart")
+	}
+
+	// But not the reset
+	advance(time.Hour)
+	if !restarted.Allow("alice", 1) {
+		t.Error("persisted usage of the previous window still counted")
+	}
+}
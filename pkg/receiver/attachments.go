@@ -0,0 +1,73 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/sender"
+)
+
+// An attachment removed by the attachment policy and the reason it was removed
+type strippedAttachment struct {
+	Name string
+	Err  error
+}
+
+// Check the attachments against the attachment policy. With the reject action the first violation is returned as an
+// error; with the strip action the offending attachments are removed and returned alongside the remaining ones.
+// Attachments beyond the maximum count are treated as violations in order.
+func (p *Policy) CheckAttachments(attachments []sender.FileAttachment) ([]sender.FileAttachment, []strippedAttachment, error) {
+	ap := p.global.AttachmentPolicy
+	if ap == nil {
+		return attachments, nil, nil
+	}
+
+	var kept []sender.FileAttachment
+	var stripped []strippedAttachment
+	for _, a := range attachments {
+		var err error
+		switch {
+		case ap.Blocks(a.Name, a.ContentType):
+			err = errs.ErrAttachmentBlocked
+		case ap.MaxEach > 0 && len(a.ContentBytes) > ap.MaxEach:
+			err = errs.ErrAttachmentTooLarge
+		case ap.MaxCount > 0 && len(kept) >= ap.MaxCount:
+			err = errs.ErrTooManyAttachments
+		}
+		if err == nil {
+			kept = append(kept, a)
+			continue
+		}
+		if ap.Action == config.AttachmentReject {
+			return nil, nil, err
+		}
+		stripped = append(stripped, strippedAttachment{Name: a.Name, Err: err})
+	}
+	return kept, stripped, nil
+}
+
+// Append a note listing the removed attachments to the body, as a paragraph for HTML bodies.
+func annotateStripped(body []byte, isHTML bool, stripped []strippedAttachment) []byte {
+	var reasons []string
+	for _, s := range stripped {
+		reasons = append(reasons, fmt.Sprintf("%s (%s)", s.Name, strings.ToLower(httpErrorMessage(s.Err))))
+	}
+	note := fmt.Sprintf("[%d attachment(s) removed by policy: %s]", len(stripped), strings.Join(reasons, ", "))
+	return appendNote(body, isHTML, note)
+}
+
+// Append a note to the body, as a paragraph for HTML bodies.
+func appendNote(body []byte, isHTML bool, note string) []byte {
+	var b bytes.Buffer
+	b.Write(body)
+	if isHTML {
+		b.WriteString("\r\n<p>" + html.EscapeString(note) + "</p>")
+	} else {
+		b.WriteString("\r\n\r\n" + note)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,138 @@
+package receiver
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+// A recipient of the current message with the DSN parameters it was submitted with
+type dsnRecipient struct {
+	address string
+	notify  []smtp.DSNNotify
+	orcpt   string // "<type>; <address>" of the ORCPT parameter, if any
+}
+
+// Send a delivery status notification to the envelope sender about the recipients which requested the notification:
+// with smtp.DSNNotifySuccess about those the message was delivered to, with smtp.DSNNotifyFailure about those it
+// failed permanently for, as told by the statuses of the delivery. Notifications are never sent about automatic
+// messages, including other notifications, and are limited per envelope sender. Returns an error only if the
+// notification could not be sent.
+func (s *Session) sendDSN(d *delivery, notify smtp.DSNNotify) error {
+	dsn := &s.configGlobal.DSN
+	if !dsn.Enabled {
+		return nil
+	}
+
+	opts := d.opts
+	report := &email.DSN{
+		ReportingMTA: s.configGlobal.Domain,
+		EnvelopeID:   s.emailEnvelopeID,
+		ArrivalDate:  opts.ReceivedAt,
+	}
+	for _, r := range s.emailRcpts {
+		if !slices.Contains(r.notify, notify) {
+			continue
+		}
+		delivered, permanent := recipientOutcome(d.statuses, r.address)
+		rcpt := email.DSNRecipient{Address: r.address, OriginalRecipient: r.orcpt, Action: email.DSNDelivered, Status: "2.0.0"}
+		switch {
+		case notify == smtp.DSNNotifySuccess && !delivered, notify == smtp.DSNNotifyFailure && !permanent:
+			continue
+		case notify == smtp.DSNNotifyFailure:
+			rcpt.Action, rcpt.Status, rcpt.Diagnostic = email.DSNFailed, "5.0.0", "smtp; 554 5.0.0 Message could not be delivered"
+		}
+		report.Recipients = append(report.Recipients, rcpt)
+	}
+	if len(report.Recipients) == 0 {
+		return nil
+	}
+
+	// Notifications are never sent about bounces (RFC 3461 section 6.2), whose sender was replaced by the mailbox
+	if s.emailNullSender {
+		s.log.Info().Str("notify", string(notify)).Msg("Not sending a delivery status notification about a message with a null sender")
+		return nil
+	}
+	log := s.log.With().Str("notify", string(notify)).Str("to", s.emailFrom).Logger()
+	if email.IsAutoMessage(s.emailHeaders) || strings.EqualFold(s.emailFrom, dsn.From) {
+		log.Info().Msg("Not sending a delivery status notification about an automatic message")
+		return nil
+	}
+	if !dsn.Limiter.Allow(strings.ToLower(s.emailFrom)) {
+		log.Warn().Int("rate_limit", dsn.RateLimit).Msg("Delivery status notification rate limit exceeded, not sending the notification")
+		return nil
+	}
+
+	subject, intro := "Delivery Status Notification (Success)", "was delivered to"
+	if notify == smtp.DSNNotifyFailure {
+		subject, intro = "Delivery Status Notification (Failure)", "could not be delivered to"
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "Your message \"%s\" %s the following recipients:\r\n\r\n", s.emailSubject, intro)
+	for _, r := range report.Recipients {
+		fmt.Fprintf(&body, "    %s\r\n", r.Address)
+	}
+
+	// The original message is returned in full only if requested with RET=FULL
+	original := sender.FileAttachment{
+		ODataType:    "#microsoft.graph.fileAttachment",
+		Name:         "original-headers.txt",
+		ContentType:  "text/rfc822-headers",
+		ContentBytes: email.HeaderSection(d.data),
+	}
+	if s.emailReturn == smtp.DSNReturnFull {
+		original.Name, original.ContentType, original.ContentBytes = "original.eml", "message/rfc822", d.data
+	}
+
+	dsnOpts := sender.SendOptions{
+		BodyType: "Text",
+		// Ask receiving systems not to answer the notification automatically
+		Headers: []sender.InternetMessageHeader{{Name: "X-Auto-Response-Suppress", Value: "All"}},
+		Attachments: []sender.FileAttachment{
+			{
+				ODataType:    "#microsoft.graph.fileAttachment",
+				Name:         "delivery-status.txt",
+				ContentType:  "message/delivery-status",
+				ContentBytes: report.DeliveryStatus(),
+			},
+			original,
+		},
+		SessionID:  opts.SessionID,
+		ReceivedAt: opts.ReceivedAt,
+	}
+	msg := &sender.Message{
+		From:        dsn.From,
+		To:          []string{s.emailFrom},
+		Subject:     subject,
+		Body:        []byte(body.String()),
+		Priority:    s.configListener.SendPriority(),
+		SendOptions: dsnOpts,
+	}
+	if _, err := d.sender.Send(s.sendContext(), msg); err != nil {
+		return fmt.Errorf("failed to send delivery status notification: %w", err)
+	}
+	log.Info().Int("recipients", len(report.Recipients)).Msg("Sent delivery status notification")
+	return nil
+}
+
+// Returns whether the message was delivered to the recipient, and whether it failed permanently for it. A recipient
+// the message was not sent to under its address, as the recipients were rewritten, shares the outcome of the
+// recipients the message was sent to if they all had the same.
+func recipientOutcome(statuses []sender.RecipientStatus, address string) (delivered, permanent bool) {
+	for _, st := range statuses {
+		if strings.EqualFold(st.Address, address) {
+			return st.Err == nil, utils.IsPermanent(st.Err)
+		}
+	}
+	delivered, permanent = len(statuses) > 0, len(statuses) > 0
+	for _, st := range statuses {
+		delivered = delivered && st.Err == nil
+		permanent = permanent && utils.IsPermanent(st.Err)
+	}
+	return delivered, permanent
+}
@@ -0,0 +1,297 @@
+package receiver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+	"github.com/goodieshq/gopostal/pkg/utils"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const dsnConfig = `  domain: relay.example.com
+  dsn:
+    enabled: true
+    from: postmaster@example.com
+`
+
+// Start a relay sending delivery status notifications through the returned capturing sender.
+func startDSNListener(t *testing.T, recv string) (string, *testutil.CapturingSender) {
+	t.Helper()
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfig(t, fg, dsnConfig+recv, "")
+	capture := testutil.NewCapturingSender()
+	cfg.Send.Sender = capture
+	return startListener(t, cfg), capture
+}
+
+// Submit the message to a single recipient with the DSN parameters.
+func submitDSN(addr string, ret smtp.DSNReturn, notify []smtp.DSNNotify, msg string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Mail("alerts@example.com", &smtp.MailOptions{Return: ret, EnvelopeID: "job-42"}); err != nil {
+		return err
+	}
+	if err := c.Rcpt("ops@example.net", &smtp.RcptOptions{Notify: notify}); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func TestSessionDSN(t *testing.T) {
+	permanent := utils.Permanent(errors.New("failed to send email (ErrorInvalidRecipients): invalid recipient"))
+	transient := errors.New("failed to send email: 503 Service Unavailable")
+	tests := []struct {
+		name    string
+		notify  []smtp.DSNNotify
+		sendErr error
+		want    string // subject of the expected notification, if any
+	}{
+		{"no notify", nil, nil, ""},
+		{"never", []smtp.DSNNotify{smtp.DSNNotifyNever}, nil, ""},
+		{"success delivered", []smtp.DSNNotify{smtp.DSNNotifySuccess}, nil, "Delivery Status Notification (Success)"},
+		{"success failed", []smtp.DSNNotify{smtp.DSNNotifySuccess}, permanent, ""},
+		{"failure delivered", []smtp.DSNNotify{smtp.DSNNotifyFailure}, nil, ""},
+		{"failure failed", []smtp.DSNNotify{smtp.DSNNotifyFailure}, permanent, "Delivery Status Notification (Failure)"},
+		{"failure deferred", []smtp.DSNNotify{smtp.DSNNotifyFailure}, transient, ""},
+		{"success and failure delivered", []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure}, nil, "Delivery Status Notification (Success)"},
+		{"success and failure failed", []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure}, permanent, "Delivery Status Notification (Failure)"},
+		{"delay delivered", []smtp.DSNNotify{smtp.DSNNotifyDelayed}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, capture := startDSNListener(t, "")
+			capture.Errs = []error{tt.sendErr}
+
+			err := submitDSN(addr, "", tt.notify, testMessage)
+			if (err != nil) != (tt.sendErr != nil) {
+				t.Fatalf("submit: %v", err)
+			}
+
+			var notifications []testutil.CapturedEmail
+			for _, e := range capture.Emails() {
+				if e.From == "postmaster@example.com" {
+					notifications = append(notifications, e)
+				}
+			}
+			if tt.want == "" {
+				if len(notifications) != 0 {
+					t.Fatalf("sent %d notifications, want none", len(notifications))
+				}
+				return
+			}
+			if len(notifications) != 1 {
+				t.Fatalf("sent %d notifications, want 1", len(notifications))
+			}
+			n := notifications[0]
+			if n.Subject != tt.want || len(n.To) != 1 || n.To[0] != "alerts@example.com" {
+				t.Errorf("notification %q to %v, want %q to alerts@example.com", n.Subject, n.To, tt.want)
+			}
+			action := "Action: delivered"
+			if tt.sendErr != nil {
+				action = "Action: failed"
+			}
+			status := string(n.Options.Attachments[0].ContentBytes)
+			for _, want := range []string{"Reporting-MTA: dns; relay.example.com", "Original-Envelope-Id: job-42", "Final-Recipient: rfc822; ops@example.net", action} {
+				if !strings.Contains(status, want) {
+					t.Errorf("delivery status does not contain %q:\n%s", want, status)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionDSNReturn(t *testing.T) {
+	for _, tt := range []struct {
+		ret         smtp.DSNReturn
+		contentType string
+		body        bool
+	}{
+		{"", "text/rfc822-headers", false},
+		{smtp.DSNReturnHeaders, "text/rfc822-headers", false},
+		{smtp.DSNReturnFull, "message/rfc822", true},
+	} {
+		addr, capture := startDSNListener(t, "")
+		if err := submitDSN(addr, tt.ret, []smtp.DSNNotify{smtp.DSNNotifySuccess}, testMessage); err != nil {
+			t.Fatalf("RET=%s: submit: %v", tt.ret, err)
+		}
+		emails := capture.Emails()
+		if len(emails) != 2 {
+			t.Fatalf("RET=%s: sent %d emails, want the message and a notification", tt.ret, len(emails))
+		}
+		original := emails[1].Options.Attachments[1]
+		if original.ContentType != tt.contentType || !bytes.Contains(original.ContentBytes, []byte("Subject: Disk usage")) ||
+			bytes.Contains(original.ContentBytes, []byte("Disk usage is at 91%")) != tt.body {
+			t.Errorf("RET=%s: returned %s:\n%s", tt.ret, original.ContentType, original.ContentBytes)
+		}
+	}
+}
+
+func TestSessionDSNLoopProtection(t *testing.T) {
+	addr, capture := startDSNListener(t, "")
+	notification := "From: postmaster@example.org\r\nTo: alerts@example.com\r\nSubject: Delivery Status Notification\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n\r\n--b\r\n\r\nDelivered\r\n--b--\r\n"
+	if err := submitDSN(addr, "", []smtp.DSNNotify{smtp.DSNNotifySuccess}, notification); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	autoReply := "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Out of office\r\nAuto-Submitted: auto-replied\r\n\r\nAway\r\n"
+	if err := submitDSN(addr, "", []smtp.DSNNotify{smtp.DSNNotifySuccess}, autoReply); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if n := len(capture.Emails()); n != 2 {
+		t.Errorf("sent %d emails, want only the 2 messages", n)
+	}
+}
+
+func TestSessionDSNRateLimit(t *testing.T) {
+	addr, capture := startDSNListener(t, "    rate_limit: 2\n")
+	for i := 0; i < 4; i++ {
+		if err := submitDSN(addr, "", []smtp.DSNNotify{smtp.DSNNotifySuccess}, testMessage); err != nil {
+			t.Fatalf("submit: %v", err)
+		}
+	}
+	if n := len(capture.Emails()); n != 6 {
+		t.Errorf("sent %d emails, want the 4 messages and 2 notifications", n)
+	}
+}
+
+// A failing side effect defers the sent message only if it is required.
+func TestSessionSideEffectFailure(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		required bool
+		wantCode int
+	}{
+		{"optional", false, 0},
+		{"required", true, 451},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs logBuffer
+			prev := log.Logger
+			log.Logger = zerolog.New(&logs)
+			t.Cleanup(func() { log.Logger = prev })
+
+			addr, capture := startDSNListener(t, fmt.Sprintf("  side_effects:\n    dsn:\n      required: %v\n", tt.required))
+			capture.Errs = []error{nil, errors.New("failed to send email: 503 Service Unavailable")}
+
+			err := submitDSN(addr, "", []smtp.DSNNotify{smtp.DSNNotifySuccess}, testMessage)
+			var smtpErr *smtp.SMTPError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Fatalf("submit: %v", err)
+			case tt.wantCode != 0 && (!errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode):
+				t.Fatalf("submit: got %v, want a %d reply", err, tt.wantCode)
+			}
+			if emails := capture.Emails(); len(emails) != 1 || emails[0].Subject != "Disk usage" {
+				t.Errorf("sent %+v, want only the message", emails)
+			}
+
+			msg := "Side effects failed, accepting the message"
+			if tt.required {
+				msg = "Required side effects failed, deferring the message"
+			}
+			records := logs.Records(t, msg)
+			if len(records) != 1 || fmt.Sprint(records[0]["failed_stages"]) != "[dsn]" {
+				t.Errorf("logged %v, want one record with the failed dsn stage", records)
+			}
+		})
+	}
+}
+
+// Sender capturing the messages it sends, delivering them to each recipient separately and failing for the
+// recipients in failed with their error
+type mixedOutcomeSender struct {
+	*testutil.CapturingSender
+	failed map[string]error
+}
+
+func (m mixedOutcomeSender) Send(ctx context.Context, msg *sender.Message) (*sender.Result, error) {
+	result, err := m.CapturingSender.Send(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	re := &sender.RecipientsError{}
+	for _, to := range msg.To {
+		re.Statuses = append(re.Statuses, sender.RecipientStatus{Address: to, Err: m.failed[to]})
+	}
+	if len(re.Failed()) > 0 {
+		return nil, re
+	}
+	return result, nil
+}
+
+// A message accepted although it was delivered to some of its recipients only is reported to the sender as delivered
+// to those recipients and as failed for the others.
+func TestSessionDSNPartialFailure(t *testing.T) {
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfig(t, fg, dsnConfig+"  partial_failure: succeed_if_any\n", "")
+	capture := mixedOutcomeSender{testutil.NewCapturingSender(), map[string]error{
+		"gone@example.net": utils.Permanent(errors.New("550 5.1.1 mailbox unavailable")),
+	}}
+	cfg.Send.Sender = capture
+	addr := startListener(t, cfg)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("alerts@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"ops@example.net", "gone@example.net"} {
+		if err := c.Rcpt(to, &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("message delivered to some recipients: %v, want it accepted", err)
+	}
+
+	notifications := make(map[string]string)
+	for _, e := range capture.Emails() {
+		if e.From == "postmaster@example.com" {
+			notifications[e.Subject] = string(e.Options.Attachments[0].ContentBytes)
+		}
+	}
+	if len(notifications) != 2 {
+		t.Fatalf("sent notifications %v, want a success and a failure notification", notifications)
+	}
+	for subject, want := range map[string]struct{ recipient, other, action string }{
+		"Delivery Status Notification (Success)": {"ops@example.net", "gone@example.net", "Action: delivered"},
+		"Delivery Status Notification (Failure)": {"gone@example.net", "ops@example.net", "Action: failed"},
+	} {
+		status := notifications[subject]
+		if !strings.Contains(status, "Final-Recipient: rfc822; "+want.recipient) || !strings.Contains(status, want.action) ||
+			strings.Contains(status, want.other) {
+			t.Errorf("%s reports:\n%s\nwant %s only, %s", subject, status, want.recipient, want.action)
+		}
+	}
+}
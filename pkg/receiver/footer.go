@@ -0,0 +1,92 @@
+package receiver
+
+import (
+	"bytes"
+	"html"
+	"slices"
+	"strings"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/email"
+)
+
+// Append the configured footer to the body of messages sent to external recipients, unless the listener or the
+// authenticated user's route skips it.
+func (s *Session) appendFooter(d *delivery) error {
+	footer := s.configSender.Footer
+	if footer == nil || s.configListener.SkipFooter {
+		return nil
+	}
+	if route := s.configSender.RouteFor(s.authenticatedUser); s.authenticated && route != nil && route.SkipFooter {
+		return nil
+	}
+	if allInternal(d.to, footer.InternalDomains) {
+		s.log.Debug().Msg("All recipients are internal, not appending the footer")
+		return nil
+	}
+
+	body, added := withFooter(s.emailBody, d.opts.BodyType == "HTML", footer)
+	if !added {
+		s.log.Debug().Msg("Message already carries the footer")
+		return nil
+	}
+	s.emailBody = body
+	if d.opts.TextBody != "" {
+		text, _ := withFooter([]byte(d.opts.TextBody), false, footer)
+		d.opts.TextBody = string(text)
+	}
+	return nil
+}
+
+// Returns true if every recipient is in one of the internal domains.
+func allInternal(to, domains []string) bool {
+	if len(domains) == 0 {
+		return false
+	}
+	for _, addr := range to {
+		domain := strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+		if !slices.ContainsFunc(domains, func(d string) bool { return strings.EqualFold(d, domain) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the body with the footer appended, the HTML variant before the closing body tag of HTML bodies and the text
+// variant at the end of text bodies, and whether it was appended. Bodies already carrying the marker comment or the
+// text footer are returned unchanged.
+func withFooter(body []byte, isHTML bool, footer *config.FooterConfig) ([]byte, bool) {
+	marker := "<!-- " + footer.Marker + " -->"
+	if bytes.Contains(body, []byte(marker)) {
+		return body, false
+	}
+
+	text := strings.TrimSpace(footer.Text)
+	if text == "" {
+		text = strings.TrimSpace(string(email.HTMLToText([]byte(footer.HTML))))
+	}
+	if !isHTML {
+		if bytes.Contains(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte(text)) {
+			return body, false
+		}
+		var b bytes.Buffer
+		b.Write(bytes.TrimRight(body, "\r\n"))
+		b.WriteString("\r\n\r\n" + strings.ReplaceAll(text, "\n", "\r\n") + "\r\n")
+		return b.Bytes(), true
+	}
+
+	htmlFooter := strings.TrimSpace(footer.HTML)
+	if htmlFooter == "" {
+		htmlFooter = "<p>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>") + "</p>"
+	}
+	insert := []byte("\r\n" + marker + "\r\n" + htmlFooter + "\r\n")
+	end := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if end < 0 {
+		return append(bytes.Clone(body), insert...), true
+	}
+	var b bytes.Buffer
+	b.Write(body[:end])
+	b.Write(insert)
+	b.Write(body[end:])
+	return b.Bytes(), true
+}
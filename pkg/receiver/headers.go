@@ -0,0 +1,58 @@
+package receiver
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+)
+
+var reHeaderField = regexp.MustCompile(`^[!-9;-~]+:`)
+
+// Leniently split a message which could not be parsed as RFC5322 into its header section and body. The header section
+// is the leading run of header fields (including folded continuation lines) and ends at the first blank line or the
+// first line which is not a header field. The body is returned untouched.
+func splitHeaderSection(data []byte) (mail.Header, []byte) {
+	header := make(mail.Header)
+	var name string
+	var value []byte
+
+	flush := func() {
+		if name != "" {
+			key := textproto.CanonicalMIMEHeaderKey(name)
+			header[key] = append(header[key], string(bytes.TrimSpace(value)))
+		}
+		name, value = "", nil
+	}
+
+	rest := data
+	for len(rest) > 0 {
+		line, next, _ := bytes.Cut(rest, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if len(line) == 0 {
+			// blank line terminates the header section
+			rest = next
+			break
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if name == "" {
+				break // continuation without a preceding header, this is body content
+			}
+			// folded header, unfold by joining with a single space
+			value = append(value, ' ')
+			value = append(value, bytes.TrimSpace(line)...)
+		} else if reHeaderField.Match(line) {
+			flush()
+			k, v, _ := bytes.Cut(line, []byte(":"))
+			name, value = string(k), append([]byte(nil), bytes.TrimSpace(v)...)
+		} else {
+			break
+		}
+		rest = next
+	}
+	flush()
+
+	return header, rest
+}
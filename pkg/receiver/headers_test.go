@@ -0,0 +1,70 @@
+package receiver
+
+import (
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+func TestSplitHeaderSection(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		header mail.Header
+		body   string
+	}{
+		{
+			name:   "headers and body",
+			data:   "From: alerts@example.com\r\nSubject: Disk full\r\n\r\nThe disk is full.\r\n",
+			header: mail.Header{"From": {"alerts@example.com"}, "Subject": {"Disk full"}},
+			body:   "The disk is full.\r\n",
+		},
+		{
+			name:   "body line looking like a header",
+			data:   "Subject: Report\r\n\r\nSubject: not a header\r\nTo: nobody\r\n",
+			header: mail.Header{"Subject": {"Report"}},
+			body:   "Subject: not a header\r\nTo: nobody\r\n",
+		},
+		{
+			name:   "folded subject",
+			data:   "Subject: Backup of\r\n  server01\r\n\tfailed\r\nFrom: alerts@example.com\r\n\r\nbody\r\n",
+			header: mail.Header{"Subject": {"Backup of server01 failed"}, "From": {"alerts@example.com"}},
+			body:   "body\r\n",
+		},
+		{
+			name:   "bare LF line endings",
+			data:   "Subject: Report\n  continued\n\nbody\n",
+			header: mail.Header{"Subject": {"Report continued"}},
+			body:   "body\n",
+		},
+		{
+			name:   "header section ended by a line which is not a header",
+			data:   "Subject: Report\r\nthis is the body\r\nSubject: still the body\r\n",
+			header: mail.Header{"Subject": {"Report"}},
+			body:   "this is the body\r\nSubject: still the body\r\n",
+		},
+		{
+			name:   "body only",
+			data:   "  indented text\r\nSubject: in the body\r\n",
+			header: mail.Header{},
+			body:   "  indented text\r\nSubject: in the body\r\n",
+		},
+		{
+			name:   "repeated header",
+			data:   "Received: from a\r\nReceived: from b\r\n\r\n",
+			header: mail.Header{"Received": {"from a", "from b"}},
+			body:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, body := splitHeaderSection([]byte(tt.data))
+			if !reflect.DeepEqual(header, tt.header) {
+				t.Errorf("header = %v, want %v", header, tt.header)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
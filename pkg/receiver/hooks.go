@@ -0,0 +1,74 @@
+package receiver
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/hooks"
+	"github.com/rs/zerolog"
+)
+
+// Pass the message through the configured hooks in order. A hook rejecting the message aborts the transaction with
+// its reply; other failures defer the message, unless the hook fails open and the message continues without its
+// changes.
+func (p *Policy) RunHooks(ctx context.Context, log zerolog.Logger, msg *hooks.Message) (*hooks.Message, error) {
+	for i := range p.global.Hooks {
+		hc := &p.global.Hooks[i]
+		next, err := hc.Hook.OnMessage(ctx, msg.Clone())
+
+		var rejection *hooks.Rejection
+		switch {
+		case errors.As(err, &rejection):
+			log.Warn().Str("hook", hc.Name).Int("code", rejection.Code).Str("reason", rejection.Message).Msg("Message rejected by hook")
+			return nil, rejection.SMTPError()
+		case err != nil && hc.FailOpen:
+			log.Warn().Str("hook", hc.Name).Err(err).Msg("Hook failed, continuing without it")
+		case err != nil:
+			log.Error().Str("hook", hc.Name).Err(err).Msg("Hook failed, deferring message")
+			return nil, p.Reply(errs.ErrHookFailed)
+		case next != nil:
+			msg = next
+		}
+	}
+	return msg, nil
+}
+
+// Describe the message about to be sent to the send hooks.
+func (s *Session) sendEnvelope(d *delivery) *hooks.EmailEnvelope {
+	return &hooks.EmailEnvelope{
+		From:      s.emailFrom,
+		To:        slices.Clone(d.to),
+		Subject:   s.emailSubject,
+		Size:      len(d.data),
+		Username:  s.authenticatedUser,
+		Listener:  s.configListener.Name,
+		SessionID: d.opts.SessionID,
+	}
+}
+
+// Call the pre-send hooks in order. A hook rejecting the message aborts the transaction with its reply; other failures
+// defer the message.
+func (s *Session) runPreSendHooks(env *hooks.EmailEnvelope) error {
+	for i, h := range s.configSender.PreSendHooks {
+		err := h.PreSend(s.ctx, env)
+		var rejection *hooks.Rejection
+		switch {
+		case errors.As(err, &rejection):
+			s.log.Warn().Int("hook", i).Int("code", rejection.Code).Str("reason", rejection.Message).Msg("Message rejected by pre-send hook")
+			return rejection.SMTPError()
+		case err != nil:
+			s.log.Error().Int("hook", i).Err(err).Msg("Pre-send hook failed, deferring message")
+			return s.policy.Reply(errs.ErrHookFailed)
+		}
+	}
+	return nil
+}
+
+// Call the post-send hooks in order with the outcome of the send.
+func (s *Session) runPostSendHooks(env *hooks.EmailEnvelope, err error) {
+	for _, h := range s.configSender.PostSendHooks {
+		h.PostSend(s.ctx, env, err)
+	}
+}
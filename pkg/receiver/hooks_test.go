@@ -0,0 +1,94 @@
+package receiver_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/hooks"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+)
+
+// Hook returning the configured error
+type failingHook struct {
+	err error
+}
+
+func (h failingHook) OnMessage(ctx context.Context, msg *hooks.Message) (*hooks.Message, error) {
+	// Changes made before failing must not reach the sent message
+	msg.Subject = "changed by a failing hook"
+	return nil, h.err
+}
+
+func init() {
+	hooks.Register("test-reject", func(map[string]string) (hooks.Hook, error) {
+		return failingHook{hooks.Reject(554, smtp.EnhancedCode{5, 7, 1}, "Ticket queue closed")}, nil
+	})
+	hooks.Register("test-fail", func(map[string]string) (hooks.Hook, error) {
+		return failingHook{errors.New("ticketing API unreachable")}, nil
+	})
+}
+
+const chainedHooks = `  hooks:
+    - name: footer-appender
+      options:
+        text: "Relayed by GoPostal"
+    - name: header-injector
+      options:
+        name: X-Relay-Site
+        value: room-a
+`
+
+func TestSessionHooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		hooks    string
+		wantCode int    // SMTP reply code of a rejected message
+		wantText string // SMTP reply text of a rejected message
+	}{
+		{"chained", chainedHooks, 0, ""},
+		{"rejection", chainedHooks + "    - name: test-reject\n", 554, "Ticket queue closed"},
+		{"fail closed", chainedHooks + "    - name: test-fail\n", errs.ErrHookFailed.Code, errs.ErrHookFailed.Message},
+		{"fail open", chainedHooks + "    - name: test-fail\n      fail_open: true\n", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			cfg := loadGraphConfig(t, fg, tt.hooks, "")
+			capture := testutil.NewCapturingSender()
+			cfg.Send.Sender = capture
+			addr := startListener(t, cfg)
+
+			err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage))
+			if tt.wantCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || !strings.Contains(smtpErr.Message, tt.wantText) {
+					t.Fatalf("got %v, want a %d reply containing %q", err, tt.wantCode, tt.wantText)
+				}
+				if n := len(capture.Emails()); n != 0 {
+					t.Errorf("sent %d messages, want none", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("submit: %v", err)
+			}
+
+			emails := capture.Emails()
+			if len(emails) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(emails))
+			}
+			sent := emails[0]
+			if sent.Subject != "Disk usage" || !strings.HasSuffix(string(sent.Body), "<p>Relayed by GoPostal</p>") {
+				t.Errorf("sent %q with body %q", sent.Subject, sent.Body)
+			}
+			headers := sent.Options.Headers
+			if len(headers) != 1 || headers[0].Name != "X-Relay-Site" || headers[0].Value != "room-a" {
+				t.Errorf("headers = %+v", headers)
+			}
+		})
+	}
+}
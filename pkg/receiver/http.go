@@ -0,0 +1,366 @@
+package receiver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/hooks"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// JSON message accepted by the HTTP submission API
+type HTTPMessage struct {
+	From        string           `json:"from"`
+	To          []string         `json:"to"`
+	Subject     string           `json:"subject"`
+	Body        string           `json:"body"`
+	ContentType string           `json:"content_type"` // "html" (default) or "text"
+	Attachments []HTTPAttachment `json:"attachments"`
+}
+
+type HTTPAttachment struct {
+	Name         string `json:"name"`
+	ContentType  string `json:"content_type"`
+	ContentBytes []byte `json:"content_bytes"` // base64 encoded
+	ContentID    string `json:"content_id"`
+	IsInline     bool   `json:"is_inline"`
+}
+
+// Response of the HTTP submission API. The ID identifies the submission in the logs like an SMTP session ID.
+type HTTPResponse struct {
+	ID         string                `json:"id,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	Recipients []HTTPRecipientStatus `json:"recipients,omitempty"`
+}
+
+type HTTPRecipientStatus struct {
+	Address string `json:"address"`
+	Status  string `json:"status"` // "accepted", "rejected" or "failed"
+	Code    int    `json:"code"`   // SMTP reply code equivalent
+	Message string `json:"message,omitempty"`
+}
+
+// HTTPHandler accepts messages as JSON and sends them through the configured sender, applying the same policy as the
+// SMTP listeners.
+type HTTPHandler struct {
+	ctx          context.Context
+	configHTTP   *config.HTTPConfig
+	configSender *config.SendConfig
+	configGlobal *config.RecvGlobalConfig
+	policy       *Policy
+}
+
+// Create a new HTTP submission handler serving POST /v1/messages.
+func NewHTTPHandler(ctx context.Context, configHTTP *config.HTTPConfig, configSender *config.SendConfig, configGlobal *config.RecvGlobalConfig) http.Handler {
+	h := &HTTPHandler{
+		ctx:          ctx,
+		configHTTP:   configHTTP,
+		configSender: configSender,
+		configGlobal: configGlobal,
+		policy:       NewPolicy(configGlobal),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/messages", h.handleMessage)
+	return mux
+}
+
+func (h *HTTPHandler) handleMessage(w http.ResponseWriter, r *http.Request) {
+	raddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, "", errs.ErrSourceIPInvalid)
+		return
+	}
+	if err := h.policy.CheckRemote(raddr); err != nil {
+		log.Warn().Str("remote", r.RemoteAddr).Err(err).Msg("HTTP submission rejected by IP policy")
+		writeHTTPError(w, http.StatusForbidden, "", err)
+		return
+	}
+
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gopostal"`)
+		writeHTTPError(w, http.StatusUnauthorized, "", smtp.ErrAuthFailed)
+		return
+	}
+
+	if !h.configSender.Health.Available() {
+		w.Header().Set("Retry-After", "60")
+		writeHTTPError(w, http.StatusServiceUnavailable, "", errs.ErrServiceUnavailable)
+		return
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate session ID")
+		writeHTTPError(w, http.StatusInternalServerError, "", err)
+		return
+	}
+	logger := log.With().
+		Str("session_id", id.String()).
+		Str("remote_addr", r.RemoteAddr).
+		Str("source", "http").
+		Logger()
+
+	// Attachments are base64 encoded in the request, so allow for the encoding overhead on top of the size limit
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.configGlobal.Limits.MaxSize)*4/3+64*1024)
+	var msg HTTPMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeHTTPError(w, http.StatusRequestEntityTooLarge, id.String(), smtp.ErrDataTooLarge)
+			return
+		}
+		logger.Debug().Err(err).Msg("Invalid JSON message")
+		writeHTTPError(w, http.StatusBadRequest, id.String(), errors.New("invalid JSON message: "+err.Error()))
+		return
+	}
+
+	status, resp := h.submit(logger, raddr, id.String(), &msg)
+	resp.ID = id.String()
+	writeHTTPJSON(w, status, resp)
+}
+
+// Apply the policy to the message and send it, returning the HTTP status and response.
+func (h *HTTPHandler) submit(logger zerolog.Logger, raddr net.Addr, id string, msg *HTTPMessage) (int, *HTTPResponse) {
+	msg.From = strings.Trim(msg.From, "<>")
+	if err := h.policy.CheckFrom(msg.From, logger); err != nil {
+		if err == errs.ErrFromDenied {
+			logger.Warn().Str("from", msg.From).Msg("Sender address is denied by configuration")
+		} else {
+			logger.Warn().Str("from", msg.From).Msg("Sender address is not allowed by configuration")
+		}
+		if err != errs.ErrInvalidEmail {
+			h.policy.RecordViolation(raddr, logger)
+		}
+		return httpStatus(err), &HTTPResponse{Error: httpErrorMessage(err)}
+	}
+
+	var bodyType string
+	switch strings.ToLower(msg.ContentType) {
+	case "", "html":
+		bodyType = "HTML"
+	case "text":
+		bodyType = "Text"
+	default:
+		return http.StatusBadRequest, &HTTPResponse{Error: "content_type must be 'html' or 'text'"}
+	}
+
+	size := int64(len(msg.Body))
+	for _, a := range msg.Attachments {
+		size += int64(len(a.ContentBytes))
+	}
+	if err := h.policy.CheckSize(size); err != nil {
+		logger.Warn().Int("max_size", h.configGlobal.Limits.MaxSize).Int64("data_size", size).Msg("Email data exceeds maximum allowed size")
+		return http.StatusRequestEntityTooLarge, &HTTPResponse{Error: httpErrorMessage(err)}
+	}
+
+	// Recipients are checked individually; the message is sent to those which are accepted
+	resp := &HTTPResponse{}
+	var to []string
+	for _, addr := range msg.To {
+		addr = strings.Trim(addr, "<>")
+		err := h.policy.CheckTo(addr, false, logger)
+		if err == nil {
+			err = h.policy.CheckRecipientCount(len(to))
+		} else if err != errs.ErrInvalidEmail {
+			h.policy.RecordViolation(raddr, logger)
+		}
+		if err != nil {
+			logger.Warn().Str("to", addr).Err(err).Msg("Recipient rejected")
+			resp.Recipients = append(resp.Recipients, recipientStatus(addr, "rejected", err))
+			continue
+		}
+		to = append(to, addr)
+		resp.Recipients = append(resp.Recipients, HTTPRecipientStatus{Address: addr, Status: "accepted", Code: 250})
+	}
+	if len(to) == 0 {
+		resp.Error = "no valid recipients"
+		return http.StatusUnprocessableEntity, resp
+	}
+
+	subject := msg.Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	subject = email.TruncateSubject(subject, h.configGlobal.Limits.MaxSubjectLength)
+
+	// Reject or truncate bodies exceeding the body limits
+	body, err := h.policy.CheckBody([]byte(msg.Body), bodyType == "HTML")
+	if err != nil {
+		logger.Warn().Err(err).Int("body_size", len(msg.Body)).Str("subject", subject).Msg("Message rejected by body limits")
+		return httpStatus(err), &HTTPResponse{Error: httpErrorMessage(err)}
+	}
+	if len(body) < len(msg.Body) {
+		logger.Warn().Int("body_size", len(msg.Body)).Int("truncated_size", len(body)).Msg("Message body truncated at the body limits")
+		msg.Body = string(appendNote(body, bodyType == "HTML", truncatedNote))
+	}
+
+	// Strip dangerous markup (scripts, event handlers, unsafe links) from HTML bodies
+	if h.configSender.Sanitizer != nil && bodyType == "HTML" {
+		msg.Body = h.configSender.Sanitizer.Sanitize(msg.Body)
+	}
+
+	// Convert HTML bodies for recipients which cannot render HTML
+	var textBody string
+	if bodyType == "HTML" {
+		switch h.configSender.ForceBodyType {
+		case config.ForceBodyText:
+			msg.Body = string(email.HTMLToText([]byte(msg.Body)))
+			bodyType = "Text"
+		case config.ForceBodyBoth:
+			textBody = string(email.HTMLToText([]byte(msg.Body)))
+		}
+	}
+
+	// Apply the first matching content filter rule
+	if rule := h.policy.MatchFilter(subject, msg.From, []byte(msg.Body), logger); rule != nil {
+		switch rule.Action {
+		case config.FilterReject:
+			logger.Warn().Str("rule", rule.Name).Str("subject", subject).Msg("Message rejected by content filter")
+			return http.StatusForbidden, &HTTPResponse{Error: httpErrorMessage(errs.ErrMessageRejected)}
+		case config.FilterDiscard:
+			logger.Warn().Str("rule", rule.Name).Str("subject", subject).Str("from", msg.From).Strs("to", to).Msg("Message discarded by content filter")
+			return http.StatusOK, resp
+		case config.FilterTag:
+			logger.Info().Str("rule", rule.Name).Msg("Message tagged by content filter")
+			subject = rule.Tag + " " + subject
+		}
+	}
+
+	opts := &sender.SendOptions{BodyType: bodyType, TextBody: textBody, SessionID: id, ReceivedAt: time.Now()}
+	for _, a := range msg.Attachments {
+		opts.Attachments = append(opts.Attachments, sender.FileAttachment{
+			ODataType:    "#microsoft.graph.fileAttachment",
+			Name:         a.Name,
+			ContentType:  a.ContentType,
+			ContentBytes: a.ContentBytes,
+			ContentID:    strings.Trim(a.ContentID, "<>"),
+			IsInline:     a.IsInline,
+		})
+	}
+
+	// Reject or strip attachments violating the attachment policy
+	kept, stripped, err := h.policy.CheckAttachments(opts.Attachments)
+	if err != nil {
+		logger.Warn().Err(err).Str("subject", subject).Msg("Message rejected by attachment policy")
+		return httpStatus(err), &HTTPResponse{Error: httpErrorMessage(err)}
+	}
+	if len(stripped) > 0 {
+		for _, a := range stripped {
+			logger.Warn().Str("attachment", a.Name).Err(a.Err).Msg("Attachment removed by attachment policy")
+		}
+		opts.Attachments = kept
+		msg.Body = string(annotateStripped([]byte(msg.Body), bodyType == "HTML", stripped))
+		if opts.TextBody != "" {
+			opts.TextBody = string(annotateStripped([]byte(opts.TextBody), false, stripped))
+		}
+	}
+
+	// Pass the message through the configured hooks
+	if len(h.configGlobal.Hooks) > 0 {
+		hooked, err := h.policy.RunHooks(h.ctx, logger, &hooks.Message{
+			From:     msg.From,
+			To:       to,
+			Subject:  subject,
+			Body:     []byte(msg.Body),
+			BodyType: opts.BodyType,
+			TextBody: opts.TextBody,
+		})
+		if err != nil {
+			return httpStatus(err), &HTTPResponse{Error: httpErrorMessage(err)}
+		}
+		msg.From, to, subject, msg.Body = hooked.From, hooked.To, hooked.Subject, string(hooked.Body)
+		opts.BodyType, opts.TextBody, opts.Headers = hooked.BodyType, hooked.TextBody, hooked.Headers
+	}
+
+	logger.Info().
+		Str("subject", subject).
+		Str("from", msg.From).
+		Strs("to", to).
+		Msg("Sending email using configured sender")
+
+	out := &sender.Message{From: msg.From, To: to, Subject: subject, Body: []byte(msg.Body), SendOptions: *opts}
+	if _, err := h.configSender.Sender.Send(logger.WithContext(h.ctx), out); err != nil {
+		logger.Error().Err(err).Msg("Failed to send email")
+		for i := range resp.Recipients {
+			if resp.Recipients[i].Status == "accepted" {
+				resp.Recipients[i] = HTTPRecipientStatus{Address: resp.Recipients[i].Address, Status: "failed", Code: 451, Message: err.Error()}
+			}
+		}
+		resp.Error = "failed to send email"
+		return http.StatusBadGateway, resp
+	}
+	metrics.ObserveSent(msg.From, int(size))
+	return http.StatusOK, resp
+}
+
+// Returns true if the request carries the configured bearer token or valid basic auth credentials.
+func (h *HTTPHandler) authorized(r *http.Request) bool {
+	if h.configHTTP.AuthToken != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(h.configHTTP.AuthToken)) == 1 {
+			return true
+		}
+	}
+	if h.configHTTP.BasicAuth {
+		if username, password, ok := r.BasicAuth(); ok && h.configGlobal.Authenticator.Check(username, password) {
+			return true
+		}
+	}
+	return false
+}
+
+func recipientStatus(addr, status string, err error) HTTPRecipientStatus {
+	rs := HTTPRecipientStatus{Address: addr, Status: status, Code: 550, Message: httpErrorMessage(err)}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		rs.Code = smtpErr.Code
+	}
+	return rs
+}
+
+// Map a policy error to an HTTP status code.
+func httpStatus(err error) int {
+	switch err {
+	case errs.ErrInvalidEmail:
+		return http.StatusBadRequest
+	case smtp.ErrDataTooLarge, errs.ErrAttachmentTooLarge, errs.ErrTooManyAttachments, errs.ErrBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errs.ErrHookFailed:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusForbidden
+	}
+}
+
+// Returns the error message without the SMTP reply code.
+func httpErrorMessage(err error) string {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Message
+	}
+	return err.Error()
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, id string, err error) {
+	writeHTTPJSON(w, status, &HTTPResponse{ID: id, Error: httpErrorMessage(err)})
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, resp *HTTPResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,115 @@
+package receiver_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/goodieshq/gopostal/pkg/receiver"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+)
+
+// Start the HTTP submission API of a relay sending through the fake Graph server, accepting mail from example.com
+// to example.net only.
+func startHTTP(t *testing.T, fg *testutil.FakeGraph) string {
+	t.Helper()
+	cfg := loadGraphConfig(t, fg, `
+  valid_from:
+    domains: ["example.com"]
+  valid_to:
+    domains: ["example.net"]
+  http:
+    port: 8025
+    auth_token: test-token
+`, "")
+	srv := httptest.NewServer(receiver.NewHTTPHandler(context.Background(), cfg.Recv.HTTP, &cfg.Send, &cfg.Recv.RecvGlobalConfig))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/v1/messages"
+}
+
+func postMessage(t *testing.T, url, token string, msg *receiver.HTTPMessage) (int, *receiver.HTTPResponse) {
+	t.Helper()
+	data, _ := json.Marshal(msg)
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var resp receiver.HTTPResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return res.StatusCode, &resp
+}
+
+func TestHTTPSubmission(t *testing.T) {
+	fg := newFakeGraph(t)
+	url := startHTTP(t, fg)
+
+	status, resp := postMessage(t, url, "test-token", &receiver.HTTPMessage{
+		From:        "alerts@example.com",
+		To:          []string{"ops@example.net", "ops@example.org"},
+		Subject:     "Disk usage",
+		Body:        "Disk usage is at 91%.",
+		ContentType: "text",
+	})
+	if status != http.StatusOK || resp.ID == "" {
+		t.Fatalf("status %d, response %+v", status, resp)
+	}
+	want := []receiver.HTTPRecipientStatus{
+		{Address: "ops@example.net", Status: "accepted", Code: 250},
+		{Address: "ops@example.org", Status: "rejected", Code: 550},
+	}
+	for i := range resp.Recipients {
+		resp.Recipients[i].Message = ""
+	}
+	if !slices.Equal(resp.Recipients, want) {
+		t.Errorf("recipients = %+v, want %+v", resp.Recipients, want)
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	msg := sent[0].Request.Message
+	if msg.Subject != "Disk usage" || msg.Body.ContentType != "Text" || len(msg.ToRecipients) != 1 || msg.ToRecipients[0].EmailAddress.Address != "ops@example.net" {
+		t.Errorf("sent %+v", msg)
+	}
+}
+
+func TestHTTPSubmissionPolicy(t *testing.T) {
+	fg := newFakeGraph(t)
+	url := startHTTP(t, fg)
+	valid := receiver.HTTPMessage{From: "alerts@example.com", To: []string{"ops@example.net"}, Subject: "Disk usage", Body: "91%"}
+
+	if status, _ := postMessage(t, url, "", &valid); status != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want 401", status)
+	}
+	if status, _ := postMessage(t, url, "wrong-token", &valid); status != http.StatusUnauthorized {
+		t.Errorf("with a wrong token: status %d, want 401", status)
+	}
+
+	from := valid
+	from.From = "alerts@example.org"
+	if status, resp := postMessage(t, url, "test-token", &from); status != http.StatusForbidden || resp.Error == "" {
+		t.Errorf("disallowed sender: status %d, response %+v, want 403", status, resp)
+	}
+
+	to := valid
+	to.To = []string{"ops@example.org"}
+	if status, resp := postMessage(t, url, "test-token", &to); status != http.StatusUnprocessableEntity || resp.Recipients[0].Status != "rejected" {
+		t.Errorf("disallowed recipient: status %d, response %+v, want 422", status, resp)
+	}
+
+	if n := len(fg.Sent()); n != 0 {
+		t.Errorf("sent %d messages, want none", n)
+	}
+}
@@ -0,0 +1,47 @@
+package receiver
+
+import (
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/errs"
+)
+
+// Note appended to bodies truncated at the body limits
+const truncatedNote = "[Message truncated: the body exceeded the size allowed by the relay]"
+
+// Check the body against recv.limits.max_body_size and max_html_elements. With the reject action a body over the
+// limits is returned with errs.ErrBodyTooLarge; with the truncate action it is returned cut at the limits, between
+// HTML tokens or at a character boundary of text bodies.
+func (p *Policy) CheckBody(body []byte, isHTML bool) ([]byte, error) {
+	limits := p.global.Limits
+	cut := email.TextCutOffset(body, limits.MaxBodySize)
+	if isHTML {
+		cut = email.HTMLCutOffset(body, limits.MaxHTMLElements, limits.MaxBodySize)
+	}
+	if cut == len(body) {
+		return body, nil
+	}
+	if limits.BodyLimitAction == config.BodyLimitTruncate {
+		return body[:cut], nil
+	}
+	return body, errs.ErrBodyTooLarge
+}
+
+// Reject or truncate bodies exceeding the body limits, which Graph accepts but mail clients may fail to render.
+func (s *Session) checkBodyLimits(d *delivery) error {
+	isHTML := d.opts.BodyType == "HTML"
+	body, err := s.policy.CheckBody(s.emailBody, isHTML)
+	if err != nil {
+		event := s.logRejection().Err(err).Int("body_size", len(s.emailBody)).Str("subject", s.emailSubject)
+		if isHTML {
+			event = event.Int("html_elements", email.CountHTMLElements(s.emailBody))
+		}
+		event.Msg("Message rejected by body limits")
+		return s.policy.Reply(err)
+	}
+	if len(body) < len(s.emailBody) {
+		s.log.Warn().Int("body_size", len(s.emailBody)).Int("truncated_size", len(body)).Msg("Message body truncated at the body limits")
+		s.emailBody = appendNote(body, isHTML, truncatedNote)
+	}
+	return nil
+}
@@ -2,11 +2,12 @@ package receiver
 
 import (
 	"context"
-	"net"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/goodieshq/gopostal/pkg/config"
 	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/metrics"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
@@ -16,6 +17,7 @@ type Listener struct {
 	configListener *config.ListenerConfig
 	configSender   *config.SendConfig
 	configGlobal   *config.RecvGlobalConfig
+	policy         *Policy
 }
 
 // Create a new listener from the provided listener and receiver global configuration.
@@ -25,32 +27,36 @@ func NewListener(ctx context.Context, configListener *config.ListenerConfig, con
 		configListener: configListener,
 		configSender:   configSender,
 		configGlobal:   configGlobal,
+		policy:         NewPolicy(configGlobal),
 	}
 }
 
 // Create a new SMTP session for each incoming connection. This method checks if the remote address is allowed based on the configuration and returns a new Session object if it is, or an error if it is not.
 func (l *Listener) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	raddr := c.Conn().RemoteAddr()
-	allowed := false
-	ta, ok := raddr.(*net.TCPAddr)
-	if !ok {
-		log.Warn().Str("remote", raddr.String()).Msg("Remote address is not a TCP address, cannot check against allowed networks")
-		return nil, errs.ErrSourceIPInvalid
-	}
-	if len(l.configGlobal.AllowedNets) > 0 {
-		for _, a := range l.configGlobal.AllowedNets {
-			if a.Contains(ta.IP) {
-				allowed = true
-				break
-			}
+	if err := l.policy.CheckRemote(raddr); err != nil {
+		event := log.WithLevel(l.configGlobal.LogLevels.IPRejectionLevel).Str("remote", raddr.String())
+		switch err {
+		case errs.ErrSourceIPInvalid:
+			event.Msg("Remote address is not a TCP address, cannot check against allowed networks")
+		case errs.ErrSourceIPBlocked:
+			event.Msg("Remote address is blocked due to repeated policy violations")
+		default:
+			event.Msg("Remote address is not allowed by configuration")
 		}
-	} else {
-		allowed = true
+		return nil, l.policy.Reply(err)
+	}
+
+	// The session is created by the client's first greeting, whose hostname is available already
+	if err := l.policy.CheckHello(c.Hostname()); err != nil {
+		log.WithLevel(l.configGlobal.LogLevels.PolicyRejectionLevel).Str("remote", raddr.String()).Int("ehlo_length", len(c.Hostname())).Str("ehlo", truncateHello(c.Hostname())).Msg("Rejecting invalid EHLO hostname")
+		return nil, l.policy.Reply(err)
 	}
 
-	if !allowed {
-		log.Warn().Str("remote", raddr.String()).Msg("Remote address is not allowed by configuration")
-		return nil, errs.ErrSourceIPDisallowed
+	// Defer new sessions while the sender cannot authenticate, so clients queue messages on their side
+	if !l.configSender.Health.Available() {
+		log.Warn().Str("remote", raddr.String()).Msg("Sender is unavailable, deferring session")
+		return nil, errs.ErrServiceUnavailable
 	}
 
 	id, err := uuid.NewRandom()
@@ -59,19 +65,48 @@ func (l *Listener) NewSession(c *smtp.Conn) (smtp.Session, error) {
 		return nil, err
 	}
 
-	sessionLogger := log.With().
+	// Sessions sampled out by the log sampler only log errors
+	sessionLogger := l.configGlobal.LogSampler.SessionLogger(log.With().
 		Str("session_id", id.String()).
 		Str("remote_addr", raddr.String()).
-		Logger()
+		Logger())
+
+	// Connections from trusted networks are authenticated by their source IP
+	trusted := l.policy.IsTrusted(raddr)
+	if err := l.policy.CheckLMTP(l.configListener, raddr, trusted); err != nil {
+		log.WithLevel(l.configGlobal.LogLevels.PolicyRejectionLevel).Str("remote", raddr.String()).Msg("Remote address is not in a trusted network, refusing the LMTP session")
+		return nil, l.policy.Reply(err)
+	}
+	if trusted {
+		sessionLogger = sessionLogger.With().Str("auth_method", "ip").Logger()
+		sessionLogger.Info().Msg("Remote address is in a trusted network, treating the session as authenticated")
+	}
 
-	return &Session{
+	session := &Session{
 		ctx:            l.ctx,
 		log:            sessionLogger,
+		connLog:        sessionLogger,
 		id:             id,
+		conn:           c,
 		configListener: l.configListener,
 		configSender:   l.configSender,
 		configGlobal:   l.configGlobal,
+		sender:         l.configSender.NamedSender(l.configListener.Sender),
+		policy:         l.policy,
 		remote:         raddr,
-		authenticated:  false,
-	}, nil
+		started:        time.Now(),
+		authenticated:  trusted,
+	}
+	session.logTLS()
+	metrics.ActiveSessions.WithLabelValues(l.configListener.Name).Inc()
+	return session, nil
+}
+
+// Returns the hostname shortened for logging, as invalid hostnames may be arbitrarily long.
+func truncateHello(hostname string) string {
+	const max = 64
+	if len(hostname) <= max {
+		return hostname
+	}
+	return hostname[:max] + "..."
 }
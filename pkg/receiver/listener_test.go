@@ -0,0 +1,107 @@
+package receiver_test
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Returns the number of observations of the histogram.
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// Session metrics are labeled with the name of the listener which received the session.
+func TestListenerMetricsLabels(t *testing.T) {
+	fg := newFakeGraph(t)
+	certFile, keyFile, err := testutil.WriteSelfSignedCert(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_GRAPH_SECRET", fg.ClientSecret)
+	cfg, err := config.LoadConfigBytes([]byte(`
+recv:
+  listeners:
+    - name: metrics-smtp
+      port: 2525
+      type: smtp
+      require_auth: true
+    - name: metrics-smtps
+      port: 4650
+      type: smtps
+      require_auth: true
+      tls:
+        cert_file: `+certFile+`
+        key_file: `+keyFile+`
+  auth:
+    mode: anonymous
+send:
+  graph:
+    tenant_id: `+fg.TenantID+`
+    client_id: `+fg.ClientID+`
+    client_secret_env: TEST_GRAPH_SECRET
+    login_endpoint: `+fg.URL()+`
+    graph_endpoint: `+fg.URL()+`
+`), true)
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	var addrs []string
+	for i := range cfg.Recv.Listeners {
+		addr, stop, err := testutil.StartListener(ctx, &cfg.Recv.Listeners[i], &cfg.Send, &cfg.Recv.RecvGlobalConfig)
+		if err != nil {
+			t.Fatalf("failed to start listener: %v", err)
+		}
+		t.Cleanup(stop)
+		addrs = append(addrs, addr)
+	}
+
+	if err := testutil.SubmitMessage(addrs[0], sasl.NewAnonymousClient("smtp"), "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Fatalf("SMTP: %v", err)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if err := testutil.SubmitMessageTLS(addrs[1], tlsConfig, sasl.NewAnonymousClient("smtps"), "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Fatalf("SMTPS: %v", err)
+	}
+
+	for _, name := range []string{"metrics-smtp", "metrics-smtps"} {
+		if v := promtest.ToFloat64(metrics.EmailsReceivedTotal.WithLabelValues(name)); v != 1 {
+			t.Errorf("%s: gopostal_emails_received_total = %v, want 1", name, v)
+		}
+		if v := promtest.ToFloat64(metrics.AuthAttemptsTotal.WithLabelValues(name, "success")); v != 1 {
+			t.Errorf("%s: gopostal_auth_attempts_total = %v, want 1", name, v)
+		}
+
+		// Sessions end once the server notices the client disconnected
+		deadline := time.Now().Add(2 * time.Second)
+		for sampleCount(t, metrics.SessionDurationSeconds.WithLabelValues(name)) == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := sampleCount(t, metrics.SessionDurationSeconds.WithLabelValues(name)); n != 1 {
+			t.Errorf("%s: gopostal_session_duration_seconds has %d samples, want 1", name, n)
+		}
+		if v := promtest.ToFloat64(metrics.ActiveSessions.WithLabelValues(name)); v != 0 {
+			t.Errorf("%s: gopostal_active_sessions = %v, want 0", name, v)
+		}
+	}
+	if n := len(fg.Sent()); n != 2 {
+		t.Errorf("sent %d messages, want 2", n)
+	}
+}
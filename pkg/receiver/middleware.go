@@ -0,0 +1,62 @@
+package receiver
+
+// Processing of a message received by DATA. The reply to the client is derived from the returned error.
+type dataHandler func(d *delivery) error
+
+// A step wrapping the processing of a message, which can act before and after calling next or reply without calling
+// it. Sequential steps of preparing and sending the message are stages of the pipeline instead (processStages).
+type dataMiddleware func(s *Session, next dataHandler) dataHandler
+
+// Middlewares wrapping the pipeline of a message received by DATA, outermost first
+var dataMiddlewares = []dataMiddleware{
+	(*Session).limitSize,
+	(*Session).countTransaction,
+	(*Session).addReceived,
+}
+
+// Returns the handler of the messages received by the session: the pipeline wrapped by the middlewares.
+func (s *Session) dataHandler() dataHandler {
+	return chainData(s, s.runPipeline, dataMiddlewares)
+}
+
+// Wrap the handler by the middlewares, so the first one is called first.
+func chainData(s *Session, h dataHandler, middlewares []dataMiddleware) dataHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](s, h)
+	}
+	return h
+}
+
+// Reject messages larger than the maximum size (recv.limits.max_size).
+func (s *Session) limitSize(next dataHandler) dataHandler {
+	return func(d *delivery) error {
+		if err := s.policy.CheckSize(int64(len(d.data))); err != nil {
+			s.logRejection().Int("max_size", s.configGlobal.Limits.MaxSize).Int("data_size", len(d.data)).Msg("Email data exceeds maximum allowed size")
+			return err
+		}
+		return next(d)
+	}
+}
+
+// Count the accepted messages and their size against the limits of the connection.
+func (s *Session) countTransaction(next dataHandler) dataHandler {
+	return func(d *delivery) error {
+		size := int64(len(d.data))
+		if err := next(d); err != nil {
+			return err
+		}
+		s.txnCount++
+		s.txnBytes += size
+		return nil
+	}
+}
+
+// Prepend the Received header to the message if recv.inject_received is set.
+func (s *Session) addReceived(next dataHandler) dataHandler {
+	return func(d *delivery) error {
+		if s.configGlobal.InjectReceived {
+			s.injectReceived(d)
+		}
+		return next(d)
+	}
+}
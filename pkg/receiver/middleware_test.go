@@ -0,0 +1,70 @@
+package receiver
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+)
+
+func TestChainData(t *testing.T) {
+	var calls []string
+	record := func(name string) dataMiddleware {
+		return func(s *Session, next dataHandler) dataHandler {
+			return func(d *delivery) error {
+				calls = append(calls, name+" before")
+				err := next(d)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	h := chainData(nil, func(d *delivery) error {
+		calls = append(calls, "handler")
+		return nil
+	}, []dataMiddleware{record("outer"), record("inner")})
+	if err := h(&delivery{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}; !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestDataMiddlewares(t *testing.T) {
+	s, d := newPipelineSession(t, func(cfg *config.Config) {
+		cfg.Recv.Limits.MaxSize = 4096
+		cfg.Recv.InjectReceived = true
+		cfg.Recv.Domain = "relay.example.com"
+	}, pipelineMessage)
+	size := len(d.data)
+	var handled *delivery
+	h := chainData(s, func(d *delivery) error {
+		handled = d
+		return nil
+	}, dataMiddlewares)
+
+	// The accepted message is counted with its size as received, before the Received header was added
+	if err := h(d); err != nil {
+		t.Fatal(err)
+	}
+	if handled == nil || !strings.HasPrefix(string(handled.data), "Received: from unknown") {
+		t.Errorf("handled %v, want the message with a Received header", handled)
+	}
+	if s.txnCount != 1 || s.txnBytes != int64(size) {
+		t.Errorf("transactions = %d (%d bytes), want 1 (%d bytes)", s.txnCount, s.txnBytes, size)
+	}
+
+	// Messages which are too large, or fail, are not counted
+	handled = nil
+	if err := h(&delivery{data: make([]byte, 4097), opts: d.opts}); err == nil || handled != nil {
+		t.Errorf("oversized message: error = %v, handled = %v", err, handled)
+	}
+	failure := errors.New("failed to send email")
+	h = chainData(s, func(d *delivery) error { return failure }, dataMiddlewares)
+	if err := h(d); !errors.Is(err, failure) || s.txnCount != 1 {
+		t.Errorf("error = %v, transactions = %d, want the handler's error and 1", err, s.txnCount)
+	}
+}
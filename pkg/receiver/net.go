@@ -0,0 +1,133 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/pires/go-proxyproto"
+	"github.com/rs/zerolog/log"
+)
+
+// Returns the network and address a listener binds to.
+func ListenAddr(lc *config.ListenerConfig) (network, addr string) {
+	if lc.IsUnix() {
+		return "unix", lc.SocketPath
+	}
+	return "tcp", lc.Addr
+}
+
+// Create the network listener for the provided listener configuration. Unix domain sockets are created with the
+// configured permissions and ownership, and stale socket files left behind by a previous run are removed first.
+// Listeners with PROXY protocol enabled report the client address from the PROXY header as the remote address.
+func Listen(lc *config.ListenerConfig) (net.Listener, error) {
+	l, err := listen(lc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections from a load balancer carry the real client address in a PROXY protocol header. The header is
+	// required so a client connecting directly cannot bypass the load balancer.
+	if lc.ProxyProtocol {
+		l = &proxyproto.Listener{
+			Listener: l,
+			ConnPolicy: func(proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+				return proxyproto.REQUIRE, nil
+			},
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
+	return l, nil
+}
+
+func listen(lc *config.ListenerConfig) (net.Listener, error) {
+	network, addr := ListenAddr(lc)
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	if err := removeStaleSocket(addr); err != nil {
+		return nil, err
+	}
+
+	// The socket is bound in a private directory and only moved to its path once its permissions and ownership are
+	// set, so no client can connect to it while it still has the permissions of the process umask.
+	dir, err := os.MkdirTemp(filepath.Dir(addr), ".gopostal-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the directory for socket '%s': %w", addr, err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "smtp.sock")
+
+	l, err := net.ListenUnix(network, &net.UnixAddr{Name: tmp, Net: network})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, lc.SocketFileMode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set permissions on socket '%s': %w", addr, err)
+	}
+	if lc.SocketUID != -1 || lc.SocketGID != -1 {
+		if err := os.Chown(tmp, lc.SocketUID, lc.SocketGID); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to set ownership on socket '%s': %w", addr, err)
+		}
+	}
+	if err := os.Rename(tmp, addr); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to move socket into place at '%s': %w", addr, err)
+	}
+	return &unixListener{UnixListener: l, addr: &net.UnixAddr{Name: addr, Net: network}}, nil
+}
+
+// Unix domain socket listener bound under another path and moved to addr. Closing it removes the socket file.
+type unixListener struct {
+	*net.UnixListener
+	addr  *net.UnixAddr
+	close sync.Once
+	err   error
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *unixListener) Close() error {
+	l.close.Do(func() {
+		l.err = l.UnixListener.Close()
+		if err := os.Remove(l.addr.Name); err != nil && !errors.Is(err, os.ErrNotExist) && l.err == nil {
+			l.err = err
+		}
+	})
+	return l.err
+}
+
+// Remove a socket file left behind by a previous process. A socket which still accepts connections is in use and is
+// left in place, as is any path which is not a socket.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("path '%s' exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket '%s' is already in use", path)
+	}
+
+	log.Debug().Str("path", path).Msg("Removing stale socket file")
+	return os.Remove(path)
+}
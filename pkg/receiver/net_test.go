@@ -0,0 +1,124 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+)
+
+// A listener bound to an address of one interface does not accept the connections to the others (127.0.0.2 is another
+// address of the loopback interface on Linux).
+func TestListenBindAddress(t *testing.T) {
+	l, err := Listen(&config.ListenerConfig{Name: "local", Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+	if err != nil {
+		t.Fatalf("connection to the bound address: %v", err)
+	}
+	conn.Close()
+	if conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.2:%d", port), time.Second); err == nil {
+		conn.Close()
+		t.Error("connection to another address was accepted")
+	}
+}
+
+// Backend whose sessions report the data of each message on a channel
+type dataBackend chan []byte
+
+func (b dataBackend) NewSession(c *smtp.Conn) (smtp.Session, error) { return dataSession{b}, nil }
+
+type dataSession struct{ dataBackend }
+
+func (s dataSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	s.dataBackend <- data
+	return err
+}
+
+func (dataSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (dataSession) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+func (dataSession) Reset()                                         {}
+func (dataSession) Logout() error                                  { return nil }
+
+func TestListenUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gopostal.sock")
+	lc := &config.ListenerConfig{Name: "local", SocketPath: path, SocketFileMode: 0620, SocketUID: -1, SocketGID: -1}
+
+	// A stale socket file of a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Addr().String() != path {
+		t.Errorf("listener address = %s, want %s", l.Addr(), path)
+	}
+	// The socket has its permissions as soon as it exists at its path, and the directory it was bound in is gone
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0620 {
+		t.Fatalf("socket file = %v, %v", fi, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory entries = %v, want the socket only", entries)
+	}
+
+	messages := make(dataBackend, 1)
+	srv := smtp.NewServer(messages)
+	srv.Domain = "localhost"
+	go srv.Serve(l)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := smtp.NewClient(conn)
+	msg := "Subject: Over a socket\r\n\r\nHello.\r\n"
+	if err := c.SendMail("app@example.com", []string{"ops@example.com"}, strings.NewReader(msg)); err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	c.Quit()
+	if got := <-messages; string(got) != msg {
+		t.Errorf("message = %q, want %q", got, msg)
+	}
+
+	// A second listener cannot take over the socket in use
+	if _, err := Listen(lc); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("second Listen error = %v", err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file after Close: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package receiver
+
+import (
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/metrics"
+)
+
+// Observer of the transcript of a session which delays NOOP commands once the client exceeds the configured rate.
+// go-smtp answers NOOP itself without calling the session, so the commands are counted as they are read from the
+// connection. Only the plaintext part of a session can be read, so NOOPs sent over TLS are not limited.
+type noopLimiter struct {
+	limit int
+	delay time.Duration
+	seen  []time.Time
+	wait  time.Duration // delay owed for the NOOPs read, applied before the server reads them
+}
+
+func newNOOPLimiter(limit int, delay time.Duration) *noopLimiter {
+	return &noopLimiter{limit: limit, delay: delay}
+}
+
+func (l *noopLimiter) observe(ev *transcriptEvent) {
+	if ev.kind == transcriptCommand && ev.verb == "NOOP" {
+		l.throttle()
+	}
+}
+
+// Record a NOOP and owe the delay before it is answered if the client has exceeded the rate limit within the last
+// minute.
+func (l *noopLimiter) throttle() {
+	now := time.Now()
+	cutoff := now.Add(-time.Minute)
+	recent := l.seen[:0]
+	for _, t := range l.seen {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	l.seen = append(recent, now)
+
+	if len(l.seen) <= l.limit {
+		metrics.NOOPTotal.WithLabelValues("false").Inc()
+		return
+	}
+	metrics.NOOPTotal.WithLabelValues("true").Inc()
+	l.wait += l.delay
+}
+
+// Sleep for the delay owed for the NOOPs read so far.
+func (l *noopLimiter) sleep() {
+	if l.wait > 0 {
+		time.Sleep(l.wait)
+		l.wait = 0
+	}
+}
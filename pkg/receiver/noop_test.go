@@ -0,0 +1,114 @@
+package receiver_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// NOOP commands are counted in the plaintext part of sessions, before STARTTLS on STARTTLS listeners, and lines of
+// message data are not commands.
+func TestNOOPRateLimit(t *testing.T) {
+	const limit, delay = 3, 200 * time.Millisecond
+
+	fg := newFakeGraph(t)
+	certFile, keyFile, err := testutil.WriteSelfSignedCert(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_GRAPH_SECRET", fg.ClientSecret)
+	tlsSettings := `
+      tls:
+        cert_file: ` + certFile + `
+        key_file: ` + keyFile
+	cfg, err := config.LoadConfigBytes([]byte(`
+recv:
+  listeners:
+    - name: noop-smtp
+      port: 2525
+      type: smtp
+    - name: noop-starttls
+      port: 5870
+      type: starttls`+tlsSettings+`
+  auth:
+    mode: disabled
+  noop_rate_limit: 3
+  noop_delay: "200ms"
+send:
+  graph:
+    tenant_id: `+fg.TenantID+`
+    client_id: `+fg.ClientID+`
+    client_secret_env: TEST_GRAPH_SECRET
+    login_endpoint: `+fg.URL()+`
+    graph_endpoint: `+fg.URL()+`
+`), true)
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	for i := range cfg.Recv.Listeners {
+		lc := &cfg.Recv.Listeners[i]
+		t.Run(lc.Name, func(t *testing.T) {
+			addr, stop, err := testutil.StartListener(ctx, lc, &cfg.Send, &cfg.Recv.RecvGlobalConfig)
+			if err != nil {
+				t.Fatalf("failed to start listener: %v", err)
+			}
+			t.Cleanup(stop)
+
+			c, err := smtp.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err := c.Hello("client.example.com"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Message lines reading NOOP are not commands
+			msg := testMessage + strings.Repeat("NOOP\r\n", limit+1)
+			if err := c.SendMail("alerts@example.com", []string{"ops@example.net"}, strings.NewReader(msg)); err != nil {
+				t.Fatalf("SendMail: %v", err)
+			}
+
+			// Commands following a refused DATA are still commands
+			if err := c.Mail("alerts@example.com", nil); err != nil {
+				t.Fatal(err)
+			}
+			if w, err := c.Data(); err == nil {
+				w.Close()
+				t.Fatal("DATA without recipients was accepted")
+			}
+			if err := c.Reset(); err != nil {
+				t.Fatal(err)
+			}
+
+			limited := promtest.ToFloat64(metrics.NOOPTotal.WithLabelValues("true"))
+			for i := 1; i <= limit+2; i++ {
+				start := time.Now()
+				if err := c.Noop(); err != nil {
+					t.Fatalf("NOOP %d: %v", i, err)
+				}
+				elapsed := time.Since(start)
+				if i <= limit && elapsed >= delay {
+					t.Errorf("NOOP %d within the rate limit was delayed by %s", i, elapsed)
+				}
+				if i > limit && elapsed < delay {
+					t.Errorf("NOOP %d beyond the rate limit was replied to after %s, want at least %s", i, elapsed, delay)
+				}
+			}
+			if got := promtest.ToFloat64(metrics.NOOPTotal.WithLabelValues("true")) - limited; got != 2 {
+				t.Errorf("gopostal_noop_total{rate_limited=\"true\"} increased by %v, want 2", got)
+			}
+		})
+	}
+}
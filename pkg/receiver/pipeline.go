@@ -0,0 +1,520 @@
+package receiver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/hooks"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/utils"
+	"github.com/rs/zerolog"
+)
+
+// A message received by DATA passing through the stages of the pipeline. The envelope sender, headers, subject and
+// body are kept on the session.
+type delivery struct {
+	data      []byte   // the message as received
+	to        []string // recipients the message is sent to
+	opts      *sender.SendOptions
+	sender    sender.Sender // sender the message is sent through
+	discarded bool          // set by a stage to accept the message without sending it
+
+	// Outcome of the send for each recipient, set by the send stage
+	statuses []sender.RecipientStatus
+}
+
+// A named step of processing a message. A stage returning an error stops the pipeline, and the error is replied to
+// the client.
+type stage struct {
+	name string
+	run  func(s *Session, d *delivery) error
+}
+
+// Stages preparing and sending the message, in order
+var processStages = []stage{
+	{"parse", (*Session).parseMessage},
+	{"body", (*Session).selectBody},
+	{"limits", (*Session).checkBodyLimits},
+	{"convert", (*Session).convertBody},
+	{"filter", (*Session).filterMessage},
+	{"rewrite", (*Session).rewriteMessage},
+	{"hooks", (*Session).runHooks},
+	{"footer", (*Session).appendFooter},
+	{"mime", (*Session).buildMIME},
+	{"quota", (*Session).checkQuota},
+	{"send", (*Session).sendMessage},
+}
+
+// Stages run once the message was sent, named after the side effects which can be required (recv.side_effects)
+var sideEffectStages = []stage{
+	{config.SideEffectQuota, (*Session).recordQuota},
+	{config.SideEffectMetrics, (*Session).recordSent},
+	{config.SideEffectDSN, (*Session).notifySent},
+	{config.SideEffectArchive, (*Session).sendArchiveCopy},
+}
+
+// Run the message through the processing stages, then through the side effects once it was sent.
+func (s *Session) runPipeline(d *delivery) error {
+	for _, st := range processStages {
+		if err := st.run(s, d); err != nil {
+			s.log.Debug().Err(err).Str("stage", st.name).Msg("Message processing stopped")
+			return err
+		}
+		if d.discarded {
+			return nil
+		}
+	}
+
+	var failed []string
+	for _, st := range sideEffectStages {
+		if err := st.run(s, d); err != nil {
+			s.log.Error().Err(err).Str("stage", st.name).Msg("Side effect failed after the message was sent")
+			failed = append(failed, st.name)
+		}
+	}
+	return s.sideEffectsReply(failed)
+}
+
+// Decide the reply to a sent message from the side effects which failed: the message is accepted unless one of them
+// is required, in which case the client is asked to retry it.
+func (s *Session) sideEffectsReply(failed []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	var required []string
+	for _, name := range failed {
+		if s.configGlobal.SideEffectRequired(name) {
+			required = append(required, name)
+		}
+	}
+	if len(required) > 0 {
+		s.log.Error().Strs("failed_stages", failed).Strs("required_stages", required).Msg("Required side effects failed, deferring the message")
+		return errs.ErrSideEffectFailed
+	}
+	s.log.Warn().Strs("failed_stages", failed).Msg("Side effects failed, accepting the message")
+	return nil
+}
+
+// Parse the message as RFC 5322 and read the headers which are carried over.
+func (s *Session) parseMessage(d *delivery) error {
+	// A 7BIT body must not contain 8-bit data, but the message is forwarded as-is rather than downgraded
+	if s.emailBodyType == smtp.Body7Bit && !isSevenBit(d.data) {
+		s.log.Warn().Msg("Message declared as 7BIT contains 8-bit data")
+	}
+
+	// Parse email message as RFC5322 to extract a clean body
+	if msg, err := mail.ReadMessage(bytes.NewReader(d.data)); err != nil {
+		s.log.Debug().Err(err).Msg("Failed to parse email message as RFC5322")
+		s.emailHeaders, s.emailBody = splitHeaderSection(d.data)
+	} else {
+		s.log.Debug().Msg("Parsed email message as RFC5322 successfully")
+		s.emailHeaders = msg.Header
+
+		bodyBytes, err := io.ReadAll(msg.Body)
+		if err != nil {
+			s.log.Warn().Err(err).Msg("Failed to read email body, using raw data instead")
+			s.emailBody = d.data
+		} else {
+			s.emailBody = bodyBytes
+		}
+	}
+
+	s.emailSubject = "(no subject)"
+	if subject := s.emailHeaders.Get("Subject"); subject != "" {
+		s.emailSubject = email.DecodeSubject(subject, s.emailUTF8)
+	}
+	if truncated := email.TruncateSubject(s.emailSubject, s.configGlobal.Limits.MaxSubjectLength); truncated != s.emailSubject {
+		s.log.Warn().Int("max_subject_length", s.configGlobal.Limits.MaxSubjectLength).Int("subject_length", len(s.emailSubject)).Msg("Truncating subject")
+		s.emailSubject = truncated
+	}
+
+	if s.configGlobal.InjectMessageID && s.emailHeaders.Get("Message-ID") == "" {
+		s.injectMessageID(d)
+	}
+
+	// Carry headers such as the thread context over to the sent message. In MIME passthrough mode the message is sent
+	// with all of its headers.
+	if !s.configSender.MIMEPassthrough {
+		for _, name := range s.configSender.PreserveHeaders {
+			if value := s.emailHeaders.Get(name); value != "" {
+				d.opts.Headers = append(d.opts.Headers, sender.InternetMessageHeader{Name: name, Value: value})
+			}
+		}
+	}
+	return nil
+}
+
+// Add a Message-ID header to a message received without one, so the recipients can deduplicate the message and thread
+// its replies. The header is prepended to the message as received, which is sent as-is in MIME passthrough mode.
+func (s *Session) injectMessageID(d *delivery) {
+	id := fmt.Sprintf("<%s.%d@%s>", s.id, d.opts.ReceivedAt.UnixNano(), s.configGlobal.Domain)
+	d.data = append([]byte("Message-ID: "+id+"\r\n"), d.data...)
+	if s.emailHeaders == nil {
+		s.emailHeaders = mail.Header{}
+	}
+	s.emailHeaders[textproto.CanonicalMIMEHeaderKey("Message-ID")] = []string{id}
+	s.log.Debug().Str("message_id", id).Msg("Added a Message-ID to the message")
+}
+
+// Select the body of multipart messages, carrying the remaining parts as attachments, or decode a single-part body.
+func (s *Session) selectBody(d *delivery) error {
+	opts := d.opts
+	contentType := s.emailHeaders.Get("Content-Type")
+	if !email.IsMultipart(contentType) {
+		// Graph expects decoded UTF-8 content, so quoted-printable and base64 bodies are decoded and legacy charsets
+		// (e.g. ISO-8859-1, Windows-1252) are transcoded
+		body := email.DecodeTransferEncoding(s.emailBody, s.emailHeaders.Get("Content-Transfer-Encoding"))
+		body, err := email.BodyToUTF8(s.emailHeaders, body)
+		if err != nil {
+			s.log.Warn().Err(err).Msg("Failed to convert message body to UTF-8, forwarding it as-is")
+		}
+		s.emailBody = body
+		if email.IsHTML(contentType) {
+			opts.BodyType = "HTML"
+		}
+		return nil
+	}
+
+	body, err := email.ParseMultipart(contentType, s.emailBody, s.configSender.PreferBody)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("Failed to parse multipart message, forwarding the raw body")
+		return nil
+	}
+	s.emailBody = body.Content
+	opts.BodyType = "Text"
+	if body.HTML {
+		opts.BodyType = "HTML"
+	}
+	for _, a := range body.Attachments {
+		opts.Attachments = append(opts.Attachments, sender.FileAttachment{
+			ODataType:    "#microsoft.graph.fileAttachment",
+			Name:         a.Name,
+			ContentType:  a.ContentType,
+			ContentBytes: a.Data,
+			ContentID:    a.ContentID,
+			IsInline:     a.Inline,
+		})
+	}
+	s.log.Debug().Str("body_type", opts.BodyType).Int("attachments", len(opts.Attachments)).
+		Int("inline_images", len(email.ExtractInlineImages(body))).Msg("Parsed multipart message")
+
+	// Reject or strip attachments violating the attachment policy before contacting Graph
+	kept, stripped, err := s.policy.CheckAttachments(opts.Attachments)
+	if err != nil {
+		s.logRejection().Err(err).Str("subject", s.emailSubject).Msg("Message rejected by attachment policy")
+		return s.policy.Reply(err)
+	}
+	if len(stripped) > 0 {
+		for _, a := range stripped {
+			s.log.Warn().Str("attachment", a.Name).Err(a.Err).Msg("Attachment removed by attachment policy")
+		}
+		opts.Attachments = kept
+		s.emailBody = annotateStripped(s.emailBody, body.HTML, stripped)
+	}
+	return nil
+}
+
+// Sanitize HTML bodies and convert them for recipients which cannot render HTML.
+func (s *Session) convertBody(d *delivery) error {
+	opts := d.opts
+	// Strip dangerous markup (scripts, event handlers, unsafe links) from HTML bodies
+	if s.configSender.Sanitizer != nil && opts.BodyType != "Text" {
+		s.emailBody = s.configSender.Sanitizer.SanitizeBytes(s.emailBody)
+	}
+
+	if opts.BodyType == "HTML" {
+		switch s.configSender.ForceBodyType {
+		case config.ForceBodyText:
+			s.emailBody = email.HTMLToText(s.emailBody)
+			opts.BodyType = "Text"
+		case config.ForceBodyBoth:
+			opts.TextBody = string(email.HTMLToText(s.emailBody))
+		}
+	}
+	return nil
+}
+
+// Apply the first matching content filter rule.
+func (s *Session) filterMessage(d *delivery) error {
+	rule := s.policy.MatchFilter(s.emailSubject, s.emailFrom, s.emailBody, s.log)
+	if rule == nil {
+		return nil
+	}
+	switch rule.Action {
+	case config.FilterReject:
+		s.logRejection().Str("rule", rule.Name).Str("subject", s.emailSubject).Msg("Message rejected by content filter")
+		return s.policy.Reply(errs.ErrMessageRejected)
+	case config.FilterDiscard:
+		s.log.Warn().Str("rule", rule.Name).Str("subject", s.emailSubject).Str("from", s.emailFrom).Strs("to", s.emailTo).Msg("Message discarded by content filter")
+		d.discarded = true
+	case config.FilterTag:
+		s.log.Info().Str("rule", rule.Name).Msg("Message tagged by content filter")
+		s.emailSubject = rule.Tag + " " + s.emailSubject
+	}
+	return nil
+}
+
+// Header carrying the identity of the AUTH= parameter of MAIL FROM
+const authenticatedAsHeader = "X-GoPostal-Authenticated-As"
+
+// Header marking the messages submitted with the null reverse-path, whose sender was replaced by the mailbox
+const nullReversePathHeader = "X-Null-Reverse-Path"
+
+// Prefix the subject and replace the recipients as configured for the listener and the authenticated user.
+func (s *Session) rewriteMessage(d *delivery) error {
+	// Tag the subject with the prefixes of the listener and of the authenticated user
+	prefixes := []string{s.configListener.SubjectPrefix}
+	if s.authenticated {
+		prefixes = append(prefixes, s.configGlobal.Auth.SubjectPrefix(s.authenticatedUser))
+	}
+	s.emailSubject = email.PrefixSubject(s.emailSubject, prefixes...)
+
+	// Listeners with forced recipients ignore the envelope recipients, which are recorded in a header instead
+	if len(s.configListener.ForceRecipients) > 0 {
+		d.to = s.configListener.ForceRecipients
+		d.opts.Headers = append(d.opts.Headers, sender.InternetMessageHeader{
+			Name:  "X-Original-To",
+			Value: strings.Join(s.emailTo, ", "),
+		})
+		s.log.Info().Strs("original_to", s.emailTo).Strs("to", d.to).Msg("Replacing recipients with forced recipients")
+	}
+
+	// Tell downstream systems who originally submitted a message relayed with the AUTH= parameter
+	if s.emailAuth != "" {
+		d.opts.Headers = append(d.opts.Headers, sender.InternetMessageHeader{Name: authenticatedAsHeader, Value: s.emailAuth})
+	}
+	if s.emailNullSender {
+		d.opts.Headers = append(d.opts.Headers, sender.InternetMessageHeader{Name: nullReversePathHeader, Value: "yes"})
+	}
+	return nil
+}
+
+// Pass the message through the configured hooks.
+func (s *Session) runHooks(d *delivery) error {
+	if len(s.configGlobal.Hooks) == 0 {
+		return nil
+	}
+	opts := d.opts
+	msg, err := s.policy.RunHooks(s.ctx, s.log, &hooks.Message{
+		From:     s.emailFrom,
+		To:       d.to,
+		Subject:  s.emailSubject,
+		Body:     s.emailBody,
+		BodyType: opts.BodyType,
+		TextBody: opts.TextBody,
+		Headers:  opts.Headers,
+		Username: s.authenticatedUser,
+	})
+	if err != nil {
+		return err
+	}
+	s.emailFrom, d.to, s.emailSubject, s.emailBody = msg.From, msg.To, msg.Subject, msg.Body
+	opts.BodyType, opts.TextBody, opts.Headers = msg.BodyType, msg.TextBody, msg.Headers
+	return nil
+}
+
+// In MIME passthrough mode the message is sent as received, with any added headers prepended, and signed if DKIM is
+// configured.
+func (s *Session) buildMIME(d *delivery) error {
+	if !s.configSender.MIMEPassthrough {
+		return nil
+	}
+	raw, err := s.passthroughMIME(d, d.data)
+	if err != nil {
+		return err
+	}
+	d.opts.MIME = raw
+	return nil
+}
+
+// Prepend the added headers of the delivery to the message data, and sign the result if DKIM is configured.
+func (s *Session) passthroughMIME(d *delivery, data []byte) ([]byte, error) {
+	var raw bytes.Buffer
+	for _, h := range d.opts.Headers {
+		raw.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	raw.Write(data)
+
+	if s.configSender.DKIM != nil {
+		signed, err := s.configSender.DKIM.Signer.Sign(s.ctx, raw.Bytes())
+		if err != nil {
+			s.log.Error().Err(err).Msg("Failed to DKIM sign message")
+			return nil, err
+		}
+		return signed, nil
+	}
+	return raw.Bytes(), nil
+}
+
+// Defer the message if it does not fit within the remaining daily quota of the user or source IP.
+func (s *Session) checkQuota(d *delivery) error {
+	key := quotaKey(s.authenticatedUser, s.remote)
+	if err := s.policy.CheckQuota(key, int64(len(d.data))); err != nil {
+		tracker := s.configGlobal.Quotas.Tracker
+		usage, limit := tracker.Usage(key), tracker.Limit(key)
+		s.logRejection().
+			Str("quota_key", key).
+			Int("messages", usage.Messages).Int("max_messages", limit.Messages).
+			Int64("bytes", usage.Bytes).Int64("max_bytes", limit.Bytes).Int("data_size", len(d.data)).
+			Time("resets_at", tracker.ResetsAt()).
+			Msg("Daily quota exhausted, deferring the message")
+		metrics.QuotaExceededTotal.WithLabelValues(s.configListener.Name).Inc()
+		return s.policy.Reply(err)
+	}
+	return nil
+}
+
+// Send the message through the listener's sender, or the route's sender of an authenticated user with a route.
+func (s *Session) sendMessage(d *delivery) error {
+	d.sender = s.sender
+	if s.authenticated {
+		if routed := s.configSender.SenderFor(s.authenticatedUser); routed != nil {
+			d.sender = routed
+		}
+	}
+
+	env := s.sendEnvelope(d)
+	if err := s.runPreSendHooks(env); err != nil {
+		return err
+	}
+
+	s.log.Info().
+		Str("subject", s.emailSubject).
+		Str("from", s.emailFrom).
+		Strs("to", d.to).
+		Msg("Sending email using configured sender")
+
+	result, err := d.sender.Send(s.sendContext(), s.outgoingMessage(d))
+	s.runPostSendHooks(env, err)
+	if err != nil {
+		s.spillFailure(d, err)
+	}
+	if err != nil && s.ctx.Err() != nil {
+		// The send was interrupted by the shutdown, so the client should retry the message
+		s.log.Warn().Err(err).Msg("Sending interrupted by server shutdown")
+		return errs.ErrShuttingDown
+	}
+	d.statuses = sender.RecipientStatuses(d.to, err)
+	s.logRecipientStatuses(d.statuses)
+
+	// Senders delivering to each recipient separately may fail for some of them only. LMTP replies for each recipient,
+	// so the failed recipients are reported without failing the delivered ones.
+	var partial *sender.RecipientsError
+	if errors.As(err, &partial) && len(partial.Delivered()) > 0 &&
+		(s.configGlobal.PartialFailure == config.PartialFailureSucceedIfAny || s.configListener.Type == config.ListenerLMTP) {
+		s.log.Warn().Strs("delivered", partial.Delivered()).Msg("Email was not sent to every recipient, accepting it")
+		// Unlike LMTP clients, SMTP clients are not told about the failed recipients, whose only report is the
+		// notification
+		if s.configListener.Type != config.ListenerLMTP {
+			if err := s.sendDSN(d, smtp.DSNNotifyFailure); err != nil {
+				s.log.Error().Err(err).Msg("Failed to send delivery status notification")
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		s.log.WithLevel(s.configGlobal.LogLevels.DeliveryFailureLevel).Err(err).Msg("Failed to send email")
+		if utils.IsPermanent(err) {
+			if err := s.sendDSN(d, smtp.DSNNotifyFailure); err != nil {
+				s.log.Error().Err(err).Msg("Failed to send delivery status notification")
+			}
+		}
+		return err
+	}
+	s.log.Debug().Str("message_id", result.MessageID).Int("attempts", result.Attempts).Msg("Email accepted by the sender")
+	return nil
+}
+
+// Returns the message of the delivery, as sent through the sender.
+func (s *Session) outgoingMessage(d *delivery) *sender.Message {
+	metadata := map[string]string{"listener": s.configListener.Name}
+	if s.authenticatedUser != "" {
+		metadata["username"] = s.authenticatedUser
+	}
+	return &sender.Message{
+		From:        s.emailFrom,
+		To:          d.to,
+		Subject:     s.emailSubject,
+		Body:        s.emailBody,
+		Metadata:    metadata,
+		Priority:    s.configListener.SendPriority(),
+		SendOptions: *d.opts,
+	}
+}
+
+// Log the outcome of the send for each recipient in one line, at the level of the delivery failures if any failed.
+func (s *Session) logRecipientStatuses(statuses []sender.RecipientStatus) {
+	level, failed := zerolog.InfoLevel, 0
+	recipients := zerolog.Arr()
+	for _, st := range statuses {
+		entry := zerolog.Dict().Str("address", st.Address)
+		if st.Err != nil {
+			level, failed = s.configGlobal.LogLevels.DeliveryFailureLevel, failed+1
+			entry.Str("status", "failed").Str("error", st.Err.Error())
+		} else {
+			entry.Str("status", "sent")
+		}
+		recipients.Dict(entry)
+	}
+	s.log.WithLevel(level).Array("recipients", recipients).Int("failed", failed).Msg("Recipient outcomes")
+}
+
+// Count the sent message against the daily quota of the user or source IP.
+func (s *Session) recordQuota(d *delivery) error {
+	return s.policy.RecordQuota(quotaKey(s.authenticatedUser, s.remote), int64(len(d.data)))
+}
+
+// Record the sent message in the metrics.
+func (s *Session) recordSent(d *delivery) error {
+	metrics.ObserveSent(s.emailFrom, len(d.data))
+	return nil
+}
+
+// Send the delivery status notification requested for the sent message.
+func (s *Session) notifySent(d *delivery) error {
+	return s.sendDSN(d, smtp.DSNNotifySuccess)
+}
+
+// Send a copy of the sent message to the archive mailbox, addressed to it only as a blind copy.
+func (s *Session) sendArchiveCopy(d *delivery) error {
+	archive := s.configSender.ArchiveBCC
+	if archive == "" {
+		return nil
+	}
+	msg := s.outgoingMessage(d)
+	msg.To, msg.Bcc = nil, []string{archive}
+	msg.Subject = email.PrefixSubject(s.emailSubject, s.configSender.ArchiveBCCLabel)
+	if msg.MIME != nil {
+		// Raw messages are sent to the recipients of their headers, which the copy keeps for reference only
+		raw, err := s.passthroughMIME(d, email.RewriteCopyHeaders(d.data, msg.Subject))
+		if err != nil {
+			return fmt.Errorf("failed to build archive copy: %w", err)
+		}
+		msg.MIME = raw
+	}
+	if _, err := d.sender.Send(s.sendContext(), msg); err != nil {
+		return fmt.Errorf("failed to send archive copy: %w", err)
+	}
+	s.log.Debug().Str("archive", archive).Msg("Sent archive copy")
+	return nil
+}
+
+// Create the delivery of the message which was just received.
+func (s *Session) newDelivery(data []byte) *delivery {
+	return &delivery{
+		data: data,
+		to:   s.emailTo,
+		opts: &sender.SendOptions{SessionID: s.id.String(), ReceivedAt: time.Now()},
+	}
+}
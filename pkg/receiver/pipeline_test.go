@@ -0,0 +1,435 @@
+package receiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/hooks"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/rs/zerolog"
+)
+
+// Sender recording the subjects of the messages, failing with err
+type recordingSender struct {
+	err      error
+	subjects []string
+}
+
+func (r *recordingSender) Authenticate(ctx context.Context) error { return nil }
+
+func (r *recordingSender) Send(ctx context.Context, msg *sender.Message) (*sender.Result, error) {
+	r.subjects = append(r.subjects, msg.Subject)
+	return &sender.Result{Attempts: 1}, r.err
+}
+
+// Create a session of the default configuration, changed by configure before it is validated, which has received the
+// message from alerts@example.com to ops@example.net.
+func newPipelineSession(t *testing.T, configure func(cfg *config.Config), msg string) (*Session, *delivery) {
+	t.Helper()
+	t.Setenv("TEST_GRAPH_SECRET", "secret")
+	cfg := config.GetDefaultConfig()
+	cfg.Send.Graph.TenantID = "tenant"
+	cfg.Send.Graph.ClientID = "client"
+	cfg.Send.Graph.ClientSecretEnv = "TEST_GRAPH_SECRET"
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	s := &Session{
+		ctx:            context.Background(),
+		log:            zerolog.Nop(),
+		connLog:        zerolog.Nop(),
+		configListener: &cfg.Recv.Listeners[0],
+		configSender:   &cfg.Send,
+		configGlobal:   &cfg.Recv.RecvGlobalConfig,
+		sender:         &recordingSender{},
+		policy:         NewPolicy(&cfg.Recv.RecvGlobalConfig),
+		emailFrom:      "alerts@example.com",
+		emailTo:        []string{"ops@example.net"},
+	}
+	return s, s.newDelivery([]byte(msg))
+}
+
+// Run the stages of the pipeline up to the named stage, failing the test if any of them fails.
+func runStagesTo(t *testing.T, s *Session, d *delivery, name string) {
+	t.Helper()
+	for _, st := range processStages {
+		if err := st.run(s, d); err != nil {
+			t.Fatalf("stage %s: %v", st.name, err)
+		}
+		if st.name == name {
+			return
+		}
+	}
+	t.Fatalf("no stage %s", name)
+}
+
+const pipelineMessage = "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Disk usage\r\nMessage-ID: <42@example.com>\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n\r\n<p>Disk usage is at 91%.</p>\r\n"
+
+func TestParseStage(t *testing.T) {
+	s, d := newPipelineSession(t, nil, pipelineMessage)
+	runStagesTo(t, s, d, "parse")
+	if s.emailSubject != "Disk usage" || !strings.Contains(string(s.emailBody), "91%") {
+		t.Errorf("subject = %q, body = %q", s.emailSubject, s.emailBody)
+	}
+	if len(d.opts.Headers) != 1 || d.opts.Headers[0].Name != "Message-ID" || d.opts.Headers[0].Value != "<42@example.com>" {
+		t.Errorf("preserved headers = %+v, want the Message-ID", d.opts.Headers)
+	}
+
+	// A message without a subject is sent with a placeholder
+	s, d = newPipelineSession(t, nil, "From: alerts@example.com\r\n\r\nDisk usage is at 91%.\r\n")
+	runStagesTo(t, s, d, "parse")
+	if s.emailSubject != "(no subject)" {
+		t.Errorf("subject = %q, want (no subject)", s.emailSubject)
+	}
+}
+
+func TestParseStageInjectMessageID(t *testing.T) {
+	inject := func(cfg *config.Config) {
+		cfg.Recv.Domain = "relay.example.com"
+		cfg.Recv.InjectMessageID = true
+	}
+	msg := "From: alerts@example.com\r\nSubject: Scan\r\n\r\nScanned document.\r\n"
+	s, d := newPipelineSession(t, inject, msg)
+	runStagesTo(t, s, d, "parse")
+
+	id := fmt.Sprintf("<%s.%d@relay.example.com>", s.id, d.opts.ReceivedAt.UnixNano())
+	if want := "Message-ID: " + id + "\r\n" + msg; string(d.data) != want {
+		t.Errorf("message = %q, want %q", d.data, want)
+	}
+	if len(d.opts.Headers) != 1 || d.opts.Headers[0].Name != "Message-ID" || d.opts.Headers[0].Value != id {
+		t.Errorf("preserved headers = %+v, want the injected Message-ID", d.opts.Headers)
+	}
+
+	// Messages with a Message-ID are not modified
+	s, d = newPipelineSession(t, inject, pipelineMessage)
+	runStagesTo(t, s, d, "parse")
+	if string(d.data) != pipelineMessage || d.opts.Headers[0].Value != "<42@example.com>" {
+		t.Errorf("message = %q with headers %+v, want it unchanged", d.data, d.opts.Headers)
+	}
+}
+
+func TestBodyStage(t *testing.T) {
+	s, d := newPipelineSession(t, nil, pipelineMessage)
+	runStagesTo(t, s, d, "body")
+	if d.opts.BodyType != "HTML" {
+		t.Errorf("body type = %q, want HTML", d.opts.BodyType)
+	}
+
+	msg := "Subject: Report\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nReport attached.\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=report.pdf\r\n\r\n%PDF-1.4\r\n--b--\r\n"
+	s, d = newPipelineSession(t, nil, msg)
+	runStagesTo(t, s, d, "body")
+	if d.opts.BodyType != "Text" || strings.TrimSpace(string(s.emailBody)) != "Report attached." ||
+		len(d.opts.Attachments) != 1 || d.opts.Attachments[0].Name != "report.pdf" {
+		t.Errorf("body %q (%s) with attachments %+v", s.emailBody, d.opts.BodyType, d.opts.Attachments)
+	}
+}
+
+func TestConvertStage(t *testing.T) {
+	s, d := newPipelineSession(t, func(cfg *config.Config) {
+		cfg.Send.ForceBodyType = config.ForceBodyText
+	}, pipelineMessage)
+	runStagesTo(t, s, d, "convert")
+	if d.opts.BodyType != "Text" || strings.Contains(string(s.emailBody), "<p>") {
+		t.Errorf("body %q (%s), want plain text", s.emailBody, d.opts.BodyType)
+	}
+}
+
+func TestFilterStage(t *testing.T) {
+	for _, tt := range []struct {
+		action      config.FilterAction
+		wantErr     error
+		wantDiscard bool
+		wantSubject string
+	}{
+		{config.FilterReject, errs.ErrMessageRejected, false, "Disk usage"},
+		{config.FilterDiscard, nil, true, "Disk usage"},
+		{config.FilterTag, nil, false, "[DISK] Disk usage"},
+	} {
+		t.Run(string(tt.action), func(t *testing.T) {
+			s, d := newPipelineSession(t, func(cfg *config.Config) {
+				cfg.Recv.Filters = []config.FilterRule{{Name: "disk", MatchSubject: "^Disk", Action: tt.action, Tag: "[DISK]"}}
+			}, pipelineMessage)
+			runStagesTo(t, s, d, "convert")
+			err := s.filterMessage(d)
+			if !errors.Is(err, tt.wantErr) || d.discarded != tt.wantDiscard || s.emailSubject != tt.wantSubject {
+				t.Errorf("error = %v, discarded = %v, subject = %q", err, d.discarded, s.emailSubject)
+			}
+		})
+	}
+}
+
+func TestRewriteStage(t *testing.T) {
+	s, d := newPipelineSession(t, func(cfg *config.Config) {
+		cfg.Recv.Listeners[0].SubjectPrefix = "[ROOM-A]"
+		cfg.Recv.Listeners[0].ForceRecipients = []string{"noc@example.net"}
+	}, pipelineMessage)
+	runStagesTo(t, s, d, "rewrite")
+	if s.emailSubject != "[ROOM-A] Disk usage" {
+		t.Errorf("subject = %q", s.emailSubject)
+	}
+	if len(d.to) != 1 || d.to[0] != "noc@example.net" {
+		t.Errorf("recipients = %v, want the forced recipient", d.to)
+	}
+	if h := d.opts.Headers[len(d.opts.Headers)-1]; h.Name != "X-Original-To" || h.Value != "ops@example.net" {
+		t.Errorf("last header = %+v, want the original recipients", h)
+	}
+}
+
+func TestFooterStage(t *testing.T) {
+	withFooter := func(cfg *config.Config) {
+		cfg.Send.Footer = &config.FooterConfig{
+			Text:            "This message is confidential.",
+			HTML:            "<p><em>This message is confidential.</em></p>",
+			InternalDomains: []string{"example.com"},
+		}
+	}
+	textMessage := "Subject: Backup\r\n\r\nBackup completed.\r\n"
+	htmlMessage := "Subject: Backup\r\nContent-Type: text/html\r\n\r\n<html><body><p>Backup completed.</p></body></html>\r\n"
+
+	tests := []struct {
+		name      string
+		configure func(cfg *config.Config)
+		msg       string
+		to        []string
+		want      string // body after the footer stage
+	}{
+		{"text", withFooter, textMessage, nil, "Backup completed.\r\n\r\nThis message is confidential.\r\n"},
+		{"html", withFooter, htmlMessage, nil,
+			"<html><body><p>Backup completed.</p>\r\n<!-- gopostal-footer -->\r\n<p><em>This message is confidential.</em></p>\r\n</body></html>\r\n"},
+		{"text already carrying the footer", withFooter, "Subject: Backup\r\n\r\nBackup completed.\r\n\r\nThis message is confidential.\r\n", nil,
+			"Backup completed.\r\n\r\nThis message is confidential.\r\n"},
+		{"html already carrying the marker", withFooter, "Subject: Backup\r\nContent-Type: text/html\r\n\r\n<p>Backup completed.</p><!-- gopostal-footer --><p>Old footer</p>\r\n", nil,
+			"<p>Backup completed.</p><!-- gopostal-footer --><p>Old footer</p>\r\n"},
+		{"internal recipients", withFooter, textMessage, []string{"ops@example.com", "dba@EXAMPLE.com"}, "Backup completed.\r\n"},
+		{"skipped by the listener", func(cfg *config.Config) {
+			withFooter(cfg)
+			cfg.Recv.Listeners[0].SkipFooter = true
+		}, textMessage, nil, "Backup completed.\r\n"},
+		{"html derived from the text", func(cfg *config.Config) {
+			cfg.Send.Footer = &config.FooterConfig{Text: "Confidential <internal>"}
+		}, htmlMessage, nil, "<html><body><p>Backup completed.</p>\r\n<!-- gopostal-footer -->\r\n<p>Confidential &lt;internal&gt;</p>\r\n</body></html>\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, d := newPipelineSession(t, tt.configure, tt.msg)
+			if tt.to != nil {
+				s.emailTo, d.to = tt.to, tt.to
+			}
+			runStagesTo(t, s, d, "footer")
+			if string(s.emailBody) != tt.want {
+				t.Errorf("body = %q, want %q", s.emailBody, tt.want)
+			}
+		})
+	}
+}
+
+func TestMIMEStage(t *testing.T) {
+	s, d := newPipelineSession(t, func(cfg *config.Config) {
+		cfg.Send.MIMEPassthrough = true
+	}, pipelineMessage)
+	s.emailAuth = "app@example.com"
+	runStagesTo(t, s, d, "mime")
+	if want := "X-GoPostal-Authenticated-As: app@example.com\r\n" + pipelineMessage; string(d.opts.MIME) != want {
+		t.Errorf("MIME = %q, want %q", d.opts.MIME, want)
+	}
+}
+
+func TestSendStage(t *testing.T) {
+	s, d := newPipelineSession(t, nil, pipelineMessage)
+	runStagesTo(t, s, d, "send")
+	if snd := s.sender.(*recordingSender); d.sender != s.sender || len(snd.subjects) != 1 || snd.subjects[0] != "Disk usage" {
+		t.Errorf("sent %v through %v", snd.subjects, d.sender)
+	}
+
+	s, d = newPipelineSession(t, nil, pipelineMessage)
+	failure := errors.New("failed to send email: 503 Service Unavailable")
+	s.sender = &recordingSender{err: failure}
+	runStagesTo(t, s, d, "mime")
+	if err := s.sendMessage(d); !errors.Is(err, failure) {
+		t.Errorf("error = %v, want the sender's error", err)
+	}
+}
+
+func TestSendStagePartialFailure(t *testing.T) {
+	rejected := errors.New("550 5.1.1 mailbox unavailable")
+	mixed := &sender.RecipientsError{Statuses: []sender.RecipientStatus{
+		{Address: "ops@example.net"},
+		{Address: "gone@example.net", Err: rejected},
+	}}
+	tests := []struct {
+		name    string
+		policy  string
+		err     error
+		wantErr bool
+	}{
+		{"fail if any", config.PartialFailureFailIfAny, mixed, true},
+		{"succeed if any", config.PartialFailureSucceedIfAny, mixed, false},
+		{"succeed if any, none sent", config.PartialFailureSucceedIfAny, &sender.RecipientsError{Statuses: []sender.RecipientStatus{
+			{Address: "ops@example.net", Err: rejected},
+			{Address: "gone@example.net", Err: rejected},
+		}}, true},
+		{"succeed if any, single error", config.PartialFailureSucceedIfAny, rejected, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, d := newPipelineSession(t, func(cfg *config.Config) { cfg.Recv.PartialFailure = tt.policy }, pipelineMessage)
+			var logs strings.Builder
+			s.log = zerolog.New(&logs)
+			s.sender = &recordingSender{err: tt.err}
+			d.to = []string{"ops@example.net", "gone@example.net"}
+			runStagesTo(t, s, d, "mime")
+
+			err := s.sendMessage(d)
+			if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, rejected) {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !strings.Contains(logs.String(), `"message":"Recipient outcomes"`) ||
+				!strings.Contains(logs.String(), `{"address":"gone@example.net","status":"failed","error":"550 5.1.1 mailbox unavailable"}`) {
+				t.Errorf("logs = %s, want the outcome of each recipient", logs.String())
+			}
+		})
+	}
+}
+
+// Send hook recording its calls under its name, failing before sending with err
+type recordingSendHook struct {
+	name  string
+	calls *[]string
+	err   error
+}
+
+func (h recordingSendHook) PreSend(ctx context.Context, env *hooks.EmailEnvelope) error {
+	*h.calls = append(*h.calls, h.name+" pre "+env.Subject)
+	return h.err
+}
+
+func (h recordingSendHook) PostSend(ctx context.Context, env *hooks.EmailEnvelope, err error) {
+	*h.calls = append(*h.calls, fmt.Sprintf("%s post %v", h.name, err))
+}
+
+func TestSendHooks(t *testing.T) {
+	var calls []string
+	first, second := recordingSendHook{name: "first", calls: &calls}, recordingSendHook{name: "second", calls: &calls}
+	failure := errors.New("503 Service Unavailable")
+	s, d := newPipelineSession(t, func(cfg *config.Config) {
+		cfg.Send.PreSendHooks = []hooks.PreSendHook{first, second}
+		cfg.Send.PostSendHooks = []hooks.PostSendHook{first, second}
+	}, pipelineMessage)
+	s.sender = &recordingSender{err: failure}
+	runStagesTo(t, s, d, "mime")
+	if err := s.sendMessage(d); !errors.Is(err, failure) {
+		t.Fatalf("error = %v, want the sender's error", err)
+	}
+	want := []string{"first pre Disk usage", "second pre Disk usage", "first post " + failure.Error(), "second post " + failure.Error()}
+	if !slices.Equal(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+
+	// A failing pre-send hook stops the message before it is sent
+	calls = nil
+	rejecting := recordingSendHook{name: "rejecting", calls: &calls, err: hooks.Reject(554, smtp.EnhancedCode{5, 7, 1}, "Outside business hours")}
+	failing := recordingSendHook{name: "failing", calls: &calls, err: errors.New("ticket API unavailable")}
+	for _, tt := range []struct {
+		hook     recordingSendHook
+		wantCode int
+	}{{rejecting, 554}, {failing, 451}} {
+		s, d := newPipelineSession(t, func(cfg *config.Config) {
+			cfg.Send.PreSendHooks = []hooks.PreSendHook{tt.hook, second}
+			cfg.Send.PostSendHooks = []hooks.PostSendHook{second}
+		}, pipelineMessage)
+		runStagesTo(t, s, d, "mime")
+		var smtpErr *smtp.SMTPError
+		if err := s.sendMessage(d); !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+			t.Errorf("%s: error = %v, want a %d reply", tt.hook.name, err, tt.wantCode)
+		}
+		if snd := s.sender.(*recordingSender); len(snd.subjects) != 0 {
+			t.Errorf("%s: sent %v", tt.hook.name, snd.subjects)
+		}
+	}
+	if want := []string{"rejecting pre Disk usage", "failing pre Disk usage"}; !slices.Equal(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestSideEffectsReply(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		failed   []string
+		required bool
+		want     error
+	}{
+		{"none failed", nil, true, nil},
+		{"optional failed", []string{config.SideEffectDSN}, false, nil},
+		{"required failed", []string{config.SideEffectDSN}, true, errs.ErrSideEffectFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newPipelineSession(t, func(cfg *config.Config) {
+				cfg.Recv.SideEffects = map[string]config.SideEffectConfig{config.SideEffectDSN: {Required: tt.required}}
+			}, pipelineMessage)
+			if err := s.sideEffectsReply(tt.failed); err != tt.want {
+				t.Errorf("reply = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaStage(t *testing.T) {
+	s, d := newPipelineSession(t, func(cfg *config.Config) {
+		cfg.Recv.Quotas = &config.QuotaConfig{Users: map[string]config.QuotaLimit{"alice": {Messages: 1}}}
+	}, pipelineMessage)
+	s.authenticated, s.authenticatedUser = true, "alice"
+	runStagesTo(t, s, d, "quota")
+	if err := s.recordQuota(d); err != nil {
+		t.Fatalf("recordQuota: %v", err)
+	}
+	if u := s.configGlobal.Quotas.Tracker.Usage("alice"); u.Messages != 1 || u.Bytes != int64(len(pipelineMessage)) {
+		t.Errorf("usage = %+v, want the sent message", u)
+	}
+
+	// The next message of the user is deferred before it is sent
+	if err := s.checkQuota(s.newDelivery([]byte(pipelineMessage))); err != errs.ErrQuotaExceeded {
+		t.Errorf("error = %v, want %v", err, errs.ErrQuotaExceeded)
+	}
+	if snd := s.sender.(*recordingSender); len(snd.subjects) != 0 {
+		t.Errorf("sent %v", snd.subjects)
+	}
+}
+
+// Transactions run concurrently on the same session are serialized by its lock, which the race detector verifies
+// (go test -race).
+func TestSessionConcurrentData(t *testing.T) {
+	s, _ := newPipelineSession(t, nil, pipelineMessage)
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Mail(fmt.Sprintf("alerts%d@example.com", i), nil)
+			s.Rcpt("ops@example.net", nil)
+			if err := s.Data(strings.NewReader(pipelineMessage)); err != nil {
+				t.Errorf("Data: %v", err)
+			}
+			s.Reset()
+		}(i)
+	}
+	wg.Wait()
+	if snd := s.sender.(*recordingSender); len(snd.subjects) != n {
+		t.Errorf("sent %d messages, want %d", len(snd.subjects), n)
+	}
+}
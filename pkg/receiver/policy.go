@@ -0,0 +1,368 @@
+package receiver
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/email"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/rs/zerolog"
+)
+
+// Policy evaluates the receiver's sender, recipient, size and content rules. It is shared by every submission path
+// (SMTP and HTTP) so messages are held to the same rules regardless of how they arrive.
+type Policy struct {
+	global *config.RecvGlobalConfig
+}
+
+// Create a new policy evaluator from the receiver global configuration.
+func NewPolicy(global *config.RecvGlobalConfig) *Policy {
+	return &Policy{global: global}
+}
+
+// Check whether the session may submit a message with the null reverse-path (MAIL FROM:<>). The null sender is not
+// an address, so recv.allow_null_sender applies to it instead of valid_from.
+func (p *Policy) CheckNullSender(authenticated bool) error {
+	if !p.global.NullSenderAllowed(authenticated) {
+		return errs.ErrNullSender
+	}
+	return nil
+}
+
+// Check the sender address against the configured sender restrictions. When valid_from is in monitor mode, a sender
+// it would reject is reported to the log and metrics and accepted.
+func (p *Policy) CheckFrom(from string, log zerolog.Logger) error {
+	if len(from) == 0 {
+		return errs.ErrInvalidEmail
+	}
+	verdict := evaluateMailPolicy(&p.global.ValidFrom, from, p.global.NormalizeOptions())
+	if verdict != mailAllowed && p.global.ValidFrom.Enforcement.Monitored() {
+		p.wouldReject(log, "valid_from", verdict.String()).Str("from", from).Msg("Sender address would be rejected, accepting it in monitor mode")
+		return nil
+	}
+	switch verdict {
+	case mailDenied:
+		return errs.ErrFromDenied
+	case mailNotAllowed:
+		return errs.ErrFromDisallowed
+	}
+	return nil
+}
+
+// Check the sender address against the allowed_from of the authenticated user when recv.auth.bind_sender is set.
+// Sessions authenticated without a username, e.g. from trusted networks, are not bound.
+func (p *Policy) CheckSenderBinding(username, from string) error {
+	if !p.global.Auth.BindSender || username == "" {
+		return nil
+	}
+	opts := p.global.NormalizeOptions()
+	addresses, domains := p.global.Auth.AllowedFrom(username)
+	if !matchesAddressList(addresses, domains, email.Normalize(from, opts), opts) {
+		return errs.ErrSenderNotPermitted
+	}
+	return nil
+}
+
+// Check a recipient address against the configured recipient restrictions. Forced recipients never deliver to the
+// envelope recipients, so the restrictions do not apply to them. When valid_to is in monitor mode, a recipient it
+// would reject is reported to the log and metrics and accepted.
+func (p *Policy) CheckTo(to string, forced bool, log zerolog.Logger) error {
+	if len(to) == 0 {
+		return errs.ErrInvalidEmail
+	}
+	if forced {
+		return nil
+	}
+	verdict := evaluateMailPolicy(&p.global.ValidTo, to, p.global.NormalizeOptions())
+	if verdict != mailAllowed && p.global.ValidTo.Enforcement.Monitored() {
+		p.wouldReject(log, "valid_to", verdict.String()).Str("to", to).Msg("Recipient address would be rejected, accepting it in monitor mode")
+		return nil
+	}
+	switch verdict {
+	case mailDenied:
+		return errs.ErrToDenied
+	case mailNotAllowed:
+		return errs.ErrToDisallowed
+	}
+	return nil
+}
+
+// Check whether another recipient can be added to a message which already has count recipients.
+func (p *Policy) CheckRecipientCount(count int) error {
+	if count >= p.global.Limits.MaxRecipients {
+		return errs.ErrTooManyRecipients
+	}
+	return nil
+}
+
+// Returns the error to reply with in place of the policy error, carrying the custom message configured for it if any.
+func (p *Policy) Reply(err error) error {
+	msg, ok := p.global.CustomErrors[errs.Name(err)]
+	if !ok {
+		return err
+	}
+	reply := *err.(*smtp.SMTPError)
+	reply.Message = msg
+	return &reply
+}
+
+// Check whether a connection which already carried count messages of size bytes in total may start another one.
+func (p *Policy) CheckConnectionLimits(count int, size int64) error {
+	limits := &p.global.Limits
+	if limits.MaxMessagesPerConnection > 0 && count >= limits.MaxMessagesPerConnection {
+		return errs.ErrConnectionLimit
+	}
+	if limits.MaxBytesPerConnection > 0 && size >= limits.MaxBytesPerConnection {
+		return errs.ErrConnectionLimit
+	}
+	return nil
+}
+
+// Check a message size in bytes against the configured maximum.
+func (p *Policy) CheckSize(size int64) error {
+	if size > int64(p.global.Limits.MaxSize) {
+		return smtp.ErrDataTooLarge
+	}
+	return nil
+}
+
+// Returns the first enforced content filter rule matching the message, or nil if none match. The matches of the rules
+// in monitor mode are reported to the log and metrics, and the following rules are evaluated as if they did not match.
+func (p *Policy) MatchFilter(subject, from string, body []byte, log zerolog.Logger) *config.FilterRule {
+	for i := range p.global.Filters {
+		rule := &p.global.Filters[i]
+		if !rule.Matches(subject, from, body) {
+			continue
+		}
+		if !rule.Enforcement.Monitored() {
+			return rule
+		}
+		p.wouldReject(log, "filters", rule.Name).Str("action", string(rule.Action)).Str("subject", subject).
+			Msg("Content filter would apply, ignoring it in monitor mode")
+	}
+	return nil
+}
+
+// Count a rejection which a rule in monitor mode would have made and return the policy_would_reject log event
+// reporting it, at the level of the policy rejections. The policy and rule identify the rule in both.
+func (p *Policy) wouldReject(log zerolog.Logger, policy, rule string) *zerolog.Event {
+	metrics.PolicyWouldRejectTotal.WithLabelValues(policy, rule).Inc()
+	return log.WithLevel(p.global.LogLevels.PolicyRejectionLevel).Str("event", "policy_would_reject").Str("policy", policy).Str("rule", rule)
+}
+
+// Check whether the remote address may submit messages: it must not be blocked and, if allowed networks are
+// configured, must be within one of them. Unix socket access is controlled by the socket file permissions.
+func (p *Policy) CheckRemote(raddr net.Addr) error {
+	if _, unix := raddr.(*net.UnixAddr); unix {
+		return nil
+	}
+	ta, ok := raddr.(*net.TCPAddr)
+	if !ok {
+		return errs.ErrSourceIPInvalid
+	}
+	if p.global.BanList.IsBanned(ta.IP.String()) {
+		return errs.ErrSourceIPBlocked
+	}
+	if len(p.global.AllowedNets) == 0 {
+		return nil
+	}
+	for _, a := range p.global.AllowedNets {
+		if a.Contains(ta.IP) {
+			return nil
+		}
+	}
+	return errs.ErrSourceIPDisallowed
+}
+
+// Check the hostname the client greeted with (EHLO/HELO): it must not exceed the configured length and must be a
+// domain name or an address literal (RFC 5321 section 4.1.3). Single-label names are accepted, as many devices greet
+// with their bare hostname.
+func (p *Policy) CheckHello(hostname string) error {
+	if limit := p.global.MaxEHLOLength; limit > 0 && len(hostname) > limit {
+		return errs.ErrInvalidEHLO
+	}
+	if literal, ok := strings.CutPrefix(hostname, "["); ok {
+		literal, ok = strings.CutSuffix(literal, "]")
+		if !ok {
+			return errs.ErrInvalidEHLO
+		}
+		if v6, isV6 := strings.CutPrefix(literal, "IPv6:"); isV6 {
+			if ip, err := netip.ParseAddr(v6); err != nil || !ip.Is6() || ip.Zone() != "" {
+				return errs.ErrInvalidEHLO
+			}
+			return nil
+		}
+		if ip, err := netip.ParseAddr(literal); err != nil || !ip.Is4() {
+			return errs.ErrInvalidEHLO
+		}
+		return nil
+	}
+	if !isValidHostname(hostname) {
+		return errs.ErrInvalidEHLO
+	}
+	return nil
+}
+
+// Returns true if the name consists of labels of letters, digits and hyphens, which do not start or end with a
+// hyphen and are at most 63 characters long. A trailing dot is allowed.
+func isValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) < 1 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns true if the remote address is within the trusted networks, whose connections are treated as authenticated.
+func (p *Policy) IsTrusted(raddr net.Addr) bool {
+	ta, ok := raddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range p.global.Auth.TrustedNets {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the remote address may open an LMTP session. LMTP clients do not authenticate, so LMTP listeners on a
+// TCP port only accept the trusted networks unless allow_untrusted is set; Unix sockets are controlled by their file
+// permissions.
+func (p *Policy) CheckLMTP(lc *config.ListenerConfig, raddr net.Addr, trusted bool) error {
+	if lc.Type != config.ListenerLMTP || lc.IsUnix() || lc.AllowUntrusted || trusted {
+		return nil
+	}
+	return errs.ErrSourceIPDisallowed
+}
+
+// Record a sender/recipient policy violation against the remote IP, blocking it once the configured threshold is reached.
+func (p *Policy) RecordViolation(raddr net.Addr, log zerolog.Logger) {
+	ta, ok := raddr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	if p.global.BanList.RecordViolation(ta.IP.String()) {
+		metrics.AutoBlockTotal.Inc()
+		log.Warn().
+			Dur("block_duration", p.global.AutoBlock.BlockDuration).
+			Msg("Remote address blocked after repeated policy violations")
+	}
+}
+
+// Returns the key the messages of a session are counted against by the quotas: the authenticated user, or else the
+// source IP. Sessions without either (e.g. anonymous sessions on Unix sockets) are not limited.
+func quotaKey(username string, raddr net.Addr) string {
+	if username != "" {
+		return username
+	}
+	if ta, ok := raddr.(*net.TCPAddr); ok {
+		return ta.IP.String()
+	}
+	return ""
+}
+
+// Check whether a message of size bytes fits within the remaining daily quota of the key.
+func (p *Policy) CheckQuota(key string, size int64) error {
+	if p.global.Quotas == nil || key == "" {
+		return nil
+	}
+	if !p.global.Quotas.Tracker.Allow(key, size) {
+		return errs.ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Count a sent message of size bytes against the daily quota of the key.
+func (p *Policy) RecordQuota(key string, size int64) error {
+	if p.global.Quotas == nil || key == "" {
+		return nil
+	}
+	return p.global.Quotas.Tracker.Record(key, size)
+}
+
+// Check the (source IP, sender, recipient) triplet against the greylist of the listener, recording the attempt. Returns
+// errs.ErrGreylisted for the first attempt of an unseen triplet and its retries before the delay, and the time a retry
+// will be accepted. Sessions without a source IP (e.g. on Unix sockets) are not greylisted.
+func (p *Policy) CheckGreylist(listener string, raddr net.Addr, from, to string, log zerolog.Logger) (time.Time, error) {
+	g := &p.global.Greylist
+	ta, ok := raddr.(*net.TCPAddr)
+	if !g.AppliesTo(listener) || !ok {
+		return time.Time{}, nil
+	}
+	passed, retryAt, err := g.Store.Check(ta.IP.String(), from, to)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to persist the greylist")
+	}
+	if !passed {
+		return retryAt, errs.ErrGreylisted
+	}
+	return time.Time{}, nil
+}
+
+// Result of evaluating an address against a mail policy
+type mailVerdict int
+
+const (
+	mailAllowed    mailVerdict = iota
+	mailDenied                 // matched a deny list
+	mailNotAllowed             // missing from the configured allow lists
+)
+
+// Returns the name of the verdict, identifying the rule of a mail policy which rejected an address.
+func (v mailVerdict) String() string {
+	switch v {
+	case mailDenied:
+		return "denied"
+	case mailNotAllowed:
+		return "not_allowed"
+	}
+	return "allowed"
+}
+
+// Evaluate the address against the policy. Deny lists win over the allow lists, and empty allow lists allow every
+// address which is not denied. The address and the listed addresses are normalized alike before they are compared.
+func evaluateMailPolicy(policy *config.MailPolicy, addr string, opts email.NormalizeOptions) mailVerdict {
+	addr = email.Normalize(addr, opts)
+	if matchesAddressList(policy.DeniedAddresses, policy.DeniedDomains, addr, opts) {
+		return mailDenied
+	}
+	if len(policy.Addresses) == 0 && len(policy.Domains) == 0 {
+		return mailAllowed
+	}
+	if matchesAddressList(policy.Addresses, policy.Domains, addr, opts) {
+		return mailAllowed
+	}
+	return mailNotAllowed
+}
+
+// Returns true if the normalized address is one of the addresses or within one of the domains.
+func matchesAddressList(addresses, domains []string, addr string, opts email.NormalizeOptions) bool {
+	for _, a := range addresses {
+		if addr == email.Normalize(a, opts) {
+			return true
+		}
+	}
+	for _, dom := range domains {
+		if strings.HasSuffix(addr, "@"+strings.ToLower(dom)) {
+			return true
+		}
+	}
+	return false
+}
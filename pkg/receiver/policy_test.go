@@ -0,0 +1,99 @@
+package receiver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/rs/zerolog"
+)
+
+func TestPolicyDenyLists(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy config.MailPolicy
+		addr   string
+		want   error
+	}{
+		{"empty policy", config.MailPolicy{}, "alerts@example.com", nil},
+		{"deny with empty allow", config.MailPolicy{DeniedDomains: []string{"abuse.example"}}, "spam@ABUSE.example", errs.ErrFromDenied},
+		{"not denied with empty allow", config.MailPolicy{DeniedDomains: []string{"abuse.example"}}, "alerts@example.com", nil},
+		{"denied address", config.MailPolicy{DeniedAddresses: []string{"spam@example.com"}}, "Spam@example.com", errs.ErrFromDenied},
+		{"deny overrides allow", config.MailPolicy{
+			Domains:         []string{"example.com"},
+			DeniedAddresses: []string{"spam@example.com"},
+		}, "spam@example.com", errs.ErrFromDenied},
+		{"allowed", config.MailPolicy{
+			Domains:         []string{"example.com"},
+			DeniedAddresses: []string{"spam@example.com"},
+		}, "alerts@example.com", nil},
+		{"not allowed", config.MailPolicy{
+			Domains:         []string{"example.com"},
+			DeniedAddresses: []string{"spam@example.com"},
+		}, "alerts@example.net", errs.ErrFromDisallowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPolicy(&config.RecvGlobalConfig{ValidFrom: tt.policy, ValidTo: tt.policy})
+			if err := p.CheckFrom(tt.addr, zerolog.Nop()); err != tt.want {
+				t.Errorf("CheckFrom(%q) = %v, want %v", tt.addr, err, tt.want)
+			}
+
+			want := map[error]error{nil: nil, errs.ErrFromDenied: errs.ErrToDenied, errs.ErrFromDisallowed: errs.ErrToDisallowed}[tt.want]
+			if err := p.CheckTo(tt.addr, false, zerolog.Nop()); err != want {
+				t.Errorf("CheckTo(%q) = %v, want %v", tt.addr, err, want)
+			}
+			if err := p.CheckTo(tt.addr, true, zerolog.Nop()); err != nil {
+				t.Errorf("CheckTo(%q) of a forced recipient = %v, want nil", tt.addr, err)
+			}
+		})
+	}
+}
+
+func TestPolicyNormalizeAddresses(t *testing.T) {
+	policy := config.MailPolicy{Addresses: []string{"Alerts@example.com"}, DeniedAddresses: []string{"spam@example.com"}}
+	tests := []struct {
+		name  string
+		strip bool
+		addr  string
+		want  error
+	}{
+		{"case-insensitive", false, "alerts@EXAMPLE.com", nil},
+		{"plus tag kept", false, "alerts+disk@example.com", errs.ErrFromDisallowed},
+		{"plus tag stripped", true, "alerts+disk@example.com", nil},
+		{"denied plus tag kept", false, "SPAM+promo@example.com", errs.ErrFromDisallowed},
+		{"denied plus tag stripped", true, "SPAM+promo@example.com", errs.ErrFromDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPolicy(&config.RecvGlobalConfig{ValidFrom: policy, StripPlusTags: tt.strip})
+			if err := p.CheckFrom(tt.addr, zerolog.Nop()); err != tt.want {
+				t.Errorf("CheckFrom(%q) = %v, want %v", tt.addr, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyCheckHello(t *testing.T) {
+	p := NewPolicy(&config.RecvGlobalConfig{MaxEHLOLength: config.DefaultMaxEHLOLength})
+	for _, hostname := range []string{"client.example.com", "client.example.com.", "localhost", "[192.0.2.1]", "[IPv6:2001:db8::1]"} {
+		if err := p.CheckHello(hostname); err != nil {
+			t.Errorf("CheckHello(%q) = %v, want nil", hostname, err)
+		}
+	}
+	for _, hostname := range []string{
+		strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 63),
+		strings.Repeat("a", 64) + ".example.com",
+		"client..example.com",
+		"client example.com",
+		"bücher.example",
+		"[192.0.2.1",
+		"[IPv6:192.0.2.1]",
+		"[IPv6:fe80::1%eth0]",
+	} {
+		if err := p.CheckHello(hostname); err != errs.ErrInvalidEHLO {
+			t.Errorf("CheckHello(%q) = %v, want %v", hostname, err, errs.ErrInvalidEHLO)
+		}
+	}
+}
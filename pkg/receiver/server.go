@@ -0,0 +1,179 @@
+package receiver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+)
+
+// SMTP server of a listener. Keeps track of the connections it accepts so those still open once a shutdown times out
+// can be closed, and follows the plaintext transcript of their sessions when NOOP commands are limited or sessions are
+// traced.
+type Server struct {
+	*smtp.Server
+	lc     *config.ListenerConfig
+	global *config.RecvGlobalConfig
+	tracer *Tracer
+
+	mu    sync.Mutex
+	conns map[*serverConn]struct{}
+}
+
+// Create the SMTP server of a listener with the server settings of the configuration, speaking LMTP on LMTP listeners.
+// Authentication without TLS is only allowed on plaintext listeners. The server is not started.
+func NewServer(ctx context.Context, lc *config.ListenerConfig, send *config.SendConfig, global *config.RecvGlobalConfig) *Server {
+	srv := smtp.NewServer(NewListener(ctx, lc, send, global))
+	srv.Network, srv.Addr = ListenAddr(lc)
+	srv.Domain = global.Domain
+	srv.EnableSMTPUTF8 = true
+	srv.EnableDSN = global.DSN.Enabled
+	srv.EnableREQUIRETLS = global.Server.EnableREQUIRETLS
+	srv.MaxLineLength = global.Server.MaxLineLength // longer lines are rejected with 500 and the connection is closed
+	srv.MaxRecipients = global.Server.MaxRecipients
+	srv.ReadTimeout = global.Server.ReadTimeout
+	srv.WriteTimeout = global.Server.WriteTimeout
+	srv.TLSConfig = lc.TLSConfig
+	srv.AllowInsecureAuth = lc.Type == config.ListenerSMTP || lc.Type == config.ListenerLMTP
+	srv.LMTP = lc.Type == config.ListenerLMTP
+	return &Server{Server: srv, lc: lc, global: global, conns: make(map[*serverConn]struct{})}
+}
+
+// Record the transcript of the sessions accepted while the tracer is enabled. Must be called before Serve.
+func (s *Server) SetTracer(t *Tracer) {
+	s.tracer = t
+}
+
+// Accept connections on the listener and serve them until the server or the listener is closed, which returns nil.
+// Connections to SMTPS listeners are wrapped with TLS by the server, so the listener accepts plaintext connections
+// only.
+func (s *Server) Serve(l net.Listener) error {
+	var sl net.Listener = &serverListener{Listener: l, server: s}
+	if s.lc.Type == config.ListenerSMTPS {
+		sl = tls.NewListener(sl, s.lc.TLSConfig)
+	}
+	// The listener may be closed before the server, to release its address while the server drains
+	if err := s.Server.Serve(sl); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Close the listener and all connections immediately.
+func (s *Server) Close() error {
+	if err := s.Server.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Close the listener and wait for the connections to end their sessions. Connections still open once the context is
+// done are closed and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if ctx.Err() != nil {
+		// go-smtp leaves the connections open when the context is done first
+		s.mu.Lock()
+		conns := slices.Collect(maps.Keys(s.conns))
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+		return ctx.Err()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Follow the plaintext transcript of the connection's session if the listener limits NOOP commands or traces the
+// session. The connections of SMTPS listeners carry TLS records only, so their transcript cannot be read.
+func (s *Server) follow(sc *serverConn) {
+	if s.lc.Type == config.ListenerSMTPS {
+		return
+	}
+	var observers []transcriptObserver
+	if s.global.NOOPRateLimit > 0 {
+		sc.noop = newNOOPLimiter(s.global.NOOPRateLimit, s.global.NOOPDelay)
+		observers = append(observers, sc.noop)
+	}
+	if s.tracer != nil {
+		if sc.trace = s.tracer.newRecorder(sc.Conn); sc.trace != nil {
+			observers = append(observers, sc.trace)
+		}
+	}
+	if len(observers) > 0 {
+		sc.transcript = newTranscript(observers...)
+	}
+}
+
+// Listener of a server, wrapping the connections it accepts.
+type serverListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *serverListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	sc := &serverConn{Conn: c, server: l.server}
+	l.server.follow(sc)
+
+	l.server.mu.Lock()
+	l.server.conns[sc] = struct{}{}
+	l.server.mu.Unlock()
+	return sc, nil
+}
+
+// Connection accepted by a server, beneath TLS on SMTPS listeners. go-smtp reads from and writes to a connection from
+// the goroutine serving it only, so its transcript needs no locking.
+type serverConn struct {
+	net.Conn
+	server     *Server
+	transcript *transcript    // nil unless the transcript is followed
+	noop       *noopLimiter   // nil unless NOOP commands are limited
+	trace      *traceRecorder // nil unless the session is traced
+	close      sync.Once
+	err        error
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.transcript != nil {
+		c.transcript.clientData(b[:n])
+		// Delaying the commands delays their replies
+		if c.noop != nil {
+			c.noop.sleep()
+		}
+	}
+	return n, err
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	if c.transcript != nil {
+		c.transcript.serverData(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *serverConn) Close() error {
+	c.close.Do(func() {
+		if c.trace != nil {
+			c.trace.close()
+		}
+		c.err = c.Conn.Close()
+		c.server.mu.Lock()
+		delete(c.server.conns, c)
+		c.server.mu.Unlock()
+	})
+	return c.err
+}
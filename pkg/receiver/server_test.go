@@ -0,0 +1,127 @@
+package receiver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/ban"
+	"github.com/goodieshq/gopostal/pkg/config"
+)
+
+func TestNewServer(t *testing.T) {
+	global := &config.RecvGlobalConfig{
+		Domain: "relay.example.com",
+		DSN:    config.DSNConfig{Enabled: true},
+		Server: config.ServerConfig{
+			MaxLineLength:    4096,
+			MaxRecipients:    50,
+			ReadTimeout:      time.Minute,
+			WriteTimeout:     15 * time.Second,
+			EnableREQUIRETLS: true,
+		},
+	}
+	lc := &config.ListenerConfig{Name: "plain", Type: config.ListenerSMTP, Addr: ":2525"}
+	server := NewServer(context.Background(), lc, &config.SendConfig{}, global)
+	srv := server.Server
+	if srv.Network != "tcp" || srv.Addr != ":2525" || srv.Domain != "relay.example.com" {
+		t.Errorf("server listens on %s %q as %q", srv.Network, srv.Addr, srv.Domain)
+	}
+	if srv.MaxLineLength != 4096 || srv.MaxRecipients != 50 || srv.ReadTimeout != time.Minute || srv.WriteTimeout != 15*time.Second {
+		t.Errorf("limits = %d line bytes, %d recipients, %s read, %s write", srv.MaxLineLength, srv.MaxRecipients, srv.ReadTimeout, srv.WriteTimeout)
+	}
+	if !srv.EnableDSN || !srv.EnableREQUIRETLS || !srv.EnableSMTPUTF8 || !srv.AllowInsecureAuth {
+		t.Errorf("extensions: DSN %v, REQUIRETLS %v, SMTPUTF8 %v, insecure auth %v", srv.EnableDSN, srv.EnableREQUIRETLS, srv.EnableSMTPUTF8, srv.AllowInsecureAuth)
+	}
+
+	// Authentication requires TLS on the other listener types
+	lc = &config.ListenerConfig{Name: "submission", Type: config.ListenerSTARTTLS, Addr: ":587"}
+	if srv := NewServer(context.Background(), lc, &config.SendConfig{}, global).Server; srv.AllowInsecureAuth {
+		t.Error("STARTTLS server allows authentication without TLS")
+	}
+
+	lc = &config.ListenerConfig{Name: "delivery", Type: config.ListenerLMTP, Addr: ":2424"}
+	if srv := NewServer(context.Background(), lc, &config.SendConfig{}, global).Server; !srv.LMTP {
+		t.Error("LMTP listener does not speak LMTP")
+	}
+}
+
+// Shutting down closes the listener at once and waits for the sessions in progress to end, closing the connections
+// still open once the context is done.
+func TestServerShutdown(t *testing.T) {
+	start := func() (*Server, string) {
+		lc := &config.ListenerConfig{Name: "plain", Type: config.ListenerSMTP, Addr: "127.0.0.1:0"}
+		server := NewServer(context.Background(), lc, &config.SendConfig{}, &config.RecvGlobalConfig{
+			Domain:  "relay.example.com",
+			BanList: ban.NewBanList(0, time.Minute, time.Minute),
+		})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(l)
+		t.Cleanup(func() { server.Close() })
+		return server, l.Addr().String()
+	}
+	dial := func(addr string) *smtp.Client {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.Hello("client.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	server, addr := start()
+	first, second := dial(addr), dial(addr)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("the listener still accepts connections")
+		}
+	}
+
+	// The sessions in progress are still served until they end
+	if err := first.Noop(); err != nil {
+		t.Fatalf("NOOP: %v", err)
+	}
+	if err := first.Quit(); err != nil {
+		t.Fatalf("QUIT: %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a session in progress", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := second.Quit(); err != nil {
+		t.Fatalf("QUIT: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// Sessions still open once the context is done are closed
+	server, addr = start()
+	idle := dial(addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := idle.Noop(); err == nil {
+		t.Error("the idle session is still open")
+	}
+}
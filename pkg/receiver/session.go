@@ -1,38 +1,88 @@
 package receiver
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
-	"mime"
 	"net"
 	"net/mail"
-	"regexp"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/email"
 	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/spool"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 )
 
 // Session is a struct that implements the smtp.Session interface.
 type Session struct {
-	ctx            context.Context
-	log            zerolog.Logger
-	id             uuid.UUID
-	configListener *config.ListenerConfig
-	configSender   *config.SendConfig
-	configGlobal   *config.RecvGlobalConfig
-	remote         net.Addr
-	authenticated  bool
-	emailSubject   string
-	emailFrom      string
-	emailTo        []string
-	emailBody      []byte
+	// Serializes the transaction commands (Mail, Rcpt, Data and Reset), which read and write the envelope and message
+	// fields below. The commands of a transaction must complete in order, so each holds the lock until it returns and
+	// no command may call another while holding it.
+	mu                sync.Mutex
+	ctx               context.Context
+	log               zerolog.Logger // logger of the current transaction, or of the connection between transactions
+	connLog           zerolog.Logger // logger of the connection
+	id                uuid.UUID
+	txnID             uuid.UUID // identifies the current MAIL FROM to DATA transaction
+	txnCount          int       // messages accepted on the connection
+	txnBytes          int64     // bytes of the messages accepted on the connection
+	conn              *smtp.Conn
+	tlsLogged         bool
+	configListener    *config.ListenerConfig
+	configSender      *config.SendConfig
+	configGlobal      *config.RecvGlobalConfig
+	sender            sender.Sender // sender of the listener, unless the authenticated user has a route
+	policy            *Policy
+	remote            net.Addr
+	started           time.Time
+	authenticated     bool
+	authenticatedUser string
+	emailBodyType     smtp.BodyType
+	emailUTF8         bool
+	emailSubject      string
+	emailHeaders      mail.Header
+	emailFrom         string
+	emailFromAddr     string // normalized sender address, checked by the policies and logged
+	emailTo           []string
+	emailRcpts        []dsnRecipient
+	emailReturn       smtp.DSNReturn
+	emailEnvelopeID   string
+	emailAuth         string // original submitter claimed by the AUTH= parameter of an authenticated session (RFC 4954)
+	emailNullSender   bool   // the message was submitted with MAIL FROM:<> and is sent from the configured mailbox
+	emailBody         []byte
+}
+
+// Add the negotiated TLS parameters to the session logger once the connection uses TLS. Implicit TLS connections are
+// established before the session is created, while STARTTLS upgrades happen later in the session.
+func (s *Session) logTLS() {
+	if s.tlsLogged || s.conn == nil {
+		return
+	}
+	state, ok := s.conn.TLSConnectionState()
+	if !ok {
+		return
+	}
+	s.tlsLogged = true
+	s.connLog = s.connLog.With().
+		Str("tls_version", tls.VersionName(state.Version)).
+		Str("tls_cipher", tls.CipherSuiteName(state.CipherSuite)).
+		Str("tls_alpn", state.NegotiatedProtocol).
+		Str("tls_server_name", state.ServerName).
+		Logger()
+	s.log = s.connLog
+	s.log.Debug().Msg("TLS connection established")
 }
 
 // Return the allowed authentication mechanisms for this service
@@ -65,24 +115,28 @@ func (s *Session) authPlain(identity, username, password string) error {
 
 	if s.configGlobal.Authenticator.Check(username, password) {
 		s.authenticated = true
+		s.authenticatedUser = username
 		log.Info().Msg("User authenticated successfully")
+		metrics.AuthAttemptsTotal.WithLabelValues(s.configListener.Name, "success").Inc()
 		return nil
 	}
-	log.Info().Msg("Failed to authenticate user")
+	log.WithLevel(s.configGlobal.LogLevels.AuthFailureLevel).Msg("Failed to authenticate user")
+	metrics.AuthAttemptsTotal.WithLabelValues(s.configListener.Name, "failure").Inc()
 	return smtp.ErrAuthFailed
 }
 
 func (s *Session) authAnonymous(identity string) error {
 	s.log.Info().Str("identity", identity).Msg("Authenticating anonymous user")
 	s.authenticated = true
+	metrics.AuthAttemptsTotal.WithLabelValues(s.configListener.Name, "success").Inc()
 	return nil
 }
 
 func (s *Session) Auth(mech string) (sasl.Server, error) {
-	// Check if the context has been cancelled
-	if s.ctx.Err() != nil {
-		s.log.Warn().Msg("Session context has been cancelled")
-		return nil, smtp.ErrServerClosed
+	s.logTLS()
+
+	if err := s.checkShutdown(); err != nil {
+		return nil, err
 	}
 
 	// Check if the requested mechanism is supported
@@ -103,190 +157,374 @@ func (s *Session) Auth(mech string) (sasl.Server, error) {
 }
 
 // Mail handles the MAIL command from the SMTP client.
-func (s *Session) Mail(from string, _ *smtp.MailOptions) error {
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logTLS()
+
+	// A connection can carry several transactions, each logged with its own ID and index
+	s.txnID = uuid.New()
+	s.log = s.connLog.With().Str("txn_id", s.txnID.String()).Int("txn_index", s.txnCount+1).Logger()
+
 	if s.configListener.RequireAuth && !s.authenticated {
 		return smtp.ErrAuthRequired
 	}
 
-	// Check if the context has been cancelled
-	if s.ctx.Err() != nil {
-		s.log.Warn().Msg("Session context has been cancelled")
-		return smtp.ErrServerClosed
+	if err := s.checkShutdown(); err != nil {
+		return err
 	}
 
-	from = strings.Trim(from, "<>")
-	if len(from) == 0 {
-		s.log.Warn().Msg("Mail from address is empty")
-		return errs.ErrInvalidEmail
+	// Clients sending many messages on one connection must reconnect, which spreads their load across the relays
+	if err := s.policy.CheckConnectionLimits(s.txnCount, s.txnBytes); err != nil {
+		s.logRejection().Int("messages", s.txnCount).Int64("bytes", s.txnBytes).Msg("Connection limits reached, refusing further messages")
+		return err
 	}
 
-	if len(s.configGlobal.ValidFrom.Addresses) > 0 || len(s.configGlobal.ValidFrom.Domains) > 0 {
-		valid := false
-		for _, addr := range s.configGlobal.ValidFrom.Addresses {
-			if strings.EqualFold(from, addr) {
-				valid = true
-				break
-			}
+	// Clients may greet again later in the session, which does not create a new session, so the hostname of the
+	// latest greeting is checked again
+	if s.conn != nil {
+		if err := s.policy.CheckHello(s.conn.Hostname()); err != nil {
+			s.logRejection().Int("ehlo_length", len(s.conn.Hostname())).Str("ehlo", truncateHello(s.conn.Hostname())).Msg("Rejecting invalid EHLO hostname")
+			return s.policy.Reply(err)
 		}
-		for _, dom := range s.configGlobal.ValidFrom.Domains {
-			if strings.HasSuffix(strings.ToLower(from), "@"+strings.ToLower(dom)) {
-				valid = true
-				break
-			}
+	}
+
+	// The policies check and the logs report the normalized address, while the message is sent from the address as
+	// submitted
+	from = strings.Trim(from, "<>")
+	addr := email.Normalize(from, s.configGlobal.NormalizeOptions())
+	s.emailUTF8 = opts != nil && opts.UTF8
+	if !s.emailUTF8 && !isSevenBit([]byte(from)) {
+		s.logRejection().Str("from", addr).Msg("Non-ASCII sender address submitted without SMTPUTF8")
+		return errs.ErrUTF8Required
+	}
+	if from == "" {
+		// Bounces are submitted with the null reverse-path (RFC 5321 section 4.5.5), which Graph cannot send from, so
+		// they are sent from the configured mailbox instead
+		if err := s.policy.CheckNullSender(s.authenticated); err != nil {
+			s.logRejection().Bool("authenticated", s.authenticated).Msg("Null sender is not allowed by configuration")
+			return s.policy.Reply(err)
+		}
+		mailbox := s.configSender.MailboxFor(s.configListener.Sender, s.authenticatedUser)
+		if mailbox == "" {
+			s.logRejection().Msg("Null sender is allowed but no mailbox is configured to send from")
+			return s.policy.Reply(errs.ErrNullSender)
+		}
+		from, s.emailNullSender = mailbox, true
+		addr = email.Normalize(from, s.configGlobal.NormalizeOptions())
+	} else if err := s.policy.CheckFrom(addr, s.log); err != nil {
+		if err == errs.ErrFromDenied {
+			s.logRejection().Str("from", addr).Msg("Sender address is denied by configuration")
+		} else {
+			s.logRejection().Str("from", addr).Msg("Sender address is not allowed by configuration")
 		}
-		if !valid {
-			s.log.Warn().Str("from", from).Msg("Sender address is not allowed by configuration")
-			return errs.ErrFromDisallowed
+		s.policy.RecordViolation(s.remote, s.log)
+		return s.policy.Reply(err)
+	} else if err := s.policy.CheckSenderBinding(s.authenticatedUser, addr); err != nil {
+		s.logRejection().Str("from", addr).Str("username", s.authenticatedUser).Msg("Sender address is not permitted for the authenticated user")
+		return s.policy.Reply(err)
+	}
+	if opts != nil {
+		// Reject messages which declare a size larger than allowed before receiving any data
+		if err := s.policy.CheckSize(opts.Size); err != nil {
+			s.logRejection().Int("max_size", s.configGlobal.Limits.MaxSize).Int64("declared_size", opts.Size).Msg("Declared message size exceeds maximum allowed size")
+			return err
+		}
+
+		// The AUTH= parameter claims the identity which originally submitted the message (RFC 4954)
+		if opts.Auth != nil && *opts.Auth != "" {
+			if !s.authenticated {
+				s.log.Debug().Str("auth_param", *opts.Auth).Msg("Ignoring AUTH parameter from unauthenticated session")
+			} else {
+				if !strings.EqualFold(*opts.Auth, s.authenticatedUser) {
+					s.log.Warn().Str("auth_param", *opts.Auth).Str("username", s.authenticatedUser).Msg("AUTH parameter does not match the authenticated identity")
+				}
+				s.emailAuth = *opts.Auth
+			}
 		}
+
+		s.emailBodyType = opts.Body
+		s.emailReturn = opts.Return
+		s.emailEnvelopeID = opts.EnvelopeID
 	}
-	s.emailFrom = from
-	s.log.Info().Str("from", from).Msg("Mail from")
+
+	s.emailFrom, s.emailFromAddr = from, addr
+	event := s.log.Info().Str("from", addr).Str("body", string(s.emailBodyType)).Bool("smtputf8", s.emailUTF8)
+	if s.emailNullSender {
+		event = event.Bool("null_sender", true)
+	}
+	if s.emailAuth != "" {
+		event = event.Str("auth_param", s.emailAuth)
+	}
+	event.Msg("Mail from")
 	return nil
 }
 
 // Rcpt handles the RCPT command from the SMTP client.
-func (s *Session) Rcpt(to string, _ *smtp.RcptOptions) error {
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.configListener.RequireAuth && !s.authenticated {
 		return smtp.ErrAuthRequired
 	}
 
-	// Check if the context has been cancelled
-	if s.ctx.Err() != nil {
-		s.log.Warn().Msg("Session context has been cancelled")
-		return smtp.ErrServerClosed
+	if err := s.checkShutdown(); err != nil {
+		return err
 	}
 
-	// Trim angle brackets from the email address if present
+	// Trim angle brackets from the email address if present. As for the sender, the policies check the normalized
+	// address and the message is sent to the address as submitted
 	to = strings.Trim(to, "<>")
-	if len(to) == 0 {
-		s.log.Warn().Msg("Mail to address is empty")
-		return errs.ErrInvalidEmail
-	}
-
-	// If there are any address/domain restrictions, enforce them
-	if len(s.configGlobal.ValidTo.Addresses) > 0 || len(s.configGlobal.ValidTo.Domains) > 0 {
-		valid := false
-		for _, addr := range s.configGlobal.ValidTo.Addresses {
-			if strings.EqualFold(to, addr) {
-				valid = true
-				break
-			}
-		}
-		for _, dom := range s.configGlobal.ValidTo.Domains {
-			if strings.HasSuffix(strings.ToLower(to), "@"+strings.ToLower(dom)) {
-				valid = true
-				break
-			}
+	addr := email.Normalize(to, s.configGlobal.NormalizeOptions())
+	if !s.emailUTF8 && !isSevenBit([]byte(to)) {
+		s.logRejection().Str("to", addr).Msg("Non-ASCII recipient address submitted without SMTPUTF8")
+		return errs.ErrUTF8Required
+	}
+	if err := s.policy.CheckTo(addr, len(s.configListener.ForceRecipients) > 0, s.log); err != nil {
+		if err == errs.ErrInvalidEmail {
+			s.logRejection().Msg("Mail to address is empty")
+			return s.policy.Reply(err)
 		}
-		if !valid {
-			s.log.Warn().Str("to", to).Msg("Recipient address is not allowed by configuration")
-			return errs.ErrToDisallowed
+		if err == errs.ErrToDenied {
+			s.logRejection().Str("to", addr).Msg("Recipient address is denied by configuration")
+		} else {
+			s.logRejection().Str("to", addr).Msg("Recipient address is not allowed by configuration")
 		}
+		s.policy.RecordViolation(s.remote, s.log)
+		return s.policy.Reply(err)
 	}
 
 	// Enforce maximum recipients limit
-	if len(s.emailTo) >= s.configGlobal.Limits.MaxRecipients {
-		s.log.Warn().Int("max_recipients", s.configGlobal.Limits.MaxRecipients).Msg("Too many recipients")
-		return errs.ErrTooManyRecipients
+	if err := s.policy.CheckRecipientCount(len(s.emailTo)); err != nil {
+		s.logRejection().Int("max_recipients", s.configGlobal.Limits.MaxRecipients).Msg("Too many recipients")
+		return s.policy.Reply(err)
 	}
 
-	// Add the recipient to the list
+	// Unauthenticated clients must retry their first message to a recipient (recv.greylist)
+	if !s.authenticated {
+		if retryAt, err := s.policy.CheckGreylist(s.configListener.Name, s.remote, s.emailFromAddr, addr, s.log); err != nil {
+			s.logRejection().Str("to", addr).Time("retry_at", retryAt).Msg("Recipient greylisted, the client must retry")
+			metrics.GreylistedTotal.WithLabelValues(s.configListener.Name).Inc()
+			return s.policy.Reply(err)
+		}
+	}
+
+	// Add the recipient to the list, with the notifications it requested
 	s.emailTo = append(s.emailTo, to)
+	rcpt := dsnRecipient{address: to}
+	if opts != nil {
+		rcpt.notify = opts.Notify
+		if opts.OriginalRecipient != "" {
+			rcpt.orcpt = string(opts.OriginalRecipientType) + "; " + opts.OriginalRecipient
+		}
+	}
+	s.emailRcpts = append(s.emailRcpts, rcpt)
 	s.log.Info().Strs("to", s.emailTo).Msg("Added recipient successfully")
 	return nil
 }
 
 // Data handles the DATA command from the SMTP client.
 func (s *Session) Data(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.data(r)
+	return err
+}
+
+// LMTPData handles the DATA command on LMTP listeners, replying for each recipient (RFC 2033 section 4.2): recipients
+// the sender failed to deliver to get their own error, so the others are not retried.
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := s.data(r)
+	if d == nil {
+		return err // the reply of every recipient
+	}
+	outcomes := make(map[string]error, len(d.statuses))
+	for _, st := range d.statuses {
+		outcomes[strings.ToLower(st.Address)] = st.Err
+	}
+	for _, to := range s.emailTo {
+		rcptErr := outcomes[strings.ToLower(to)]
+		if rcptErr == nil {
+			rcptErr = err
+		}
+		status.SetStatus(to, rcptErr)
+	}
+	return err
+}
+
+// Receive the message and run it through the pipeline. Returns the delivery with the error replied to the message, or
+// no delivery if the message was refused before it was processed.
+func (s *Session) data(r io.Reader) (*delivery, error) {
 	if s.configListener.RequireAuth && !s.authenticated {
-		return smtp.ErrAuthRequired
+		return nil, smtp.ErrAuthRequired
 	}
 
-	// Check if the context has been cancelled
-	if s.ctx.Err() != nil {
-		s.log.Warn().Msg("Session context has been cancelled")
-		return smtp.ErrServerClosed
+	if err := s.checkShutdown(); err != nil {
+		return nil, err
 	}
 
+	// The stages of the pipeline and the delivery APIs all work on the whole message, which is kept in memory while it
+	// is processed. Its size is unknown until it was read, so it reserves max_size of the memory budget while it is
+	// received, or only memory_spool_threshold if larger messages are received into a file. Spooling only bounds the
+	// memory of the transfer: a spooled message is read back whole to be processed
+	limits := s.configGlobal.Limits
+	threshold := int64(limits.MemorySpoolThreshold)
+	reserved := int64(limits.MaxSize)
+	if threshold > 0 {
+		reserved = min(reserved, threshold)
+	}
+	if err := s.reserveDataMemory(reserved); err != nil {
+		return nil, err
+	}
+	defer func() { limits.DataMemory.Release(reserved) }()
+
 	// Read the email data with an enforced size limit
-	reader := io.LimitReader(r, int64(s.configGlobal.Limits.MaxSize)+1) // prevent reading more than max size + 1 byte
-	data, err := io.ReadAll(reader)
+	reader := io.LimitReader(r, int64(limits.MaxSize)+1) // prevent reading more than max size + 1 byte
+	sp, err := spool.Receive(reader, threshold, s.configGlobal.SpoolDir)
 	if err != nil {
-		return err
+		if errors.Is(err, spool.ErrFile) {
+			s.log.Error().Err(err).Msg("Failed to spool message data")
+			return nil, errs.ErrSpoolFailed
+		}
+		return nil, err
 	}
+	defer sp.Close()
+	metrics.EmailsReceivedTotal.WithLabelValues(s.configListener.Name).Inc()
 
-	// Enforce maximum email size limit
-	if len(data) > s.configGlobal.Limits.MaxSize {
-		s.log.Warn().Int("max_size", s.configGlobal.Limits.MaxSize).Int("data_size", len(data)).Msg("Email data exceeds maximum allowed size")
-		return smtp.ErrDataTooLarge
+	// The server may have started shutting down while the message was transferred
+	if err := s.checkShutdown(); err != nil {
+		return nil, err
 	}
 
-	// Parse email message as RFC5322 to extract a clean body
-	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err != nil {
-		s.log.Debug().Err(err).Msg("Failed to parse email message as RFC5322")
-		re := regexp.MustCompile(`(?mi)^Subject:\s*(.+)$`)
-		if m := re.FindSubmatch(data); m != nil {
-			subject := string(bytes.TrimSpace(m[1]))
-			if decoded, err := (&mime.WordDecoder{}).DecodeHeader(subject); err == nil {
-				subject = decoded
-			}
-			s.emailSubject = subject
-			data = re.ReplaceAll(data, []byte{})
-		} else {
-			s.emailSubject = "(no subject)"
+	// A spooled message holds no memory until it is read back, once the budget has room for its size. The reservation
+	// made for its transfer is released first, so sessions waiting for the budget do not hold any of it. A message over
+	// max_size is rejected from its file, without reading it back
+	if file, ok := sp.(*spool.FileSpool); ok {
+		s.log.Debug().Int64("size", sp.Size()).Str("path", file.Path()).Msg("Message spooled to disk")
+		if err := s.policy.CheckSize(sp.Size()); err != nil {
+			s.logRejection().Int("max_size", limits.MaxSize).Int64("data_size", sp.Size()).Msg("Email data exceeds maximum allowed size")
+			return nil, err
 		}
-		s.emailBody = data
-	} else {
-		s.log.Debug().Msg("Parsed email message as RFC5322 successfully")
-		subject := msg.Header.Get("Subject")
-		if subject != "" {
-			if decoded, err := (&mime.WordDecoder{}).DecodeHeader(subject); err == nil {
-				subject = decoded
-			}
-		} else {
-			subject = "(no subject)"
+		limits.DataMemory.Release(reserved)
+		reserved = 0
+		if err := s.reserveDataMemory(sp.Size()); err != nil {
+			return nil, err
 		}
+		reserved = sp.Size()
+	}
+	data, err := sp.Bytes()
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to read spooled message data")
+		return nil, errs.ErrSpoolFailed
+	}
 
-		bodyBytes, err := io.ReadAll(msg.Body)
-		if err != nil {
-			s.log.Warn().Err(err).Msg("Failed to read email body, using raw data instead")
-			s.emailBody = data
-		} else {
-			s.emailBody = bodyBytes
+	d := s.newDelivery(data)
+	return d, s.dataHandler()(d)
+}
+
+// Reserve memory for the message data in the budget of recv.limits.max_data_memory, waiting up to data_memory_wait
+// while other messages use it. The message is deferred if the budget stays exhausted or the server shuts down.
+func (s *Session) reserveDataMemory(weight int64) error {
+	budget := s.configGlobal.Limits.DataMemory
+	ctx, cancel := context.WithTimeout(s.ctx, s.configGlobal.Limits.DataMemoryWait)
+	defer cancel()
+	start := time.Now()
+	if err := budget.Acquire(ctx, weight); err != nil {
+		if s.ctx.Err() != nil {
+			return s.checkShutdown()
 		}
+		s.log.Warn().Err(err).Int64("reserved", budget.Held()).Dur("waited", time.Since(start)).Msg("Cannot reserve memory for the message data, deferring the message")
+		return errs.ErrInsufficientMemory
+	}
+	if waited := time.Since(start); waited >= time.Second {
+		s.log.Info().Dur("waited", waited).Msg("Message data waited for the memory budget")
+	}
+	return nil
+}
 
-		s.emailSubject = subject
+// Prepend a Received header documenting the relay hop (RFC 5321 section 4.4) to the message, before it is parsed so
+// the header is carried by MIME passthrough messages.
+func (s *Session) injectReceived(d *delivery) {
+	hello := "unknown"
+	if s.conn != nil && s.conn.Hostname() != "" {
+		hello = s.conn.Hostname()
+	}
+	remote := "unknown"
+	if ta, ok := s.remote.(*net.TCPAddr); ok {
+		remote = ta.IP.String()
+	} else if s.remote != nil {
+		remote = s.remote.String()
 	}
+	protocol := "SMTP"
+	if s.configListener.Type == config.ListenerLMTP {
+		protocol = "LMTP"
+	}
+	header := fmt.Sprintf("Received: from %s (%s)\r\n\tby %s with %s id %s;\r\n\t%s\r\n",
+		hello, remote, s.configGlobal.Domain, protocol, s.id, d.opts.ReceivedAt.Format(time.RFC1123Z))
+	d.data = append([]byte(header), d.data...)
+}
 
-	s.log.Info().
-		Str("subject", s.emailSubject).
-		Str("from", s.emailFrom).
-		Strs("to", s.emailTo).
-		Msg("Sending email using configured sender")
+// Returns the session context carrying the transaction logger, so the sender logs the calls it makes for the message
+// with the session_id and remote_addr of the session.
+func (s *Session) sendContext() context.Context {
+	return s.log.WithContext(s.ctx)
+}
 
-	err = s.configSender.Sender.SendEmail(
-		s.ctx,
-		s.emailFrom,
-		s.emailTo,
-		s.emailSubject,
-		s.emailBody,
-	)
-	if err != nil {
-		s.log.Error().Err(err).Msg("Failed to send email")
-		return err
-	}
+// Returns an event of the transaction logger at the level of the policy rejections (recv.log_levels).
+func (s *Session) logRejection() *zerolog.Event {
+	return s.log.WithLevel(s.configGlobal.LogLevels.PolicyRejectionLevel)
+}
 
+// Returns errs.ErrShuttingDown once the server is shutting down, so clients requeue their messages instead of treating
+// the closed connection as an ambiguous failure. The session context is the server's, so its cancellation always means
+// a shutdown.
+func (s *Session) checkShutdown() error {
+	if s.ctx.Err() != nil {
+		s.log.Warn().Msg("Server is shutting down, deferring the command")
+		return errs.ErrShuttingDown
+	}
 	return nil
 }
 
 // Reset resets the session state for a new email transaction.
 func (s *Session) Reset() {
-	s.emailFrom = ""
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.txnID = uuid.Nil
+	s.log = s.connLog
+	s.emailFrom, s.emailFromAddr = "", ""
+	s.emailBodyType = ""
+	s.emailUTF8 = false
 	s.emailTo = []string{}
+	s.emailRcpts = nil
+	s.emailReturn = ""
+	s.emailEnvelopeID = ""
+	s.emailAuth = ""
+	s.emailNullSender = false
+	s.emailHeaders = nil
 	s.emailBody = nil
 }
 
 // Logout handles the logout of the SMTP session.
 func (s *Session) Logout() error {
+	metrics.ActiveSessions.WithLabelValues(s.configListener.Name).Dec()
+	metrics.SessionDurationSeconds.WithLabelValues(s.configListener.Name).Observe(time.Since(s.started).Seconds())
 	return nil
 }
+
+// Returns true if the data contains only 7-bit bytes.
+func isSevenBit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,2283 @@
+package receiver_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Load the configuration of a test relay sending through the fake Graph server, without authentication.
+func loadGraphConfig(t *testing.T, fg *testutil.FakeGraph, recv, send string) *config.Config {
+	t.Helper()
+	return loadGraphConfigListener(t, fg, "port: 2525", `
+  auth:
+    mode: disabled
+`+recv, send)
+}
+
+// Load the configuration of a test relay sending through the fake Graph server, with the settings of the listener
+// indented by six spaces. The recv settings must configure the authentication.
+func loadGraphConfigListener(t *testing.T, fg *testutil.FakeGraph, listener, recv, send string) *config.Config {
+	t.Helper()
+	t.Setenv("TEST_GRAPH_SECRET", fg.ClientSecret)
+	cfg, err := config.LoadConfigBytes([]byte(`
+recv:
+  listeners:
+    - name: test
+      `+listener+`
+      type: smtp
+`+recv+`
+send:
+  retries: 2
+  backoff: "1ms"
+  graph:
+    tenant_id: `+fg.TenantID+`
+    client_id: `+fg.ClientID+`
+    client_secret_env: TEST_GRAPH_SECRET
+    login_endpoint: `+fg.URL()+`
+    graph_endpoint: `+fg.URL()+`
+    token_cooldown: "1ns"
+`+send), true)
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	return cfg
+}
+
+func startListener(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, stop, err := testutil.StartListener(ctx, &cfg.Recv.Listeners[0], &cfg.Send, &cfg.Recv.RecvGlobalConfig)
+	if err != nil {
+		cancel()
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	t.Cleanup(func() {
+		stop()
+		cancel()
+	})
+	return addr
+}
+
+func newFakeGraph(t *testing.T) *testutil.FakeGraph {
+	t.Helper()
+	fg := testutil.NewFakeGraph("tenant", "client", "secret")
+	t.Cleanup(fg.Close)
+	return fg
+}
+
+// Connect to the listener, greet it with the hostname and return the reply. The go-smtp client would fall back to HELO.
+func ehlo(t *testing.T, addr, hostname string) (int, error) {
+	t.Helper()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PrintfLine("EHLO %s", hostname); err != nil {
+		return 0, err
+	}
+	code, _, err := c.ReadResponse(250)
+	return code, err
+}
+
+func TestSessionRejectsOverlongLine(t *testing.T) {
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, `
+  server:
+    max_line_length: 1024
+`, ""))
+
+	if _, err := ehlo(t, addr, "client.example.com"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	if code, err := ehlo(t, addr, strings.Repeat("a", 2048)+".example.com"); code != 500 {
+		t.Fatalf("oversized EHLO: got %d %v, want a 500 reply", code, err)
+	}
+}
+
+func TestSessionRejectsInvalidEHLO(t *testing.T) {
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, `
+  max_ehlo_length: 64
+`, ""))
+
+	for _, tt := range []struct {
+		hostname string
+		want     int
+	}{
+		{"client.example.com", 250},
+		{"SCANNER-01", 250},
+		{"[192.0.2.1]", 250},
+		{"[IPv6:2001:db8::1]", 250},
+		{strings.Repeat("a", 60) + ".example.com", errs.ErrInvalidEHLO.Code},
+		{"client_01.example.com", errs.ErrInvalidEHLO.Code},
+		{"-client.example.com", errs.ErrInvalidEHLO.Code},
+		{"[192.0.2.300]", errs.ErrInvalidEHLO.Code},
+		{"[2001:db8::1]", errs.ErrInvalidEHLO.Code},
+	} {
+		if code, err := ehlo(t, addr, tt.hostname); code != tt.want {
+			t.Errorf("EHLO %s: got %d %v, want %d", tt.hostname, code, err, tt.want)
+		}
+	}
+}
+
+const testMessage = "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Disk usage\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n\r\nDisk usage is at 91%.\r\n"
+
+func TestSessionContentFilters(t *testing.T) {
+	const filters = `
+  filters:
+    - name: tag-disk
+      match_subject: "^Disk"
+      action: tag
+      tag: "[DISK]"
+    - name: reject-full
+      match_subject: "usage$"
+      match_body: "91%"
+      action: reject
+    - name: discard-noise
+      match_subject: "^Heartbeat"
+      match_from: "@example\\.com$"
+      action: discard
+    - name: reject-backups
+      match_subject: "^Backup"
+      action: reject
+`
+	tests := []struct {
+		name        string
+		subject     string
+		wantCode    int    // SMTP code of the rejection, 0 if the message is accepted
+		wantSubject string // subject of the sent message, empty if it is not sent
+	}{
+		{"first matching rule applies", "Disk usage", 0, "[DISK] Disk usage"},
+		{"every pattern matches", "CPU usage", 550, ""},
+		{"discard", "Heartbeat", 0, ""},
+		{"reject", "Backup failed", 550, ""},
+		{"no match", "Weekly report", 0, "Weekly report"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			addr := startListener(t, loadGraphConfig(t, fg, filters, ""))
+			msg := strings.Replace(testMessage, "Subject: Disk usage", "Subject: "+tt.subject, 1)
+
+			err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(msg))
+			var smtpErr *smtp.SMTPError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Fatalf("SubmitMessage: %v", err)
+			case tt.wantCode != 0 && (!errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode):
+				t.Fatalf("SubmitMessage: got %v, want a %d reply", err, tt.wantCode)
+			}
+
+			sent := fg.Sent()
+			if tt.wantSubject == "" {
+				if len(sent) != 0 {
+					t.Errorf("sent %d messages, want none", len(sent))
+				}
+				return
+			}
+			if len(sent) != 1 || sent[0].Request.Message.Subject != tt.wantSubject {
+				t.Errorf("sent %+v, want one message with subject %q", sent, tt.wantSubject)
+			}
+		})
+	}
+}
+
+// Single-part bodies are decoded from their transfer encoding and charset before they are sent.
+func TestSessionTransferEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		body     string
+		wantBody string
+	}{
+		{
+			"quoted-printable",
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable",
+			"Disk usage is at 91% on /var, the =\r\nlimit is 90%=3D\r\nTemp=C3=A9rature: 45=C2=B0C",
+			"Disk usage is at 91% on /var, the limit is 90%=\r\nTempérature: 45°C",
+		},
+		{
+			"base64",
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: BASE64",
+			"RGlzayB1c2FnZSBpcyBhdCA5MSUu\r\nIFRlbXDDqXJhdHVyZTogNDXCsEM=",
+			"Disk usage is at 91%. Température: 45°C",
+		},
+		{
+			"iso-8859-1",
+			"Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable",
+			"Temp=E9rature: 45=B0C",
+			"Température: 45°C",
+		},
+		{
+			"binary",
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit",
+			"Température: 45°C",
+			"Température: 45°C",
+		},
+		{
+			"unknown encoding",
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: x-uuencode",
+			"begin 644 disk.txt",
+			"begin 644 disk.txt",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			addr := startListener(t, loadGraphConfig(t, fg, "", ""))
+			msg := "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Disk usage\r\n" + tt.header + "\r\n\r\n" + tt.body + "\r\n"
+			if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(msg)); err != nil {
+				t.Fatalf("SubmitMessage: %v", err)
+			}
+
+			sent := fg.Sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(sent))
+			}
+			if body := strings.TrimSuffix(sent[0].Request.Message.Body.Content, "\r\n"); body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// Submit a message from the local IP address to the listener, as a client of another host would.
+func submitFrom(localIP, addr string, from string, to []string, msg string) error {
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	c := smtp.NewClient(conn)
+	defer c.Close()
+	return c.SendMail(from, to, strings.NewReader(msg))
+}
+
+// Behind a load balancer, the client address of the PROXY header is checked against the allowed networks and a
+// connection without the header is refused.
+func TestSessionProxyProtocol(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      proxy_protocol: true`, `
+  allowed_ips: ["203.0.113.0/24"]
+  auth:
+    mode: disabled
+`, ""))
+
+	submit := func(header string) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(header)); err != nil {
+			t.Fatal(err)
+		}
+		c := smtp.NewClient(conn)
+		defer c.Close()
+		return c.SendMail("alerts@example.com", []string{"ops@example.net"}, strings.NewReader(testMessage))
+	}
+
+	if err := submit("PROXY TCP4 203.0.113.7 192.0.2.1 40000 25\r\n"); err != nil {
+		t.Errorf("client allowed by the PROXY header was refused: %v", err)
+	}
+	if err := submit("PROXY TCP4 198.51.100.7 192.0.2.1 40001 25\r\n"); err == nil {
+		t.Error("client disallowed by the PROXY header was accepted")
+	}
+	if records := logs.Records(t, "Remote address is not allowed by configuration"); len(records) != 1 || records[0]["remote"] != "198.51.100.7:40001" {
+		t.Errorf("rejections logged = %v, want one with the client address of the PROXY header", records)
+	}
+	if err := submit("EHLO client.example.com\r\n"); err == nil {
+		t.Error("connection without a PROXY header was accepted")
+	}
+	if n := len(fg.Sent()); n != 1 {
+		t.Errorf("sent %d messages, want 1", n)
+	}
+}
+
+// Messages are submitted over the unix domain socket of a listener, which has the configured permissions.
+func TestSessionUnixSocket(t *testing.T) {
+	fg := newFakeGraph(t)
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+	addr := startListener(t, loadGraphConfigListener(t, fg, `socket_path: `+path+`
+      socket_mode: "0600"`, `
+  auth:
+    mode: disabled
+`, ""))
+	if addr != path {
+		t.Fatalf("listener address = %s, want %s", addr, path)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket file = %v, %v", fi, err)
+	}
+
+	if err := testutil.SubmitMessageUnix(path, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Fatalf("SubmitMessageUnix: %v", err)
+	}
+	sent := fg.Sent()
+	if len(sent) != 1 || sent[0].Request.Message.Subject != "Disk usage" {
+		t.Fatalf("sent = %+v", sent)
+	}
+}
+
+// Trusted networks are authenticated by their source IP, while clients which are merely allowed must authenticate.
+func TestSessionTrustedNetworks(t *testing.T) {
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true`, `
+  allowed_ips: ["127.0.0.1", "127.0.0.2"]
+  auth:
+    mode: disabled
+    trusted_networks: ["127.0.0.2/32"]
+`, ""))
+
+	if err := submitFrom("127.0.0.2", addr, "alerts@example.com", []string{"ops@example.net"}, testMessage); err != nil {
+		t.Errorf("trusted client: %v", err)
+	}
+	err := submitFrom("127.0.0.1", addr, "alerts@example.com", []string{"ops@example.net"}, testMessage)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ErrAuthRequired.Code {
+		t.Errorf("allowed client: got %v, want %v", err, smtp.ErrAuthRequired)
+	}
+	if n := len(fg.Sent()); n != 1 {
+		t.Errorf("sent %d messages, want 1", n)
+	}
+}
+
+// Bounces submitted with the null reverse-path are sent from the configured mailbox by the sessions allowed by
+// recv.allow_null_sender, which defaults to authenticated sessions only.
+func TestSessionNullSender(t *testing.T) {
+	tests := []struct {
+		name          string
+		allow         string
+		mailbox       string
+		wantTrusted   bool
+		wantUntrusted bool
+	}{
+		{"default", "", "relay@example.com", true, false},
+		{"allowed", "true", "relay@example.com", true, true},
+		{"disallowed", "false", "relay@example.com", false, false},
+		{"no mailbox", "true", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recv := `
+  allowed_ips: ["127.0.0.1", "127.0.0.2"]
+  auth:
+    mode: disabled
+    trusted_networks: ["127.0.0.2/32"]
+`
+			if tt.allow != "" {
+				recv += "  allow_null_sender: " + tt.allow + "\n"
+			}
+			var send string
+			if tt.mailbox != "" {
+				send = "    mailbox: " + tt.mailbox + "\n"
+			}
+			fg := newFakeGraph(t)
+			addr := startListener(t, loadGraphConfigListener(t, fg, "port: 2525", recv, send))
+
+			var want int
+			for _, c := range []struct {
+				ip      string
+				allowed bool
+			}{{"127.0.0.2", tt.wantTrusted}, {"127.0.0.1", tt.wantUntrusted}} {
+				err := submitFrom(c.ip, addr, "", []string{"ops@example.net"}, testMessage)
+				if c.allowed {
+					want++
+					if err != nil {
+						t.Errorf("%s: %v", c.ip, err)
+					}
+					continue
+				}
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != errs.ErrNullSender.Code || smtpErr.EnhancedCode != errs.ErrNullSender.EnhancedCode {
+					t.Errorf("%s: got %v, want %v", c.ip, err, errs.ErrNullSender)
+				}
+			}
+
+			sent := fg.Sent()
+			if len(sent) != want {
+				t.Fatalf("sent %d messages, want %d", len(sent), want)
+			}
+			for _, m := range sent {
+				var marked bool
+				for _, h := range m.Request.Message.InternetMessageHeaders {
+					marked = marked || h.Name == "X-Null-Reverse-Path" && h.Value == "yes"
+				}
+				if m.Mailbox != tt.mailbox || !marked {
+					t.Errorf("sent from %q, marked = %v, want %q and the X-Null-Reverse-Path header", m.Mailbox, marked, tt.mailbox)
+				}
+			}
+		})
+	}
+}
+
+// New sessions are deferred with 421 once the sender failed to authenticate repeatedly, and accepted again as soon as
+// a probe succeeds.
+func TestSessionDeferredWhileAuthFailing(t *testing.T) {
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfig(t, fg, "", "  auth_failure_threshold: 2\n")
+	addr := startListener(t, cfg)
+	health := cfg.Send.Health
+	ctx := context.Background()
+
+	// The failing send authenticates once per attempt, reaching the threshold
+	fg.FailTokens(true)
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err == nil {
+		t.Fatal("message accepted with a failing token endpoint")
+	}
+	if failures, _ := health.State(); health.Available() || failures < 2 {
+		t.Fatalf("available = %v after %d failures", health.Available(), failures)
+	}
+	if code, err := ehlo(t, addr, "client.example.com"); code != errs.ErrServiceUnavailable.Code {
+		t.Errorf("EHLO while unavailable: %d %v, want %d", code, err, errs.ErrServiceUnavailable.Code)
+	}
+
+	// A failing probe keeps deferring sessions, a successful one recovers
+	if err := health.Probe(ctx, cfg.Send.Sender); err == nil || health.Available() {
+		t.Fatal("probe succeeded with a failing token endpoint")
+	}
+	fg.FailTokens(false)
+	if err := health.Probe(ctx, cfg.Send.Sender); err != nil || !health.Available() {
+		t.Fatalf("probe: %v", err)
+	}
+	if code, err := ehlo(t, addr, "client.example.com"); err != nil {
+		t.Errorf("EHLO after recovery: %d %v", code, err)
+	}
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Errorf("submit after recovery: %v", err)
+	}
+	if n := len(fg.Sent()); n != 1 {
+		t.Errorf("sent %d messages, want 1", n)
+	}
+}
+
+// Multipart message with a plain text body, a PDF report and an installer declared as application/octet-stream
+const attachmentMessage = "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Nightly report\r\n" +
+	"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=mixed\r\n\r\n" +
+	"--mixed\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nThe nightly report is attached.\r\n" +
+	"--mixed\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"report.pdf\"\r\n\r\n" +
+	"%PDF-1.4 report\r\n" +
+	"--mixed\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"setup.EXE\"\r\n\r\n" +
+	"MZ\r\n" +
+	"--mixed--\r\n"
+
+func TestSessionAttachmentPolicy(t *testing.T) {
+	tests := []struct {
+		name            string
+		policy          string
+		wantCode        int      // SMTP code of the rejection, 0 if the message is accepted
+		wantAttachments []string // names of the sent attachments
+		wantNote        string   // note appended to the body of the sent message
+	}{
+		{"default blocklist rejects executables", "{}", 550, nil, ""},
+		{"blocked content type", `
+    blocked_types: ["application/pdf"]`, 550, nil, ""},
+		{"allowlist", `
+    allowed_types: ["application/*"]
+    allowed_extensions: [pdf, exe]`, 0, []string{"report.pdf", "setup.EXE"}, ""},
+		{"too many attachments", `
+    blocked_extensions: [".js"]
+    max_count: 1`, 552, nil, ""},
+		{"attachment too large", `
+    blocked_extensions: [".js"]
+    max_each: 8`, 552, nil, ""},
+		{"strip blocked attachment", `
+    action: strip`, 0, []string{"report.pdf"}, "[1 attachment(s) removed by policy: setup.EXE (attachment type is not allowed)]"},
+		{"strip beyond the maximum count", `
+    allowed_extensions: [".pdf", ".exe"]
+    max_count: 1
+    action: strip`, 0, []string{"report.pdf"}, "[1 attachment(s) removed by policy: setup.EXE (too many attachments)]"},
+		{"strip oversized attachments", `
+    blocked_types: ["text/*"]
+    max_each: 8
+    action: strip`, 0, []string{"setup.EXE"}, "[1 attachment(s) removed by policy: report.pdf (attachment exceeds maximum allowed size)]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			addr := startListener(t, loadGraphConfig(t, fg, "  attachment_policy: "+tt.policy+"\n", ""))
+
+			err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(attachmentMessage))
+			var smtpErr *smtp.SMTPError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Fatalf("SubmitMessage: %v", err)
+			case tt.wantCode != 0:
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+					t.Fatalf("SubmitMessage: got %v, want a %d reply", err, tt.wantCode)
+				}
+				if n := len(fg.Sent()); n != 0 {
+					t.Errorf("sent %d messages, want none", n)
+				}
+				return
+			}
+
+			sent := fg.Sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(sent))
+			}
+			msg := sent[0].Request.Message
+			var names []string
+			for _, a := range msg.Attachments {
+				names = append(names, a.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantAttachments, ",") {
+				t.Errorf("attachments = %v, want %v", names, tt.wantAttachments)
+			}
+			if !strings.HasPrefix(msg.Body.Content, "The nightly report is attached.") {
+				t.Errorf("body = %q, want the text part", msg.Body.Content)
+			}
+			if tt.wantNote != "" && !strings.HasSuffix(msg.Body.Content, "\r\n\r\n"+tt.wantNote) {
+				t.Errorf("body = %q, want the note %q appended", msg.Body.Content, tt.wantNote)
+			}
+			if tt.wantNote == "" && strings.Contains(msg.Body.Content, "removed by policy") {
+				t.Errorf("body = %q, want no note", msg.Body.Content)
+			}
+		})
+	}
+}
+
+// Grafana alert with the logo and a panel screenshot referenced by the HTML body, sent as inline attachments.
+func TestSessionInlineImages(t *testing.T) {
+	data, err := os.ReadFile("testdata/grafana_alert.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, "", ""))
+	if err := testutil.SubmitMessage(addr, nil, "grafana@example.com", []string{"ops@example.net"}, data); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	msg := sent[0].Request.Message
+	if msg.Body.ContentType != "HTML" || !strings.Contains(msg.Body.Content, `src="cid:image_0.png"`) {
+		t.Errorf("body = %s %q, want the HTML part referencing the screenshot", msg.Body.ContentType, msg.Body.Content)
+	}
+	var ids []string
+	for _, a := range msg.Attachments {
+		if !a.IsInline {
+			t.Errorf("attachment %q is not inline", a.Name)
+		}
+		ids = append(ids, a.ContentID)
+	}
+	if strings.Join(ids, ",") != "grafana_v2.png,image_0.png" {
+		t.Errorf("content IDs = %v, want the referenced images", ids)
+	}
+}
+
+// HTML bodies are converted to plain text, or sent as MIME with a plain text alternative, for recipients which cannot
+// render HTML.
+func TestSessionForceBodyType(t *testing.T) {
+	const msg = "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Disk usage\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n<p>Disk usage is at <b>91%</b>.</p>\r\n"
+	submit := func(t *testing.T, forceBodyType string) testutil.SentMail {
+		t.Helper()
+		fg := newFakeGraph(t)
+		addr := startListener(t, loadGraphConfig(t, fg, "", "  force_body_type: "+forceBodyType+"\n"))
+		if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(msg)); err != nil {
+			t.Fatalf("SubmitMessage: %v", err)
+		}
+		sent := fg.Sent()
+		if len(sent) != 1 {
+			t.Fatalf("sent %d messages, want 1", len(sent))
+		}
+		return sent[0]
+	}
+
+	t.Run("html", func(t *testing.T) {
+		body := submit(t, "html").Request.Message.Body
+		if body.ContentType != "HTML" || !strings.Contains(body.Content, "<b>91%</b>") {
+			t.Errorf("body = %s %q, want the HTML as received", body.ContentType, body.Content)
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		body := submit(t, "text").Request.Message.Body
+		if body.ContentType != "Text" || !strings.Contains(body.Content, "Disk usage is at 91%.") || strings.Contains(body.Content, "<") {
+			t.Errorf("body = %s %q, want it converted to plain text", body.ContentType, body.Content)
+		}
+	})
+
+	t.Run("both", func(t *testing.T) {
+		sent := submit(t, "both")
+		if sent.MIME == nil {
+			t.Fatal("message sent as JSON, want MIME carrying the text alternative")
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(sent.MIME))
+		if err != nil {
+			t.Fatalf("invalid MIME: %v", err)
+		}
+		mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("Content-Type = %q, want multipart/alternative", parsed.Header.Get("Content-Type"))
+		}
+		alternatives := map[string]string{}
+		mr := multipart.NewReader(parsed.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("NextPart: %v", err)
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			alternatives[contentType] = string(data)
+		}
+		if text := alternatives["text/plain"]; !strings.Contains(text, "Disk usage is at 91%.") || strings.Contains(text, "<") {
+			t.Errorf("text alternative = %q", text)
+		}
+		if html := alternatives["text/html"]; !strings.Contains(html, "<b>91%</b>") {
+			t.Errorf("HTML alternative = %q", html)
+		}
+	})
+}
+
+func TestSessionInjectReceived(t *testing.T) {
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, `
+  domain: relay.example.com
+  inject_received: true
+`, `
+  mime_passthrough: true
+`))
+	msg := "From: scanner@example.com\r\nTo: ops@example.net\r\nSubject: Scan\r\n\r\nScanned document.\r\n"
+	if err := testutil.SubmitMessage(addr, nil, "scanner@example.com", []string{"ops@example.net"}, []byte(msg)); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(sent[0].MIME))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	received := parsed.Header.Get("Received")
+	m := regexp.MustCompile(`^from (\S+) \((\S+)\)\s+by relay\.example\.com with SMTP id ([0-9a-f-]{36});\s+(.+)$`).FindStringSubmatch(received)
+	if m == nil {
+		t.Fatalf("Received = %q, want a relay hop of relay.example.com", received)
+	}
+	if m[1] != "localhost" || m[2] != "127.0.0.1" {
+		t.Errorf("Received from %s (%s), want localhost (127.0.0.1)", m[1], m[2])
+	}
+	date, err := mail.ParseDate(m[4])
+	if err != nil {
+		t.Errorf("Received date %q: %v", m[4], err)
+	} else if d := time.Since(date); d < -time.Minute || d > time.Minute {
+		t.Errorf("Received date %s, want the current time", date)
+	}
+	if parsed.Header.Get("Subject") != "Scan" {
+		t.Errorf("Subject = %q, want the original headers after the Received header", parsed.Header.Get("Subject"))
+	}
+}
+
+func TestSessionArchiveBCC(t *testing.T) {
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, "", `
+  archive_bcc: archive@example.com
+`))
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d messages, want the message and its archive copy", len(sent))
+	}
+	original, archived := sent[0].Request.Message, sent[1].Request.Message
+	if len(original.BccRecipients) != 0 || len(original.ToRecipients) != 1 {
+		t.Errorf("original message recipients = %+v, bcc = %+v, want ops@example.net only", original.ToRecipients, original.BccRecipients)
+	}
+	if len(archived.ToRecipients) != 0 || len(archived.BccRecipients) != 1 || archived.BccRecipients[0].EmailAddress.Address != "archive@example.com" {
+		t.Errorf("archive copy recipients = %+v, bcc = %+v, want archive@example.com as the only blind copy", archived.ToRecipients, archived.BccRecipients)
+	}
+	if archived.Subject != "[ARCHIVED] "+original.Subject {
+		t.Errorf("archive copy subject = %q, want the labelled subject of %q", archived.Subject, original.Subject)
+	}
+	if archived.Body.Content != original.Body.Content {
+		t.Errorf("archive copy body = %q, want %q", archived.Body.Content, original.Body.Content)
+	}
+}
+
+// The archive copy of a message passed through is sent to the archive mailbox only, as Graph sends raw messages to the
+// recipients of their headers.
+func TestSessionArchiveBCCPassthrough(t *testing.T) {
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, "", `
+  mime_passthrough: true
+  archive_bcc: archive@example.com
+`))
+	msg := "From: alerts@example.com\r\nTo: ops@example.net\r\nCc: dev@example.net\r\nSubject: Disk usage\r\n\r\nDisk usage is at 91%.\r\n"
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net", "dev@example.net"}, []byte(msg)); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d messages, want the message and its archive copy", len(sent))
+	}
+	recipients := func(raw []byte) (*mail.Message, map[string][]string) {
+		t.Helper()
+		parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		rcpts := make(map[string][]string)
+		for _, key := range []string{"To", "Cc", "Bcc"} {
+			addrs, _ := parsed.Header.AddressList(key)
+			for _, a := range addrs {
+				rcpts[key] = append(rcpts[key], a.Address)
+			}
+		}
+		return parsed, rcpts
+	}
+	if _, rcpts := recipients(sent[0].MIME); !reflect.DeepEqual(rcpts, map[string][]string{"To": {"ops@example.net"}, "Cc": {"dev@example.net"}}) {
+		t.Errorf("original message recipients = %v, want ops@example.net and dev@example.net", rcpts)
+	}
+	archived, rcpts := recipients(sent[1].MIME)
+	if !reflect.DeepEqual(rcpts, map[string][]string{"Bcc": {"archive@example.com"}}) {
+		t.Errorf("archive copy recipients = %v, want archive@example.com as the only blind copy", rcpts)
+	}
+	if got := archived.Header.Get("Subject"); got != "[ARCHIVED] Disk usage" {
+		t.Errorf("archive copy subject = %q, want the labelled subject", got)
+	}
+	if archived.Header.Get("X-Original-To") != "ops@example.net" || archived.Header.Get("X-Original-Cc") != "dev@example.net" {
+		t.Errorf("archive copy headers = %v, want the original recipients in X-Original-To and X-Original-Cc", archived.Header)
+	}
+}
+
+// Messages of users with a route are sent through the route's sender, the others through the default sender.
+func TestSessionUserRoutes(t *testing.T) {
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true`, `
+  auth:
+    mode: plain
+    credentials:
+      - username: team-a
+        password: alpha
+      - username: team-b
+        password: bravo
+      - username: team-c
+        password: charlie
+`, `  user_routes:
+    - username: team-a
+      graph:
+        tenant_id: tenant-a
+        client_id: client-a
+        client_secret_env: TEST_GRAPH_SECRET
+    - username: team-b
+      graph:
+        tenant_id: tenant-b
+        client_id: client-b
+        client_secret_env: TEST_GRAPH_SECRET
+`)
+	teamA, teamB, fallback := testutil.NewCapturingSender(), testutil.NewCapturingSender(), testutil.NewCapturingSender()
+	cfg.Send.UserRoutes[0].Sender = teamA
+	cfg.Send.UserRoutes[1].Sender = teamB
+	cfg.Send.Sender = fallback
+	addr := startListener(t, cfg)
+
+	for _, user := range []struct{ name, password string }{{"team-a", "alpha"}, {"team-b", "bravo"}, {"team-b", "bravo"}, {"team-c", "charlie"}} {
+		if err := testutil.SubmitMessage(addr, sasl.NewPlainClient("", user.name, user.password), user.name+"@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+			t.Fatalf("submit as %s: %v", user.name, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		sender *testutil.CapturingSender
+		from   string
+		count  int
+	}{
+		{"team-a route", teamA, "team-a@example.com", 1},
+		{"team-b route", teamB, "team-b@example.com", 2},
+		{"default sender", fallback, "team-c@example.com", 1},
+	} {
+		emails := tt.sender.Emails()
+		if len(emails) != tt.count || emails[0].From != tt.from {
+			t.Errorf("%s sent %+v, want %d messages from %s", tt.name, emails, tt.count, tt.from)
+		}
+	}
+}
+
+// Each listener sends through its named Graph application, which authenticates against its own tenant only.
+func TestSessionNamedSenders(t *testing.T) {
+	fgA := testutil.NewFakeGraph("tenant-a", "client-a", "secret-a")
+	t.Cleanup(fgA.Close)
+	fgB := testutil.NewFakeGraph("tenant-b", "client-b", "secret-b")
+	t.Cleanup(fgB.Close)
+	t.Setenv("TEST_SECRET_A", fgA.ClientSecret)
+	t.Setenv("TEST_SECRET_B", fgB.ClientSecret)
+
+	cfg, err := config.LoadConfigBytes([]byte(`
+recv:
+  auth:
+    mode: disabled
+  listeners:
+    - name: customer-a
+      port: 2525
+      type: smtp
+      sender: customer-a
+    - name: customer-b
+      port: 2526
+      type: smtp
+      sender: customer-b
+send:
+  retries: 1
+  graph:
+    tenant_id: tenant-default
+    client_id: client-default
+    client_secret_env: TEST_SECRET_A
+    login_endpoint: `+fgA.URL()+`
+    graph_endpoint: `+fgA.URL()+`
+  senders:
+    - name: customer-a
+      graph:
+        tenant_id: `+fgA.TenantID+`
+        client_id: `+fgA.ClientID+`
+        client_secret_env: TEST_SECRET_A
+        login_endpoint: `+fgA.URL()+`
+        graph_endpoint: `+fgA.URL()+`
+    - name: customer-b
+      graph:
+        tenant_id: `+fgB.TenantID+`
+        client_id: `+fgB.ClientID+`
+        client_secret_env: TEST_SECRET_B
+        login_endpoint: `+fgB.URL()+`
+        graph_endpoint: `+fgB.URL()+`
+`), true)
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	for _, ns := range cfg.Send.Senders {
+		if err := ns.Sender.Authenticate(context.Background()); err != nil {
+			t.Fatalf("authenticate %s: %v", ns.Name, err)
+		}
+	}
+
+	for i, from := range []string{"alerts@customer-a.example", "alerts@customer-b.example", "backup@customer-b.example"} {
+		listener := &cfg.Recv.Listeners[min(i, 1)]
+		ctx, cancel := context.WithCancel(context.Background())
+		addr, stop, err := testutil.StartListener(ctx, listener, &cfg.Send, &cfg.Recv.RecvGlobalConfig)
+		if err != nil {
+			cancel()
+			t.Fatalf("failed to start listener %s: %v", listener.Name, err)
+		}
+		err = testutil.SubmitMessage(addr, nil, from, []string{"ops@example.net"}, []byte(testMessage))
+		stop()
+		cancel()
+		if err != nil {
+			t.Fatalf("submit to %s: %v", listener.Name, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		fg    *testutil.FakeGraph
+		froms []string
+	}{
+		{"customer-a", fgA, []string{"alerts@customer-a.example"}},
+		{"customer-b", fgB, []string{"alerts@customer-b.example", "backup@customer-b.example"}},
+	} {
+		var froms []string
+		for _, sent := range tt.fg.Sent() {
+			froms = append(froms, sent.Mailbox)
+		}
+		if !slices.Equal(froms, tt.froms) {
+			t.Errorf("%s tenant sent from %v, want %v", tt.name, froms, tt.froms)
+		}
+	}
+	// Each tenant issued a single token, and none was requested for the unused default application
+	if n := fgA.TokenRequests(); n != 1 {
+		t.Errorf("customer-a tenant received %d token requests, want 1", n)
+	}
+	if n := fgB.TokenRequests(); n != 1 {
+		t.Errorf("customer-b tenant received %d token requests, want 1", n)
+	}
+}
+
+func TestSessionSubjectPrefix(t *testing.T) {
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true
+      subject_prefix: "[SCANNER-ROOM-A]"`, `
+  auth:
+    mode: plain
+    credentials:
+      - username: scanner
+        password: alpha
+        subject_prefix: "[scanner]"
+      - username: printer
+        password: bravo
+`, "")
+	capture := testutil.NewCapturingSender()
+	cfg.Send.Sender = capture
+	addr := startListener(t, cfg)
+
+	for _, user := range []struct{ name, password string }{{"scanner", "alpha"}, {"printer", "bravo"}} {
+		if err := testutil.SubmitMessage(addr, sasl.NewPlainClient("", user.name, user.password), user.name+"@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+			t.Fatalf("submit as %s: %v", user.name, err)
+		}
+	}
+
+	emails := capture.Emails()
+	if len(emails) != 2 {
+		t.Fatalf("%d messages sent, want 2", len(emails))
+	}
+	if want := "[SCANNER-ROOM-A] [scanner] Disk usage"; emails[0].Subject != want {
+		t.Errorf("subject = %q, want %q", emails[0].Subject, want)
+	}
+	if want := "[SCANNER-ROOM-A] Disk usage"; emails[1].Subject != want {
+		t.Errorf("subject = %q, want %q", emails[1].Subject, want)
+	}
+}
+
+// Listeners with forced recipients deliver to them instead of the envelope recipients, which bypass valid_to and are
+// recorded in X-Original-To.
+func TestSessionForceRecipients(t *testing.T) {
+	const recv = `
+  auth:
+    mode: disabled
+  valid_to:
+    domains: ["example.net"]
+`
+	envelope := []string{"ops@example.net", "someone@elsewhere.example.com"}
+
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfigListener(t, fg, `port: 2525
+      force_recipients: ["archive@example.org", "security@example.org"]`, recv, "")
+	capture := testutil.NewCapturingSender()
+	cfg.Send.Sender = capture
+	addr := startListener(t, cfg)
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", envelope, []byte(testMessage)); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	emails := capture.Emails()
+	if len(emails) != 1 {
+		t.Fatalf("%d messages sent, want 1", len(emails))
+	}
+	if want := []string{"archive@example.org", "security@example.org"}; !slices.Equal(emails[0].To, want) {
+		t.Errorf("recipients = %v, want %v", emails[0].To, want)
+	}
+	var originalTo []string
+	for _, h := range emails[0].Options.Headers {
+		if h.Name == "X-Original-To" {
+			originalTo = append(originalTo, h.Value)
+		}
+	}
+	if want := strings.Join(envelope, ", "); len(originalTo) != 1 || originalTo[0] != want {
+		t.Errorf("X-Original-To = %q, want %q", originalTo, want)
+	}
+
+	// Without forced recipients, valid_to rejects the recipient outside its domains
+	addr = startListener(t, loadGraphConfigListener(t, fg, "port: 2525", recv, ""))
+	err := testutil.SubmitMessage(addr, nil, "alerts@example.com", envelope, []byte(testMessage))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("SubmitMessage without forced recipients: got %v, want the recipient rejected", err)
+	}
+	if n := len(fg.Sent()); n != 0 {
+		t.Errorf("sent %d messages, want none", n)
+	}
+}
+
+func TestSessionCustomErrors(t *testing.T) {
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, `  valid_from:
+    domains: ["example.com"]
+  valid_to:
+    denied_addresses: ["ceo@example.net"]
+  custom_errors:
+    from_disallowed: "This relay only accepts mail from @example.com"
+`, ""))
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want string
+	}{
+		{"custom message", "alerts@example.org", "ops@example.net", "This relay only accepts mail from @example.com"},
+		{"default message", "alerts@example.com", "ceo@example.net", errs.ErrToDenied.Message},
+	}
+	for _, tt := range tests {
+		err := testutil.SubmitMessage(addr, nil, tt.from, []string{tt.to}, []byte(testMessage))
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || !strings.Contains(smtpErr.Message, tt.want) {
+			t.Errorf("%s: got %v, want a 550 reply containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// Buffer receiving the log output of the sessions
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Returns the decoded log records with the message.
+func (b *logBuffer) Records(t *testing.T, msg string) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if record["message"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestSessionTransactionID(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, "", ""))
+
+	// Two transactions on one connection
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if err := c.SendMail("alerts@example.com", []string{"ops@example.net"}, strings.NewReader(testMessage)); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var txnIDs [2]string
+	for _, msg := range []string{"Mail from", "Added recipient successfully", "Sending email using configured sender"} {
+		records := logs.Records(t, msg)
+		if len(records) != 2 {
+			t.Fatalf("%d %q records, want 2", len(records), msg)
+		}
+		if records[0]["session_id"] != records[1]["session_id"] {
+			t.Errorf("%q: session IDs %v and %v differ within one connection", msg, records[0]["session_id"], records[1]["session_id"])
+		}
+		for i, record := range records {
+			id, _ := record["txn_id"].(string)
+			if id == "" {
+				t.Fatalf("%q record %d has no txn_id", msg, i)
+			}
+			if txnIDs[i] == "" {
+				txnIDs[i] = id
+			} else if txnIDs[i] != id {
+				t.Errorf("%q record %d: txn_id %s, want %s as in the rest of the transaction", msg, i, id, txnIDs[i])
+			}
+		}
+	}
+	if txnIDs[0] == txnIDs[1] {
+		t.Errorf("both transactions logged with txn_id %s", txnIDs[0])
+	}
+
+	// The sendMail requests are correlated with the session by its ID
+	sessionID := logs.Records(t, "Mail from")[0]["session_id"]
+	for i, sent := range fg.Sent() {
+		if sent.SessionID != sessionID {
+			t.Errorf("message %d sent with session ID %q, want %v", i, sent.SessionID, sessionID)
+		}
+	}
+}
+
+// A relay forwarding messages with the AUTH= parameter has the original submitter logged and carried in a header.
+func TestSessionAuthParameter(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true`, `
+  auth:
+    mode: plain
+    credentials:
+      - username: relay
+        password: secret
+`, ""))
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Auth(sasl.NewPlainClient("", "relay", "secret")); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	submit := func(opts *smtp.MailOptions) {
+		t.Helper()
+		if err := c.Mail("sender@example.com", opts); err != nil {
+			t.Fatalf("Mail: %v", err)
+		}
+		if err := c.Rcpt("ops@example.net", nil); err != nil {
+			t.Fatalf("Rcpt: %v", err)
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+		w.Write([]byte(testMessage))
+		if err := w.Close(); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+	original := "user@example.com"
+	submit(&smtp.MailOptions{Auth: &original})
+	submit(nil) // the identity does not carry over to the next transaction
+	c.Quit()
+
+	records := logs.Records(t, "Mail from")
+	if len(records) != 2 || records[0]["auth_param"] != original || records[1]["auth_param"] != nil {
+		t.Errorf("Mail from records = %v, want the AUTH parameter logged for the first message only", records)
+	}
+	sent := fg.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(sent))
+	}
+	for i, want := range []string{original, ""} {
+		var got string
+		for _, h := range sent[i].Request.Message.InternetMessageHeaders {
+			if h.Name == "X-GoPostal-Authenticated-As" {
+				got = h.Value
+			}
+		}
+		if got != want {
+			t.Errorf("message %d: X-GoPostal-Authenticated-As = %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+// A declared SIZE over the limit is refused before the data, BODY is logged, and addresses with non-ASCII characters are
+// only accepted with SMTPUTF8, whose message headers are decoded as UTF-8.
+func TestSessionMailParameters(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, `
+  limits:
+    max_size: 1024
+`, ""))
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	expectCode := func(err error, code int, enhanced smtp.EnhancedCode) {
+		t.Helper()
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != code || smtpErr.EnhancedCode != enhanced {
+			t.Fatalf("got %v, want %d %v", err, code, enhanced)
+		}
+		if err := c.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	submit := func(from, to string, opts *smtp.MailOptions, msg string) {
+		t.Helper()
+		if err := c.Mail(from, opts); err != nil {
+			t.Fatalf("Mail: %v", err)
+		}
+		if err := c.Rcpt(to, nil); err != nil {
+			t.Fatalf("Rcpt: %v", err)
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+		w.Write([]byte(msg))
+		if err := w.Close(); err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+	}
+
+	expectCode(c.Mail("alerts@example.com", &smtp.MailOptions{Size: 2048}), 552, smtp.EnhancedCode{5, 3, 4})
+	expectCode(c.Mail("alertés@example.com", nil), 553, smtp.EnhancedCode{5, 6, 7})
+	if err := c.Mail("alerts@example.com", nil); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	expectCode(c.Rcpt("opérations@example.net", nil), 553, smtp.EnhancedCode{5, 6, 7})
+
+	// The raw subject is Windows-1252 unless the message was submitted with SMTPUTF8
+	msg := strings.Replace(testMessage, "Subject: Disk usage", "Subject: Caf\xe9", 1)
+	submit("alerts@example.com", "ops@example.net", &smtp.MailOptions{Body: smtp.Body8BitMIME}, msg)
+	submit("alertés@example.com", "opérations@example.net", &smtp.MailOptions{Body: smtp.Body8BitMIME, UTF8: true}, msg)
+	c.Quit()
+
+	records := logs.Records(t, "Mail from")
+	if len(records) != 3 || records[1]["body"] != "8BITMIME" || records[1]["smtputf8"] != false || records[2]["smtputf8"] != true {
+		t.Errorf("Mail from records = %v, want BODY and SMTPUTF8 logged", records)
+	}
+	sent := fg.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(sent))
+	}
+	if got := sent[0].Request.Message.Subject; got != "Café" {
+		t.Errorf("subject without SMTPUTF8 = %q, want %q", got, "Café")
+	}
+	if got := sent[1].Request.Message.Subject; got != "Caf\uFFFD" {
+		t.Errorf("subject with SMTPUTF8 = %q, want the invalid UTF-8 replaced", got)
+	}
+	if to := sent[1].Request.Message.ToRecipients; len(to) != 1 || to[0].EmailAddress.Address != "opérations@example.net" {
+		t.Errorf("recipients with SMTPUTF8 = %+v", to)
+	}
+}
+
+// Users bound by recv.auth.bind_sender may only send from the addresses and domains of their allowed_from.
+func TestSessionSenderBinding(t *testing.T) {
+	tests := []struct {
+		name  string
+		bind  bool
+		from  string
+		allow bool
+	}{
+		{"unbound", false, "alerts@example.org", true},
+		{"allowed domain", true, "alerts@example.com", true},
+		{"allowed address", true, "Backup@Example.net", true},
+		{"other address of the domain", true, "alerts@example.net", false},
+		{"other domain", true, "alerts@example.org", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			recv := `
+  auth:
+    mode: plain
+    credentials:
+      - username: relay
+        password: secret
+        allowed_from: ["example.com", "backup@example.net"]
+`
+			if tt.bind {
+				recv += "    bind_sender: true\n"
+			}
+			addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true`, recv, ""))
+
+			c, err := smtp.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err := c.Auth(sasl.NewPlainClient("", "relay", "secret")); err != nil {
+				t.Fatalf("Auth: %v", err)
+			}
+			err = c.Mail(tt.from, nil)
+			if tt.allow {
+				if err != nil {
+					t.Errorf("Mail(%q): %v", tt.from, err)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 553 || smtpErr.EnhancedCode != errs.ErrSenderNotPermitted.EnhancedCode {
+				t.Errorf("Mail(%q): got %v, want %v", tt.from, err, errs.ErrSenderNotPermitted)
+			}
+		})
+	}
+}
+
+func TestSessionLogLevels(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true`, `
+  auth:
+    mode: plain
+    credentials:
+      - username: scanner
+        password: secret
+  valid_to:
+    denied_addresses: ["blocked@example.net"]
+  log_levels:
+    auth_failure: debug
+`, ""))
+
+	// A scanner retrying stale credentials is logged at the demoted level
+	if err := testutil.SubmitMessage(addr, sasl.NewPlainClient("", "scanner", "stale"), "scanner@example.com", []string{"ops@example.net"}, []byte(testMessage)); err == nil {
+		t.Fatal("SubmitMessage with wrong credentials succeeded")
+	}
+	records := logs.Records(t, "Failed to authenticate user")
+	if len(records) != 1 || records[0]["level"] != "debug" {
+		t.Errorf("auth failure records = %v, want one at debug level", records)
+	}
+
+	// Other categories keep their default level
+	if err := testutil.SubmitMessage(addr, sasl.NewPlainClient("", "scanner", "secret"), "scanner@example.com", []string{"blocked@example.net"}, []byte(testMessage)); err == nil {
+		t.Fatal("SubmitMessage to a denied recipient succeeded")
+	}
+	records = logs.Records(t, "Recipient address is denied by configuration")
+	if len(records) != 1 || records[0]["level"] != "warn" {
+		t.Errorf("policy rejection records = %v, want one at warn level", records)
+	}
+}
+
+func TestSessionConnectionLimits(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		limits string
+	}{
+		{"messages", "max_messages_per_connection: 2"},
+		{"bytes", fmt.Sprintf("max_bytes_per_connection: %d", 2*len(testMessage)-10)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs logBuffer
+			prev := log.Logger
+			log.Logger = zerolog.New(&logs)
+			t.Cleanup(func() { log.Logger = prev })
+
+			fg := newFakeGraph(t)
+			addr := startListener(t, loadGraphConfig(t, fg, `
+  limits:
+    `+tt.limits+`
+`, ""))
+
+			c, err := smtp.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			for i := 0; i < 2; i++ {
+				if err := c.SendMail("alerts@example.com", []string{"ops@example.net"}, strings.NewReader(testMessage)); err != nil {
+					t.Fatalf("message %d: %v", i+1, err)
+				}
+			}
+			err = c.Mail("alerts@example.com", nil)
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != errs.ErrConnectionLimit.Code {
+				t.Fatalf("third MAIL: got %v, want %d", err, errs.ErrConnectionLimit.Code)
+			}
+			if n := len(fg.Sent()); n != 2 {
+				t.Errorf("%d messages delivered, want 2", n)
+			}
+
+			records := logs.Records(t, "Mail from")
+			if len(records) != 2 {
+				t.Fatalf("%d MAIL commands logged, want 2", len(records))
+			}
+			for i, record := range records {
+				if record["txn_index"] != float64(i+1) {
+					t.Errorf("transaction %d logged with txn_index %v", i+1, record["txn_index"])
+				}
+			}
+
+			// A new connection is accepted again
+			if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+				t.Errorf("message on a new connection: %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionLogSampling(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfig(t, fg, "", `log:
+  sampling:
+    enabled: true
+    rate: 0.3
+`)
+	cfg.Send.Sender = testutil.NewCapturingSender()
+	addr := startListener(t, cfg)
+
+	for i := 0; i < 100; i++ {
+		if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	if n := len(logs.Records(t, "Mail from")); n < 10 || n > 50 {
+		t.Errorf("%d of 100 sessions logged at INFO level, want about 30", n)
+	}
+}
+
+// Sender calling the function for each message
+type funcSender func(ctx context.Context) error
+
+func (f funcSender) Send(ctx context.Context, msg *sender.Message) (*sender.Result, error) {
+	return &sender.Result{Attempts: 1}, f(ctx)
+}
+
+func (f funcSender) Authenticate(ctx context.Context) error {
+	return nil
+}
+
+func TestSessionShuttingDown(t *testing.T) {
+	tests := []struct {
+		name  string
+		stage string // command during which the server shuts down
+		send  func(ctx context.Context, shutdown context.CancelFunc) error
+		want  int // reply code of the interrupted command
+	}{
+		{"auth", "AUTH", nil, 421},
+		{"mail", "MAIL", nil, 421},
+		{"rcpt", "RCPT", nil, 421},
+		{"data", "DATA", nil, 421},
+		{"while sending", "send", func(ctx context.Context, shutdown context.CancelFunc) error {
+			shutdown()
+			<-ctx.Done()
+			return ctx.Err()
+		}, 421},
+		{"after sending", "send", func(ctx context.Context, shutdown context.CancelFunc) error {
+			shutdown()
+			return nil
+		}, 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			cfg := loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true`, `
+  auth:
+    mode: plain
+    credentials:
+      - username: relay
+        password: secret
+`, "")
+			ctx, shutdown := context.WithCancel(context.Background())
+			defer shutdown()
+			cfg.Send.Sender = funcSender(func(sendCtx context.Context) error {
+				if tt.send == nil {
+					return nil
+				}
+				return tt.send(sendCtx, shutdown)
+			})
+			addr, stop, err := testutil.StartListener(ctx, &cfg.Recv.Listeners[0], &cfg.Send, &cfg.Recv.RecvGlobalConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stop()
+
+			c, err := smtp.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err := c.Hello("client.example.com"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Run the transaction, shutting down before the command of the stage
+			err = func() error {
+				step := func(stage string, cmd func() error) error {
+					if stage == tt.stage {
+						shutdown()
+					}
+					return cmd()
+				}
+				if err := step("AUTH", func() error { return c.Auth(sasl.NewPlainClient("", "relay", "secret")) }); err != nil {
+					return err
+				}
+				if err := step("MAIL", func() error { return c.Mail("alerts@example.com", nil) }); err != nil {
+					return err
+				}
+				if err := step("RCPT", func() error { return c.Rcpt("ops@example.net", nil) }); err != nil {
+					return err
+				}
+				return step("DATA", func() error {
+					w, err := c.Data()
+					if err != nil {
+						return err
+					}
+					if _, err := w.Write([]byte(testMessage)); err != nil {
+						return err
+					}
+					return w.Close()
+				})
+			}()
+
+			var smtpErr *smtp.SMTPError
+			switch {
+			case tt.want == 250 && err != nil:
+				t.Fatalf("got %v, want the message accepted", err)
+			case tt.want != 250 && (!errors.As(err, &smtpErr) || smtpErr.Code != tt.want || smtpErr.EnhancedCode != errs.ErrShuttingDown.EnhancedCode):
+				t.Fatalf("got %v, want %d %v", err, tt.want, errs.ErrShuttingDown.EnhancedCode)
+			}
+		})
+	}
+}
+
+// Unauthenticated clients are refused with 450 until they retry after the greylisting delay, while trusted networks,
+// and authenticated sessions are exempt.
+func TestSessionGreylist(t *testing.T) {
+	const greylist = `
+  greylist:
+    enabled: true
+    delay: "50ms"
+    retention: "1h"
+`
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfigListener(t, fg, "port: 2525", `
+  allowed_ips: ["127.0.0.1", "127.0.0.2"]
+  auth:
+    mode: disabled
+    trusted_networks: ["127.0.0.2/32"]
+`+greylist, ""))
+
+	err := submitFrom("127.0.0.1", addr, "alerts@example.com", []string{"ops@example.net"}, testMessage)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != errs.ErrGreylisted.Code {
+		t.Fatalf("first attempt: got %v, want %d", err, errs.ErrGreylisted.Code)
+	}
+	if err := submitFrom("127.0.0.1", addr, "alerts@example.com", []string{"ops@example.net"}, testMessage); !errors.As(err, &smtpErr) || smtpErr.Code != errs.ErrGreylisted.Code {
+		t.Fatalf("early retry: got %v, want %d", err, errs.ErrGreylisted.Code)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := submitFrom("127.0.0.1", addr, "alerts@example.com", []string{"ops@example.net"}, testMessage); err != nil {
+		t.Fatalf("retry after the delay: %v", err)
+	}
+
+	// Exempt sessions are never greylisted
+	if err := submitFrom("127.0.0.2", addr, "alerts@example.com", []string{"noc@example.net"}, testMessage); err != nil {
+		t.Errorf("trusted network: %v", err)
+	}
+	if n := len(fg.Sent()); n != 2 {
+		t.Errorf("sent %d messages, want 2", n)
+	}
+
+	fg = newFakeGraph(t)
+	addr = startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true`, `
+  auth:
+    mode: plain
+    credentials:
+      - username: relay
+        password: secret
+`+greylist, ""))
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Auth(sasl.NewPlainClient("", "relay", "secret")); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if err := c.SendMail("alerts@example.com", []string{"helpdesk@example.net"}, strings.NewReader(testMessage)); err != nil {
+		t.Errorf("authenticated session: %v", err)
+	}
+}
+
+// The greylist sees the normalized addresses, so a retry differing only in case, or in plus tags when strip_plus_tags is
+// set, is the same triplet.
+func TestSessionGreylistNormalizedAddresses(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strip_plus_tags=%t", strip), func(t *testing.T) {
+			fg := newFakeGraph(t)
+			addr := startListener(t, loadGraphConfigListener(t, fg, "port: 2525", fmt.Sprintf(`
+  allowed_ips: ["127.0.0.1"]
+  auth:
+    mode: disabled
+  strip_plus_tags: %t
+  greylist:
+    enabled: true
+    delay: "50ms"
+    retention: "1h"
+`, strip), ""))
+
+			err := submitFrom("127.0.0.1", addr, "alerts+disk@example.com", []string{"ops+pager@example.net"}, testMessage)
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != errs.ErrGreylisted.Code {
+				t.Fatalf("first attempt: got %v, want %d", err, errs.ErrGreylisted.Code)
+			}
+			time.Sleep(60 * time.Millisecond)
+			err = submitFrom("127.0.0.1", addr, "Alerts+CPU@Example.com", []string{"OPS+mail@EXAMPLE.net"}, testMessage)
+			if strip && err != nil {
+				t.Fatalf("retry with other plus tags: %v", err)
+			}
+			if !strip && (!errors.As(err, &smtpErr) || smtpErr.Code != errs.ErrGreylisted.Code) {
+				t.Fatalf("retry with other plus tags: got %v, want %d", err, errs.ErrGreylisted.Code)
+			}
+
+			err = submitFrom("127.0.0.1", addr, "ALERTS+disk@example.COM", []string{"Ops+Pager@Example.NET"}, testMessage)
+			if err != nil {
+				t.Fatalf("retry in other case: %v", err)
+			}
+		})
+	}
+}
+
+// Rules in monitor mode accept the messages exactly as if they were not configured, and report what they would have
+// rejected. Switching them to enforce mode applies them with no other change.
+func TestSessionPolicyMonitorMode(t *testing.T) {
+	const rules = `
+  valid_from:
+    domains: ["example.com"]
+    enforcement: %[1]s
+  valid_to:
+    denied_addresses: ["blocked@example.net"]
+    enforcement: %[1]s
+  filters:
+    - name: reject-backups
+      match_subject: "^Backup"
+      action: reject
+      enforcement: %[1]s
+    - name: tag-all
+      match_subject: "."
+      action: tag
+      tag: "[RELAYED]"
+`
+	type outcome struct {
+		err     error
+		from    string
+		to      []string
+		subject string
+	}
+	submit := func(t *testing.T, recv string) (outcome, *logBuffer) {
+		var logs logBuffer
+		prev := log.Logger
+		log.Logger = zerolog.New(&logs)
+		t.Cleanup(func() { log.Logger = prev })
+
+		fg := newFakeGraph(t)
+		addr := startListener(t, loadGraphConfig(t, fg, recv, ""))
+		msg := strings.Replace(testMessage, "Subject: Disk usage", "Subject: Backup failed", 1)
+		var out outcome
+		out.err = testutil.SubmitMessage(addr, nil, "alerts@example.org", []string{"ops@example.net", "blocked@example.net"}, []byte(msg))
+		for _, sent := range fg.Sent() {
+			m := sent.Request.Message
+			out.from, out.subject = m.From.EmailAddress.Address, m.Subject
+			for _, r := range m.ToRecipients {
+				out.to = append(out.to, r.EmailAddress.Address)
+			}
+		}
+		return out, &logs
+	}
+
+	unconfigured, _ := submit(t, `
+  filters:
+    - name: tag-all
+      match_subject: "."
+      action: tag
+      tag: "[RELAYED]"
+`)
+	if unconfigured.err != nil || unconfigured.subject != "[RELAYED] Backup failed" {
+		t.Fatalf("without the rules: %+v, want the tagged message sent", unconfigured)
+	}
+
+	monitored, logs := submit(t, fmt.Sprintf(rules, "monitor"))
+	if !reflect.DeepEqual(monitored, unconfigured) {
+		t.Errorf("in monitor mode: %+v, want %+v as without the rules", monitored, unconfigured)
+	}
+	for _, want := range []struct{ msg, policy, rule string }{
+		{"Sender address would be rejected, accepting it in monitor mode", "valid_from", "not_allowed"},
+		{"Recipient address would be rejected, accepting it in monitor mode", "valid_to", "denied"},
+		{"Content filter would apply, ignoring it in monitor mode", "filters", "reject-backups"},
+	} {
+		records := logs.Records(t, want.msg)
+		if len(records) != 1 || records[0]["event"] != "policy_would_reject" || records[0]["policy"] != want.policy || records[0]["rule"] != want.rule {
+			t.Errorf("%q records = %v, want one policy_would_reject event of %s %s", want.msg, records, want.policy, want.rule)
+		}
+	}
+
+	enforced, logs := submit(t, fmt.Sprintf(rules, "enforce"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(enforced.err, &smtpErr) || smtpErr.Code != 550 || enforced.subject != "" {
+		t.Errorf("in enforce mode: %+v, want the sender rejected with 550", enforced)
+	}
+	if records := logs.Records(t, "Sender address would be rejected, accepting it in monitor mode"); len(records) != 0 {
+		t.Errorf("in enforce mode: %d would-reject events, want none", len(records))
+	}
+}
+
+// Follow-ups keep the headers threading them to the original message. Graph only accepts "X-" headers in JSON messages,
+// so they are sent as MIME, with a Message-ID generated only for the messages received without one.
+func TestSessionThreadingHeaders(t *testing.T) {
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, `
+  domain: relay.example.com
+  inject_message_id: true
+`, ""))
+
+	const threading = "In-Reply-To: <41@alerts.example.com>\r\nReferences: <40@alerts.example.com> <41@alerts.example.com>\r\n"
+	reply := "Message-ID: <42@alerts.example.com>\r\n" + threading + strings.Replace(testMessage, "Subject: Disk usage", "Subject: Re: Disk usage", 1)
+	for _, msg := range []string{reply, threading + testMessage} {
+		if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(msg)); err != nil {
+			t.Fatalf("SubmitMessage: %v", err)
+		}
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(sent))
+	}
+	for i, s := range sent {
+		if s.MIME == nil {
+			t.Fatalf("message %d sent as JSON, want MIME carrying the threading headers", i)
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(s.MIME))
+		if err != nil {
+			t.Fatalf("message %d: invalid MIME: %v", i, err)
+		}
+		if got := parsed.Header.Get("In-Reply-To"); got != "<41@alerts.example.com>" {
+			t.Errorf("message %d: In-Reply-To = %q", i, got)
+		}
+		if got := parsed.Header.Get("References"); got != "<40@alerts.example.com> <41@alerts.example.com>" {
+			t.Errorf("message %d: References = %q", i, got)
+		}
+		ids := parsed.Header["Message-Id"]
+		switch {
+		case len(ids) != 1:
+			t.Errorf("message %d: Message-ID headers = %q, want one", i, ids)
+		case i == 0 && ids[0] != "<42@alerts.example.com>":
+			t.Errorf("reply: Message-ID = %q, want the original", ids[0])
+		case i == 1 && !strings.HasSuffix(ids[0], "@relay.example.com>"):
+			t.Errorf("reply without Message-ID: Message-ID = %q, want one generated with recv.domain", ids[0])
+		}
+	}
+}
+
+// Messages whose preserved headers Graph accepts in JSON are sent as JSON, with Message-ID as the Graph message ID and
+// Date left to Graph. Only the configured headers are preserved.
+func TestSessionPreserveHeaders(t *testing.T) {
+	const headers = "Message-ID: <42@alerts.example.com>\r\nDate: Tue, 10 Mar 2026 12:00:00 +0000\r\n" +
+		"In-Reply-To: <41@alerts.example.com>\r\nX-Ticket-ID: INC-1234\r\n"
+	tests := []struct {
+		name      string
+		send      string
+		msg       string
+		messageID string
+		custom    map[string]string
+	}{
+		{"default without threading", "", "Message-ID: <42@alerts.example.com>\r\nDate: Tue, 10 Mar 2026 12:00:00 +0000\r\n" + testMessage,
+			"<42@alerts.example.com>", map[string]string{}},
+		{"custom header", "  preserve_headers: [\"X-Ticket-ID\"]\n", headers + testMessage,
+			"", map[string]string{"X-Ticket-ID": "INC-1234"}},
+		{"none", "  preserve_headers: []\n", headers + testMessage,
+			"", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			addr := startListener(t, loadGraphConfig(t, fg, "", tt.send))
+			if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(tt.msg)); err != nil {
+				t.Fatalf("SubmitMessage: %v", err)
+			}
+
+			sent := fg.Sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(sent))
+			}
+			if sent[0].MIME != nil {
+				t.Fatalf("message sent as MIME, want JSON")
+			}
+			msg := sent[0].Request.Message
+			if msg.InternetMessageID != tt.messageID {
+				t.Errorf("internetMessageId = %q, want %q", msg.InternetMessageID, tt.messageID)
+			}
+			custom := map[string]string{}
+			for _, h := range msg.InternetMessageHeaders {
+				custom[h.Name] = h.Value
+			}
+			if !maps.Equal(custom, tt.custom) {
+				t.Errorf("headers = %v, want %v", custom, tt.custom)
+			}
+		})
+	}
+}
+
+func TestSessionBodyLimits(t *testing.T) {
+	table := "<table>" + strings.Repeat("<tr><td>/dev/sda1</td><td>91%</td></tr>", 100) + "</table>"
+	htmlMessage := "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Disk usage\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" + table
+	textMessage := testMessage + strings.Repeat("Disk usage details.\r\n", 100)
+	const note = "[Message truncated: the body exceeded the size allowed by the relay]"
+
+	tests := []struct {
+		name     string
+		limits   string
+		msg      string
+		wantCode int    // SMTP code of the rejection, 0 if the message is accepted
+		wantBody string // prefix of the sent body
+	}{
+		{"within limits", `
+    max_body_size: 8192
+    max_html_elements: 301`, htmlMessage, 0, table},
+		{"too many elements", `
+    max_html_elements: 300`, htmlMessage, 552, ""},
+		{"body too large", `
+    max_body_size: 1024`, textMessage, 552, ""},
+		{"truncate elements", `
+    max_html_elements: 7
+    body_limit_action: truncate`, htmlMessage, 0, "<table>" + strings.Repeat("<tr><td>/dev/sda1</td><td>91%</td></tr>", 2) + "\r\n<p>" + note},
+		{"truncate text", `
+    max_body_size: 40
+    body_limit_action: truncate`, textMessage, 0, "Disk usage is at 91%.\r\nDisk usage detail\r\n\r\n" + note},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			addr := startListener(t, loadGraphConfig(t, fg, "  limits:"+tt.limits+"\n", ""))
+
+			err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(tt.msg))
+			if tt.wantCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != errs.ErrBodyTooLarge.EnhancedCode {
+					t.Fatalf("SubmitMessage: got %v, want a %d reply", err, tt.wantCode)
+				}
+				if n := len(fg.Sent()); n != 0 {
+					t.Errorf("sent %d messages, want none", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SubmitMessage: %v", err)
+			}
+			sent := fg.Sent()
+			if len(sent) != 1 || !strings.HasPrefix(sent[0].Request.Message.Body.Content, tt.wantBody) {
+				t.Fatalf("sent %v, want one message with the body %q", sent, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSessionFailureSpill(t *testing.T) {
+	fg := newFakeGraph(t)
+	dir := t.TempDir()
+	addr := startListener(t, loadGraphConfig(t, fg, "  failure_spill_dir: "+dir+"\n", ""))
+
+	// Messages sent successfully are not spilled
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("spilled %d files after a successful send, want none", len(files))
+	}
+
+	// The message is spilled with its envelope, and the client still gets the sender's error
+	fg.FailNext(testutil.FailureForbidden, testutil.FailureForbidden) // every attempt fails
+	err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net", "dba@example.net"}, []byte(testMessage))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 554 {
+		t.Fatalf("SubmitMessage: got %v, want a 554 reply", err)
+	}
+	emls, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(emls) != 1 {
+		t.Fatalf("spilled %v, want one message", emls)
+	}
+	data, err := os.ReadFile(emls[0])
+	if err != nil || !bytes.Contains(data, []byte(testMessage)) {
+		t.Fatalf("spilled message = %q (%v), want the received message", data, err)
+	}
+	envelope, err := os.ReadFile(strings.TrimSuffix(emls[0], ".eml") + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env struct {
+		SessionID string   `json:"session_id"`
+		Listener  string   `json:"listener"`
+		From      string   `json:"from"`
+		To        []string `json:"to"`
+		Error     string   `json:"error"`
+		Size      int      `json:"size"`
+	}
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.SessionID == "" || env.Listener != "test" || env.From != "alerts@example.com" ||
+		!slices.Equal(env.To, []string{"ops@example.net", "dba@example.net"}) || env.Error == "" || env.Size != len(data) {
+		t.Errorf("envelope = %+v", env)
+	}
+}
+
+func TestSessionFailureSpillPruning(t *testing.T) {
+	fg := newFakeGraph(t)
+	dir := t.TempDir()
+	addr := startListener(t, loadGraphConfig(t, fg, "  failure_spill_dir: "+dir+"\n  failure_spill_max_size: 4096\n", ""))
+
+	// Each copy takes over 1 KiB, so only the newest ones fit in 4 KiB
+	body := strings.Repeat("Disk usage details.\r\n", 40)
+	for i := range 6 {
+		fg.FailNext(testutil.FailureForbidden, testutil.FailureForbidden) // every attempt fails
+		msg := fmt.Sprintf("From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Disk usage %d\r\n\r\n%s", i, body)
+		if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(msg)); err == nil {
+			t.Fatalf("message %d: sent, want the sender's error", i)
+		}
+	}
+
+	emls, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	jsons, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(emls) == 0 || len(emls) >= 6 || len(jsons) != len(emls) {
+		t.Fatalf("kept %d messages and %d envelopes, want the newest pairs only", len(emls), len(jsons))
+	}
+	var total int64
+	for _, name := range append(emls, jsons...) {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	if total > 4096 {
+		t.Errorf("spill directory holds %d bytes, want at most 4096", total)
+	}
+	newest, _ := os.ReadFile(emls[len(emls)-1])
+	if !bytes.Contains(newest, []byte("Subject: Disk usage 5")) {
+		t.Errorf("newest message kept = %.60q, want the last one", newest)
+	}
+}
+
+// Sender delivering to each recipient separately, failing for the recipients in failed with their error
+type perRecipientSender struct {
+	failed map[string]error
+}
+
+func (p perRecipientSender) Authenticate(ctx context.Context) error { return nil }
+
+func (p perRecipientSender) Send(ctx context.Context, msg *sender.Message) (*sender.Result, error) {
+	re := &sender.RecipientsError{}
+	for _, to := range msg.To {
+		re.Statuses = append(re.Statuses, sender.RecipientStatus{Address: to, Err: p.failed[to]})
+	}
+	if len(re.Failed()) > 0 {
+		return nil, re
+	}
+	return &sender.Result{Attempts: 1}, nil
+}
+
+// LMTP listeners reply for each recipient after DATA, so a recipient the sender failed to deliver to is refused
+// without the delivered ones being retried.
+func TestSessionLMTP(t *testing.T) {
+	gone := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "Mailbox unavailable"}
+	busy := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 2, 1}, Message: "Mailbox busy"}
+	tests := []struct {
+		name   string
+		failed map[string]error
+		want   map[string]int // reply codes of the refused recipients
+	}{
+		{"all delivered", nil, nil},
+		{"mixed", map[string]error{"gone@example.net": gone, "busy@example.net": busy},
+			map[string]int{"gone@example.net": 550, "busy@example.net": 451}},
+		{"all failed", map[string]error{"ops@example.net": gone, "gone@example.net": gone, "busy@example.net": gone},
+			map[string]int{"ops@example.net": 550, "gone@example.net": 550, "busy@example.net": 550}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := newFakeGraph(t)
+			cfg := loadGraphConfigListener(t, fg, "port: 2525", `
+  auth:
+    mode: disabled
+    trusted_networks: ["127.0.0.0/8"]
+`, "")
+			cfg.Recv.Listeners[0].Type = config.ListenerLMTP
+			cfg.Send.Sender = perRecipientSender{failed: tt.failed}
+			addr := startListener(t, cfg)
+
+			err := testutil.SubmitMessageLMTP(addr, "alerts@example.com", []string{"ops@example.net", "gone@example.net", "busy@example.net"}, []byte(testMessage))
+			got := map[string]int{}
+			var lmtpErr smtp.LMTPDataError
+			if errors.As(err, &lmtpErr) {
+				for rcpt, e := range lmtpErr {
+					got[rcpt] = e.Code
+				}
+			} else if err != nil {
+				t.Fatalf("SubmitMessageLMTP: %v", err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("refused recipients = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// LMTP clients do not authenticate, so the other networks are refused
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfigListener(t, fg, "port: 2525", `
+  auth:
+    mode: disabled
+    trusted_networks: ["10.0.0.0/8"]
+`, "")
+	cfg.Recv.Listeners[0].Type = config.ListenerLMTP
+	addr := startListener(t, cfg)
+	err := testutil.SubmitMessageLMTP(addr, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != errs.ErrSourceIPDisallowed.Code {
+		t.Fatalf("SubmitMessageLMTP from an untrusted network: got %v, want a %d reply", err, errs.ErrSourceIPDisallowed.Code)
+	}
+	if n := len(fg.Sent()); n != 0 {
+		t.Errorf("sent %d messages, want none", n)
+	}
+}
+
+// The Graph calls made for a message are logged with the fields of the session which received it.
+func TestSessionSenderLogContext(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, "", ""))
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	records := logs.Records(t, "Fetching a new access token for Microsoft Graph API")
+	if len(records) != 1 {
+		t.Fatalf("token records = %v, want one", records)
+	}
+	sent := fg.Sent()
+	if len(sent) != 1 || records[0]["session_id"] != sent[0].SessionID || records[0]["remote_addr"] == nil || records[0]["txn_id"] == nil {
+		t.Errorf("token record = %v, want the session_id, remote_addr and txn_id of the session", records[0])
+	}
+}
+
+// A message reserves max_size of recv.limits.max_data_memory while it is received and sent, and messages which cannot
+// reserve it within data_memory_wait are deferred.
+func TestSessionMaxDataMemory(t *testing.T) {
+	fg := newFakeGraph(t)
+	fg.SetDelay(500 * time.Millisecond)
+	cfg := loadGraphConfig(t, fg, `
+  limits:
+    max_size: 4096
+    max_data_memory: 4096
+    data_memory_wait: 100ms
+`, "")
+	addr := startListener(t, cfg)
+
+	first := make(chan error, 1)
+	go func() {
+		first <- testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage))
+	}()
+	for cfg.Recv.Limits.DataMemory.Held() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != errs.ErrInsufficientMemory.Code || smtpErr.EnhancedCode != errs.ErrInsufficientMemory.EnhancedCode {
+		t.Fatalf("SubmitMessage while the budget is reserved: got %v, want %d %v", err, errs.ErrInsufficientMemory.Code, errs.ErrInsufficientMemory.EnhancedCode)
+	}
+	if err := <-first; err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+	if held := cfg.Recv.Limits.DataMemory.Held(); held != 0 {
+		t.Errorf("%d bytes still reserved once the message was sent", held)
+	}
+
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Fatalf("SubmitMessage once the budget was released: %v", err)
+	}
+	if n := len(fg.Sent()); n != 2 {
+		t.Errorf("sent %d messages, want 2", n)
+	}
+}
+
+// Messages above recv.limits.memory_spool_threshold are spooled to recv.spool_dir while they are received, and sent
+// alike.
+func TestSessionMemorySpoolThreshold(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	dir := t.TempDir()
+	fg := newFakeGraph(t)
+	addr := startListener(t, loadGraphConfig(t, fg, `
+  spool_dir: `+dir+`
+  limits:
+    memory_spool_threshold: 4096
+`, ""))
+
+	large := testMessage + strings.Repeat("Disk usage details.\r\n", 500)
+	for _, msg := range []string{testMessage, large} {
+		if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(msg)); err != nil {
+			t.Fatalf("SubmitMessage: %v", err)
+		}
+	}
+
+	records := logs.Records(t, "Message spooled to disk")
+	if len(records) != 1 || records[0]["size"].(float64) <= 4096 {
+		t.Fatalf("spool records = %v, want one for the large message", records)
+	}
+	if path, _ := records[0]["path"].(string); filepath.Dir(path) != dir {
+		t.Errorf("message spooled to %q, want a file of %s", path, dir)
+	} else if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spool file %s left after the message was sent: %v", path, err)
+	}
+	sent := fg.Sent()
+	if len(sent) != 2 || !strings.Contains(sent[1].Request.Message.Body.Content, "Disk usage details.") {
+		t.Errorf("sent %d messages, want both, with the body of the spooled message", len(sent))
+	}
+}
+
+// A message spooled to disk reserves only memory_spool_threshold of the memory budget while it is transferred, so a
+// slow client does not hold back the messages of others.
+func TestSessionMemorySpoolReservation(t *testing.T) {
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfig(t, fg, `
+  limits:
+    max_size: 65536
+    max_data_memory: 65536
+    data_memory_wait: 100ms
+    memory_spool_threshold: 1024
+`, "")
+	addr := startListener(t, cfg)
+
+	// A client stalling in the middle of a large message
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, step := range []struct {
+		cmd  string
+		code int
+	}{
+		{"", 220},
+		{"EHLO client.example.com", 250},
+		{"MAIL FROM:<alerts@example.com>", 250},
+		{"RCPT TO:<ops@example.net>", 250},
+		{"DATA", 354},
+	} {
+		if step.cmd != "" {
+			if err := c.PrintfLine("%s", step.cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := c.ReadResponse(step.code); err != nil {
+			t.Fatalf("%q: %v", step.cmd, err)
+		}
+	}
+	body := strings.Repeat("Disk usage details.\r\n", 1000)
+	if _, err := io.WriteString(c.W, testMessage+body[:len(body)/2]); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	time.Sleep(50 * time.Millisecond)
+	if held := cfg.Recv.Limits.DataMemory.Held(); held != 1024 {
+		t.Errorf("%d bytes reserved by the stalled message, want the spool threshold", held)
+	}
+
+	if err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(testMessage)); err != nil {
+		t.Fatalf("SubmitMessage while a large message is transferred: %v", err)
+	}
+
+	if _, err := io.WriteString(c.W, body[len(body)/2:]+".\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("end of the large message: %v", err)
+	}
+	if held := cfg.Recv.Limits.DataMemory.Held(); held != 0 {
+		t.Errorf("%d bytes still reserved once the messages were sent", held)
+	}
+	if n := len(fg.Sent()); n != 2 {
+		t.Errorf("sent %d messages, want 2", n)
+	}
+}
+
+// A spooled message over max_size is rejected with 552 and releases its reservation.
+func TestSessionMemorySpoolTooLarge(t *testing.T) {
+	var logs logBuffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = prev })
+
+	fg := newFakeGraph(t)
+	cfg := loadGraphConfig(t, fg, `
+  limits:
+    max_size: 8192
+    max_data_memory: 8192
+    memory_spool_threshold: 1024
+`, "")
+	addr := startListener(t, cfg)
+
+	large := testMessage + strings.Repeat("Disk usage details.\r\n", 1000)
+	err := testutil.SubmitMessage(addr, nil, "alerts@example.com", []string{"ops@example.net"}, []byte(large))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != smtp.ErrDataTooLarge.Code {
+		t.Fatalf("SubmitMessage: got %v, want %d", err, smtp.ErrDataTooLarge.Code)
+	}
+
+	records := logs.Records(t, "Email data exceeds maximum allowed size")
+	if len(records) != 1 || records[0]["data_size"].(float64) != 8193 {
+		t.Errorf("rejection records = %v, want one for the data read up to max_size+1", records)
+	}
+	if held := cfg.Recv.Limits.DataMemory.Held(); held != 0 {
+		t.Errorf("%d bytes still reserved once the message was rejected", held)
+	}
+	if n := len(fg.Sent()); n != 0 {
+		t.Errorf("sent %d messages, want none", n)
+	}
+}
@@ -0,0 +1,118 @@
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serializes the writing and pruning of the spill directory across sessions
+var spillMu sync.Mutex
+
+// Envelope of a message the sender failed to send, written next to the message in the spill directory
+type spillEnvelope struct {
+	SessionID  string    `json:"session_id"`
+	Listener   string    `json:"listener"`
+	Remote     string    `json:"remote"`
+	User       string    `json:"user,omitempty"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	ReceivedAt time.Time `json:"received_at"`
+	FailedAt   time.Time `json:"failed_at"`
+	Error      string    `json:"error"`
+	Size       int       `json:"size"`
+}
+
+// Write the message as received and its envelope to recv.failure_spill_dir after the sender failed to send it, so a
+// message the client does not retry can still be looked into. The copy is only diagnostic: failing to write it is
+// logged at debug level and does not change the reply.
+func (s *Session) spillFailure(d *delivery, sendErr error) {
+	dir := s.configGlobal.FailureSpillDir
+	if dir == "" {
+		return
+	}
+	env := spillEnvelope{
+		SessionID:  s.id.String(),
+		Listener:   s.configListener.Name,
+		Remote:     s.remote.String(),
+		User:       s.authenticatedUser,
+		From:       s.emailFrom,
+		To:         d.to,
+		ReceivedAt: d.opts.ReceivedAt,
+		FailedAt:   time.Now(),
+		Error:      sendErr.Error(),
+		Size:       len(d.data),
+	}
+	name, err := writeSpill(dir, s.configGlobal.FailureSpillMaxSize, &env, d.data)
+	if err != nil {
+		s.log.Debug().Err(err).Str("dir", dir).Msg("Failed to spill the message which failed to send")
+		return
+	}
+	s.log.Debug().Str("file", name).Msg("Spilled the message which failed to send")
+}
+
+// Write the message to <name>.eml and its envelope to <name>.json in the directory, then remove the oldest copies
+// beyond the total size. Returns the path of the message file.
+func writeSpill(dir string, maxSize int64, env *spillEnvelope, data []byte) (string, error) {
+	envelope, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	spillMu.Lock()
+	defer spillMu.Unlock()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// Names sort chronologically, so the oldest copies are pruned first
+	base := filepath.Join(dir, fmt.Sprintf("%s-%s", env.FailedAt.UTC().Format("20060102T150405.000000"), env.SessionID))
+	if err := os.WriteFile(base+".eml", data, 0600); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(base+".json", envelope, 0600); err != nil {
+		os.Remove(base + ".eml")
+		return "", err
+	}
+	return base + ".eml", pruneSpill(dir, maxSize)
+}
+
+// Remove the oldest copies, message and envelope together, until the directory holds at most maxSize bytes. The
+// newest copy is kept even if it is larger.
+func pruneSpill(dir string, maxSize int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64)
+	var total int64
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if !e.Type().IsRegular() || ext != ".eml" && ext != ".json" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		sizes[strings.TrimSuffix(e.Name(), ext)] += info.Size()
+		total += info.Size()
+	}
+
+	names := slices.Sorted(maps.Keys(sizes))
+	for len(names) > 1 && total > maxSize {
+		for _, ext := range []string{".eml", ".json"} {
+			if err := os.Remove(filepath.Join(dir, names[0]+ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		total -= sizes[names[0]]
+		names = names[1:]
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Tracer records the SMTP transcript of each session accepted by a listener to its own file while it is enabled.
+// Credentials sent with AUTH are redacted and message data is truncated.
+type Tracer struct {
+	name    string
+	config  *config.TraceConfig
+	enabled atomic.Bool
+	seq     atomic.Uint64
+	mu      sync.Mutex // serializes the pruning of the trace directory
+}
+
+// Create a new tracer for the listener, initially enabled if the listener has debug_trace set.
+func NewTracer(lc *config.ListenerConfig, cfg *config.TraceConfig) *Tracer {
+	t := &Tracer{name: lc.Name, config: cfg}
+	t.enabled.Store(lc.DebugTrace)
+	return t
+}
+
+// Enable or disable tracing of new sessions. Sessions already being traced are traced until they end.
+func (t *Tracer) SetEnabled(enabled bool) {
+	if t.enabled.Swap(enabled) != enabled {
+		log.Info().Str("listener", t.name).Bool("enabled", enabled).Str("dir", t.config.Dir).Msg("Session tracing toggled")
+	}
+}
+
+// Returns true if new sessions are traced.
+func (t *Tracer) Enabled() bool {
+	return t.enabled.Load()
+}
+
+// Create the transcript file of a new session and remove the oldest files beyond the maximum count.
+func (t *Tracer) create() (*os.File, error) {
+	if err := os.MkdirAll(t.config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	// Names sort chronologically, so the oldest files are pruned first
+	name := fmt.Sprintf("%s-%s-%06d.trace", time.Now().UTC().Format("20060102T150405.000000"), sanitizeFileName(t.name), t.seq.Add(1))
+	f, err := os.OpenFile(filepath.Join(t.config.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t.prune()
+	return f, nil
+}
+
+func (t *Tracer) prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries, err := os.ReadDir(t.config.Dir)
+	if err != nil {
+		log.Warn().Err(err).Str("dir", t.config.Dir).Msg("Failed to list session traces")
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".trace") {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	for len(names) > t.config.MaxFiles {
+		if err := os.Remove(filepath.Join(t.config.Dir, names[0])); err != nil {
+			log.Warn().Err(err).Str("file", names[0]).Msg("Failed to remove session trace")
+		}
+		names = names[1:]
+	}
+}
+
+// Replace the characters of a listener name which are unsafe in file names.
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Create the recorder of a new session's transcript, or return nil if the tracer is disabled or the trace file cannot
+// be created.
+func (t *Tracer) newRecorder(c net.Conn) *traceRecorder {
+	if !t.Enabled() {
+		return nil
+	}
+	f, err := t.create()
+	if err != nil {
+		log.Warn().Err(err).Str("listener", t.name).Msg("Failed to create session trace, not tracing the session")
+		return nil
+	}
+	r := &traceRecorder{file: f, maxSize: t.config.MaxFileSize, maxData: t.config.MaxDataBytes, started: time.Now()}
+	r.note(fmt.Sprintf("session from %s to listener '%s' at %s", c.RemoteAddr(), t.name, r.started.UTC().Format(time.RFC3339Nano)))
+	return r
+}
+
+// Observer of the transcript of a session which records it to the session's trace file, redacting credentials and
+// truncating message data.
+type traceRecorder struct {
+	mu      sync.Mutex // the connection may be closed from another goroutine than the one serving it
+	file    *os.File
+	size    int
+	maxSize int
+	maxData int
+	started time.Time
+	stopped bool // the transcript ended (TLS started, size limit reached or connection closed)
+
+	dataRecorded int // bytes of message data recorded
+	dataSkipped  int // bytes of message data truncated
+}
+
+func (r *traceRecorder) observe(ev *transcriptEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch ev.kind {
+	case transcriptCommand:
+		r.command(ev)
+	case transcriptCredential:
+		r.record("C: <redacted>")
+	case transcriptData:
+		r.dataLine(ev.line, ev.length)
+	case transcriptChunk:
+		r.chunkData(ev.line)
+	case transcriptDataEnd:
+		if r.dataSkipped > 0 {
+			r.note(fmt.Sprintf("%d bytes of message data truncated", r.dataSkipped))
+		}
+		r.dataRecorded, r.dataSkipped = 0, 0
+		if ev.line != nil {
+			r.record("C: " + string(ev.line))
+		}
+	case transcriptReply:
+		r.record("S: " + string(ev.line))
+	case transcriptTLS:
+		r.note("TLS started, the rest of the session is encrypted")
+		r.stop()
+	}
+}
+
+func (r *traceRecorder) command(ev *transcriptEvent) {
+	if ev.verb == "AUTH" {
+		// Keep the mechanism but redact the initial response
+		verb, args, _ := strings.Cut(string(ev.line), " ")
+		if mech, _, hasResponse := strings.Cut(args, " "); hasResponse {
+			r.record("C: " + verb + " " + mech + " <redacted>")
+			return
+		}
+	}
+	r.record("C: " + string(ev.line))
+}
+
+// Record a line of message data up to the limit, truncating the line which reaches it.
+func (r *traceRecorder) dataLine(line []byte, length int) {
+	if room := r.maxData - r.dataRecorded; room < length {
+		r.dataSkipped += length - max(room, 0)
+		if room <= 0 {
+			return
+		}
+		line = line[:min(room, len(line))]
+		length = room
+	}
+	r.dataRecorded += length
+	r.record("C: " + string(line))
+}
+
+// Record the data of a BDAT chunk up to the message data limit.
+func (r *traceRecorder) chunkData(data []byte) {
+	recorded := data[:min(max(r.maxData-r.dataRecorded, 0), len(data))]
+	r.dataRecorded += len(recorded)
+	r.dataSkipped += len(data) - len(recorded)
+	for _, line := range strings.SplitAfter(string(recorded), "\n") {
+		if line != "" {
+			r.record("C: " + strings.TrimRight(line, "\r\n"))
+		}
+	}
+}
+
+// End the transcript when the connection is closed.
+func (r *traceRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stopped {
+		r.note(fmt.Sprintf("session closed after %s", time.Since(r.started).Round(time.Millisecond)))
+		r.stop()
+	}
+}
+
+// Write a comment line to the transcript.
+func (r *traceRecorder) note(text string) {
+	r.record("# " + text)
+}
+
+// Write a line to the transcript, ending it once the maximum size is reached.
+func (r *traceRecorder) record(line string) {
+	if r.stopped {
+		return
+	}
+	if r.size+len(line)+1 > r.maxSize {
+		r.file.WriteString("# trace size limit reached\n")
+		r.stop()
+		return
+	}
+	n, err := r.file.WriteString(line + "\n")
+	r.size += n
+	if err != nil {
+		log.Warn().Err(err).Str("file", r.file.Name()).Msg("Failed to write session trace")
+		r.stop()
+	}
+}
+
+func (r *traceRecorder) stop() {
+	r.stopped = true
+	r.file.Close()
+}
+
+// Returns a handler reporting whether the listeners' sessions are traced (GET) and enabling or disabling tracing of a
+// listener's sessions (POST with the listener and enabled query parameters).
+func TraceHandler(tracers []*Tracer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+				return
+			}
+			name := r.URL.Query().Get("listener")
+			i := slices.IndexFunc(tracers, func(t *Tracer) bool { return t.name == name })
+			if i < 0 {
+				http.Error(w, "unknown listener", http.StatusNotFound)
+				return
+			}
+			tracers[i].SetEnabled(enabled)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		state := make(map[string]bool, len(tracers))
+		for _, t := range tracers {
+			state[t.name] = t.Enabled()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+}
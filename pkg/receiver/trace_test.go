@@ -0,0 +1,209 @@
+package receiver_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+)
+
+// Returns the contents of the trace files in the directory once every session has been closed.
+func readTraces(t *testing.T, dir string, want int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.trace"))
+		var traces []string
+		closed := 0
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			traces = append(traces, string(data))
+			if strings.Contains(string(data), "# session closed") {
+				closed++
+			}
+		}
+		if closed >= want || time.Now().After(deadline) {
+			return traces
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionTrace(t *testing.T) {
+	fg := newFakeGraph(t)
+	dir := t.TempDir()
+	addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      require_auth: true
+      debug_trace: true`, `
+  auth:
+    mode: plain-any
+  trace:
+    dir: `+dir+`
+    max_data_bytes: 64
+`, ""))
+
+	body := strings.Repeat("Disk usage is at 91% on every volume of the database server.\r\n", 20)
+	msg := "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Disk usage\r\n\r\n" + body
+	if err := testutil.SubmitMessage(addr, sasl.NewPlainClient("", "relay", "hunter2"), "alerts@example.com", []string{"ops@example.net"}, []byte(msg)); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	traces := readTraces(t, dir, 1)
+	if len(traces) != 1 {
+		t.Fatalf("got %d traces, want 1", len(traces))
+	}
+	trace := traces[0]
+
+	// Credentials are redacted, in the initial response or in later SASL responses
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00relay\x00hunter2"))
+	if strings.Contains(trace, credentials) || strings.Contains(trace, "hunter2") {
+		t.Errorf("trace contains the credentials:\n%s", trace)
+	}
+	if !strings.Contains(trace, "C: AUTH PLAIN <redacted>") && !strings.Contains(trace, "C: <redacted>") {
+		t.Errorf("trace does not record the redacted AUTH command:\n%s", trace)
+	}
+	for _, want := range []string{"C: MAIL FROM:<alerts@example.com>", "C: RCPT TO:<ops@example.net>", "C: DATA", "S: 354 ", "C: .", "S: 250 "} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("trace does not contain %q:\n%s", want, trace)
+		}
+	}
+
+	// The message data is truncated to max_data_bytes
+	if !strings.Contains(trace, "C: From: alerts@example.com") || strings.Count(trace, "Disk usage is at 91%") > 1 {
+		t.Errorf("message data is not truncated:\n%s", trace)
+	}
+	if !strings.Contains(trace, "bytes of message data truncated") {
+		t.Errorf("trace does not record the truncation:\n%s", trace)
+	}
+}
+
+// The oldest traces are removed beyond the maximum count.
+func TestSessionTracePruning(t *testing.T) {
+	fg := newFakeGraph(t)
+	dir := t.TempDir()
+	addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      debug_trace: true`, `
+  auth:
+    mode: disabled
+  trace:
+    dir: `+dir+`
+    max_files: 2
+`, ""))
+
+	for i := 0; i < 4; i++ {
+		if _, err := ehlo(t, addr, "client.example.com"); err != nil {
+			t.Fatalf("EHLO: %v", err)
+		}
+	}
+	if traces := readTraces(t, dir, 2); len(traces) != 2 {
+		t.Errorf("got %d traces, want 2", len(traces))
+	}
+}
+
+// Message data sent in BDAT chunks is truncated like DATA.
+func TestSessionTraceBDAT(t *testing.T) {
+	fg := newFakeGraph(t)
+	dir := t.TempDir()
+	addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      debug_trace: true`, `
+  auth:
+    mode: disabled
+  trace:
+    dir: `+dir+`
+    max_data_bytes: 32
+`, ""))
+
+	msg := "From: alerts@example.com\r\nTo: ops@example.net\r\nSubject: Disk usage\r\n\r\nDisk usage is at 91%.\r\n"
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, step := range []struct {
+		cmd  string
+		code int
+	}{
+		{"", 220},
+		{"EHLO client.example.com", 250},
+		{"MAIL FROM:<alerts@example.com>", 250},
+		{"RCPT TO:<ops@example.net>", 250},
+		{fmt.Sprintf("BDAT %d LAST\r\n%s", len(msg), msg), 250},
+		{"QUIT", 221},
+	} {
+		if step.cmd != "" {
+			if err := c.PrintfLine("%s", strings.TrimSuffix(step.cmd, "\r\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := c.ReadResponse(step.code); err != nil {
+			t.Fatalf("%q: %v", step.cmd, err)
+		}
+	}
+
+	traces := readTraces(t, dir, 1)
+	if len(traces) != 1 {
+		t.Fatalf("got %d traces, want 1", len(traces))
+	}
+	if trace := traces[0]; !strings.Contains(trace, "C: BDAT ") || !strings.Contains(trace, "C: From: alerts@example.com") ||
+		strings.Contains(trace, "Disk usage is at 91%") || !strings.Contains(trace, fmt.Sprintf("# %d bytes of message data truncated", len(msg)-32)) {
+		t.Errorf("BDAT data is not truncated:\n%s", trace)
+	}
+}
+
+// Tracing and NOOP limiting follow the same transcript of a session.
+func TestSessionTraceNOOPLimit(t *testing.T) {
+	const delay = 100 * time.Millisecond
+
+	fg := newFakeGraph(t)
+	dir := t.TempDir()
+	addr := startListener(t, loadGraphConfigListener(t, fg, `port: 2525
+      debug_trace: true`, `
+  auth:
+    mode: disabled
+  noop_rate_limit: 1
+  noop_delay: "100ms"
+  trace:
+    dir: `+dir+`
+`, ""))
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		start := time.Now()
+		if err := c.PrintfLine("NOOP"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("NOOP %d: %v", i, err)
+		}
+		if elapsed := time.Since(start); (elapsed >= delay) != (i > 1) {
+			t.Errorf("NOOP %d was replied to after %s", i, elapsed)
+		}
+	}
+	c.PrintfLine("QUIT")
+	c.ReadResponse(221)
+
+	traces := readTraces(t, dir, 1)
+	if len(traces) != 1 {
+		t.Fatalf("got %d traces, want 1", len(traces))
+	}
+	if trace := traces[0]; strings.Count(trace, "C: NOOP\n") != 2 || strings.Count(trace, "S: 250 ") != 2 {
+		t.Errorf("trace does not record both NOOPs:\n%s", trace)
+	}
+}
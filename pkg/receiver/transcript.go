@@ -0,0 +1,192 @@
+package receiver
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Maximum length of a transcript line passed to the observers; longer lines are truncated
+const maxTranscriptLine = 1024
+
+// Kind of a transcript event.
+type transcriptKind int
+
+const (
+	transcriptCommand    transcriptKind = iota // a client command
+	transcriptCredential                       // a client line of an AUTH exchange, which carries credentials
+	transcriptData                             // a line of message data following DATA
+	transcriptChunk                            // raw bytes of a BDAT chunk
+	transcriptDataEnd                          // the end of the message data: the final dot of DATA or the last BDAT chunk
+	transcriptReply                            // a line of a server reply
+	transcriptTLS                              // TLS started after STARTTLS, ending the plaintext transcript
+)
+
+// Event of the transcript of a session.
+type transcriptEvent struct {
+	kind   transcriptKind
+	line   []byte // line without its line ending, of at most maxTranscriptLine bytes
+	length int    // full length of the line as received, with its line ending
+	verb   string // upper-cased verb of a command
+}
+
+// Observer of the transcript of a session.
+type transcriptObserver interface {
+	observe(ev *transcriptEvent)
+}
+
+// Follows the plaintext SMTP transcript of a session, telling commands from credentials, message data and replies, and
+// passes each line to the observers. The transcript ends when TLS starts, after which the connection carries TLS
+// records only.
+type transcript struct {
+	observers []transcriptObserver
+
+	client, server lineBuffer
+	verb           string // verb of the last client command
+	auth           bool   // within an AUTH exchange, whose client lines are credentials
+	dataPending    bool   // DATA was sent and the server has not replied yet
+	data           bool   // within the message data
+	pending        []byte // client data received after DATA, before the reply telling whether it is message data
+	chunk          int    // bytes remaining in the current BDAT chunk
+	lastChunk      bool   // the current BDAT chunk is the last one
+	stopped        bool
+}
+
+func newTranscript(observers ...transcriptObserver) *transcript {
+	return &transcript{observers: observers}
+}
+
+func (t *transcript) emit(kind transcriptKind, line []byte, length int, verb string) {
+	ev := &transcriptEvent{kind: kind, line: line, length: length, verb: verb}
+	for _, o := range t.observers {
+		o.observe(ev)
+	}
+}
+
+// Feed data read from the client.
+func (t *transcript) clientData(data []byte) {
+	for len(data) > 0 && !t.stopped {
+		// BDAT chunks are sent as raw bytes following the command
+		if t.chunk > 0 {
+			n := min(t.chunk, len(data))
+			t.chunk -= n
+			t.emit(transcriptChunk, data[:n], n, "")
+			if t.chunk == 0 && t.lastChunk {
+				t.lastChunk = false
+				t.emit(transcriptDataEnd, nil, 0, "")
+			}
+			data = data[n:]
+			continue
+		}
+		// The data following DATA is message data only if the server accepts the command
+		if t.dataPending {
+			t.pending = append(t.pending, data...)
+			return
+		}
+		var line []byte
+		var length int
+		var complete bool
+		line, length, data, complete = t.client.next(data)
+		if complete {
+			t.clientLine(line, length)
+		}
+	}
+}
+
+func (t *transcript) clientLine(line []byte, length int) {
+	switch {
+	case t.data:
+		if string(line) == "." {
+			t.data = false
+			t.emit(transcriptDataEnd, line, length, "")
+			return
+		}
+		t.emit(transcriptData, line, length, "")
+		return
+	case t.auth:
+		t.emit(transcriptCredential, line, length, "")
+		return
+	}
+
+	verb, args, _ := strings.Cut(string(line), " ")
+	t.verb = strings.ToUpper(verb)
+	switch t.verb {
+	case "AUTH":
+		t.auth = true
+	case "DATA":
+		t.dataPending = true
+	case "BDAT":
+		size, last, _ := strings.Cut(args, " ")
+		t.chunk, _ = strconv.Atoi(size)
+		t.lastChunk = strings.EqualFold(strings.TrimSpace(last), "LAST")
+	}
+	t.emit(transcriptCommand, line, length, t.verb)
+	if t.verb == "BDAT" && t.chunk <= 0 && t.lastChunk {
+		t.chunk, t.lastChunk = 0, false
+		t.emit(transcriptDataEnd, nil, 0, "")
+	}
+}
+
+// Feed data written to the client.
+func (t *transcript) serverData(data []byte) {
+	for len(data) > 0 && !t.stopped {
+		var line []byte
+		var length int
+		var complete bool
+		line, length, data, complete = t.server.next(data)
+		if complete {
+			t.serverLine(line, length)
+		}
+	}
+}
+
+func (t *transcript) serverLine(line []byte, length int) {
+	t.emit(transcriptReply, line, length, "")
+
+	// Replies continued with '-' are followed by more lines
+	if len(line) >= 4 && line[3] == '-' {
+		return
+	}
+	code, _ := strconv.Atoi(string(line[:min(3, len(line))]))
+	switch {
+	case t.auth && code != 334:
+		t.auth = false
+	case t.verb == "STARTTLS" && code == 220:
+		t.stopped = true
+		t.emit(transcriptTLS, nil, 0, "")
+	case t.dataPending:
+		t.dataPending = false
+		t.data = code == 354
+		pending := t.pending
+		t.pending = nil
+		t.clientData(pending)
+	}
+}
+
+// A partial line, of which at most maxTranscriptLine bytes are kept so a client cannot grow it without bound
+type lineBuffer struct {
+	buf    []byte
+	length int // full length of the line
+}
+
+// Append data to the partial line. Returns the line it completes, without its line ending, with its full length, and
+// the data following it.
+func (lb *lineBuffer) next(data []byte) (line []byte, length int, rest []byte, complete bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		lb.append(data)
+		return nil, 0, nil, false
+	}
+	lb.append(data[:i+1])
+	line, length = bytes.TrimRight(lb.buf, "\r\n"), lb.length
+	lb.buf, lb.length = lb.buf[:0], 0
+	return line, length, data[i+1:], true
+}
+
+func (lb *lineBuffer) append(data []byte) {
+	lb.length += len(data)
+	if room := maxTranscriptLine - len(lb.buf); room < len(data) {
+		data = data[:max(room, 0)]
+	}
+	lb.buf = append(lb.buf, data...)
+}
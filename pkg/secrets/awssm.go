@@ -0,0 +1,199 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// AWSSecretsManagerConfig locates a secret in AWS Secrets Manager. Credentials are read from the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+type AWSSecretsManagerConfig struct {
+	Region       string        `yaml:"region"`                  // AWS region (defaults to AWS_REGION)
+	SecretARN    string        `yaml:"secret_arn"`              // ARN or name of the secret
+	VersionStage string        `yaml:"version_stage,omitempty"` // Version stage to retrieve (default "AWSCURRENT")
+	Endpoint     string        `yaml:"endpoint,omitempty"`      // Override the service endpoint (e.g. a VPC endpoint)
+	TTL          time.Duration `yaml:"ttl,omitempty"`           // How long the cached value is used before it is refreshed (default 1h)
+	Timeout      time.Duration `yaml:"timeout,omitempty"`       // Request timeout (default 10s)
+}
+
+func (a *AWSSecretsManagerConfig) Validate() error {
+	if a.Region == "" {
+		a.Region = os.Getenv("AWS_REGION")
+	}
+	if a.Region == "" {
+		return errors.New("region: must be defined")
+	}
+	if a.SecretARN == "" {
+		return errors.New("secret_arn: must be defined")
+	}
+	if a.VersionStage == "" {
+		a.VersionStage = "AWSCURRENT"
+	}
+	if a.Endpoint == "" {
+		a.Endpoint = "https://secretsmanager." + a.Region + ".amazonaws.com"
+	}
+	if a.TTL < 0 {
+		return errors.New("ttl: must be a non-negative duration")
+	}
+	if a.TTL == 0 {
+		a.TTL = time.Hour
+	}
+	if a.Timeout < 0 {
+		return errors.New("timeout: must be a non-negative duration")
+	}
+	if a.Timeout == 0 {
+		a.Timeout = 10 * time.Second
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		return errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return nil
+}
+
+// Resolves a secret from AWS Secrets Manager. The resolved value is cached for the configured TTL and refreshed in
+// the background by Renew.
+type AWSSecretsManagerResolver struct {
+	cfg        *AWSSecretsManagerConfig
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	value     string
+	fetchedAt time.Time
+}
+
+func NewAWSSecretsManagerResolver(cfg *AWSSecretsManagerConfig) *AWSSecretsManagerResolver {
+	return &AWSSecretsManagerResolver{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+// GetSecretValue response; exactly one of SecretString or SecretBinary (base64) is set
+type awsGetSecretValueResponse struct {
+	SecretString string `json:"SecretString"`
+	SecretBinary string `json:"SecretBinary"`
+}
+
+// AWS JSON protocol error response
+type awsErrorResponse struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (a *AWSSecretsManagerResolver) Resolve(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.value != "" && time.Since(a.fetchedAt) < a.cfg.TTL {
+		return a.value, nil
+	}
+
+	value, err := a.fetch(ctx)
+	if err != nil {
+		if a.value != "" {
+			// keep serving the previous value rather than failing outright
+			log.Warn().Err(err).Str("secret_arn", a.cfg.SecretARN).Msg("Failed to refresh AWS secret, using cached value")
+			return a.value, nil
+		}
+		return "", err
+	}
+
+	a.value = value
+	a.fetchedAt = time.Now()
+	return value, nil
+}
+
+// Refresh the cached value every TTL until the context is cancelled.
+func (a *AWSSecretsManagerResolver) Renew(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.cfg.TTL):
+		}
+
+		value, err := a.fetch(ctx)
+		if err != nil {
+			log.Warn().Err(err).Str("secret_arn", a.cfg.SecretARN).Msg("Failed to refresh AWS secret")
+			continue
+		}
+
+		a.mu.Lock()
+		a.value = value
+		a.fetchedAt = time.Now()
+		a.mu.Unlock()
+		log.Debug().Str("secret_arn", a.cfg.SecretARN).Msg("Refreshed AWS secret")
+	}
+}
+
+func (a *AWSSecretsManagerResolver) fetch(ctx context.Context) (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"SecretId":     a.cfg.SecretARN,
+		"VersionStage": a.cfg.VersionStage,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(a.cfg.Endpoint, "/")+"/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	utils.SignAWSv4(req, payload, "secretsmanager", a.cfg.Region, utils.AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, time.Now())
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read AWS secret '%s': %w", a.cfg.SecretARN, err)
+	}
+	defer resp.Body.Close()
+
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20)) // limit to 1MB
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var er awsErrorResponse
+		if json.Unmarshal(respData, &er) == nil && er.Message != "" {
+			return "", fmt.Errorf("failed to read AWS secret '%s': %s: %s", a.cfg.SecretARN, resp.Status, er.Message)
+		}
+		return "", fmt.Errorf("failed to read AWS secret '%s': %s", a.cfg.SecretARN, resp.Status)
+	}
+
+	var sv awsGetSecretValueResponse
+	if err := json.Unmarshal(respData, &sv); err != nil {
+		return "", fmt.Errorf("invalid AWS Secrets Manager response: %w", err)
+	}
+
+	switch {
+	case sv.SecretString != "":
+		return sv.SecretString, nil
+	case sv.SecretBinary != "":
+		data, err := base64.StdEncoding.DecodeString(sv.SecretBinary)
+		if err != nil {
+			return "", fmt.Errorf("invalid binary secret '%s': %w", a.cfg.SecretARN, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		return "", fmt.Errorf("AWS secret '%s' is empty", a.cfg.SecretARN)
+	}
+}
@@ -0,0 +1,195 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake Secrets Manager endpoint replying to GetSecretValue with the current status and body.
+type fakeSecretsManager struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	body     string
+	requests []*http.Request
+	payloads []map[string]string
+}
+
+func newFakeSecretsManager(t *testing.T, status int, body string) *fakeSecretsManager {
+	t.Helper()
+	fs := &fakeSecretsManager{status: status, body: body}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &payload)
+
+		fs.mu.Lock()
+		fs.requests = append(fs.requests, r)
+		fs.payloads = append(fs.payloads, payload)
+		status, body := fs.status, fs.body
+		fs.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+// Change the reply to the next requests.
+func (fs *fakeSecretsManager) Reply(status int, body string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.status, fs.body = status, body
+}
+
+func (fs *fakeSecretsManager) Requests() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return len(fs.requests)
+}
+
+func newTestAWSResolver(t *testing.T, endpoint string, ttl time.Duration) *AWSSecretsManagerResolver {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	cfg := &AWSSecretsManagerConfig{Region: "eu-west-1", SecretARN: "gopostal/graph", Endpoint: endpoint, TTL: ttl}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	return NewAWSSecretsManagerResolver(cfg)
+}
+
+// The secret is read with a signed GetSecretValue request, from SecretString or the base64 SecretBinary.
+func TestAWSSecretsManagerResolver(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"string", `{"ARN":"arn:aws:secretsmanager:eu-west-1:123456789012:secret:gopostal/graph","SecretString":"s3cret"}`, "s3cret"},
+		{"binary", `{"SecretBinary":"` + base64.StdEncoding.EncodeToString([]byte("s3cret\n")) + `"}`, "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFakeSecretsManager(t, http.StatusOK, tt.body)
+			a := newTestAWSResolver(t, fs.URL, time.Hour)
+
+			value, err := a.Resolve(context.Background())
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if value != tt.want {
+				t.Errorf("Resolve = %q, want %q", value, tt.want)
+			}
+
+			r, payload := fs.requests[0], fs.payloads[0]
+			if r.Method != http.MethodPost || r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" ||
+				r.Header.Get("Content-Type") != "application/x-amz-json-1.1" {
+				t.Errorf("request = %s with headers %v", r.Method, r.Header)
+			}
+			if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+				!strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request") {
+				t.Errorf("Authorization = %q", auth)
+			}
+			if payload["SecretId"] != "gopostal/graph" || payload["VersionStage"] != "AWSCURRENT" {
+				t.Errorf("payload = %v", payload)
+			}
+		})
+	}
+}
+
+// The cached value is used for the TTL, then fetched again; a failed refresh keeps serving the cached value.
+func TestAWSSecretsManagerResolverTTL(t *testing.T) {
+	fs := newFakeSecretsManager(t, http.StatusOK, `{"SecretString":"first"}`)
+	a := newTestAWSResolver(t, fs.URL, 50*time.Millisecond)
+	resolve := func(want string) {
+		t.Helper()
+		if value, err := a.Resolve(context.Background()); err != nil || value != want {
+			t.Fatalf("Resolve = %q, %v, want %q", value, err, want)
+		}
+	}
+
+	resolve("first")
+	fs.Reply(http.StatusOK, `{"SecretString":"second"}`)
+	resolve("first")
+	if n := fs.Requests(); n != 1 {
+		t.Fatalf("%d requests within the TTL, want 1", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	resolve("second")
+
+	fs.Reply(http.StatusInternalServerError, "")
+	time.Sleep(60 * time.Millisecond)
+	resolve("second")
+	if n := fs.Requests(); n != 3 {
+		t.Errorf("%d requests, want the expired value fetched again each time", n)
+	}
+}
+
+// Renew refreshes the cached value every TTL in the background.
+func TestAWSSecretsManagerResolverRenew(t *testing.T) {
+	fs := newFakeSecretsManager(t, http.StatusOK, `{"SecretString":"first"}`)
+	a := newTestAWSResolver(t, fs.URL, 50*time.Millisecond)
+	if _, err := a.Resolve(context.Background()); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Renew(ctx)
+		close(done)
+	}()
+	fs.Reply(http.StatusOK, `{"SecretString":"second"}`)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		a.mu.Lock()
+		value := a.value
+		a.mu.Unlock()
+		if value == "second" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the value was not refreshed in the background")
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestAWSSecretsManagerResolverErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{"not found", http.StatusBadRequest, `{"__type":"ResourceNotFoundException","message":"Secrets Manager can't find the specified secret."}`,
+			"failed to read AWS secret 'gopostal/graph': 400 Bad Request: Secrets Manager can't find the specified secret."},
+		{"access denied without message", http.StatusForbidden, ``, "failed to read AWS secret 'gopostal/graph': 403 Forbidden"},
+		{"invalid response", http.StatusOK, `<html>`, "invalid AWS Secrets Manager response"},
+		{"invalid binary", http.StatusOK, `{"SecretBinary":"not base64!"}`, "invalid binary secret 'gopostal/graph'"},
+		{"empty", http.StatusOK, `{}`, "AWS secret 'gopostal/graph' is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFakeSecretsManager(t, tt.status, tt.body)
+			a := newTestAWSResolver(t, fs.URL, time.Hour)
+			if _, err := a.Resolve(context.Background()); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Resolve: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
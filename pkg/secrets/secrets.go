@@ -0,0 +1,106 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Resolver retrieves the value of a secret from its backing store.
+type Resolver interface {
+	Resolve(ctx context.Context) (string, error)
+}
+
+// Renewer is implemented by resolvers holding leases which must be kept alive in the background.
+type Renewer interface {
+	Renew(ctx context.Context)
+}
+
+// SecretRef references a secret stored in exactly one backend.
+type SecretRef struct {
+	Env   string                   `yaml:"env,omitempty"`                 // Name of an environment variable holding the secret
+	File  string                   `yaml:"file,omitempty"`                // Path of a file holding the secret (e.g. a Docker or Kubernetes secret)
+	Vault *VaultConfig             `yaml:"vault,omitempty"`               // HashiCorp Vault secret
+	AWS   *AWSSecretsManagerConfig `yaml:"aws_secrets_manager,omitempty"` // AWS Secrets Manager secret
+}
+
+// Returns true if no backend is configured.
+func (r *SecretRef) IsEmpty() bool {
+	return r.Env == "" && r.File == "" && r.Vault == nil && r.AWS == nil
+}
+
+// Validate the reference and create a resolver for the configured backend.
+func (r *SecretRef) Resolver() (Resolver, error) {
+	configured := 0
+	for _, set := range []bool{r.Env != "", r.File != "", r.Vault != nil, r.AWS != nil} {
+		if set {
+			configured++
+		}
+	}
+	if configured != 1 {
+		return nil, errors.New("exactly one of 'env', 'file', 'vault' or 'aws_secrets_manager' must be defined")
+	}
+
+	switch {
+	case r.Vault != nil:
+		if err := r.Vault.Validate(); err != nil {
+			return nil, fmt.Errorf("vault.%v", err)
+		}
+		return NewVaultResolver(r.Vault), nil
+	case r.AWS != nil:
+		if err := r.AWS.Validate(); err != nil {
+			return nil, fmt.Errorf("aws_secrets_manager.%v", err)
+		}
+		return NewAWSSecretsManagerResolver(r.AWS), nil
+	case r.File != "":
+		return NewFileResolver(r.File), nil
+	default:
+		return NewEnvResolver(r.Env), nil
+	}
+}
+
+// Resolves a secret from an environment variable.
+type EnvResolver struct {
+	name string
+}
+
+func NewEnvResolver(name string) *EnvResolver {
+	return &EnvResolver{name: name}
+}
+
+func (e *EnvResolver) Resolve(ctx context.Context) (string, error) {
+	value := os.Getenv(e.name)
+	if value == "" {
+		return "", fmt.Errorf("environment variable '%s' is not set or empty", e.name)
+	}
+	return value, nil
+}
+
+// Resolves a secret from a file. The file is read on each resolution, so a secret rotated in place is picked up.
+type FileResolver struct {
+	path string
+}
+
+func NewFileResolver(path string) *FileResolver {
+	return &FileResolver{path: path}
+}
+
+func (f *FileResolver) Resolve(ctx context.Context) (string, error) {
+	return ReadFile(f.path)
+}
+
+// Read a secret from a file, without the trailing newline editors and `echo` leave. Returns an error if the file
+// cannot be read or holds no secret.
+func ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret file: %v", err)
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("secret file '%s' is empty", path)
+	}
+	return value, nil
+}
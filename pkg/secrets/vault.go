@@ -0,0 +1,257 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// VaultConfig locates a secret in HashiCorp Vault. Authentication uses either a static token or AppRole.
+type VaultConfig struct {
+	Addr       string        `yaml:"addr"`                // Vault address (e.g. "https://vault.example.com:8200")
+	Token      string        `yaml:"token,omitempty"`     // Static token
+	TokenEnv   string        `yaml:"token_env,omitempty"` // Environment variable holding a static token
+	RoleID     string        `yaml:"role_id,omitempty"`   // AppRole role ID
+	SecretID   string        `yaml:"secret_id,omitempty"` // AppRole secret ID
+	SecretPath string        `yaml:"secret_path"`         // API path of the secret (e.g. "secret/data/gopostal" for KV v2)
+	Field      string        `yaml:"field,omitempty"`     // Key within the secret data (default "client_secret")
+	Timeout    time.Duration `yaml:"timeout,omitempty"`   // Request timeout (default 10s)
+}
+
+func (v *VaultConfig) Validate() error {
+	if v.Addr == "" {
+		return errors.New("addr: must be defined")
+	}
+	if v.SecretPath == "" {
+		return errors.New("secret_path: must be defined")
+	}
+	if v.TokenEnv != "" {
+		v.Token = os.Getenv(v.TokenEnv)
+		if v.Token == "" {
+			return fmt.Errorf("token_env: environment variable '%s' is not set or empty", v.TokenEnv)
+		}
+	}
+	approle := v.RoleID != "" || v.SecretID != ""
+	if v.Token != "" && approle {
+		return errors.New("token: cannot be combined with role_id/secret_id")
+	}
+	if v.Token == "" && (v.RoleID == "" || v.SecretID == "") {
+		return errors.New("token: either a token or both role_id and secret_id must be defined")
+	}
+	if v.Field == "" {
+		v.Field = "client_secret"
+	}
+	if v.Timeout < 0 {
+		return errors.New("timeout: must be a non-negative duration")
+	}
+	if v.Timeout == 0 {
+		v.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// Resolves a secret from Vault's KV (v1 or v2) engine. The resolved value is cached in memory, and the token and
+// secret leases are renewed in the background by Renew.
+type VaultResolver struct {
+	cfg        *VaultConfig
+	httpClient *http.Client
+
+	mu            sync.Mutex
+	token         string
+	tokenTTL      time.Duration
+	tokenRenew    bool
+	value         string
+	leaseID       string
+	leaseDuration time.Duration
+	leaseRenew    bool
+}
+
+func NewVaultResolver(cfg *VaultConfig) *VaultResolver {
+	return &VaultResolver{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: cfg.Timeout},
+		token:      cfg.Token,
+	}
+}
+
+// Vault API response envelope
+type vaultResponse struct {
+	LeaseID       string         `json:"lease_id"`
+	LeaseDuration int            `json:"lease_duration"`
+	Renewable     bool           `json:"renewable"`
+	Data          map[string]any `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func (v *VaultResolver) Resolve(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.value != "" {
+		return v.value, nil
+	}
+
+	if v.token == "" {
+		if err := v.login(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	resp, err := v.do(ctx, http.MethodGet, "/v1/"+strings.TrimPrefix(v.cfg.SecretPath, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read vault secret '%s': %w", v.cfg.SecretPath, err)
+	}
+
+	data := resp.Data
+	// KV v2 nests the secret data alongside its metadata
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[v.cfg.Field].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("vault secret '%s' has no string field '%s'", v.cfg.SecretPath, v.cfg.Field)
+	}
+
+	v.value = value
+	v.leaseID = resp.LeaseID
+	v.leaseDuration = time.Duration(resp.LeaseDuration) * time.Second
+	v.leaseRenew = resp.Renewable
+	return value, nil
+}
+
+// Renew the token and secret leases until the context is cancelled. Renewal happens at half of the shortest
+// remaining lease; if a lease can no longer be renewed the cached value is kept.
+func (v *VaultResolver) Renew(ctx context.Context) {
+	for {
+		v.mu.Lock()
+		interval := time.Duration(0)
+		for _, ttl := range []time.Duration{v.tokenTTL, v.leaseDuration} {
+			if ttl > 0 && (interval == 0 || ttl/2 < interval) {
+				interval = ttl / 2
+			}
+		}
+		v.mu.Unlock()
+
+		if interval == 0 {
+			return // nothing to renew
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		v.mu.Lock()
+		if err := v.renew(ctx); err != nil {
+			log.Warn().Err(err).Str("secret_path", v.cfg.SecretPath).Msg("Failed to renew vault lease")
+		}
+		v.mu.Unlock()
+	}
+}
+
+func (v *VaultResolver) renew(ctx context.Context) error {
+	if v.tokenRenew {
+		resp, err := v.do(ctx, http.MethodPost, "/v1/auth/token/renew-self", map[string]any{})
+		if err != nil {
+			return fmt.Errorf("token renewal failed: %w", err)
+		}
+		if resp.Auth != nil {
+			v.tokenTTL = time.Duration(resp.Auth.LeaseDuration) * time.Second
+			v.tokenRenew = resp.Auth.Renewable
+		}
+	}
+	if v.leaseRenew && v.leaseID != "" {
+		resp, err := v.do(ctx, http.MethodPut, "/v1/sys/leases/renew", map[string]any{"lease_id": v.leaseID})
+		if err != nil {
+			return fmt.Errorf("lease renewal failed: %w", err)
+		}
+		v.leaseDuration = time.Duration(resp.LeaseDuration) * time.Second
+		v.leaseRenew = resp.Renewable
+	}
+	log.Debug().Str("secret_path", v.cfg.SecretPath).Msg("Renewed vault leases")
+	return nil
+}
+
+// Authenticate with AppRole and store the resulting token.
+func (v *VaultResolver) login(ctx context.Context) error {
+	resp, err := v.do(ctx, http.MethodPost, "/v1/auth/approle/login", map[string]any{
+		"role_id":   v.cfg.RoleID,
+		"secret_id": v.cfg.SecretID,
+	})
+	if err != nil {
+		return fmt.Errorf("vault approle login failed: %w", err)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return errors.New("vault approle login returned no token")
+	}
+	v.token = resp.Auth.ClientToken
+	v.tokenTTL = time.Duration(resp.Auth.LeaseDuration) * time.Second
+	v.tokenRenew = resp.Auth.Renewable
+	return nil
+}
+
+func (v *VaultResolver) do(ctx context.Context, method, path string, payload any) (*vaultResponse, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.cfg.Addr, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20)) // limit to 1MB
+	if err != nil {
+		return nil, err
+	}
+
+	var vr vaultResponse
+	if len(respData) > 0 {
+		if err := json.Unmarshal(respData, &vr); err != nil {
+			return nil, fmt.Errorf("invalid vault response: %w", err)
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if len(vr.Errors) > 0 {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.Join(vr.Errors, "; "))
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return &vr, nil
+}
@@ -0,0 +1,280 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Request received by the fake Vault server
+type vaultRequest struct {
+	Method string
+	Path   string
+	Token  string
+	Body   map[string]any
+}
+
+// Fake Vault server replying to each API path with a status and a JSON body, and recording the requests.
+type fakeVault struct {
+	*httptest.Server
+	replies map[string]func() (int, string)
+
+	mu       sync.Mutex
+	requests []vaultRequest
+}
+
+func newFakeVault(t *testing.T, replies map[string]func() (int, string)) *fakeVault {
+	t.Helper()
+	fv := &fakeVault{replies: replies}
+	fv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := vaultRequest{Method: r.Method, Path: r.URL.Path, Token: r.Header.Get("X-Vault-Token")}
+		if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+			json.Unmarshal(data, &req.Body)
+		}
+		fv.mu.Lock()
+		fv.requests = append(fv.requests, req)
+		fv.mu.Unlock()
+
+		reply, ok := fv.replies[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		status, body := reply()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(fv.Close)
+	return fv
+}
+
+// Reply with a fixed status and body.
+func vaultReply(status int, body string) func() (int, string) {
+	return func() (int, string) { return status, body }
+}
+
+func (fv *fakeVault) Requests() []vaultRequest {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	return append([]vaultRequest(nil), fv.requests...)
+}
+
+func newTestVaultResolver(t *testing.T, cfg VaultConfig) *VaultResolver {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	return NewVaultResolver(&cfg)
+}
+
+// A KV v2 secret is read with the static token, from the data nested next to its metadata, and cached.
+func TestVaultResolverTokenKVv2(t *testing.T) {
+	fv := newFakeVault(t, map[string]func() (int, string){
+		"/v1/secret/data/gopostal": vaultReply(http.StatusOK, `{"data":{"data":{"client_secret":"s3cret"},"metadata":{"version":3}}}`),
+	})
+	v := newTestVaultResolver(t, VaultConfig{Addr: fv.URL + "/", Token: "root-token", SecretPath: "/secret/data/gopostal"})
+
+	for range 2 {
+		value, err := v.Resolve(context.Background())
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		if value != "s3cret" {
+			t.Fatalf("Resolve = %q, want %q", value, "s3cret")
+		}
+	}
+	requests := fv.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1 as the value is cached", len(requests))
+	}
+	if r := requests[0]; r.Method != http.MethodGet || r.Path != "/v1/secret/data/gopostal" || r.Token != "root-token" {
+		t.Errorf("request = %+v", r)
+	}
+}
+
+// A KV v1 secret holds its fields directly in data.
+func TestVaultResolverKVv1(t *testing.T) {
+	fv := newFakeVault(t, map[string]func() (int, string){
+		"/v1/kv/gopostal": vaultReply(http.StatusOK, `{"data":{"api_key":"SG.key","metadata":"not KV v2"}}`),
+	})
+	v := newTestVaultResolver(t, VaultConfig{Addr: fv.URL, Token: "root-token", SecretPath: "kv/gopostal", Field: "api_key"})
+
+	value, err := v.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if value != "SG.key" {
+		t.Errorf("Resolve = %q, want %q", value, "SG.key")
+	}
+}
+
+// AppRole logs in first and reads the secret with the token it was given.
+func TestVaultResolverAppRole(t *testing.T) {
+	fv := newFakeVault(t, map[string]func() (int, string){
+		"/v1/auth/approle/login":   vaultReply(http.StatusOK, `{"auth":{"client_token":"approle-token","lease_duration":3600,"renewable":true}}`),
+		"/v1/secret/data/gopostal": vaultReply(http.StatusOK, `{"data":{"data":{"client_secret":"s3cret"},"metadata":{}}}`),
+	})
+	v := newTestVaultResolver(t, VaultConfig{Addr: fv.URL, RoleID: "role", SecretID: "secret-id", SecretPath: "secret/data/gopostal"})
+
+	if value, err := v.Resolve(context.Background()); err != nil || value != "s3cret" {
+		t.Fatalf("Resolve = %q, %v", value, err)
+	}
+	requests := fv.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("%d requests, want 2", len(requests))
+	}
+	login := requests[0]
+	if login.Method != http.MethodPost || login.Path != "/v1/auth/approle/login" || login.Token != "" ||
+		login.Body["role_id"] != "role" || login.Body["secret_id"] != "secret-id" {
+		t.Errorf("login request = %+v", login)
+	}
+	if requests[1].Token != "approle-token" {
+		t.Errorf("secret read with token %q, want the AppRole token", requests[1].Token)
+	}
+	if v.tokenTTL != time.Hour || !v.tokenRenew {
+		t.Errorf("token TTL = %s, renewable = %v", v.tokenTTL, v.tokenRenew)
+	}
+}
+
+// The renewable token and secret lease are renewed with the durations Vault returns.
+func TestVaultResolverRenew(t *testing.T) {
+	fv := newFakeVault(t, map[string]func() (int, string){
+		"/v1/auth/approle/login":    vaultReply(http.StatusOK, `{"auth":{"client_token":"approle-token","lease_duration":60,"renewable":true}}`),
+		"/v1/database/creds/relay":  vaultReply(http.StatusOK, `{"lease_id":"database/creds/relay/abc","lease_duration":30,"renewable":true,"data":{"client_secret":"s3cret"}}`),
+		"/v1/auth/token/renew-self": vaultReply(http.StatusOK, `{"auth":{"client_token":"approle-token","lease_duration":120,"renewable":true}}`),
+		"/v1/sys/leases/renew":      vaultReply(http.StatusOK, `{"lease_id":"database/creds/relay/abc","lease_duration":90,"renewable":false}`),
+	})
+	v := newTestVaultResolver(t, VaultConfig{Addr: fv.URL, RoleID: "role", SecretID: "secret-id", SecretPath: "database/creds/relay"})
+	if _, err := v.Resolve(context.Background()); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if v.leaseID != "database/creds/relay/abc" || v.leaseDuration != 30*time.Second || !v.leaseRenew {
+		t.Fatalf("lease = %q for %s, renewable = %v", v.leaseID, v.leaseDuration, v.leaseRenew)
+	}
+
+	if err := v.renew(context.Background()); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	requests := fv.Requests()[2:]
+	if len(requests) != 2 {
+		t.Fatalf("%d renewal requests, want 2", len(requests))
+	}
+	if r := requests[0]; r.Method != http.MethodPost || r.Path != "/v1/auth/token/renew-self" || r.Token != "approle-token" {
+		t.Errorf("token renewal request = %+v", r)
+	}
+	if r := requests[1]; r.Method != http.MethodPut || r.Path != "/v1/sys/leases/renew" || r.Body["lease_id"] != "database/creds/relay/abc" {
+		t.Errorf("lease renewal request = %+v", r)
+	}
+	if v.tokenTTL != 2*time.Minute || v.leaseDuration != 90*time.Second || v.leaseRenew {
+		t.Errorf("after renewal: token TTL = %s, lease = %s, lease renewable = %v", v.tokenTTL, v.leaseDuration, v.leaseRenew)
+	}
+
+	// A lease which is no longer renewable is left to expire, and the cached value is kept
+	if err := v.renew(context.Background()); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if got := len(fv.Requests()); got != 5 {
+		t.Errorf("%d requests, want only the token renewed again", got)
+	}
+	if value, err := v.Resolve(context.Background()); err != nil || value != "s3cret" {
+		t.Errorf("Resolve = %q, %v", value, err)
+	}
+}
+
+// Without leases to keep alive, Renew returns at once.
+func TestVaultResolverRenewNothing(t *testing.T) {
+	fv := newFakeVault(t, map[string]func() (int, string){
+		"/v1/secret/gopostal": vaultReply(http.StatusOK, `{"data":{"client_secret":"s3cret"}}`),
+	})
+	v := newTestVaultResolver(t, VaultConfig{Addr: fv.URL, Token: "root-token", SecretPath: "secret/gopostal"})
+	if _, err := v.Resolve(context.Background()); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		v.Renew(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Renew did not return without leases")
+	}
+}
+
+func TestVaultResolverErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     VaultConfig
+		replies map[string]func() (int, string)
+		wantErr string
+	}{
+		{
+			name: "permission denied",
+			cfg:  VaultConfig{Token: "bad-token", SecretPath: "secret/data/gopostal"},
+			replies: map[string]func() (int, string){
+				"/v1/secret/data/gopostal": vaultReply(http.StatusForbidden, `{"errors":["permission denied"]}`),
+			},
+			wantErr: "failed to read vault secret 'secret/data/gopostal': 403 Forbidden: permission denied",
+		},
+		{
+			name: "server error without body",
+			cfg:  VaultConfig{Token: "root-token", SecretPath: "secret/data/gopostal"},
+			replies: map[string]func() (int, string){
+				"/v1/secret/data/gopostal": vaultReply(http.StatusInternalServerError, ""),
+			},
+			wantErr: "500 Internal Server Error",
+		},
+		{
+			name: "invalid response",
+			cfg:  VaultConfig{Token: "root-token", SecretPath: "secret/data/gopostal"},
+			replies: map[string]func() (int, string){
+				"/v1/secret/data/gopostal": vaultReply(http.StatusOK, `<html>`),
+			},
+			wantErr: "invalid vault response",
+		},
+		{
+			name: "missing field",
+			cfg:  VaultConfig{Token: "root-token", SecretPath: "secret/data/gopostal"},
+			replies: map[string]func() (int, string){
+				"/v1/secret/data/gopostal": vaultReply(http.StatusOK, `{"data":{"data":{"password":"s3cret"},"metadata":{}}}`),
+			},
+			wantErr: "vault secret 'secret/data/gopostal' has no string field 'client_secret'",
+		},
+		{
+			name: "login refused",
+			cfg:  VaultConfig{RoleID: "role", SecretID: "wrong", SecretPath: "secret/data/gopostal"},
+			replies: map[string]func() (int, string){
+				"/v1/auth/approle/login": vaultReply(http.StatusBadRequest, `{"errors":["invalid role or secret ID"]}`),
+			},
+			wantErr: "vault approle login failed: 400 Bad Request: invalid role or secret ID",
+		},
+		{
+			name: "login without token",
+			cfg:  VaultConfig{RoleID: "role", SecretID: "secret-id", SecretPath: "secret/data/gopostal"},
+			replies: map[string]func() (int, string){
+				"/v1/auth/approle/login": vaultReply(http.StatusOK, `{"auth":null}`),
+			},
+			wantErr: "vault approle login returned no token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fv := newFakeVault(t, tt.replies)
+			tt.cfg.Addr = fv.URL
+			v := newTestVaultResolver(t, tt.cfg)
+			if _, err := v.Resolve(context.Background()); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Resolve: got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package selftest
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/receiver"
+	"github.com/goodieshq/gopostal/pkg/sender"
+)
+
+// Certificates expiring within this duration are reported as warnings
+const CertExpiryWarning = 14 * 24 * time.Hour
+
+// Time allowed to each check contacting a remote service (sender authentication, DNS)
+const CheckTimeout = 10 * time.Second
+
+// Outcome of a check
+type Status string
+
+const (
+	StatusOK   Status = "ok"
+	StatusWarn Status = "warn" // the relay works, but needs attention (e.g. a certificate expiring soon)
+	StatusFail Status = "fail"
+)
+
+// Result of a single check
+type Result struct {
+	Check  string `json:"check"`  // what was checked, e.g. "bind" or "sender"
+	Target string `json:"target"` // what it was checked for, e.g. the name of a listener
+	Status Status `json:"status"`
+	Detail string `json:"detail"`
+}
+
+func ok(check, target, format string, args ...any) Result {
+	return Result{Check: check, Target: target, Status: StatusOK, Detail: fmt.Sprintf(format, args...)}
+}
+
+func warn(check, target, format string, args ...any) Result {
+	return Result{Check: check, Target: target, Status: StatusWarn, Detail: fmt.Sprintf(format, args...)}
+}
+
+func fail(check, target string, err error) Result {
+	return Result{Check: check, Target: target, Status: StatusFail, Detail: err.Error()}
+}
+
+// Results of the checks of a configuration
+type Report struct {
+	Time    time.Time `json:"time"`
+	OK      bool      `json:"ok"` // no check failed
+	Results []Result  `json:"results"`
+}
+
+// Options of the checks run by Run
+type Options struct {
+	// Bind the listeners to check their addresses are available, releasing them at once. Disabled when the listeners
+	// are already serving.
+	Bind bool
+}
+
+// Run the checks of the configuration: the listeners and their certificates, the effective limits, the
+// authentication of the senders, the spool and failure spill directories and the DNS resolution of the Graph
+// endpoints.
+func Run(ctx context.Context, cfg *config.Config, opts Options) *Report {
+	var results []Result
+	for i := range cfg.Recv.Listeners {
+		lc := &cfg.Recv.Listeners[i]
+		if opts.Bind {
+			results = append(results, CheckBind(lc))
+		}
+		if lc.TLSConfig != nil {
+			results = append(results, CheckCertificate(lc, time.Now()))
+		}
+	}
+	results = append(results, CheckLimits(&cfg.Recv.RecvGlobalConfig))
+	results = append(results, CheckSender(ctx, "default", cfg.Send.Sender))
+	for _, ns := range cfg.Send.Senders {
+		results = append(results, CheckSender(ctx, ns.Name, ns.Sender))
+	}
+	if cfg.Recv.Limits.MemorySpoolThreshold > 0 {
+		results = append(results, CheckSpoolDir(cfg.Recv.SpoolDir))
+	}
+	if cfg.Recv.FailureSpillDir != "" {
+		results = append(results, CheckSpillDir(cfg.Recv.FailureSpillDir))
+	}
+	if cfg.Send.Type == config.SenderGraph {
+		for _, host := range GraphHosts(&cfg.Send) {
+			results = append(results, CheckDNS(ctx, net.DefaultResolver, host))
+		}
+	}
+	return NewReport(results)
+}
+
+// Create the report of the results.
+func NewReport(results []Result) *Report {
+	report := &Report{Time: time.Now(), OK: true, Results: results}
+	for _, r := range results {
+		if r.Status == StatusFail {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+// Write the report as a table with a line per check.
+func (r *Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tTARGET\tSTATUS\tDETAIL")
+	for _, res := range r.Results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", res.Check, res.Target, res.Status, res.Detail)
+	}
+	return tw.Flush()
+}
+
+// Write the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Check the address of the listener can be bound, releasing it at once.
+func CheckBind(lc *config.ListenerConfig) Result {
+	network, addr := receiver.ListenAddr(lc)
+	l, err := receiver.Listen(lc)
+	if err != nil {
+		return fail("bind", lc.Name, err)
+	}
+	l.Close()
+	return ok("bind", lc.Name, "%s listener can bind %s %s", lc.Type, network, addr)
+}
+
+// Check the certificate served by the listener is valid at the time, warning if it expires within CertExpiryWarning.
+func CheckCertificate(lc *config.ListenerConfig, now time.Time) Result {
+	if lc.TLSConfig == nil || len(lc.TLSConfig.Certificates) == 0 {
+		return fail("tls", lc.Name, fmt.Errorf("no certificate loaded"))
+	}
+	cert := lc.TLSConfig.Certificates[0]
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fail("tls", lc.Name, fmt.Errorf("invalid certificate: %w", err))
+		}
+	}
+	subject := leaf.Subject.CommonName
+	switch {
+	case now.After(leaf.NotAfter):
+		return fail("tls", lc.Name, fmt.Errorf("certificate of '%s' expired on %s", subject, leaf.NotAfter.Format(time.RFC3339)))
+	case now.Before(leaf.NotBefore):
+		return fail("tls", lc.Name, fmt.Errorf("certificate of '%s' is not valid before %s", subject, leaf.NotBefore.Format(time.RFC3339)))
+	case leaf.NotAfter.Sub(now) < CertExpiryWarning:
+		return warn("tls", lc.Name, "certificate of '%s' expires soon, on %s", subject, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return ok("tls", lc.Name, "certificate of '%s' expires on %s", subject, leaf.NotAfter.Format(time.RFC3339))
+}
+
+// Report the effective message limits, once the defaults are applied.
+func CheckLimits(global *config.RecvGlobalConfig) Result {
+	l := global.Limits
+	return ok("limits", "recv", "max_size=%d max_recipients=%d max_subject_length=%d timeout=%s max_body_size=%d max_html_elements=%d max_data_memory=%d memory_spool_threshold=%d",
+		l.MaxSize, l.MaxRecipients, l.MaxSubjectLength, l.Timeout, l.MaxBodySize, l.MaxHTMLElements, l.MaxDataMemory, l.MemorySpoolThreshold)
+}
+
+// Check the sender can authenticate to its API.
+func CheckSender(ctx context.Context, name string, s sender.Sender) Result {
+	if s == nil {
+		return fail("sender", name, fmt.Errorf("sender is not configured"))
+	}
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+	if err := s.Authenticate(ctx); err != nil {
+		return fail("sender", name, err)
+	}
+	if dr, isDryRunner := s.(sender.DryRunner); isDryRunner && dr.DryRun() {
+		return warn("sender", name, "authenticated, but the sender does not deliver messages")
+	}
+	return ok("sender", name, "authenticated")
+}
+
+// Check a file can be created in the directory large messages are spooled to (recv.spool_dir).
+func CheckSpoolDir(dir string) Result {
+	f, err := os.CreateTemp(dir, "gopostal-selftest-*")
+	if err != nil {
+		return fail("spool", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return ok("spool", dir, "writable")
+}
+
+// Check a file can be created in the directory the messages which failed to send are copied to
+// (recv.failure_spill_dir), creating the directory like the copies do.
+func CheckSpillDir(dir string) Result {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fail("spill", dir, err)
+	}
+	f, err := os.CreateTemp(dir, "gopostal-selftest-*")
+	if err != nil {
+		return fail("spill", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return ok("spill", dir, "writable")
+}
+
+// Returns the hosts of the login and Graph endpoints of the Graph senders, the default endpoints included.
+func GraphHosts(send *config.SendConfig) []string {
+	graphs := []config.GraphSenderConfig{send.Graph}
+	for _, ns := range send.Senders {
+		graphs = append(graphs, ns.Graph)
+	}
+	for _, route := range send.UserRoutes {
+		graphs = append(graphs, route.Graph)
+	}
+
+	var hosts []string
+	for _, g := range graphs {
+		login, graph := g.LoginEndpoint, g.GraphEndpoint
+		if login == "" {
+			login = sender.DefaultLoginEndpoint
+		}
+		if graph == "" {
+			graph = sender.DefaultGraphEndpoint
+		}
+		for _, endpoint := range []string{login, graph} {
+			if u, err := url.Parse(endpoint); err == nil && u.Hostname() != "" && !slices.Contains(hosts, u.Hostname()) {
+				hosts = append(hosts, u.Hostname())
+			}
+		}
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// Check the host name resolves.
+func CheckDNS(ctx context.Context, resolver *net.Resolver, host string) Result {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return fail("dns", host, err)
+	}
+	return ok("dns", host, "resolves to %v", addrs)
+}
+
+// Returns a handler serving the report as JSON, replying 503 if a check failed.
+func Handler(report *Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		report.WriteJSON(w)
+	})
+}
@@ -0,0 +1,192 @@
+package selftest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+)
+
+func TestCheckBind(t *testing.T) {
+	if res := CheckBind(&config.ListenerConfig{Name: "ephemeral", Type: config.ListenerSMTP, Addr: "127.0.0.1:0"}); res.Status != StatusOK {
+		t.Errorf("ephemeral port: %+v", res)
+	}
+
+	socket := &config.ListenerConfig{Name: "local", Type: config.ListenerLMTP, SocketPath: filepath.Join(t.TempDir(), "lmtp.sock"),
+		SocketFileMode: 0o660, SocketUID: -1, SocketGID: -1}
+	if res := CheckBind(socket); res.Status != StatusOK || !strings.Contains(res.Detail, "unix") {
+		t.Errorf("socket: %+v", res)
+	}
+
+	// A port in use cannot be bound
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	busy := &config.ListenerConfig{Name: "busy", Type: config.ListenerSMTP, Addr: l.Addr().String()}
+	if res := CheckBind(busy); res.Status != StatusFail || res.Target != "busy" {
+		t.Errorf("port in use: %+v", res)
+	}
+}
+
+func TestCheckCertificate(t *testing.T) {
+	certFile, keyFile, err := testutil.WriteSelfSignedCert(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := &config.ListenerConfig{Name: "submission", TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+
+	// The test certificate is valid for a day
+	tests := []struct {
+		now    time.Time
+		status Status
+		detail string
+	}{
+		{time.Now(), StatusWarn, "certificate of 'localhost' expires soon"},
+		{time.Now().Add(48 * time.Hour), StatusFail, "certificate of 'localhost' expired on"},
+		{time.Now().Add(-48 * time.Hour), StatusFail, "certificate of 'localhost' is not valid before"},
+	}
+	for _, tt := range tests {
+		if res := CheckCertificate(lc, tt.now); res.Status != tt.status || !strings.Contains(res.Detail, tt.detail) {
+			t.Errorf("at %s: %+v, want %s %q", tt.now, res, tt.status, tt.detail)
+		}
+	}
+
+	if res := CheckCertificate(&config.ListenerConfig{Name: "plain"}, time.Now()); res.Status != StatusFail {
+		t.Errorf("without certificate: %+v", res)
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	global := &config.RecvGlobalConfig{}
+	global.Limits.MaxSize = 10 << 20
+	global.Limits.MaxHTMLElements = 5000
+	global.Limits.MaxDataMemory = 160 << 20
+	res := CheckLimits(global)
+	if res.Status != StatusOK || !strings.Contains(res.Detail, "max_size=10485760") || !strings.Contains(res.Detail, "max_html_elements=5000") ||
+		!strings.Contains(res.Detail, "max_data_memory=167772160") {
+		t.Errorf("limits: %+v", res)
+	}
+}
+
+// Sender failing to authenticate with err
+type authSender struct {
+	err error
+}
+
+func (s authSender) Authenticate(ctx context.Context) error { return s.err }
+
+func (s authSender) Send(ctx context.Context, msg *sender.Message) (*sender.Result, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestCheckSender(t *testing.T) {
+	if res := CheckSender(context.Background(), "default", authSender{}); res.Status != StatusOK {
+		t.Errorf("authenticated: %+v", res)
+	}
+	res := CheckSender(context.Background(), "customer-a", authSender{err: errors.New("invalid client secret")})
+	if res.Status != StatusFail || res.Target != "customer-a" || res.Detail != "invalid client secret" {
+		t.Errorf("failing: %+v", res)
+	}
+	if res := CheckSender(context.Background(), "default", nil); res.Status != StatusFail {
+		t.Errorf("missing: %+v", res)
+	}
+}
+
+func TestCheckSpoolDir(t *testing.T) {
+	dir := t.TempDir()
+	if res := CheckSpoolDir(dir); res.Status != StatusOK {
+		t.Errorf("temporary directory: %+v", res)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) != 0 {
+		t.Errorf("files left in the spool directory: %v", matches)
+	}
+	if res := CheckSpoolDir(filepath.Join(dir, "missing")); res.Status != StatusFail {
+		t.Errorf("missing directory: %+v", res)
+	}
+}
+
+func TestCheckSpillDir(t *testing.T) {
+	dir := t.TempDir()
+	if res := CheckSpillDir(dir); res.Status != StatusOK {
+		t.Errorf("temporary directory: %+v", res)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) != 0 {
+		t.Errorf("files left in the spill directory: %v", matches)
+	}
+	// The directory is created like the copies create it
+	if res := CheckSpillDir(filepath.Join(dir, "spill")); res.Status != StatusOK {
+		t.Errorf("missing directory: %+v", res)
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if res := CheckSpillDir(filepath.Join(file, "spill")); res.Status != StatusFail {
+		t.Errorf("directory under a file: %+v", res)
+	}
+}
+
+func TestGraphHosts(t *testing.T) {
+	send := &config.SendConfig{
+		Senders: []config.NamedSender{{Name: "gov", Graph: config.GraphSenderConfig{
+			LoginEndpoint: "https://login.microsoftonline.us",
+			GraphEndpoint: "https://graph.microsoft.us/",
+		}}},
+	}
+	want := []string{"graph.microsoft.com", "graph.microsoft.us", "login.microsoftonline.com", "login.microsoftonline.us"}
+	if got := GraphHosts(send); !slices.Equal(got, want) {
+		t.Errorf("hosts = %v, want %v", got, want)
+	}
+}
+
+func TestCheckDNS(t *testing.T) {
+	if res := CheckDNS(context.Background(), net.DefaultResolver, "localhost"); res.Status != StatusOK {
+		t.Errorf("localhost: %+v", res)
+	}
+	if res := CheckDNS(context.Background(), net.DefaultResolver, "graph.example.invalid"); res.Status != StatusFail {
+		t.Errorf("invalid host: %+v", res)
+	}
+}
+
+func TestReport(t *testing.T) {
+	report := NewReport([]Result{
+		ok("limits", "recv", "max_size=1"),
+		warn("tls", "submission", "certificate expires soon"),
+	})
+	if !report.OK {
+		t.Error("report with warnings is not OK")
+	}
+	var table strings.Builder
+	if err := report.WriteTable(&table); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "CHECK") || !strings.Contains(lines[2], "submission  warn    certificate expires soon") {
+		t.Errorf("table =\n%s", table.String())
+	}
+
+	report = NewReport(append(report.Results, fail("sender", "default", errors.New("invalid client secret"))))
+	rec := httptest.NewRecorder()
+	Handler(report).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz/details", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"detail": "invalid client secret"`) {
+		t.Errorf("handler replied %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,110 @@
+package sender
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/metrics"
+)
+
+// Default number of sendMail calls in flight for the same mailbox
+const DefaultMaxConcurrent = 4
+
+// Waits for a mailbox slot longer than this are logged and counted
+const SlowSlotWait = 5 * time.Second
+
+// Limits the calls in flight for each mailbox, as Graph throttles concurrent requests per mailbox more aggressively
+// than per application.
+type mailboxSlots struct {
+	limit int
+
+	mu        sync.Mutex
+	mailboxes map[string]*mailboxSlot
+}
+
+type mailboxSlot struct {
+	sem  *fairSemaphore
+	refs int // calls holding or waiting for a slot; the mailbox is forgotten once none are left
+}
+
+// Create a limit of calls in flight per mailbox. A limit of 0 or less does not limit the calls.
+func newMailboxSlots(limit int) *mailboxSlots {
+	return &mailboxSlots{limit: limit, mailboxes: make(map[string]*mailboxSlot)}
+}
+
+// Wait for a slot of the mailbox and return the function releasing it, or the context's error if it is cancelled
+// while waiting. The free slots go to the waiting calls by priority, see fairSemaphore.
+func (m *mailboxSlots) acquire(ctx context.Context, mailbox string, priority Priority) (func(), error) {
+	if m == nil || m.limit <= 0 {
+		return func() {}, nil
+	}
+	mailbox = strings.ToLower(mailbox)
+
+	m.mu.Lock()
+	slot, ok := m.mailboxes[mailbox]
+	if !ok {
+		slot = &mailboxSlot{sem: newFairSemaphore(m.limit)}
+		m.mailboxes[mailbox] = slot
+	}
+	slot.refs++
+	m.mu.Unlock()
+
+	start := time.Now()
+	if err := slot.sem.acquire(ctx, priority); err != nil {
+		m.unref(mailbox, slot)
+		return nil, err
+	}
+	if wait := time.Since(start); wait > SlowSlotWait {
+		ctxLog(ctx).Warn().Str("mailbox", mailbox).Dur("wait", wait).Int("max_concurrent", m.limit).Str("priority", priority.String()).
+			Interface("queued", slot.sem.depths()).Msg("Waited long for a mailbox concurrency slot")
+		metrics.MailboxSlowWaitsTotal.Inc()
+	}
+
+	return func() {
+		slot.sem.release()
+		m.unref(mailbox, slot)
+	}, nil
+}
+
+func (m *mailboxSlots) unref(mailbox string, slot *mailboxSlot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slot.refs--
+	if slot.refs == 0 {
+		delete(m.mailboxes, mailbox)
+	}
+}
+
+// Limits the sendMail calls in flight across all the mailboxes of a sender, as Graph also throttles the application as
+// a whole. A nil sendSlots does not limit the calls.
+type sendSlots struct {
+	sem *fairSemaphore
+}
+
+// Create a limit of calls in flight across mailboxes. A limit of 0 or less does not limit the calls.
+func newSendSlots(limit int) *sendSlots {
+	if limit <= 0 {
+		return nil
+	}
+	return &sendSlots{sem: newFairSemaphore(limit)}
+}
+
+// Wait for a slot and return the function releasing it, or the context's error if it is cancelled while waiting. The
+// free slots go to the waiting calls by priority, see fairSemaphore. The calls holding a slot are counted in the
+// gopostal_graph_concurrent_sends gauge.
+func (s *sendSlots) acquire(ctx context.Context, priority Priority) (func(), error) {
+	if s != nil {
+		if err := s.sem.acquire(ctx, priority); err != nil {
+			return nil, err
+		}
+	}
+	metrics.GraphConcurrentSends.Inc()
+	return func() {
+		metrics.GraphConcurrentSends.Dec()
+		if s != nil {
+			s.sem.release()
+		}
+	}, nil
+}
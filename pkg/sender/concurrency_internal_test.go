@@ -0,0 +1,30 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// The slots of a mailbox are forgotten once no call holds or waits for them.
+func TestMailboxSlotsForgotten(t *testing.T) {
+	slots := newMailboxSlots(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mailbox := []string{"mailbox0@example.com", "MAILBOX1@example.com"}[i%2]
+			release, err := slots.acquire(context.Background(), mailbox, PriorityNormal)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			release()
+		}(i)
+	}
+	wg.Wait()
+	if n := len(slots.mailboxes); n != 0 {
+		t.Errorf("%d mailboxes still tracked after all calls completed", n)
+	}
+}
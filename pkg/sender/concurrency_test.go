@@ -0,0 +1,163 @@
+package sender_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/metrics"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGraphSenderMaxConcurrent(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	fg.SetDelay(20 * time.Millisecond)
+	gs.SetMaxConcurrent(3)
+	if err := gs.Authenticate(context.Background()); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Two mailboxes, each limited on its own
+			from := fmt.Sprintf("mailbox%d@example.com", i%2)
+			errs <- sender.SendEmail(context.Background(), gs, from, []string{"ops@example.net"}, "Alert", []byte("body"), nil)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("SendEmail: %v", err)
+		}
+	}
+
+	for _, mailbox := range []string{"mailbox0@example.com", "mailbox1@example.com"} {
+		if peak := fg.PeakInFlight(mailbox); peak != 3 {
+			t.Errorf("%s: %d calls in flight at most, want 3", mailbox, peak)
+		}
+	}
+}
+
+func TestGraphSenderSlotWaitCancelled(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	fg.SetDelay(200 * time.Millisecond)
+	gs.SetMaxConcurrent(1)
+
+	// Occupy the only slot of the mailbox
+	done := make(chan error)
+	go func() {
+		done <- sender.SendEmail(context.Background(), gs, "alerts@example.com", []string{"ops@example.net"}, "First", []byte("body"), nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := sender.SendEmail(ctx, gs, "alerts@example.com", []string{"ops@example.net"}, "Second", []byte("body"), nil)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("waiting call returned %v after %s, want the context's error once it expires", err, time.Since(start))
+	}
+	if err := <-done; err != nil {
+		t.Errorf("first call: %v", err)
+	}
+}
+
+func TestGraphSenderMaxConcurrentSends(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	fg.SetDelay(50 * time.Millisecond)
+	gs.SetMaxConcurrentSends(2)
+	if err := gs.Authenticate(context.Background()); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	// Sends from distinct mailboxes, so only the limit across mailboxes applies
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := sender.NewMessage(fmt.Sprintf("mailbox%d@example.com", i), []string{"ops@example.net"}, "Alert", []byte("body"), nil)
+			_, err := gs.Send(context.Background(), msg)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Send: %v", err)
+		}
+	}
+
+	if peak := fg.PeakInFlight(""); peak != 2 {
+		t.Errorf("%d calls in flight at most across mailboxes, want 2", peak)
+	}
+	if n := len(fg.Sent()); n != 6 {
+		t.Errorf("%d messages sent, want 6", n)
+	}
+}
+
+// A flood of low priority messages delays a high priority one by a few sends only, rather than queueing it behind
+// the whole flood.
+func TestGraphSenderPriorityUnderLoad(t *testing.T) {
+	const flood = 30
+	const delay = 10 * time.Millisecond
+	fg, gs := newFakeGraph(t)
+	fg.SetDelay(delay)
+	gs.SetMaxConcurrent(1)
+	if err := gs.Authenticate(context.Background()); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	var mu sync.Mutex
+	var completed []string
+	var wg sync.WaitGroup
+	send := func(name string, priority sender.Priority) {
+		defer wg.Done()
+		msg := sender.NewMessage("alerts@example.com", []string{"ops@example.net"}, name, []byte("body"), nil)
+		msg.Priority = priority
+		if _, err := gs.Send(context.Background(), msg); err != nil {
+			t.Errorf("Send %s: %v", name, err)
+		}
+		mu.Lock()
+		completed = append(completed, name)
+		mu.Unlock()
+	}
+	queued := metrics.SendQueueDepth.WithLabelValues(sender.PriorityLow.String())
+	base := promtest.ToFloat64(queued)
+	for i := 0; i < flood; i++ {
+		wg.Add(1)
+		go send(fmt.Sprintf("low%d", i), sender.PriorityLow)
+	}
+	// Wait until all but the sending message are queued
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if promtest.ToFloat64(queued)-base == flood-1 {
+			break
+		}
+	}
+
+	start := time.Now()
+	wg.Add(1)
+	send("high", sender.PriorityHigh)
+	latency := time.Since(start)
+	wg.Wait()
+
+	position := slices.Index(completed, "high")
+	if position > 2 {
+		t.Errorf("high priority message completed after %d low priority ones, want at most 2", position)
+	}
+	if latency > 10*delay {
+		t.Errorf("high priority message took %s behind the flood, want at most %s", latency, 10*delay)
+	}
+}
@@ -3,6 +3,8 @@ package sender
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,15 +14,49 @@ import (
 	"sync"
 	"time"
 
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/secrets"
 	"github.com/goodieshq/gopostal/pkg/utils"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	DefaultLoginEndpoint = "https://login.microsoftonline.com"
+	DefaultGraphEndpoint = "https://graph.microsoft.com"
+)
+
+// A token is refreshed before sending once it expires within the buffer, and in the background once it expires within
+// twice the buffer
+const DefaultTokenRefreshBuffer = time.Minute
+
+// Shortest time between two background refreshes, e.g. after a failed refresh or for tokens living less than twice the
+// buffer
+const minTokenRefreshInterval = 10 * time.Second
+
+// Header of the sendMail requests carrying the ID of the session which received the message, to correlate the
+// requests seen by Graph or a proxy with the relay's logs
+const SessionIDHeader = "X-GoPostal-Session-ID"
+
 type Sender interface {
-	SendEmail(ctx context.Context, from string, to []string, subject string, body []byte) error
+	Send(ctx context.Context, msg *Message) (*Result, error)
 	Authenticate(ctx context.Context) error
 }
 
+// Returns the logger carried by the context, such as the logger of the session sending the message with its
+// session_id and remote_addr, or the global logger if the context carries none.
+func ctxLog(ctx context.Context) *zerolog.Logger {
+	if l := log.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &log.Logger
+}
+
+// DryRunner is implemented by senders which may not deliver messages (e.g. dry-run or file backends).
+type DryRunner interface {
+	DryRun() bool
+}
+
 type GraphSender struct {
 	mu           sync.Mutex
 	token        *AuthToken
@@ -28,22 +64,130 @@ type GraphSender struct {
 	tenantID     string
 	clientID     string
 	clientSecret string
+	secret       secrets.Resolver
+	loginURL     string
+	graphURL     string
 	httpClient   *http.Client
 	retries      int
-	backoff      time.Duration
+	strategy     utils.RetryStrategy
+	health       *Health
+	breaker      *utils.CircuitBreaker
+	slots        *mailboxSlots
+	sends        *sendSlots
+
+	refreshBuffer time.Duration
+	fetchMu       sync.Mutex    // serializes the token requests, so concurrent messages share one
+	tokenFailures *tokenBreaker // failure memory of the token endpoint
+	tokenSet      chan struct{} // signaled when a token is obtained or fails, to schedule its background refresh
+	stop          chan struct{}
+	stopOnce      sync.Once
 }
 
+// Create a sender refreshing its token in the background until it is closed.
 func NewGraphSender(tenantID, clientID, clientSecret string, timeout time.Duration, retries int, backoff time.Duration) *GraphSender {
-	return &GraphSender{
+	gs := &GraphSender{
 		tenantID:     tenantID,
 		clientID:     clientID,
 		clientSecret: clientSecret,
+		loginURL:     DefaultLoginEndpoint,
+		graphURL:     DefaultGraphEndpoint,
 		httpClient: &http.Client{
 			Timeout: timeout,
 		},
-		retries: retries,
-		backoff: backoff,
+		retries:  retries,
+		strategy: utils.ExponentialBackoff{Base: backoff},
+		slots:    newMailboxSlots(DefaultMaxConcurrent),
+
+		refreshBuffer: DefaultTokenRefreshBuffer,
+		tokenFailures: newTokenBreaker(),
+		tokenSet:      make(chan struct{}, 1),
+		stop:          make(chan struct{}),
 	}
+	go gs.refreshTokens()
+	return gs
+}
+
+// Refresh the token before sending once it expires within the buffer (DefaultTokenRefreshBuffer by default), so it
+// cannot expire during the request, and in the background once it expires within twice the buffer. A buffer of 0 or
+// less restores the default.
+func (gs *GraphSender) SetTokenRefreshBuffer(d time.Duration) {
+	if d <= 0 {
+		d = DefaultTokenRefreshBuffer
+	}
+	gs.mu.Lock()
+	gs.refreshBuffer = d
+	gs.mu.Unlock()
+	gs.notifyTokenSet()
+}
+
+// Fail authentication at once for the cool-down (DefaultTokenCooldown by default) after a failed token request, instead
+// of calling the token endpoint again for every message. The endpoint is probed in the background once the cool-down
+// elapsed. A cool-down of 0 or less restores the default.
+func (gs *GraphSender) SetTokenCooldown(d time.Duration) {
+	if d <= 0 {
+		d = DefaultTokenCooldown
+	}
+	gs.tokenFailures.setCooldown(d)
+}
+
+// Returns whether the token endpoint is failing, with its last error.
+func (gs *GraphSender) TokenEndpointState() TokenEndpointState {
+	return gs.tokenFailures.state()
+}
+
+// Stop the background refresh of the token.
+func (gs *GraphSender) Close() error {
+	gs.stopOnce.Do(func() { close(gs.stop) })
+	return nil
+}
+
+// Limit the sendMail calls in flight for the same mailbox (DefaultMaxConcurrent by default). Calls beyond the limit
+// wait for one of the others to complete. A limit of 0 or less does not limit the calls.
+func (gs *GraphSender) SetMaxConcurrent(n int) {
+	gs.slots = newMailboxSlots(n)
+}
+
+// Limit the sendMail calls in flight across all mailboxes. Calls beyond the limit wait for one of the others to
+// complete. A limit of 0 or less (the default) does not limit the calls.
+func (gs *GraphSender) SetMaxConcurrentSends(n int) {
+	gs.sends = newSendSlots(n)
+}
+
+// Wait between attempts to send a message as determined by the strategy (exponential backoff by default).
+func (gs *GraphSender) SetRetryStrategy(strategy utils.RetryStrategy) {
+	gs.strategy = strategy
+}
+
+// Override the Microsoft identity platform and Graph API endpoints (e.g., for national clouds or testing).
+func (gs *GraphSender) SetEndpoints(loginURL, graphURL string) {
+	if loginURL != "" {
+		gs.loginURL = strings.TrimSuffix(loginURL, "/")
+	}
+	if graphURL != "" {
+		gs.graphURL = strings.TrimSuffix(graphURL, "/")
+	}
+}
+
+// Connect to the login and Graph endpoints with the TLS configuration, e.g. to trust a custom CA or pin the
+// certificates of the endpoints (see NewTLSConfig).
+func (gs *GraphSender) SetTLSConfig(cfg *tls.Config) {
+	gs.httpClient.Transport = newTLSTransport(cfg)
+}
+
+// Record the result of the authentication before each message in the health tracker.
+func (gs *GraphSender) SetHealth(h *Health) {
+	gs.health = h
+}
+
+// Stop calling the Graph API while it is failing: messages are refused with errs.ErrCircuitOpen without being attempted
+// once the circuit breaker is open.
+func (gs *GraphSender) SetCircuitBreaker(cb *utils.CircuitBreaker) {
+	gs.breaker = cb
+}
+
+// Resolve the client secret from the resolver on each token request so rotated or refreshed secrets are picked up.
+func (gs *GraphSender) SetClientSecretResolver(r secrets.Resolver) {
+	gs.secret = r
 }
 
 func (gs *GraphSender) getAuthTokenWithTimeout(ctx context.Context, timeout time.Duration) (*AuthToken, error) {
@@ -54,14 +198,23 @@ func (gs *GraphSender) getAuthTokenWithTimeout(ctx context.Context, timeout time
 }
 
 func (gs *GraphSender) getAuthToken(ctx context.Context) (*AuthToken, error) {
-	apiUrl := "https://login.microsoftonline.com/" + gs.tenantID + "/oauth2/v2.0/token"
+	apiUrl := gs.loginURL + "/" + gs.tenantID + "/oauth2/v2.0/token"
+
+	clientSecret := gs.clientSecret
+	if gs.secret != nil {
+		secret, err := gs.secret.Resolve(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve client secret: %w", err)
+		}
+		clientSecret = secret
+	}
 
 	// Create the form data for the token request
 	form := url.Values{}
 	form.Set("grant_type", "client_credentials")
-	form.Set("scope", "https://graph.microsoft.com/.default")
+	form.Set("scope", gs.graphURL+"/.default")
 	form.Set("client_id", gs.clientID)
-	form.Set("client_secret", gs.clientSecret)
+	form.Set("client_secret", clientSecret)
 
 	// Create a new HTTP request with the form data
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiUrl, strings.NewReader(form.Encode()))
@@ -101,82 +254,268 @@ func (gs *GraphSender) getAuthToken(ctx context.Context) (*AuthToken, error) {
 	}, nil
 }
 
+// Returns the current access token, which may be nil or expired, and the refresh buffer.
+func (gs *GraphSender) currentToken() (*AuthToken, time.Duration) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.token, gs.refreshBuffer
+}
+
+// Returns true if the current token does not expire within the refresh buffer.
+func (gs *GraphSender) tokenValid() bool {
+	tok, buffer := gs.currentToken()
+	return tok != nil && time.Until(tok.ExpiresAt) > buffer
+}
+
+// Wake the background refresh to schedule it for the current token.
+func (gs *GraphSender) notifyTokenSet() {
+	select {
+	case gs.tokenSet <- struct{}{}:
+	default:
+	}
+}
+
 func (gs *GraphSender) Authenticate(ctx context.Context) error {
-	if gs.token != nil && time.Until(gs.token.ExpiresAt) > 1*time.Minute {
+	if gs.tokenValid() {
 		// Token is still valid, no need to re-authenticate
-		log.Debug().Msg("Existing token is still valid")
+		ctxLog(ctx).Debug().Msg("Existing token is still valid")
+		return nil
+	}
+
+	gs.fetchMu.Lock()
+	defer gs.fetchMu.Unlock()
+	// A concurrent caller may have obtained a token, or failed to, while this one waited
+	if gs.tokenValid() {
 		return nil
 	}
-	log.Debug().Msg("Fetching a new access token for Microsoft Graph API")
+	if err := gs.tokenFailures.check(); err != nil {
+		return err
+	}
+	ctxLog(ctx).Debug().Msg("Fetching a new access token for Microsoft Graph API")
+	return gs.fetchToken(ctx)
+}
 
+// Get a new access token, replacing the current one. The caller must hold fetchMu.
+func (gs *GraphSender) fetchToken(ctx context.Context) error {
 	tok, err := gs.getAuthTokenWithTimeout(ctx, 10*time.Second)
+	if err != nil && ctx.Err() == nil {
+		// Interrupted requests say nothing about the endpoint
+		gs.tokenFailures.record(err)
+		gs.notifyTokenSet()
+	}
 	if err != nil {
 		return fmt.Errorf("authentication failed: %w", err)
 	}
 
 	gs.mu.Lock()
-	defer gs.mu.Unlock()
 	gs.token = tok
-	log.Debug().Time("expires_at", gs.token.ExpiresAt).Msg("Successfully obtained access token for Microsoft Graph API")
+	gs.mu.Unlock()
+	gs.tokenFailures.record(nil)
+	gs.notifyTokenSet()
+	ctxLog(ctx).Debug().Time("expires_at", tok.ExpiresAt).Msg("Successfully obtained access token for Microsoft Graph API")
 	return nil
 }
 
-func makeEmailRequest(from string, to []string, subject string, body []byte) *SendEmailRequest {
+// Refresh the token once it expires within twice the refresh buffer, so messages do not wait for a new token, until
+// the sender is closed. Nothing is refreshed until a first token is requested by Authenticate. While the token endpoint
+// is failing, it is probed each time the cool-down elapsed until it recovers.
+func (gs *GraphSender) refreshTokens() {
+	var notBefore time.Time
+	for {
+		var due <-chan time.Time
+		probe := false
+		if state := gs.tokenFailures.state(); state.Failing {
+			due, probe = time.After(time.Until(state.RetryAt)), true
+		} else if tok, buffer := gs.currentToken(); tok != nil {
+			at := tok.ExpiresAt.Add(-2 * buffer)
+			if at.Before(notBefore) {
+				at = notBefore
+			}
+			due = time.After(time.Until(at))
+		}
+
+		select {
+		case <-gs.stop:
+			return
+		case <-gs.tokenSet:
+			continue
+		case <-due:
+		}
+
+		gs.fetchMu.Lock()
+		if probe {
+			log.Debug().Msg("Probing the token endpoint of Microsoft Graph API")
+			gs.fetchToken(context.Background()) // failures are logged by the breaker
+		} else {
+			notBefore = time.Now().Add(minTokenRefreshInterval)
+			log.Debug().Msg("Refreshing the access token for Microsoft Graph API")
+			if err := gs.fetchToken(context.Background()); err != nil {
+				log.Warn().Err(err).Msg("Failed to refresh the access token in the background, retrying")
+			}
+		}
+		gs.fetchMu.Unlock()
+	}
+}
+
+func makeEmailRequest(msg *Message) *SendEmailRequest {
 	var emailReq SendEmailRequest
 
 	// Set the email request fields
-	emailReq.Message.Subject = subject
+	emailReq.Message.Subject = msg.Subject
 
 	// Set the body
 	emailReq.Message.Body.ContentType = "HTML"
-	emailReq.Message.Body.Content = string(body)
-
-	// Set the from and to addresses
-	emailReq.Message.From.EmailAddress.Address = from
-	emailReq.Message.ToRecipients = make([]EmailAddress, len(to))
-	for i, addr := range to {
-		emailReq.Message.ToRecipients[i] = EmailAddress{
-			EmailAddress: Address{
-				Address: addr,
-			},
+	emailReq.Message.Body.Content = string(msg.Body)
+	if msg.BodyType != "" {
+		emailReq.Message.Body.ContentType = msg.BodyType
+	}
+
+	// Set the from address and the recipients
+	emailReq.Message.From.EmailAddress.Address = msg.From
+	emailReq.Message.ToRecipients = makeEmailAddresses(msg.To)
+	if len(msg.To) == 0 {
+		emailReq.Message.ToRecipients = []EmailAddress{}
+	}
+	emailReq.Message.CcRecipients = makeEmailAddresses(msg.Cc)
+	emailReq.Message.BccRecipients = makeEmailAddresses(msg.Bcc)
+	emailReq.Message.ReplyTo = makeEmailAddresses(msg.ReplyTo)
+
+	for _, h := range msg.Headers {
+		switch {
+		case isCustomHeader(h.Name):
+			emailReq.Message.InternetMessageHeaders = append(emailReq.Message.InternetMessageHeaders, h)
+		case strings.EqualFold(h.Name, "Message-ID"):
+			emailReq.Message.InternetMessageID = h.Value
 		}
+		// Graph sets the Date of JSON messages itself
+	}
+	for _, a := range msg.Attachments {
+		// Inline attachments are file attachments too, related to the HTML body by their content ID
+		a.ODataType = "#microsoft.graph.fileAttachment"
+		emailReq.Message.Attachments = append(emailReq.Message.Attachments, a)
 	}
 
 	return &emailReq
 }
 
-func (gs *GraphSender) sendEmailOnce(ctx context.Context, from string, to []string, subject string, body []byte) error {
+// Returns the Graph recipients of the addresses, or nil if there are none.
+func makeEmailAddresses(addrs []string) []EmailAddress {
+	if len(addrs) == 0 {
+		return nil
+	}
+	recipients := make([]EmailAddress, len(addrs))
+	for i, addr := range addrs {
+		recipients[i] = EmailAddress{EmailAddress: Address{Address: addr}}
+	}
+	return recipients
+}
+
+// Returns true if the header is a custom header which Graph accepts in JSON messages.
+func isCustomHeader(name string) bool {
+	return len(name) > 2 && strings.EqualFold(name[:2], "X-")
+}
+
+// Returns true if the message cannot be represented as a Graph JSON message: it has a plain text alternative or
+// headers other than custom headers, Message-ID and Date.
+func requiresMIME(msg *Message) bool {
+	if msg.TextBody != "" {
+		return true
+	}
+	for _, h := range msg.Headers {
+		if !isCustomHeader(h.Name) && !strings.EqualFold(h.Name, "Message-ID") && !strings.EqualFold(h.Name, "Date") {
+			return true
+		}
+	}
+	return false
+}
+
+func (gs *GraphSender) sendEmailOnce(ctx context.Context, msg *Message) error {
 	// Ensure the authentication token is valid before sending the email
-	if err := gs.Authenticate(ctx); err != nil {
+	var err error
+	if gs.health != nil {
+		err = gs.health.Probe(ctx, gs)
+	} else {
+		err = gs.Authenticate(ctx)
+	}
+	if err != nil {
 		return fmt.Errorf("authentication failed: %w", err)
 	}
 
-	// If a mailbox is configured, use it as the sender address instead of the provided 'from' parameter
+	// If a mailbox is configured, use it as the sender address instead of the message's
 	if gs.mailbox != "" {
-		from = gs.mailbox
-		log.Debug().
-			Str("original", from).
+		ctxLog(ctx).Debug().
+			Str("original", msg.From).
 			Str("mailbox", gs.mailbox).
 			Msg("Using configured mailbox as sender address")
+		sent := *msg
+		sent.From = gs.mailbox
+		msg = &sent
+	}
+	from := msg.From
+
+	apiUrl := gs.graphURL + "/v1.0/users/" + url.PathEscape(from) + "/sendMail"
+
+	// Build the email request payload. Raw MIME messages are sent base64 encoded as text/plain, in which case Graph
+	// takes the recipients from the message headers.
+	var emailReqData []byte
+	contentType := "application/json"
+	if msg.MIME != nil || requiresMIME(msg) {
+		mimeData, bcc := msg.MIME, msg.Bcc
+		if mimeData == nil {
+			mimeData = makeMIME(msg)
+		} else {
+			// The envelope recipients the headers of a message passed through do not list are blind copies
+			bcc = append(unlistedRecipients(mimeData, msg.To), bcc...)
+		}
+		if len(bcc) > 0 {
+			// Graph takes the blind copy recipients from the Bcc header, which it removes from the sent message
+			mimeData = append([]byte("Bcc: "+strings.Join(bcc, ", ")+"\r\n"), mimeData...)
+		}
+		emailReqData = []byte(base64.StdEncoding.EncodeToString(mimeData))
+		contentType = "text/plain"
+	} else {
+		emailReq := makeEmailRequest(msg)
+		data, err := json.Marshal(emailReq)
+		if err != nil {
+			return fmt.Errorf("failed to marshal email request: %w", err)
+		}
+		emailReqData = data
 	}
 
-	apiUrl := "https://graph.microsoft.com/v1.0/users/" + url.PathEscape(from) + "/sendMail"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiUrl, bytes.NewReader(emailReqData))
+	if err != nil {
+		return err
+	}
 
-	// Build the email request payload
-	emailReq := makeEmailRequest(from, to, subject, body)
-	emailReqData, err := json.Marshal(emailReq)
+	// Wait until fewer than the maximum number of calls are in flight for the mailbox
+	release, err := gs.slots.acquire(ctx, from, msg.Priority)
 	if err != nil {
-		return fmt.Errorf("failed to marshal email request: %w", err)
+		return err
 	}
+	defer release()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiUrl, bytes.NewReader(emailReqData))
+	// Then until fewer than the maximum number of calls are in flight for the whole sender, so calls waiting for a
+	// throttled mailbox do not hold the slots of the others
+	releaseSend, err := gs.sends.acquire(ctx, msg.Priority)
 	if err != nil {
 		return err
 	}
+	defer releaseSend()
+
+	// The token checked before waiting for the slots may have expired since, as the waits are not bounded
+	if !gs.tokenValid() {
+		if err := gs.Authenticate(ctx); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
 
 	// Set the request authorization and content type headers
-	req.Header.Set("Authorization", "Bearer "+gs.token.Token)
-	req.Header.Set("Content-Type", "application/json")
+	tok, _ := gs.currentToken()
+	req.Header.Set("Authorization", "Bearer "+tok.Token)
+	req.Header.Set("Content-Type", contentType)
+	if msg.SessionID != "" {
+		req.Header.Set(SessionIDHeader, msg.SessionID)
+	}
 
 	// Send the email request
 	resp, err := gs.httpClient.Do(req)
@@ -194,18 +533,44 @@ func (gs *GraphSender) sendEmailOnce(ctx context.Context, from string, to []stri
 	// Check if the response status code indicates success
 	if resp.StatusCode != http.StatusAccepted {
 		var errorResp SendEmailErrorResponse
-		if err := json.Unmarshal(respData, &errorResp); err != nil {
-			log.Debug().Int("status_code", resp.StatusCode).Str("response", string(respData)).Msg("Invalid error response from email send")
-			return fmt.Errorf("failed to send email: %s", resp.Status)
+		err := fmt.Errorf("failed to send email: %s", resp.Status)
+		if jsonErr := json.Unmarshal(respData, &errorResp); jsonErr != nil {
+			ctxLog(ctx).Debug().Int("status_code", resp.StatusCode).Str("response", string(respData)).Msg("Invalid error response from email send")
+		} else {
+			err = fmt.Errorf("failed to send email (%s): %s", errorResp.Error.Code, errorResp.Error.Message)
 		}
-		return fmt.Errorf("failed to send email (%s): %s", errorResp.Error.Code, errorResp.Error.Message)
+
+		// Malformed or oversized messages and unknown mailboxes are rejected again when retried
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge:
+			return utils.Permanent(err)
+		}
+		return err
 	}
 
 	return nil
 }
 
-func (gs *GraphSender) SendEmail(ctx context.Context, from string, to []string, subject string, body []byte) error {
-	return utils.DoWithBackoff(ctx, func() error {
-		return gs.sendEmailOnce(ctx, from, to, subject, body)
-	}, gs.retries, gs.backoff)
+// Send the message through the sendMail API of the sender's mailbox. Graph does not return an ID for sent messages.
+func (gs *GraphSender) Send(ctx context.Context, msg *Message) (*Result, error) {
+	if !gs.breaker.Allow() {
+		return nil, errs.ErrCircuitOpen
+	}
+	result := &Result{}
+	err := utils.DoWithRetry(ctx, func() error {
+		result.Attempts++
+		return gs.sendEmailOnce(ctx, msg)
+	}, gs.retries, gs.strategy)
+
+	// Permanent errors are caused by the message, and interrupted sends by the shutdown, not by a failing API
+	failed := err != nil && !utils.IsPermanent(err) && ctx.Err() == nil
+	if state, changed := gs.breaker.Record(failed); changed {
+		switch state {
+		case utils.CircuitOpen:
+			ctxLog(ctx).Error().Err(err).Str("tenant_id", gs.tenantID).Msg("Graph API is failing, refusing messages until the circuit breaker closes")
+		case utils.CircuitClosed:
+			ctxLog(ctx).Info().Str("tenant_id", gs.tenantID).Msg("Graph API recovered, circuit breaker closed")
+		}
+	}
+	return result, err
 }
@@ -0,0 +1,117 @@
+package sender
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMakeEmailRequest(t *testing.T) {
+	addresses := func(addrs ...string) []EmailAddress {
+		out := make([]EmailAddress, len(addrs))
+		for i, addr := range addrs {
+			out[i] = EmailAddress{EmailAddress: Address{Address: addr}}
+		}
+		return out
+	}
+	tests := []struct {
+		name string
+		msg  *Message
+		want EmailMessage
+	}{
+		{
+			name: "envelope",
+			msg: &Message{
+				From:    "alerts@example.com",
+				To:      []string{"ops@example.net", "dev@example.net"},
+				Cc:      []string{"lead@example.net"},
+				ReplyTo: []string{"noc@example.com"},
+				Subject: "Disk full",
+				Body:    []byte("<p>/var is full</p>"),
+				SendOptions: SendOptions{
+					Bcc: []string{"audit@example.com"},
+				},
+			},
+			want: EmailMessage{
+				Subject:       "Disk full",
+				Body:          EmailBody{ContentType: "HTML", Content: "<p>/var is full</p>"},
+				From:          addresses("alerts@example.com")[0],
+				ToRecipients:  addresses("ops@example.net", "dev@example.net"),
+				CcRecipients:  addresses("lead@example.net"),
+				BccRecipients: addresses("audit@example.com"),
+				ReplyTo:       addresses("noc@example.com"),
+			},
+		},
+		{
+			name: "blind copies only",
+			msg:  &Message{From: "alerts@example.com", Subject: "Archive", Body: []byte("copy"), SendOptions: SendOptions{Bcc: []string{"archive@example.com"}}},
+			want: EmailMessage{
+				Subject:       "Archive",
+				Body:          EmailBody{ContentType: "HTML", Content: "copy"},
+				From:          addresses("alerts@example.com")[0],
+				ToRecipients:  []EmailAddress{},
+				BccRecipients: addresses("archive@example.com"),
+			},
+		},
+		{
+			name: "text body and headers",
+			msg: &Message{
+				From:    "alerts@example.com",
+				To:      []string{"ops@example.net"},
+				Subject: "Disk full",
+				Body:    []byte("/var is full"),
+				SendOptions: SendOptions{
+					BodyType: "Text",
+					Headers: []InternetMessageHeader{
+						{Name: "X-Alert-ID", Value: "42"},
+						{Name: "Message-ID", Value: "<42@example.com>"},
+						{Name: "Date", Value: "Mon, 2 Jan 2006 15:04:05 -0700"},
+					},
+				},
+			},
+			want: EmailMessage{
+				Subject:                "Disk full",
+				Body:                   EmailBody{ContentType: "Text", Content: "/var is full"},
+				From:                   addresses("alerts@example.com")[0],
+				ToRecipients:           addresses("ops@example.net"),
+				InternetMessageID:      "<42@example.com>",
+				InternetMessageHeaders: []InternetMessageHeader{{Name: "X-Alert-ID", Value: "42"}},
+			},
+		},
+		{
+			name: "attachments",
+			msg: &Message{
+				From:    "alerts@example.com",
+				To:      []string{"ops@example.net"},
+				Subject: "Report",
+				Body:    []byte(`<img src="cid:logo">`),
+				SendOptions: SendOptions{
+					Attachments: []FileAttachment{
+						{Name: "report.pdf", ContentType: "application/pdf", ContentBytes: []byte("%PDF")},
+						{Name: "logo.png", ContentType: "image/png", ContentBytes: []byte("PNG"), ContentID: "logo", IsInline: true},
+					},
+				},
+			},
+			want: EmailMessage{
+				Subject:      "Report",
+				Body:         EmailBody{ContentType: "HTML", Content: `<img src="cid:logo">`},
+				From:         addresses("alerts@example.com")[0],
+				ToRecipients: addresses("ops@example.net"),
+				Attachments: []FileAttachment{
+					{ODataType: "#microsoft.graph.fileAttachment", Name: "report.pdf", ContentType: "application/pdf", ContentBytes: []byte("%PDF")},
+					{ODataType: "#microsoft.graph.fileAttachment", Name: "logo.png", ContentType: "image/png", ContentBytes: []byte("PNG"), ContentID: "logo", IsInline: true},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if requiresMIME(tt.msg) {
+				t.Fatal("message sent as MIME, want JSON")
+			}
+			got := makeEmailRequest(tt.msg).Message
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("makeEmailRequest =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package sender_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/errs"
+	"github.com/goodieshq/gopostal/pkg/sender"
+	"github.com/goodieshq/gopostal/pkg/testutil"
+	"github.com/goodieshq/gopostal/pkg/utils"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Start a fake Graph server and a sender talking to it, attempting each message once. Both are closed at the end of
+// the test.
+func newFakeGraph(t *testing.T) (*testutil.FakeGraph, *sender.GraphSender) {
+	t.Helper()
+	fg := testutil.NewFakeGraph("tenant", "client", "secret")
+	t.Cleanup(fg.Close)
+	gs := fg.NewSender(5*time.Second, 1, time.Millisecond)
+	t.Cleanup(func() { gs.Close() })
+	return fg, gs
+}
+
+func TestGraphSenderCircuitBreaker(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	gs.SetCircuitBreaker(utils.NewCircuitBreaker(2, 50*time.Millisecond))
+	send := func() error {
+		return sender.SendEmail(context.Background(), gs, "alerts@example.com", []string{"ops@example.net"}, "Disk usage", []byte("full"), nil)
+	}
+
+	// The API fails twice, opening the circuit, so the next message is refused without calling it
+	fg.FailNext(testutil.FailureUnavailable, testutil.FailureUnavailable)
+	for i := 0; i < 2; i++ {
+		if err := send(); err == nil || errors.Is(err, errs.ErrCircuitOpen) {
+			t.Fatalf("message %d: got %v, want the API's error", i+1, err)
+		}
+	}
+	if err := send(); !errors.Is(err, errs.ErrCircuitOpen) {
+		t.Fatalf("message while open: got %v, want %v", err, errs.ErrCircuitOpen)
+	}
+
+	if n := len(fg.Sent()); n != 0 {
+		t.Errorf("%d messages sent while failing, want 0", n)
+	}
+
+	// Once the timeout elapsed the test message is sent, closing the circuit
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := send(); err != nil {
+			t.Fatalf("message %d after recovery: %v", i+1, err)
+		}
+	}
+	if n := len(fg.Sent()); n != 2 {
+		t.Errorf("%d messages sent, want 2", n)
+	}
+}
+
+// The JSON messages use the property names of the Graph message resource.
+func TestSendJSON(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	result, err := gs.Send(context.Background(), &sender.Message{
+		From:        "alerts@example.com",
+		To:          []string{"ops@example.net"},
+		Cc:          []string{"lead@example.net"},
+		ReplyTo:     []string{"noc@example.com"},
+		Subject:     "Disk full",
+		Body:        []byte("full"),
+		Metadata:    map[string]string{"listener": "scanners"},
+		SendOptions: sender.SendOptions{Bcc: []string{"audit@example.com"}, BodyType: "Text"},
+	})
+	if err != nil || result == nil || result.Attempts != 1 {
+		t.Fatalf("Send = %+v, %v, want one attempt", result, err)
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 1 || sent[0].Mailbox != "alerts@example.com" || sent[0].MIME != nil {
+		t.Fatalf("sent = %+v, want one JSON request to the sender's mailbox", sent)
+	}
+	var body map[string]map[string]any
+	if err := json.Unmarshal(sent[0].Body, &body); err != nil {
+		t.Fatalf("invalid request body %s: %v", sent[0].Body, err)
+	}
+	message := body["message"]
+	for key, want := range map[string]string{
+		"subject":       `"Disk full"`,
+		"body":          `{"content":"full","contentType":"Text"}`,
+		"from":          `{"emailAddress":{"address":"alerts@example.com"}}`,
+		"toRecipients":  `[{"emailAddress":{"address":"ops@example.net"}}]`,
+		"ccRecipients":  `[{"emailAddress":{"address":"lead@example.net"}}]`,
+		"bccRecipients": `[{"emailAddress":{"address":"audit@example.com"}}]`,
+		"replyTo":       `[{"emailAddress":{"address":"noc@example.com"}}]`,
+	} {
+		got, _ := json.Marshal(message[key])
+		if string(got) != want {
+			t.Errorf("message.%s = %s, want %s", key, got, want)
+		}
+	}
+	if len(message) != 7 {
+		t.Errorf("message has %d properties, want 7 (the metadata is not sent): %s", len(message), sent[0].Body)
+	}
+}
+
+// Messages which Graph's JSON messages cannot represent are sent as MIME, with the recipients in the headers.
+func TestSendMIME(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	_, err := gs.Send(context.Background(), &sender.Message{
+		From:    "alerts@example.com",
+		To:      []string{"ops@example.net"},
+		Cc:      []string{"lead@example.net"},
+		ReplyTo: []string{"noc@example.com"},
+		Subject: "Disk full",
+		Body:    []byte("<p>full</p>"),
+		SendOptions: sender.SendOptions{
+			TextBody: "full",
+			Bcc:      []string{"audit@example.com"},
+			Headers: []sender.InternetMessageHeader{
+				{Name: "Message-ID", Value: "<42@example.com>"},
+				{Name: "In-Reply-To", Value: "<41@example.com>"},
+				{Name: "References", Value: "<40@example.com> <41@example.com>"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 1 || sent[0].Mailbox != "alerts@example.com" || sent[0].MIME == nil {
+		t.Fatalf("sent = %+v, want one MIME request to the sender's mailbox", sent)
+	}
+	mime := string(sent[0].MIME)
+	header := mime[:strings.Index(mime, "\r\n\r\n")]
+	for _, want := range []string{
+		"Bcc: audit@example.com\r\n",
+		"From: alerts@example.com\r\n",
+		"To: ops@example.net\r\n",
+		"Cc: lead@example.net\r\n",
+		"Reply-To: noc@example.com\r\n",
+		"Message-ID: <42@example.com>\r\n",
+		"In-Reply-To: <41@example.com>\r\n",
+		"References: <40@example.com> <41@example.com>\r\n",
+		"Content-Type: multipart/alternative;",
+	} {
+		if !strings.Contains(header+"\r\n", want) {
+			t.Errorf("MIME header misses %q:\n%s", want, header)
+		}
+	}
+}
+
+// Messages passed through as MIME are sent as received, with the envelope recipients their headers do not list added
+// as blind copies.
+func TestSendMIMEPassthrough(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	raw := "From: alerts@example.com\r\nTo: Ops <OPS@example.net>\r\nSubject: Disk full\r\n\r\nfull\r\n"
+	_, err := gs.Send(context.Background(), &sender.Message{
+		From:        "alerts@example.com",
+		To:          []string{"ops@example.net", "audit@example.com"},
+		SendOptions: sender.SendOptions{MIME: []byte(raw)},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	sent := fg.Sent()
+	if len(sent) != 1 || sent[0].MIME == nil {
+		t.Fatalf("sent = %+v, want one MIME request", sent)
+	}
+	if want := "Bcc: audit@example.com\r\n" + raw; string(sent[0].MIME) != want {
+		t.Errorf("MIME = %q, want %q", sent[0].MIME, want)
+	}
+}
+
+// The adapter of the former SendEmail method sends the message built from its arguments.
+func TestSendEmailAdapter(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	opts := &sender.SendOptions{BodyType: "Text", Bcc: []string{"audit@example.com"}}
+	if err := sender.SendEmail(context.Background(), gs, "alerts@example.com", []string{"ops@example.net"}, "Disk full", []byte("full"), opts); err != nil {
+		t.Fatalf("SendEmail: %v", err)
+	}
+	sent := fg.Sent()
+	if len(sent) != 1 || sent[0].MIME != nil {
+		t.Fatalf("sent = %+v, want one JSON request", sent)
+	}
+	address := func(addr string) sender.EmailAddress {
+		return sender.EmailAddress{EmailAddress: sender.Address{Address: addr}}
+	}
+	want := sender.EmailMessage{
+		Subject:       "Disk full",
+		Body:          sender.EmailBody{ContentType: "Text", Content: "full"},
+		From:          address("alerts@example.com"),
+		ToRecipients:  []sender.EmailAddress{address("ops@example.net")},
+		BccRecipients: []sender.EmailAddress{address("audit@example.com")},
+	}
+	if got := sent[0].Request.Message; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %+v, want %+v", got, want)
+	}
+}
+
+// The sendMail requests carry the ID of the session which received the message, including those of MIME messages.
+func TestSendSessionIDHeader(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	const id = "5f2b9a17-bd3f-4b3e-b3f8-9346283b985e"
+	for _, opts := range []sender.SendOptions{{SessionID: id}, {SessionID: id, TextBody: "full"}, {}} {
+		msg := sender.NewMessage("alerts@example.com", []string{"ops@example.net"}, "Disk full", []byte("<p>full</p>"), &opts)
+		if _, err := gs.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	sent := fg.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("%d requests, want 3", len(sent))
+	}
+	for i, want := range []string{id, id, ""} {
+		if sent[i].SessionID != want {
+			t.Errorf("request %d (MIME: %t): %s = %q, want %q", i, sent[i].MIME != nil, sender.SessionIDHeader, sent[i].SessionID, want)
+		}
+	}
+}
+
+// The calls made for a message are logged with the logger of its context, such as the session's, falling back to the
+// global logger.
+func TestSendContextLogger(t *testing.T) {
+	var global strings.Builder
+	prev := log.Logger
+	log.Logger = zerolog.New(&global)
+	t.Cleanup(func() { log.Logger = prev })
+
+	_, gs := newFakeGraph(t)
+	var session strings.Builder
+	ctx := zerolog.New(&session).With().Str("session_id", "5f2b9a17").Str("remote_addr", "192.0.2.10:41522").Logger().WithContext(context.Background())
+	msg := sender.NewMessage("alerts@example.com", []string{"ops@example.net"}, "Disk full", []byte("full"), nil)
+	if _, err := gs.Send(ctx, msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if out := session.String(); !strings.Contains(out, `"session_id":"5f2b9a17","remote_addr":"192.0.2.10:41522","message":"Fetching a new access token for Microsoft Graph API"`) {
+		t.Errorf("session logs = %s, want the token request with the session fields", out)
+	}
+	if global.Len() != 0 {
+		t.Errorf("global logs = %s, want none", global.String())
+	}
+
+	if _, err := gs.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if out := global.String(); !strings.Contains(out, `"message":"Existing token is still valid"`) {
+		t.Errorf("global logs = %s, want the token check without a context logger", out)
+	}
+}
+
+func TestGraphSenderTokenRefreshBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		buffer   time.Duration
+		want     int
+	}{
+		{"valid token reused", time.Hour, 0, 1},
+		{"token expiring within the default buffer", 50 * time.Second, 0, 2},
+		{"token expiring within the buffer", 5 * time.Minute, 10 * time.Minute, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg, gs := newFakeGraph(t)
+			gs.Close() // only refresh on demand
+			fg.SetTokenLifetime(tt.lifetime)
+			gs.SetTokenRefreshBuffer(tt.buffer)
+			for i := 0; i < 2; i++ {
+				if err := gs.Authenticate(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := fg.TokenRequests(); n != tt.want {
+				t.Errorf("%d token requests, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestGraphSenderProactiveTokenRefresh(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	fg.SetTokenLifetime(2 * time.Second)
+	gs.SetTokenRefreshBuffer(500 * time.Millisecond)
+
+	// Nothing is refreshed before the first token
+	time.Sleep(100 * time.Millisecond)
+	if n := fg.TokenRequests(); n != 0 {
+		t.Fatalf("%d token requests before authenticating, want 0", n)
+	}
+
+	// The token living 2s is refreshed in the background once 1s (twice the buffer) remains
+	if err := gs.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for fg.TokenRequests() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := fg.TokenRequestTimes()
+	if len(got) < 2 {
+		t.Fatal("token not refreshed in the background")
+	}
+	if after := got[1].Sub(got[0]); after < 900*time.Millisecond || after > 1500*time.Millisecond {
+		t.Errorf("token refreshed %s after it was obtained, want 1s", after)
+	}
+
+	// The refreshed token is used without another request
+	if err := gs.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := fg.TokenRequests(); n != 2 {
+		t.Errorf("%d token requests, want 2", n)
+	}
+
+	// Closing the sender stops the refresh
+	gs.Close()
+	time.Sleep(1200 * time.Millisecond)
+	if n := fg.TokenRequests(); n != 2 {
+		t.Errorf("%d token requests after closing, want 2", n)
+	}
+}
+
+// A token expiring while a message waits for a mailbox slot is replaced before the message is sent, rather than sent
+// expired.
+func TestGraphSenderTokenExpiresDuringSlotWait(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	gs.Close() // only refresh on demand
+	fg.SetTokenLifetime(time.Second)
+	fg.SetDelay(1500 * time.Millisecond)
+	gs.SetTokenRefreshBuffer(100 * time.Millisecond)
+	gs.SetMaxConcurrent(1)
+
+	// The first message holds the only slot of the mailbox past the expiry of the token
+	done := make(chan error)
+	go func() {
+		done <- sender.SendEmail(context.Background(), gs, "alerts@example.com", []string{"ops@example.net"}, "First", []byte("body"), nil)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// The second one finds the token valid, then waits for the slot until the token expired
+	msg := sender.NewMessage("alerts@example.com", []string{"ops@example.net"}, "Second", []byte("body"), nil)
+	result, err := gs.Send(context.Background(), msg)
+	if err != nil || result.Attempts != 1 {
+		t.Errorf("Send = %+v, %v, want it sent at the first attempt", result, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("first message: %v", err)
+	}
+	if n := fg.TokenRequests(); n != 2 {
+		t.Errorf("%d token requests, want 2", n)
+	}
+	if n := len(fg.Sent()); n != 2 {
+		t.Errorf("%d messages sent, want 2", n)
+	}
+}
+
+func TestGraphSenderTokenCooldown(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	gs.SetTokenCooldown(300 * time.Millisecond)
+	sendAll := func(n int) []error {
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = sender.SendEmail(context.Background(), gs, "alerts@example.com", []string{"ops@example.net"}, "Disk usage", []byte("full"), nil)
+			}()
+		}
+		wg.Wait()
+		return errs
+	}
+
+	// Concurrent messages share the failed token request instead of each calling the endpoint
+	fg.FailTokens(true)
+	for i, err := range sendAll(20) {
+		if err == nil {
+			t.Fatalf("message %d sent with a failing token endpoint", i)
+		}
+	}
+	if n := fg.TokenRequests(); n != 1 {
+		t.Errorf("%d token requests while failing, want 1", n)
+	}
+	state := gs.TokenEndpointState()
+	if !state.Failing || state.LastError == nil || !strings.Contains(state.LastError.Error(), "401") {
+		t.Errorf("state = %+v, want the endpoint failing with its error", state)
+	}
+	if err := gs.Authenticate(context.Background()); err == nil || !strings.Contains(err.Error(), "token endpoint failing") {
+		t.Errorf("Authenticate during the cool-down: got %v, want the cached failure", err)
+	}
+
+	// The background probe recovers the sender once the endpoint is back, without a message triggering it
+	fg.FailTokens(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for gs.TokenEndpointState().Failing && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := gs.TokenEndpointState(); state.Failing {
+		t.Fatalf("state = %+v after the endpoint recovered, want it working", state)
+	}
+	probes := fg.TokenRequests()
+	for i, err := range sendAll(20) {
+		if err != nil {
+			t.Fatalf("message %d after recovery: %v", i, err)
+		}
+	}
+	if n := fg.TokenRequests(); n != probes {
+		t.Errorf("%d token requests after recovery, want the probe's token to be reused", n-probes)
+	}
+	if n := len(fg.Sent()); n != 20 {
+		t.Errorf("sent %d messages, want 20", n)
+	}
+}
+
+func TestGraphSenderTokenCooldownElapsed(t *testing.T) {
+	fg, gs := newFakeGraph(t)
+	gs.Close() // no background probe
+	gs.SetTokenCooldown(50 * time.Millisecond)
+	fg.FailTokens(true)
+
+	// Within the cool-down the failure is returned without calling the endpoint, after it the endpoint is called again
+	for range 3 {
+		if err := gs.Authenticate(context.Background()); err == nil {
+			t.Fatal("authenticated with a failing token endpoint")
+		}
+	}
+	if n := fg.TokenRequests(); n != 1 {
+		t.Errorf("%d token requests within the cool-down, want 1", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := gs.Authenticate(context.Background()); err == nil || strings.Contains(err.Error(), "token endpoint failing") {
+		t.Errorf("Authenticate after the cool-down: got %v, want the endpoint's error", err)
+	}
+	if n := fg.TokenRequests(); n != 2 {
+		t.Errorf("%d token requests, want 2", n)
+	}
+}
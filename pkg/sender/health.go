@@ -0,0 +1,99 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Health tracks whether the sender can authenticate. Once the configured number of consecutive authentication
+// failures is reached (e.g. because the client secret expired) the sender is reported as unavailable, so receivers
+// can defer messages instead of accepting them and failing each one. A successful authentication recovers it.
+type Health struct {
+	threshold int
+	now       func() time.Time
+
+	mu          sync.Mutex
+	failures    int // consecutive authentication failures
+	lastSuccess time.Time
+}
+
+// Create a new health tracker reporting the sender as unavailable after threshold consecutive failures.
+func NewHealth(threshold int) *Health {
+	return &Health{
+		threshold: threshold,
+		now:       time.Now,
+	}
+}
+
+// Record the result of an authentication attempt.
+func (h *Health) Record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		if h.failures >= h.threshold {
+			log.Info().Int("failures", h.failures).Msg("Sender authentication recovered, accepting messages again")
+		}
+		h.failures = 0
+		h.lastSuccess = h.now()
+		return
+	}
+
+	h.failures++
+	switch {
+	case h.failures == h.threshold:
+		log.Error().Err(err).Int("failures", h.failures).Time("last_success", h.lastSuccess).Msg("Sender authentication failed repeatedly, deferring new sessions until it recovers")
+	case h.failures < h.threshold:
+		log.Warn().Err(err).Int("failures", h.failures).Msg("Sender authentication failed")
+	}
+}
+
+// Returns true unless the failure threshold of consecutive authentication failures has been reached. A nil health
+// tracker is always available.
+func (h *Health) Available() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures < h.threshold
+}
+
+// Returns the number of consecutive authentication failures and the time of the last successful authentication.
+func (h *Health) State() (int, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures, h.lastSuccess
+}
+
+// Authenticate the sender while it is unavailable, at every interval until the context is cancelled. Successful
+// probes recover the sender.
+func (h *Health) Run(ctx context.Context, s Sender, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if h.Available() {
+			continue
+		}
+		log.Debug().Msg("Probing sender authentication")
+		h.Probe(ctx, s)
+	}
+}
+
+// Authenticate the sender and record the result, unless the context was cancelled.
+func (h *Health) Probe(ctx context.Context, s Sender) error {
+	err := s.Authenticate(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err() // shutting down, not an authentication failure
+	}
+	h.Record(err)
+	return err
+}
@@ -0,0 +1,41 @@
+package sender
+
+import "context"
+
+// A message to send: its envelope, headers and content. The optional properties shared with the former SendEmail
+// method (body type, attachments, blind copies, ...) are embedded from SendOptions.
+type Message struct {
+	From     string
+	To       []string
+	Cc       []string // Copy recipients, listed in the Cc header
+	ReplyTo  []string // Addresses replies are sent to instead of the sender
+	Subject  string
+	Body     []byte
+	Metadata map[string]string // Properties of the message which are not part of it, e.g. the listener which received it
+	Priority Priority          // Order in which the message gets the sender's capacity when it waits for it
+	SendOptions
+}
+
+// Outcome of a message sent through a Sender.
+type Result struct {
+	MessageID string // ID assigned to the message by the delivery API, if it returns one
+	Attempts  int    // Calls made to the delivery API, including the retries
+}
+
+// Create the message of the positional arguments of the former SendEmail method.
+func NewMessage(from string, to []string, subject string, body []byte, opts *SendOptions) *Message {
+	msg := &Message{From: from, To: to, Subject: subject, Body: body}
+	if opts != nil {
+		msg.SendOptions = *opts
+	}
+	return msg
+}
+
+// Send a message through the sender with the positional arguments of the former SendEmail method.
+//
+// Deprecated: create a Message and call Sender.Send instead. This adapter is kept until the remaining callers are
+// migrated.
+func SendEmail(ctx context.Context, s Sender, from string, to []string, subject string, body []byte, opts *SendOptions) error {
+	_, err := s.Send(ctx, NewMessage(from, to, subject, body, opts))
+	return err
+}
@@ -0,0 +1,154 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// A MIME entity: its content headers and encoded body.
+type mimePart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Build a MIME message from the body, its plain text alternative if any, and attachments. Graph's JSON messages carry
+// a single body and only X- headers, so other messages are sent as MIME. Inline attachments are related to the HTML
+// body and the others are mixed in.
+func makeMIME(msg *Message) []byte {
+	var content mimePart
+	switch {
+	case msg.TextBody != "":
+		content = makeMultipart("alternative", makeTextPart("text/plain", []byte(msg.TextBody)), makeTextPart("text/html", msg.Body))
+	case strings.EqualFold(msg.BodyType, "Text"):
+		content = makeTextPart("text/plain", msg.Body)
+	default:
+		content = makeTextPart("text/html", msg.Body)
+	}
+
+	var inline, attached []mimePart
+	for _, a := range msg.Attachments {
+		if a.IsInline {
+			inline = append(inline, makeAttachmentPart(a))
+		} else {
+			attached = append(attached, makeAttachmentPart(a))
+		}
+	}
+	if len(inline) > 0 {
+		content = makeMultipart("related", append([]mimePart{content}, inline...)...)
+	}
+	if len(attached) > 0 {
+		content = makeMultipart("mixed", append([]mimePart{content}, attached...)...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("From: " + msg.From + "\r\n")
+	if len(msg.To) > 0 {
+		buf.WriteString("To: " + strings.Join(msg.To, ", ") + "\r\n")
+	}
+	if len(msg.Cc) > 0 {
+		buf.WriteString("Cc: " + strings.Join(msg.Cc, ", ") + "\r\n")
+	}
+	if len(msg.ReplyTo) > 0 {
+		buf.WriteString("Reply-To: " + strings.Join(msg.ReplyTo, ", ") + "\r\n")
+	}
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	for _, h := range msg.Headers {
+		buf.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: " + content.header.Get("Content-Type") + "\r\n")
+	if cte := content.header.Get("Content-Transfer-Encoding"); cte != "" {
+		buf.WriteString("Content-Transfer-Encoding: " + cte + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(content.body)
+	return buf.Bytes()
+}
+
+// Create a multipart entity of the given subtype (e.g. "alternative") containing the parts in order.
+func makeMultipart(subtype string, parts ...mimePart) mimePart {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		pw, _ := w.CreatePart(p.header) // writes to a bytes.Buffer cannot fail
+		pw.Write(p.body)
+	}
+	w.Close()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": w.Boundary()}))
+	return mimePart{header: header, body: buf.Bytes()}
+}
+
+// Create a quoted-printable UTF-8 text entity.
+func makeTextPart(mediaType string, content []byte) mimePart {
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write(content)
+	qp.Close()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mediaType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return mimePart{header: header, body: buf.Bytes()}
+}
+
+// Create a base64 attachment entity.
+func makeAttachmentPart(a FileAttachment) mimePart {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if a.IsInline {
+		disposition = "inline"
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	if a.Name != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+	} else {
+		header.Set("Content-Disposition", disposition)
+	}
+	if a.ContentID != "" {
+		header.Set("Content-ID", "<"+a.ContentID+">")
+	}
+
+	// Wrap the encoded data at 76 characters per line
+	encoded := base64.StdEncoding.EncodeToString(a.ContentBytes)
+	var body bytes.Buffer
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded + "\r\n")
+	return mimePart{header: header, body: body.Bytes()}
+}
+
+// Returns the recipients which the To and Cc headers of the raw MIME message do not list.
+func unlistedRecipients(raw []byte, recipients []string) []string {
+	listed := make(map[string]bool)
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		for _, key := range []string{"To", "Cc"} {
+			addrs, _ := msg.Header.AddressList(key)
+			for _, addr := range addrs {
+				listed[strings.ToLower(addr.Address)] = true
+			}
+		}
+	}
+	var unlisted []string
+	for _, rcpt := range recipients {
+		if !listed[strings.ToLower(rcpt)] {
+			unlisted = append(unlisted, rcpt)
+		}
+	}
+	return unlisted
+}
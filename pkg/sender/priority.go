@@ -0,0 +1,146 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/goodieshq/gopostal/pkg/metrics"
+)
+
+// Priority of a message when it waits for the sender's capacity, e.g. the concurrency slots of a Graph mailbox
+type Priority int
+
+const (
+	PriorityNormal Priority = iota // the zero value, so messages without a priority are scheduled as normal
+	PriorityLow
+	PriorityHigh
+)
+
+// Share of the free slots handed to the waiting calls of each priority, e.g. high priority calls get 4 of every 7
+// slots while calls of every priority are waiting
+var priorityWeights = map[Priority]int{PriorityHigh: 4, PriorityNormal: 2, PriorityLow: 1}
+
+// Priorities in the order their waiting calls are considered, which breaks ties in favor of the higher ones
+var priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// Parse a priority name: "high", "normal" or "low". An empty name is the normal priority.
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case "high":
+		return PriorityHigh, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return PriorityNormal, fmt.Errorf("must be one of 'high', 'normal' or 'low', got '%s'", name)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+// A counting semaphore handing the slots released to the waiting calls by smooth weighted round-robin across the
+// priorities, and in arrival order within a priority. Higher priorities get most of the slots while lower ones are
+// never starved, so a flood of low priority messages delays the high priority ones by a few sends at most.
+type fairSemaphore struct {
+	mu      sync.Mutex
+	free    int
+	queues  map[Priority][]chan struct{}
+	current map[Priority]int // weighted round-robin state of the priorities with waiting calls
+}
+
+func newFairSemaphore(limit int) *fairSemaphore {
+	return &fairSemaphore{free: limit, queues: make(map[Priority][]chan struct{}), current: make(map[Priority]int)}
+}
+
+// Wait for a slot, or return the context's error if it is cancelled first.
+func (s *fairSemaphore) acquire(ctx context.Context, priority Priority) error {
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.queues[priority] = append(s.queues[priority], ready)
+	metrics.SendQueueDepth.WithLabelValues(priority.String()).Inc()
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.queues[priority] {
+		if w == ready {
+			s.queues[priority] = append(s.queues[priority][:i], s.queues[priority][i+1:]...)
+			metrics.SendQueueDepth.WithLabelValues(priority.String()).Dec()
+			return ctx.Err()
+		}
+	}
+	// The slot was handed over while the context was cancelled, so it is passed on
+	s.releaseLocked()
+	return ctx.Err()
+}
+
+// Release a slot, handing it to the next waiting call if any.
+func (s *fairSemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+func (s *fairSemaphore) releaseLocked() {
+	next, ok := s.next()
+	if !ok {
+		s.free++
+		return
+	}
+	ready := s.queues[next][0]
+	s.queues[next] = s.queues[next][1:]
+	metrics.SendQueueDepth.WithLabelValues(next.String()).Dec()
+	close(ready)
+}
+
+// Select the priority whose first waiting call gets the next slot: each priority with waiting calls gains its weight,
+// and the one with the most takes the slot and gives back the total weight.
+func (s *fairSemaphore) next() (Priority, bool) {
+	total, best, found := 0, PriorityNormal, false
+	for _, p := range priorities {
+		if len(s.queues[p]) == 0 {
+			s.current[p] = 0
+			continue
+		}
+		s.current[p] += priorityWeights[p]
+		total += priorityWeights[p]
+		if !found || s.current[p] > s.current[best] {
+			best, found = p, true
+		}
+	}
+	if found {
+		s.current[best] -= total
+	}
+	return best, found
+}
+
+// Returns the number of waiting calls by priority name.
+func (s *fairSemaphore) depths() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	depths := make(map[string]int, len(priorities))
+	for _, p := range priorities {
+		depths[p.String()] = len(s.queues[p])
+	}
+	return depths
+}
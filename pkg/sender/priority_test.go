@@ -0,0 +1,86 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePriority(t *testing.T) {
+	for name, want := range map[string]Priority{"": PriorityNormal, "normal": PriorityNormal, "high": PriorityHigh, "low": PriorityLow} {
+		if got, err := ParsePriority(name); err != nil || got != want {
+			t.Errorf("ParsePriority(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("ParsePriority accepted an unknown priority")
+	}
+}
+
+// Waiting calls get the released slots in weighted turns across priorities (4 high for 1 low), and in arrival order
+// within one.
+func TestFairSemaphoreOrder(t *testing.T) {
+	sem := newFairSemaphore(1)
+	if err := sem.acquire(context.Background(), PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(p Priority, i int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sem.acquire(context.Background(), p); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, fmt.Sprintf("%s%d", p, i))
+			mu.Unlock()
+			sem.release()
+		}()
+		// Wait until the call is queued so the arrival order is known
+		for deadline := time.Now().Add(time.Second); sem.depths()[p.String()] <= i && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		enqueue(PriorityLow, i)
+	}
+	for i := 0; i < 6; i++ {
+		enqueue(PriorityHigh, i)
+	}
+	sem.release()
+	wg.Wait()
+
+	want := []string{"high0", "high1", "low0", "high2", "high3", "high4", "high5", "low1", "low2", "low3"}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("slots granted in order %v, want %v", order, want)
+	}
+}
+
+func TestFairSemaphoreCancelled(t *testing.T) {
+	sem := newFairSemaphore(1)
+	if err := sem.acquire(context.Background(), PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sem.acquire(ctx, PriorityHigh); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire = %v, want the context's error", err)
+	}
+	if depth := sem.depths()["high"]; depth != 0 {
+		t.Errorf("%d calls queued after the waiting call was cancelled, want 0", depth)
+	}
+
+	// The slot is free again once released
+	sem.release()
+	if err := sem.acquire(context.Background(), PriorityLow); err != nil {
+		t.Errorf("acquire after release: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Outcome of the delivery of a message to one recipient, Err is nil if it was delivered.
+type RecipientStatus struct {
+	Address string
+	Err     error
+}
+
+// Error of a send which failed for some of the recipients only. Senders delivering to each recipient separately return
+// it instead of a single error; the statuses cover every recipient, including those the message was delivered to.
+type RecipientsError struct {
+	Statuses []RecipientStatus
+}
+
+func (e *RecipientsError) Error() string {
+	failed := e.Failed()
+	reasons := make([]string, len(failed))
+	for i, st := range failed {
+		reasons[i] = st.Address + ": " + st.Err.Error()
+	}
+	return fmt.Sprintf("failed to send to %d of %d recipients: %s", len(failed), len(e.Statuses), strings.Join(reasons, "; "))
+}
+
+// Returns the errors of the failed recipients, so errors.Is and errors.As match any of them.
+func (e *RecipientsError) Unwrap() []error {
+	var errs []error
+	for _, st := range e.Statuses {
+		if st.Err != nil {
+			errs = append(errs, st.Err)
+		}
+	}
+	return errs
+}
+
+// Returns the statuses of the recipients the message could not be delivered to.
+func (e *RecipientsError) Failed() []RecipientStatus {
+	var failed []RecipientStatus
+	for _, st := range e.Statuses {
+		if st.Err != nil {
+			failed = append(failed, st)
+		}
+	}
+	return failed
+}
+
+// Returns the recipients the message was delivered to.
+func (e *RecipientsError) Delivered() []string {
+	var delivered []string
+	for _, st := range e.Statuses {
+		if st.Err == nil {
+			delivered = append(delivered, st.Address)
+		}
+	}
+	return delivered
+}
+
+// Returns the status of each recipient of a send which returned err. A RecipientsError reports the recipients
+// individually; any other error, or its absence, applies to every recipient alike (e.g. a single Graph sendMail).
+func RecipientStatuses(to []string, err error) []RecipientStatus {
+	var re *RecipientsError
+	if errors.As(err, &re) {
+		return re.Statuses
+	}
+	statuses := make([]RecipientStatus, len(to))
+	for i, addr := range to {
+		statuses[i] = RecipientStatus{Address: addr, Err: err}
+	}
+	return statuses
+}
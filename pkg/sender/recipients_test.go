@@ -0,0 +1,50 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+func TestRecipientsError(t *testing.T) {
+	rejected := utils.Permanent(errors.New("550 5.1.1 mailbox unavailable"))
+	err := error(&RecipientsError{Statuses: []RecipientStatus{
+		{Address: "ops@example.net"},
+		{Address: "gone@example.net", Err: rejected},
+	}})
+
+	if want := "failed to send to 1 of 2 recipients: gone@example.net: 550 5.1.1 mailbox unavailable"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	if !errors.Is(err, rejected) || !utils.IsPermanent(err) {
+		t.Error("the errors of the failed recipients are not unwrapped")
+	}
+	re := err.(*RecipientsError)
+	if delivered := re.Delivered(); !slices.Equal(delivered, []string{"ops@example.net"}) {
+		t.Errorf("Delivered() = %v", delivered)
+	}
+	if failed := re.Failed(); len(failed) != 1 || failed[0].Address != "gone@example.net" {
+		t.Errorf("Failed() = %v", failed)
+	}
+}
+
+func TestRecipientStatuses(t *testing.T) {
+	to := []string{"ops@example.net", "noc@example.net"}
+	failure := errors.New("503 Service Unavailable")
+
+	// Senders with a single outcome report it for every recipient
+	for _, err := range []error{nil, failure} {
+		statuses := RecipientStatuses(to, err)
+		if len(statuses) != 2 || statuses[0].Address != to[0] || statuses[1].Address != to[1] || statuses[0].Err != err || statuses[1].Err != err {
+			t.Errorf("RecipientStatuses(%v) = %v", err, statuses)
+		}
+	}
+
+	re := &RecipientsError{Statuses: []RecipientStatus{{Address: "ops@example.net"}, {Address: "noc@example.net", Err: failure}}}
+	if statuses := RecipientStatuses(to, fmt.Errorf("failed to send email: %w", re)); len(statuses) != 2 || statuses[1].Err != failure {
+		t.Errorf("RecipientStatuses(wrapped RecipientsError) = %v", statuses)
+	}
+}
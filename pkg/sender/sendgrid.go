@@ -0,0 +1,272 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/secrets"
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+const DefaultSendGridEndpoint = "https://api.sendgrid.com"
+
+// SendGridSender sends messages with the SendGrid v3 mail send API, authenticated with an API key.
+type SendGridSender struct {
+	apiKey     string
+	secret     secrets.Resolver
+	endpoint   string
+	httpClient *http.Client
+	retries    int
+	strategy   utils.RetryStrategy
+}
+
+func NewSendGridSender(apiKey string, timeout time.Duration, retries int, backoff time.Duration) *SendGridSender {
+	return &SendGridSender{
+		apiKey:   apiKey,
+		endpoint: DefaultSendGridEndpoint,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		retries:  retries,
+		strategy: utils.ExponentialBackoff{Base: backoff},
+	}
+}
+
+// Wait between attempts to send a message as determined by the strategy (exponential backoff by default).
+func (sg *SendGridSender) SetRetryStrategy(strategy utils.RetryStrategy) {
+	sg.strategy = strategy
+}
+
+// Override the SendGrid API endpoint (e.g., for the EU region or testing).
+func (sg *SendGridSender) SetEndpoint(endpoint string) {
+	if endpoint != "" {
+		sg.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+}
+
+// Resolve the API key from the resolver on each request so rotated or refreshed keys are picked up.
+func (sg *SendGridSender) SetAPIKeyResolver(r secrets.Resolver) {
+	sg.secret = r
+}
+
+func (sg *SendGridSender) resolveAPIKey(ctx context.Context) (string, error) {
+	if sg.secret == nil {
+		return sg.apiKey, nil
+	}
+	apiKey, err := sg.secret.Resolve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve API key: %w", err)
+	}
+	return apiKey, nil
+}
+
+// Verify the API key by listing its scopes.
+func (sg *SendGridSender) Authenticate(ctx context.Context) error {
+	apiKey, err := sg.resolveAPIKey(ctx)
+	if err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sg.endpoint+"/v3/scopes", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := sg.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("authentication failed: %s", resp.Status)
+	}
+	ctxLog(ctx).Debug().Msg("Successfully verified the SendGrid API key")
+	return nil
+}
+
+// Build the SendGrid mail send request of a message.
+func makeSendGridRequest(msg *Message) *sendGridRequest {
+	req := &sendGridRequest{
+		Personalizations: []sendGridPersonalization{{
+			To:  makeSendGridAddresses(msg.To),
+			Cc:  makeSendGridAddresses(msg.Cc),
+			Bcc: makeSendGridAddresses(msg.Bcc),
+		}},
+		From:        sendGridAddress{Email: msg.From},
+		ReplyToList: makeSendGridAddresses(msg.ReplyTo),
+		Subject:     msg.Subject,
+	}
+	// SendGrid requires a To recipient, so messages sent only to blind copy recipients are addressed to them
+	if len(msg.To) == 0 && len(msg.Bcc) > 0 {
+		req.Personalizations[0].To, req.Personalizations[0].Bcc = req.Personalizations[0].Bcc, nil
+	}
+	if req.Personalizations[0].To == nil {
+		req.Personalizations[0].To = []sendGridAddress{}
+	}
+
+	bodyType := "HTML"
+	if msg.BodyType != "" {
+		bodyType = msg.BodyType
+	}
+	// SendGrid requires text/plain to be the first content if present
+	if strings.EqualFold(bodyType, "Text") {
+		req.Content = append(req.Content, sendGridContent{Type: "text/plain", Value: string(msg.Body)})
+	} else {
+		if msg.TextBody != "" {
+			req.Content = append(req.Content, sendGridContent{Type: "text/plain", Value: msg.TextBody})
+		}
+		req.Content = append(req.Content, sendGridContent{Type: "text/html", Value: string(msg.Body)})
+	}
+
+	for _, h := range msg.Headers {
+		if req.Headers == nil {
+			req.Headers = make(map[string]string)
+		}
+		req.Headers[h.Name] = h.Value
+	}
+	for _, a := range msg.Attachments {
+		att := sendGridAttachment{
+			Content:     a.ContentBytes,
+			Type:        a.ContentType,
+			Filename:    a.Name,
+			Disposition: "attachment",
+		}
+		if a.IsInline {
+			att.Disposition = "inline"
+			att.ContentID = a.ContentID
+		}
+		req.Attachments = append(req.Attachments, att)
+	}
+	return req
+}
+
+// Returns the SendGrid addresses of the addresses, or nil if there are none.
+func makeSendGridAddresses(addrs []string) []sendGridAddress {
+	if len(addrs) == 0 {
+		return nil
+	}
+	out := make([]sendGridAddress, len(addrs))
+	for i, addr := range addrs {
+		out[i] = sendGridAddress{Email: addr}
+	}
+	return out
+}
+
+func (sg *SendGridSender) sendEmailOnce(ctx context.Context, msg *Message) (string, error) {
+	if msg.MIME != nil {
+		return "", utils.Permanent(errors.New("SendGrid does not accept raw MIME messages"))
+	}
+
+	apiKey, err := sg.resolveAPIKey(ctx)
+	if err != nil {
+		return "", fmt.Errorf("authentication failed: %w", err)
+	}
+
+	data, err := json.Marshal(makeSendGridRequest(msg))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal email request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sg.endpoint+"/v3/mail/send", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sg.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send email: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20)) // limit to 1MB
+	if err != nil {
+		return "", fmt.Errorf("failed to read email send response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		var errorResp sendGridErrorResponse
+		err := fmt.Errorf("failed to send email: %s", resp.Status)
+		if jsonErr := json.Unmarshal(respData, &errorResp); jsonErr != nil || len(errorResp.Errors) == 0 {
+			ctxLog(ctx).Debug().Int("status_code", resp.StatusCode).Str("response", string(respData)).Msg("Invalid error response from email send")
+		} else if e := errorResp.Errors[0]; e.Field != "" {
+			err = fmt.Errorf("failed to send email (%s): %s: %s", resp.Status, e.Field, e.Message)
+		} else {
+			err = fmt.Errorf("failed to send email (%s): %s", resp.Status, e.Message)
+		}
+
+		// Malformed or oversized messages and invalid or unauthorized API keys are rejected again when retried
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestEntityTooLarge:
+			return "", utils.Permanent(err)
+		}
+		return "", err
+	}
+
+	return resp.Header.Get("X-Message-Id"), nil
+}
+
+func (sg *SendGridSender) Send(ctx context.Context, msg *Message) (*Result, error) {
+	result := &Result{}
+	err := utils.DoWithRetry(ctx, func() error {
+		result.Attempts++
+		id, err := sg.sendEmailOnce(ctx, msg)
+		if err == nil {
+			result.MessageID = id
+			ctxLog(ctx).Debug().Str("message_id", id).Msg("Email accepted by SendGrid")
+		}
+		return err
+	}, sg.retries, sg.strategy)
+	return result, err
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyToList      []sendGridAddress         `json:"reply_to_list,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     []byte `json:"content"` // base64 encoded when marshalled
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendGridErrorResponse struct {
+	Errors []struct {
+		Message string `json:"message"`
+		Field   string `json:"field"`
+	} `json:"errors"`
+}
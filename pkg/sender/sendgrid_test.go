@@ -0,0 +1,139 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+func TestSendGridSendEmail(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer SG.test-key" {
+			t.Errorf("Authorization = %q", auth)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v3/scopes":
+			w.Write([]byte(`{"scopes":["mail.send"]}`))
+		case "/v3/mail/send":
+			if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			data, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Errorf("invalid request body %s: %v", data, err)
+			}
+			w.Header().Set("X-Message-Id", "sg-message-1")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	sg := NewSendGridSender("SG.test-key", 5*time.Second, 1, time.Millisecond)
+	sg.SetEndpoint(srv.URL)
+	ctx := context.Background()
+
+	if err := sg.Authenticate(ctx); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	opts := &SendOptions{
+		TextBody: "Hello",
+		Headers:  []InternetMessageHeader{{Name: "In-Reply-To", Value: "<parent@example.com>"}},
+		Attachments: []FileAttachment{
+			{Name: "report.txt", ContentType: "text/plain", ContentBytes: []byte("report")},
+			{Name: "logo.png", ContentType: "image/png", ContentBytes: []byte("png"), ContentID: "logo", IsInline: true},
+		},
+	}
+	if err := SendEmail(ctx, sg, "alice@example.com", []string{"bob@example.net", "carol@example.net"}, "Greetings", []byte("<p>Hello</p>"), opts); err != nil {
+		t.Fatalf("SendEmail: %v", err)
+	}
+
+	want := `{
+		"personalizations": [{"to": [{"email": "bob@example.net"}, {"email": "carol@example.net"}]}],
+		"from": {"email": "alice@example.com"},
+		"subject": "Greetings",
+		"content": [{"type": "text/plain", "value": "Hello"}, {"type": "text/html", "value": "<p>Hello</p>"}],
+		"headers": {"In-Reply-To": "<parent@example.com>"},
+		"attachments": [
+			{"content": "cmVwb3J0", "type": "text/plain", "filename": "report.txt", "disposition": "attachment"},
+			{"content": "cG5n", "type": "image/png", "filename": "logo.png", "disposition": "inline", "content_id": "logo"}
+		]
+	}`
+	var wantBody map[string]any
+	if err := json.Unmarshal([]byte(want), &wantBody); err != nil {
+		t.Fatal(err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(wantBody)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("request body\n got %s\nwant %s", gotJSON, wantJSON)
+	}
+
+	id, err := sg.sendEmailOnce(ctx, NewMessage("alice@example.com", []string{"bob@example.net"}, "Greetings", []byte("Hello"), nil))
+	if err != nil || id != "sg-message-1" {
+		t.Errorf("message ID = %q, %v", id, err)
+	}
+}
+
+// Rejected requests are not retried; server errors are.
+func TestSendGridErrors(t *testing.T) {
+	var attempts atomic.Int32
+	status := http.StatusBadRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"errors":[{"message":"The from address does not match a verified Sender Identity.","field":"from"}]}`))
+	}))
+	defer srv.Close()
+
+	sg := NewSendGridSender("SG.test-key", 5*time.Second, 3, time.Millisecond)
+	sg.SetEndpoint(srv.URL)
+
+	err := SendEmail(context.Background(), sg, "alice@example.com", []string{"bob@example.net"}, "Greetings", []byte("Hello"), nil)
+	want := "failed to send email (400 Bad Request): from: The from address does not match a verified Sender Identity."
+	if err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("400 response sent in %d attempts, want 1", n)
+	}
+
+	for _, status = range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestEntityTooLarge} {
+		attempts.Store(0)
+		if err := SendEmail(context.Background(), sg, "alice@example.com", []string{"bob@example.net"}, "Greetings", []byte("Hello"), nil); !utils.IsPermanent(err) {
+			t.Errorf("%d response: error = %v, want a permanent error", status, err)
+		}
+		if n := attempts.Load(); n != 1 {
+			t.Errorf("%d response sent in %d attempts, want 1", status, n)
+		}
+	}
+
+	status = http.StatusServiceUnavailable
+	attempts.Store(0)
+	if err := SendEmail(context.Background(), sg, "alice@example.com", []string{"bob@example.net"}, "Greetings", []byte("Hello"), nil); err == nil || utils.IsPermanent(err) {
+		t.Errorf("503 response: error = %v, want a temporary error", err)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("503 response sent in %d attempts, want 3", n)
+	}
+
+	attempts.Store(0)
+	if err := SendEmail(context.Background(), sg, "alice@example.com", []string{"bob@example.net"}, "Greetings", nil, &SendOptions{MIME: []byte("Subject: raw\r\n\r\n")}); !utils.IsPermanent(err) {
+		t.Errorf("raw MIME message: error = %v, want a permanent error", err)
+	}
+	if n := attempts.Load(); n != 0 {
+		t.Errorf("raw MIME message sent in %d attempts, want none", n)
+	}
+}
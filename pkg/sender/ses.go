@@ -0,0 +1,242 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+// SESSender sends messages with the Amazon SES v2 API, signed with AWS Signature Version 4. Credentials are read from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN on each request so refreshed credentials are picked up.
+type SESSender struct {
+	region           string
+	endpoint         string
+	configurationSet string
+	httpClient       *http.Client
+	retries          int
+	strategy         utils.RetryStrategy
+}
+
+func NewSESSender(region string, timeout time.Duration, retries int, backoff time.Duration) *SESSender {
+	return &SESSender{
+		region:   region,
+		endpoint: DefaultSESEndpoint(region),
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		retries:  retries,
+		strategy: utils.ExponentialBackoff{Base: backoff},
+	}
+}
+
+// Wait between attempts to send a message as determined by the strategy (exponential backoff by default).
+func (ss *SESSender) SetRetryStrategy(strategy utils.RetryStrategy) {
+	ss.strategy = strategy
+}
+
+// Returns the SES v2 API endpoint of the region.
+func DefaultSESEndpoint(region string) string {
+	return "https://email." + region + ".amazonaws.com"
+}
+
+// Override the SES API endpoint (e.g., for a VPC endpoint or testing).
+func (ss *SESSender) SetEndpoint(endpoint string) {
+	if endpoint != "" {
+		ss.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+}
+
+// Send messages with the configuration set, applying its event destinations and tracking options.
+func (ss *SESSender) SetConfigurationSet(name string) {
+	ss.configurationSet = name
+}
+
+// Sign and send a request to the SES v2 API, returning the response body of a successful request.
+func (ss *SESSender) do(ctx context.Context, method, path string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, ss.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	utils.SignAWSv4(req, payload, "ses", ss.region, utils.AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, time.Now())
+
+	resp, err := ss.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20)) // limit to 1MB
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errorResp sesErrorResponse
+		// The error type may be followed by a colon and a URL
+		errType, _, _ := strings.Cut(resp.Header.Get("X-Amzn-ErrorType"), ":")
+		err := fmt.Errorf("%s", resp.Status)
+		switch {
+		case json.Unmarshal(respData, &errorResp) != nil || errorResp.Message == "":
+			ctxLog(ctx).Debug().Int("status_code", resp.StatusCode).Str("response", string(respData)).Msg("Invalid error response from SES")
+		case errType != "":
+			err = fmt.Errorf("%s (%s): %s", resp.Status, errType, errorResp.Message)
+		default:
+			err = fmt.Errorf("%s: %s", resp.Status, errorResp.Message)
+		}
+
+		// Malformed, rejected or oversized messages and invalid or unauthorized credentials are rejected again when
+		// retried. Exceeding the sending quota is reported with 400 as well, but clears over time
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusRequestEntityTooLarge:
+			if errType != "LimitExceededException" {
+				return nil, utils.Permanent(err)
+			}
+		}
+		return nil, err
+	}
+	return respData, nil
+}
+
+// Verify the credentials by reading the account's sending status.
+func (ss *SESSender) Authenticate(ctx context.Context) error {
+	if _, err := ss.do(ctx, http.MethodGet, "/v2/email/account", nil); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+	ctxLog(ctx).Debug().Str("region", ss.region).Msg("Successfully verified the SES credentials")
+	return nil
+}
+
+// Build the SES request of a message. Messages with attachments or a raw MIME message are sent as raw messages; the
+// others as simple messages with their headers.
+func makeSESRequest(msg *Message) *sesSendEmailRequest {
+	req := &sesSendEmailRequest{
+		FromEmailAddress: msg.From,
+		Destination:      sesDestination{ToAddresses: msg.To, CcAddresses: msg.Cc, BccAddresses: msg.Bcc},
+		ReplyToAddresses: msg.ReplyTo,
+	}
+
+	switch {
+	case msg.MIME != nil:
+		req.Content.Raw = &sesRawMessage{Data: msg.MIME}
+		return req
+	case len(msg.Attachments) > 0:
+		req.Content.Raw = &sesRawMessage{Data: makeMIME(msg)}
+		return req
+	}
+
+	simple := &sesSimpleMessage{Subject: sesContent{Data: msg.Subject, Charset: "UTF-8"}}
+	if strings.EqualFold(msg.BodyType, "Text") {
+		simple.Body.Text = &sesContent{Data: string(msg.Body), Charset: "UTF-8"}
+	} else {
+		simple.Body.Html = &sesContent{Data: string(msg.Body), Charset: "UTF-8"}
+		if msg.TextBody != "" {
+			simple.Body.Text = &sesContent{Data: msg.TextBody, Charset: "UTF-8"}
+		}
+	}
+	for _, h := range msg.Headers {
+		simple.Headers = append(simple.Headers, sesHeader{Name: h.Name, Value: h.Value})
+	}
+	req.Content.Simple = simple
+	return req
+}
+
+func (ss *SESSender) sendEmailOnce(ctx context.Context, msg *Message) (string, error) {
+	emailReq := makeSESRequest(msg)
+	emailReq.ConfigurationSetName = ss.configurationSet
+	data, err := json.Marshal(emailReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal email request: %w", err)
+	}
+
+	respData, err := ss.do(ctx, http.MethodPost, "/v2/email/outbound-emails", data)
+	if err != nil {
+		return "", fmt.Errorf("failed to send email: %w", err)
+	}
+
+	var sendResp sesSendEmailResponse
+	if err := json.Unmarshal(respData, &sendResp); err != nil {
+		return "", fmt.Errorf("invalid SES response: %w", err)
+	}
+	return sendResp.MessageId, nil
+}
+
+func (ss *SESSender) Send(ctx context.Context, msg *Message) (*Result, error) {
+	result := &Result{}
+	err := utils.DoWithRetry(ctx, func() error {
+		result.Attempts++
+		id, err := ss.sendEmailOnce(ctx, msg)
+		if err == nil {
+			result.MessageID = id
+			ctxLog(ctx).Debug().Str("message_id", id).Msg("Email accepted by SES")
+		}
+		return err
+	}, ss.retries, ss.strategy)
+	return result, err
+}
+
+type sesSendEmailRequest struct {
+	FromEmailAddress     string          `json:"FromEmailAddress"`
+	Destination          sesDestination  `json:"Destination"`
+	ReplyToAddresses     []string        `json:"ReplyToAddresses,omitempty"`
+	Content              sesEmailContent `json:"Content"`
+	ConfigurationSetName string          `json:"ConfigurationSetName,omitempty"`
+}
+
+type sesDestination struct {
+	ToAddresses  []string `json:"ToAddresses"`
+	CcAddresses  []string `json:"CcAddresses,omitempty"`
+	BccAddresses []string `json:"BccAddresses,omitempty"`
+}
+
+type sesEmailContent struct {
+	Simple *sesSimpleMessage `json:"Simple,omitempty"`
+	Raw    *sesRawMessage    `json:"Raw,omitempty"`
+}
+
+type sesSimpleMessage struct {
+	Subject sesContent  `json:"Subject"`
+	Body    sesBody     `json:"Body"`
+	Headers []sesHeader `json:"Headers,omitempty"`
+}
+
+type sesBody struct {
+	Text *sesContent `json:"Text,omitempty"`
+	Html *sesContent `json:"Html,omitempty"`
+}
+
+type sesContent struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset,omitempty"`
+}
+
+type sesHeader struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type sesRawMessage struct {
+	Data []byte `json:"Data"` // base64 encoded when marshalled
+}
+
+type sesSendEmailResponse struct {
+	MessageId string `json:"MessageId"`
+}
+
+type sesErrorResponse struct {
+	Message string `json:"message"`
+}
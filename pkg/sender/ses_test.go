@@ -0,0 +1,152 @@
+package sender
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+func TestSESSendEmail(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session-token")
+
+	var requests []sesSendEmailRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		scope := "/" + time.Now().UTC().Format("20060102") + "/eu-west-1/ses/aws4_request"
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE"+scope) || !strings.Contains(auth, "Signature=") {
+			t.Errorf("Authorization = %q", auth)
+		}
+		if tok := r.Header.Get("X-Amz-Security-Token"); tok != "session-token" {
+			t.Errorf("X-Amz-Security-Token = %q", tok)
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v2/email/account":
+			w.Write([]byte(`{"SendingEnabled":true}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/email/outbound-emails":
+			data, _ := io.ReadAll(r.Body)
+			var req sesSendEmailRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				t.Errorf("invalid request body %s: %v", data, err)
+			}
+			requests = append(requests, req)
+			w.Write([]byte(`{"MessageId":"ses-message-1"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ss := NewSESSender("eu-west-1", 5*time.Second, 1, time.Millisecond)
+	ss.SetEndpoint(srv.URL)
+	ss.SetConfigurationSet("relay")
+	ctx := context.Background()
+
+	if err := ss.Authenticate(ctx); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	// Messages without attachments are sent as simple messages with their headers
+	opts := &SendOptions{
+		TextBody: "Hello",
+		Headers:  []InternetMessageHeader{{Name: "In-Reply-To", Value: "<parent@example.com>"}},
+	}
+	id, err := ss.sendEmailOnce(ctx, NewMessage("alice@example.com", []string{"bob@example.net"}, "Greetings", []byte("<p>Hello</p>"), opts))
+	if err != nil || id != "ses-message-1" {
+		t.Fatalf("message ID = %q, %v", id, err)
+	}
+	req := requests[0]
+	if req.FromEmailAddress != "alice@example.com" || len(req.Destination.ToAddresses) != 1 || req.Destination.ToAddresses[0] != "bob@example.net" || req.ConfigurationSetName != "relay" {
+		t.Errorf("request = %+v", req)
+	}
+	simple := req.Content.Simple
+	if simple == nil || req.Content.Raw != nil {
+		t.Fatalf("content = %+v, want a simple message", req.Content)
+	}
+	if simple.Subject.Data != "Greetings" || simple.Body.Html == nil || simple.Body.Html.Data != "<p>Hello</p>" || simple.Body.Text == nil || simple.Body.Text.Data != "Hello" {
+		t.Errorf("simple message = %+v", simple)
+	}
+	if len(simple.Headers) != 1 || simple.Headers[0] != (sesHeader{Name: "In-Reply-To", Value: "<parent@example.com>"}) {
+		t.Errorf("headers = %+v", simple.Headers)
+	}
+
+	// Messages with attachments are sent as raw MIME messages
+	opts = &SendOptions{Attachments: []FileAttachment{{Name: "report.txt", ContentType: "text/plain", ContentBytes: []byte("report")}}}
+	if err := SendEmail(ctx, ss, "alice@example.com", []string{"bob@example.net"}, "Report", []byte("<p>Attached</p>"), opts); err != nil {
+		t.Fatalf("SendEmail: %v", err)
+	}
+	raw := requests[1].Content.Raw
+	if raw == nil || requests[1].Content.Simple != nil {
+		t.Fatalf("content = %+v, want a raw message", requests[1].Content)
+	}
+	if !strings.Contains(string(raw.Data), "Content-Type: multipart/mixed") || !strings.Contains(string(raw.Data), base64.StdEncoding.EncodeToString([]byte("report"))) {
+		t.Errorf("raw message:\n%s", raw.Data)
+	}
+}
+
+// Rejected requests are not retried; exceeded sending quotas and server errors are.
+func TestSESErrors(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	var attempts atomic.Int32
+	status, errType := http.StatusBadRequest, "MessageRejected"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("X-Amzn-ErrorType", errType+":http://internal.amazon.com/coral/com.amazonaws.sesv2/")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"message":"Email address is not verified."}`))
+	}))
+	defer srv.Close()
+
+	ss := NewSESSender("us-east-1", 5*time.Second, 3, time.Millisecond)
+	ss.SetEndpoint(srv.URL)
+	send := func() error {
+		attempts.Store(0)
+		return SendEmail(context.Background(), ss, "alice@example.com", []string{"bob@example.net"}, "Greetings", []byte("Hello"), nil)
+	}
+
+	err := send()
+	want := "failed to send email: 400 Bad Request (MessageRejected): Email address is not verified."
+	if err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("400 response sent in %d attempts, want 1", n)
+	}
+
+	status, errType = http.StatusForbidden, "AccessDeniedException"
+	if err := send(); !utils.IsPermanent(err) {
+		t.Errorf("403 response: error = %v, want a permanent error", err)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("403 response sent in %d attempts, want 1", n)
+	}
+
+	for _, tc := range []struct {
+		status  int
+		errType string
+	}{
+		{http.StatusBadRequest, "LimitExceededException"},
+		{http.StatusTooManyRequests, "TooManyRequestsException"},
+		{http.StatusInternalServerError, "InternalFailure"},
+	} {
+		status, errType = tc.status, tc.errType
+		if err := send(); err == nil || utils.IsPermanent(err) {
+			t.Errorf("%s: error = %v, want a temporary error", errType, err)
+		}
+		if n := attempts.Load(); n != 3 {
+			t.Errorf("%s sent in %d attempts, want 3", errType, n)
+		}
+	}
+}
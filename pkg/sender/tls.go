@@ -0,0 +1,97 @@
+package sender
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Prefix of the pins in the notation of HTTP public key pinning (RFC 7469)
+const spkiPinPrefix = "sha256/"
+
+// Returns the pin of the certificate: the base64 encoded SHA-256 hash of its SubjectPublicKeyInfo.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Parse a pin, with or without the "sha256/" prefix, returning it without the prefix.
+func ParseSPKIPin(pin string) (string, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), spkiPinPrefix)
+	sum, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(sum) != sha256.Size {
+		return "", errors.New("must be the base64 encoded SHA-256 hash of a SubjectPublicKeyInfo")
+	}
+	return pin, nil
+}
+
+// Create the TLS configuration of the connections to an API. The server certificates are verified against the CAs of
+// the PEM bundle if caFile is set, or the system roots otherwise. If pins are set, the verified chain must also contain
+// a certificate whose public key matches one of them, so a certificate issued by another trusted CA is refused.
+func NewTLSConfig(caFile string, pins []string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificate found in %s", caFile)
+		}
+		cfg.RootCAs = roots
+	}
+	if len(pins) == 0 {
+		return cfg, nil
+	}
+
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		parsed, err := ParseSPKIPin(pin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin '%s': %w", pin, err)
+		}
+		pinned[parsed] = true
+	}
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		chains := verifiedChains
+		if len(chains) == 0 {
+			// Without verification (insecure_skip_verify) the pins are matched against the presented certificates
+			var presented []*x509.Certificate
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("certificate pinning: %w", err)
+				}
+				presented = append(presented, cert)
+			}
+			chains = [][]*x509.Certificate{presented}
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if pinned[SPKIPin(cert)] {
+					return nil
+				}
+			}
+		}
+		if len(chains[0]) == 0 {
+			return errors.New("certificate pinning: no certificate presented")
+		}
+		leaf := chains[0][0]
+		return fmt.Errorf("certificate pinning: no pinned key matches the chain of '%s' (leaf key %s%s)", leaf.Subject.CommonName, spkiPinPrefix, SPKIPin(leaf))
+	}
+	return cfg, nil
+}
+
+// Returns an HTTP transport using the TLS configuration, with the settings of the default transport otherwise.
+func newTLSTransport(cfg *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return transport
+}
@@ -0,0 +1,74 @@
+package sender
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a login endpoint serving a self-signed certificate, and write the certificate to a CA bundle. Returns the
+// server and the path of the bundle.
+func newTLSLogin(t *testing.T) (*httptest.Server, string) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+	}))
+	t.Cleanup(srv.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, caFile
+}
+
+// Authenticate against the server with the TLS configuration.
+func authenticateTLS(t *testing.T, srv *httptest.Server, caFile string, pins []string) error {
+	t.Helper()
+	cfg, err := NewTLSConfig(caFile, pins, false)
+	if err != nil {
+		t.Fatalf("NewTLSConfig: %v", err)
+	}
+	gs := NewGraphSender("tenant", "client", "secret", 5*time.Second, 1, time.Millisecond)
+	gs.SetEndpoints(srv.URL, srv.URL)
+	gs.SetTLSConfig(cfg)
+	return gs.Authenticate(context.Background())
+}
+
+func TestGraphSenderCustomCA(t *testing.T) {
+	srv, caFile := newTLSLogin(t)
+	if err := authenticateTLS(t, srv, caFile, nil); err != nil {
+		t.Errorf("Authenticate with the server's CA: %v", err)
+	}
+	if err := authenticateTLS(t, srv, "", nil); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Authenticate with the system roots: got %v, want a certificate error", err)
+	}
+}
+
+func TestGraphSenderPinnedSPKI(t *testing.T) {
+	srv, caFile := newTLSLogin(t)
+	pin := SPKIPin(srv.Certificate())
+
+	if err := authenticateTLS(t, srv, caFile, []string{"sha256/" + pin}); err != nil {
+		t.Errorf("Authenticate with the server's pin: %v", err)
+	}
+
+	other := "sha256/" + strings.Repeat("A", 43) + "="
+	err := authenticateTLS(t, srv, caFile, []string{other})
+	if err == nil || !strings.Contains(err.Error(), "certificate pinning") || !strings.Contains(err.Error(), "sha256/"+pin) {
+		t.Errorf("Authenticate with another pin: got %v, want a pinning error naming the server's key", err)
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	if _, err := NewTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), nil, false); err == nil {
+		t.Error("missing CA bundle accepted")
+	}
+	if _, err := NewTLSConfig("", []string{"sha256/not-a-hash"}, false); err == nil || !strings.Contains(err.Error(), "sha256/not-a-hash") {
+		t.Errorf("invalid pin: got %v, want an error naming the pin", err)
+	}
+}
@@ -0,0 +1,84 @@
+package sender
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Time the token endpoint is not called again after a failed token request
+const DefaultTokenCooldown = 5 * time.Second
+
+// State of the token endpoint as seen by a sender
+type TokenEndpointState struct {
+	Failing   bool      // the last token request failed
+	LastError error     // error of the last failed token request, nil while the endpoint works
+	Since     time.Time // time of the first failure since the endpoint last worked
+	RetryAt   time.Time // time the endpoint is called again, by a message or the background probe
+}
+
+// Failure memory of the token endpoint: after a failed token request the endpoint is not called again until the
+// cool-down elapsed, and callers get the failure at once instead of each waiting for the endpoint to time out.
+type tokenBreaker struct {
+	mu       sync.Mutex
+	cooldown time.Duration
+	now      func() time.Time
+	err      error
+	since    time.Time
+	failedAt time.Time
+}
+
+func newTokenBreaker() *tokenBreaker {
+	return &tokenBreaker{cooldown: DefaultTokenCooldown, now: time.Now}
+}
+
+func (b *tokenBreaker) setCooldown(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cooldown = d
+}
+
+// Returns the last failure while within its cool-down, or nil if the endpoint may be called.
+func (b *tokenBreaker) check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		return nil
+	}
+	retryAt := b.failedAt.Add(b.cooldown)
+	if !b.now().Before(retryAt) {
+		return nil
+	}
+	return fmt.Errorf("token endpoint failing, not retried before %s: %w", retryAt.Format(time.RFC3339), b.err)
+}
+
+// Record the result of a token request, logging when the endpoint starts failing and when it recovers.
+func (b *tokenBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	switch {
+	case err != nil && b.err == nil:
+		b.since = now
+		log.Warn().Err(err).Dur("cooldown", b.cooldown).Msg("Token endpoint failed, failing authentication without calling it until the cool-down elapses")
+	case err != nil:
+		log.Debug().Err(err).Time("since", b.since).Msg("Token endpoint still failing")
+	case b.err != nil:
+		log.Info().Time("since", b.since).Msg("Token endpoint recovered")
+	}
+	b.err = err
+	if err != nil {
+		b.failedAt = now
+	}
+}
+
+func (b *tokenBreaker) state() TokenEndpointState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		return TokenEndpointState{}
+	}
+	return TokenEndpointState{Failing: true, LastError: b.err, Since: b.since, RetryAt: b.failedAt.Add(b.cooldown)}
+}
@@ -14,10 +14,45 @@ type SendEmailErrorResponse struct {
 }
 
 type EmailMessage struct {
-	Subject      string         `json:"subject"`
-	Body         EmailBody      `json:"body"`
-	From         EmailAddress   `json:"from"`
-	ToRecipients []EmailAddress `json:"toRecipients"`
+	Subject                string                  `json:"subject"`
+	Body                   EmailBody               `json:"body"`
+	From                   EmailAddress            `json:"from"`
+	ToRecipients           []EmailAddress          `json:"toRecipients"`
+	CcRecipients           []EmailAddress          `json:"ccRecipients,omitempty"`
+	BccRecipients          []EmailAddress          `json:"bccRecipients,omitempty"`
+	ReplyTo                []EmailAddress          `json:"replyTo,omitempty"`
+	InternetMessageID      string                  `json:"internetMessageId,omitempty"`
+	InternetMessageHeaders []InternetMessageHeader `json:"internetMessageHeaders,omitempty"`
+	Attachments            []FileAttachment        `json:"attachments,omitempty"`
+}
+
+// File attachment. Inline attachments are referenced from an HTML body by their content ID.
+type FileAttachment struct {
+	ODataType    string `json:"@odata.type"` // always "#microsoft.graph.fileAttachment"
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType,omitempty"`
+	ContentBytes []byte `json:"contentBytes"` // base64 encoded when marshalled
+	ContentID    string `json:"contentId,omitempty"`
+	IsInline     bool   `json:"isInline"`
+}
+
+// Internet message header. Graph's JSON messages only accept custom header names beginning with "X-", so messages with
+// other headers (e.g. In-Reply-To) are sent as MIME.
+type InternetMessageHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Optional message properties passed to a Sender alongside the envelope, subject and body.
+type SendOptions struct {
+	Headers     []InternetMessageHeader
+	BodyType    string // "HTML" (default) or "Text"
+	TextBody    string // Plain text alternative of an HTML body, sent as a multipart/alternative MIME message if set
+	Attachments []FileAttachment
+	MIME        []byte    // Raw MIME message sent instead of the subject, body and attachments if set
+	Bcc         []string  // Blind copy recipients, hidden from the other recipients
+	SessionID   string    // ID of the SMTP session or HTTP request which received the message, if any
+	ReceivedAt  time.Time // Time the message was received, if known
 }
 
 type EmailBody struct {
@@ -0,0 +1,198 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+const DefaultSignatureHeader = "X-GoPostal-Signature"
+
+// WebhookSender posts messages as JSON to an HTTP endpoint, optionally signed with HMAC-SHA256 and authenticated with a
+// bearer token or basic auth. 2xx responses are successful, 5xx responses (and 408 or 429) are retried and other
+// responses fail the message without retrying.
+type WebhookSender struct {
+	url             string
+	secret          []byte
+	signatureHeader string
+	bearerToken     string
+	username        string
+	password        string
+	httpClient      *http.Client
+	retries         int
+	strategy        utils.RetryStrategy
+}
+
+func NewWebhookSender(url string, timeout time.Duration, retries int, backoff time.Duration) *WebhookSender {
+	return &WebhookSender{
+		url: url,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		retries:  retries,
+		strategy: utils.ExponentialBackoff{Base: backoff},
+	}
+}
+
+// Wait between attempts to send a message as determined by the strategy (exponential backoff by default).
+func (ws *WebhookSender) SetRetryStrategy(strategy utils.RetryStrategy) {
+	ws.strategy = strategy
+}
+
+// Sign each request body with the shared secret, sending the signature in the header (DefaultSignatureHeader if
+// empty) as "sha256=<hex encoded HMAC-SHA256>".
+func (ws *WebhookSender) SetSigningSecret(secret, header string) {
+	if header == "" {
+		header = DefaultSignatureHeader
+	}
+	ws.secret = []byte(secret)
+	ws.signatureHeader = header
+}
+
+// Authenticate requests with the bearer token.
+func (ws *WebhookSender) SetBearerToken(token string) {
+	ws.bearerToken = token
+}
+
+// Authenticate requests with basic auth.
+func (ws *WebhookSender) SetBasicAuth(username, password string) {
+	ws.username = username
+	ws.password = password
+}
+
+// The webhook has no credentials to verify ahead of a message.
+func (ws *WebhookSender) Authenticate(ctx context.Context) error {
+	return nil
+}
+
+// Returns the signature header value of the body.
+func SignWebhookPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Build the JSON payload of a message.
+func makeWebhookPayload(msg *Message) *WebhookPayload {
+	payload := &WebhookPayload{
+		From:        msg.From,
+		To:          msg.To,
+		Cc:          msg.Cc,
+		Bcc:         msg.Bcc,
+		ReplyTo:     msg.ReplyTo,
+		Subject:     msg.Subject,
+		Body:        string(msg.Body),
+		ContentType: "html",
+		TextBody:    msg.TextBody,
+		Headers:     map[string]string{},
+		Metadata:    msg.Metadata,
+		SessionID:   msg.SessionID,
+	}
+	if strings.EqualFold(msg.BodyType, "Text") {
+		payload.ContentType = "text"
+	}
+	for _, h := range msg.Headers {
+		payload.Headers[h.Name] = h.Value
+	}
+	for _, a := range msg.Attachments {
+		payload.Attachments = append(payload.Attachments, WebhookAttachment{
+			Name:         a.Name,
+			ContentType:  a.ContentType,
+			ContentBytes: a.ContentBytes,
+			ContentID:    a.ContentID,
+			IsInline:     a.IsInline,
+		})
+	}
+	if !msg.ReceivedAt.IsZero() {
+		payload.ReceivedAt = msg.ReceivedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return payload
+}
+
+func (ws *WebhookSender) sendEmailOnce(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.url, bytes.NewReader(data))
+	if err != nil {
+		return utils.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ws.secret != nil {
+		req.Header.Set(ws.signatureHeader, SignWebhookPayload(ws.secret, data))
+	}
+	switch {
+	case ws.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+ws.bearerToken)
+	case ws.username != "":
+		req.SetBasicAuth(ws.username, ws.password)
+	}
+
+	resp, err := ws.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	defer resp.Body.Close()
+	respData, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10)) // only the start of the response is logged
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		ctxLog(ctx).Debug().Int("status_code", resp.StatusCode).Str("response", string(respData)).Msg("Webhook request failed")
+		return fmt.Errorf("failed to send email: %s", resp.Status)
+	default:
+		ctxLog(ctx).Debug().Int("status_code", resp.StatusCode).Str("response", string(respData)).Msg("Webhook request rejected")
+		return utils.Permanent(fmt.Errorf("failed to send email: webhook rejected the message: %s", resp.Status))
+	}
+}
+
+func (ws *WebhookSender) Send(ctx context.Context, msg *Message) (*Result, error) {
+	if msg.MIME != nil {
+		return nil, errors.New("the webhook sender does not accept raw MIME messages")
+	}
+	data, err := json.Marshal(makeWebhookPayload(msg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+	result := &Result{}
+	err = utils.DoWithRetry(ctx, func() error {
+		result.Attempts++
+		return ws.sendEmailOnce(ctx, data)
+	}, ws.retries, ws.strategy)
+	return result, err
+}
+
+// JSON payload posted to the webhook
+type WebhookPayload struct {
+	From        string              `json:"from"`
+	To          []string            `json:"to"`
+	Cc          []string            `json:"cc,omitempty"`
+	Bcc         []string            `json:"bcc,omitempty"`
+	ReplyTo     []string            `json:"reply_to,omitempty"`
+	Subject     string              `json:"subject"`
+	Body        string              `json:"body"`
+	ContentType string              `json:"content_type"`        // "html" or "text"
+	TextBody    string              `json:"text_body,omitempty"` // plain text alternative of an HTML body
+	Headers     map[string]string   `json:"headers"`
+	Attachments []WebhookAttachment `json:"attachments,omitempty"`
+	ReceivedAt  string              `json:"received_at,omitempty"` // RFC 3339
+	SessionID   string              `json:"session_id,omitempty"`
+	Metadata    map[string]string   `json:"metadata,omitempty"`
+}
+
+type WebhookAttachment struct {
+	Name         string `json:"name"`
+	ContentType  string `json:"content_type,omitempty"`
+	ContentBytes []byte `json:"content_bytes"` // base64 encoded when marshalled
+	ContentID    string `json:"content_id,omitempty"`
+	IsInline     bool   `json:"is_inline,omitempty"`
+}
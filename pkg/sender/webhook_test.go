@@ -0,0 +1,94 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/utils"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	// HMAC-SHA256 test vector from RFC 4231 (test case 2)
+	got := SignWebhookPayload([]byte("Jefe"), []byte("what do ya want for nothing?"))
+	want := "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookSendEmail(t *testing.T) {
+	var payload WebhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get("X-Hook-Signature"); sig != SignWebhookPayload([]byte("s3cret"), data) {
+			t.Errorf("signature = %q", sig)
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "relay" || pass != "hunter2" {
+			t.Errorf("basic auth = %q, %q, %v", user, pass, ok)
+		}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Errorf("invalid payload %s: %v", data, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ws := NewWebhookSender(srv.URL, 5*time.Second, 1, time.Millisecond)
+	ws.SetSigningSecret("s3cret", "X-Hook-Signature")
+	ws.SetBasicAuth("relay", "hunter2")
+
+	received := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	opts := &SendOptions{
+		BodyType:   "Text",
+		Headers:    []InternetMessageHeader{{Name: "X-Priority", Value: "1"}},
+		SessionID:  "4f0c6c2e-2d0e-4b8f-9a43-3f8f3c2b8c11",
+		ReceivedAt: received,
+	}
+	if err := SendEmail(context.Background(), ws, "alerts@example.com", []string{"ops@example.net"}, "Disk full", []byte("/var is 98% full"), opts); err != nil {
+		t.Fatalf("SendEmail: %v", err)
+	}
+	if payload.From != "alerts@example.com" || len(payload.To) != 1 || payload.To[0] != "ops@example.net" || payload.Subject != "Disk full" ||
+		payload.Body != "/var is 98% full" || payload.ContentType != "text" || payload.Headers["X-Priority"] != "1" ||
+		payload.SessionID != opts.SessionID || payload.ReceivedAt != "2026-10-16T12:00:00Z" {
+		t.Errorf("payload = %+v", payload)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		status    int
+		calls     int32
+		permanent bool
+	}{
+		{http.StatusOK, 1, false},
+		{http.StatusBadRequest, 1, true},
+		{http.StatusUnauthorized, 1, true},
+		{http.StatusTooManyRequests, 3, false},
+		{http.StatusInternalServerError, 3, false},
+		{http.StatusServiceUnavailable, 3, false},
+	}
+	for _, tt := range tests {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(tt.status)
+		}))
+
+		ws := NewWebhookSender(srv.URL, 5*time.Second, 3, time.Millisecond)
+		err := SendEmail(context.Background(), ws, "alerts@example.com", []string{"ops@example.net"}, "Disk full", []byte("full"), nil)
+		srv.Close()
+
+		if calls.Load() != tt.calls {
+			t.Errorf("status %d: %d requests, want %d", tt.status, calls.Load(), tt.calls)
+		}
+		if (err != nil) != (tt.status >= 300) || utils.IsPermanent(err) != tt.permanent {
+			t.Errorf("status %d: error = %v, permanent = %v", tt.status, err, utils.IsPermanent(err))
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Returned, wrapped, for the failures of the spool files, e.g. a full disk, as opposed to the failures of the reader
+var ErrFile = errors.New("spool file failed")
+
+// Spool holds the data of a message from the time it is received until it is processed.
+type Spool interface {
+	io.Writer
+
+	// Returns the number of bytes written to the spool.
+	Size() int64
+
+	// Returns the data written to the spool. A file spool reads the whole file back into memory.
+	Bytes() ([]byte, error)
+
+	// Release the data of the spool. The spool must not be used afterwards.
+	Close() error
+}
+
+// MemorySpool buffers the message in memory.
+type MemorySpool struct {
+	buf bytes.Buffer
+}
+
+// Create an empty in-memory spool.
+func NewMemorySpool() *MemorySpool {
+	return &MemorySpool{}
+}
+
+func (m *MemorySpool) Write(p []byte) (int, error) {
+	return m.buf.Write(p)
+}
+
+func (m *MemorySpool) Size() int64 {
+	return int64(m.buf.Len())
+}
+
+func (m *MemorySpool) Bytes() ([]byte, error) {
+	return m.buf.Bytes(), nil
+}
+
+func (m *MemorySpool) Close() error {
+	m.buf = bytes.Buffer{}
+	return nil
+}
+
+// FileSpool writes the message to a temporary file, which is deleted when the spool is closed.
+type FileSpool struct {
+	file *os.File
+	size int64
+}
+
+// Create a spool backed by a new temporary file in the directory, or in the default directory for temporary files if
+// dir is empty.
+func NewFileSpool(dir string) (*FileSpool, error) {
+	f, err := os.CreateTemp(dir, "gopostal-spool-*.eml")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFile, err)
+	}
+	return &FileSpool{file: f}, nil
+}
+
+// Returns the path of the spool file.
+func (f *FileSpool) Path() string {
+	return f.file.Name()
+}
+
+func (f *FileSpool) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("%w: %w", ErrFile, err)
+	}
+	return n, nil
+}
+
+func (f *FileSpool) Size() int64 {
+	return f.size
+}
+
+func (f *FileSpool) Bytes() ([]byte, error) {
+	data := make([]byte, f.size)
+	if _, err := f.file.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFile, err)
+	}
+	return data, nil
+}
+
+func (f *FileSpool) Close() error {
+	return errors.Join(f.file.Close(), os.Remove(f.file.Name()))
+}
+
+// Receive the data of a message into a spool. Data of up to threshold bytes is buffered in memory; larger data is
+// written to a file spool in the directory, so it does not hold memory while it is transferred. A threshold of 0
+// buffers all data in memory. The caller must close the returned spool.
+func Receive(r io.Reader, threshold int64, dir string) (Spool, error) {
+	mem := NewMemorySpool()
+	if threshold <= 0 {
+		if _, err := io.Copy(mem, r); err != nil {
+			return nil, err
+		}
+		return mem, nil
+	}
+
+	// Peek one byte past the threshold to tell whether the data fits in memory
+	n, err := io.Copy(mem, io.LimitReader(r, threshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= threshold {
+		return mem, nil
+	}
+
+	file, err := NewFileSpool(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mem.buf.WriteTo(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,79 @@
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReceive(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		threshold int64
+		wantFile  bool
+	}{
+		{"below threshold", 100, 1024, false},
+		{"at threshold", 1024, 1024, false},
+		{"above threshold", 1025, 1024, true},
+		{"large", 1 << 20, 1024, true},
+		{"no threshold", 1 << 20, 0, false},
+		{"empty", 0, 1024, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := bytes.Repeat([]byte("0123456789abcdef"), tt.size/16+1)[:tt.size]
+			sp, err := Receive(bytes.NewReader(data), tt.threshold, dir)
+			if err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			file, isFile := sp.(*FileSpool)
+			if isFile != tt.wantFile {
+				t.Fatalf("spool = %T, want a file spool: %v", sp, tt.wantFile)
+			}
+			if sp.Size() != int64(tt.size) {
+				t.Errorf("Size = %d, want %d", sp.Size(), tt.size)
+			}
+			got, err := sp.Bytes()
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("Bytes = %d bytes, %v, want the %d bytes received", len(got), err, len(data))
+			}
+
+			if isFile {
+				if filepath.Dir(file.Path()) != dir {
+					t.Errorf("spool file %s, want it in %s", file.Path(), dir)
+				}
+				if info, err := os.Stat(file.Path()); err != nil || info.Size() != int64(tt.size) {
+					t.Errorf("spool file = %v, %v, want %d bytes", info, err, tt.size)
+				}
+			}
+			if err := sp.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("%d files left in the spool directory after Close", len(entries))
+			}
+		})
+	}
+}
+
+func TestReceiveErrors(t *testing.T) {
+	// Failures of the reader are returned as-is
+	readErr := errors.New("connection reset")
+	_, err := Receive(iotest.ErrReader(readErr), 1024, t.TempDir())
+	if !errors.Is(err, readErr) || errors.Is(err, ErrFile) {
+		t.Errorf("Receive from a failing reader: %v, want the reader error", err)
+	}
+
+	// Failures of the spool file are distinguished from them
+	missing := filepath.Join(t.TempDir(), "missing")
+	_, err = Receive(strings.NewReader(strings.Repeat("x", 2048)), 1024, missing)
+	if !errors.Is(err, ErrFile) {
+		t.Errorf("Receive into a missing directory: %v, want ErrFile", err)
+	}
+}
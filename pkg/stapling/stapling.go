@@ -0,0 +1,156 @@
+package stapling
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Delay before fetching the response again after a failed fetch
+const RetryInterval = 5 * time.Minute
+
+// Delay before fetching a response again when the responder does not tell when it is updated
+const DefaultRefreshInterval = time.Hour
+
+// Largest OCSP response read from a responder
+const maxResponseSize = 1 << 20
+
+// Stapler fetches the OCSP response of a listener certificate from its issuer's responder and staples it to the TLS
+// handshakes, so clients learn the revocation status without querying the responder themselves.
+type Stapler struct {
+	cert   tls.Certificate
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+	client *http.Client
+	now    func() time.Time
+
+	mu         sync.RWMutex
+	staple     []byte
+	nextUpdate time.Time
+}
+
+// Create a stapler for the certificate issued by the issuer. The certificate must name an OCSP responder.
+func NewStapler(cert tls.Certificate, leaf, issuer *x509.Certificate) (*Stapler, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("certificate of '%s' names no OCSP responder", leaf.Subject.CommonName)
+	}
+	return &Stapler{
+		cert:   cert,
+		leaf:   leaf,
+		issuer: issuer,
+		client: &http.Client{Timeout: 30 * time.Second},
+		now:    time.Now,
+	}, nil
+}
+
+// Returns the current OCSP response, or nil if none was fetched or it expired.
+func (s *Stapler) Staple() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.nextUpdate.IsZero() && s.now().After(s.nextUpdate) {
+		return nil
+	}
+	return s.staple
+}
+
+// Returns a tls.Config.GetConfigForClient function serving the base configuration with the current OCSP response
+// stapled to the certificate.
+func (s *Stapler) GetConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cert := s.cert
+		cert.OCSPStaple = s.Staple()
+		cfg.Certificates = []tls.Certificate{cert}
+		return cfg, nil
+	}
+}
+
+// Fetch the OCSP response immediately and again before it expires until the context is cancelled. Failed fetches are
+// retried after RetryInterval while the previous response is still served.
+func (s *Stapler) Run(ctx context.Context) {
+	log.Info().Str("subject", s.leaf.Subject.CommonName).Str("responder", s.leaf.OCSPServer[0]).Msg("Starting OCSP stapling")
+	for {
+		wait := RetryInterval
+		if refresh, err := s.Refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error().Err(err).Str("subject", s.leaf.Subject.CommonName).Dur("retry", wait).Msg("Failed to fetch the OCSP response")
+		} else {
+			wait = refresh
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Fetch and verify the OCSP response, staple it and return the delay until it should be fetched again, halfway to
+// its next update.
+func (s *Stapler) Refresh(ctx context.Context) (time.Duration, error) {
+	req, err := ocsp.CreateRequest(s.leaf, s.issuer, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create the OCSP request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.leaf.OCSPServer[0], bytes.NewReader(req))
+	if err != nil {
+		return 0, fmt.Errorf("invalid OCSP responder '%s': %w", s.leaf.OCSPServer[0], err)
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	httpReq.Header.Set("Accept", "application/ocsp-response")
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("OCSP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("OCSP responder replied with status %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the OCSP response: %w", err)
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(raw, s.leaf, s.issuer)
+	if err != nil {
+		return 0, fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	now := s.now()
+	if !parsed.NextUpdate.IsZero() && now.After(parsed.NextUpdate) {
+		return 0, errors.New("OCSP response is expired")
+	}
+	if parsed.Status != ocsp.Good {
+		// The response is stapled anyway, so clients are told about the revocation
+		log.Error().Str("subject", s.leaf.Subject.CommonName).Int("status", parsed.Status).Msg("OCSP responder reports the certificate as not good")
+	}
+
+	s.mu.Lock()
+	s.staple, s.nextUpdate = raw, parsed.NextUpdate
+	s.mu.Unlock()
+	log.Debug().Str("subject", s.leaf.Subject.CommonName).Time("next_update", parsed.NextUpdate).Msg("OCSP response stapled")
+
+	if parsed.NextUpdate.IsZero() {
+		return DefaultRefreshInterval, nil
+	}
+	refresh := parsed.ThisUpdate.Add(parsed.NextUpdate.Sub(parsed.ThisUpdate) / 2).Sub(now)
+	if refresh < time.Minute {
+		refresh = time.Minute
+	}
+	return refresh, nil
+}
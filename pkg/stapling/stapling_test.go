@@ -0,0 +1,225 @@
+package stapling
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Certificate issued by a test CA, with the CA answering the OCSP requests about it
+type testPKI struct {
+	ca        *x509.Certificate
+	caKey     crypto.Signer
+	leaf      *x509.Certificate
+	cert      tls.Certificate
+	responder *httptest.Server
+	requests  atomic.Int32
+	status    int // OCSP status of the leaf
+	fail      bool
+}
+
+func newTestPKI(t *testing.T, withResponder bool) *testPKI {
+	t.Helper()
+	p := &testPKI{status: ocsp.Good}
+	p.responder = httptest.NewServer(http.HandlerFunc(p.respond))
+	t.Cleanup(p.responder.Close)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ca, _ = x509.ParseCertificate(caDER)
+	p.caKey = caKey
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mail.example.com"},
+		DNSNames:     []string{"mail.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if withResponder {
+		leafTemplate.OCSPServer = []string{p.responder.URL}
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, p.ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.leaf, _ = x509.ParseCertificate(leafDER)
+	p.cert = tls.Certificate{Certificate: [][]byte{leafDER, caDER}, PrivateKey: leafKey, Leaf: p.leaf}
+	return p
+}
+
+func (p *testPKI) respond(w http.ResponseWriter, r *http.Request) {
+	p.requests.Add(1)
+	body, _ := io.ReadAll(r.Body)
+	req, err := ocsp.ParseRequest(body)
+	if p.fail || err != nil {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Truncate(time.Minute)
+	resp, err := ocsp.CreateResponse(p.ca, p.ca, ocsp.Response{
+		Status:       p.status,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now.Add(-time.Hour),
+		NextUpdate:   now.Add(3 * time.Hour),
+		RevokedAt:    now.Add(-time.Hour),
+	}, p.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// Complete a TLS handshake with the configuration and return the OCSP response received by the client.
+func handshake(t *testing.T, p *testPKI, cfg *tls.Config) []byte {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		tls.Server(serverConn, cfg).Handshake()
+	}()
+	client := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: "mail.example.com"})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	return client.ConnectionState().OCSPResponse
+}
+
+func TestStaplerServesResponse(t *testing.T) {
+	p := newTestPKI(t, true)
+	s, err := NewStapler(p.cert, p.leaf, p.ca)
+	if err != nil {
+		t.Fatalf("NewStapler: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{p.cert}}
+	cfg.GetConfigForClient = s.GetConfigForClient(cfg)
+
+	// Nothing is stapled before the first fetch
+	if staple := handshake(t, p, cfg); staple != nil {
+		t.Errorf("stapled %d bytes before the first fetch", len(staple))
+	}
+
+	refresh, err := s.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if refresh < time.Minute || refresh > 2*time.Hour {
+		t.Errorf("refresh in %v, want halfway to the next update", refresh)
+	}
+	staple := handshake(t, p, cfg)
+	if staple == nil || !bytes.Equal(staple, s.Staple()) {
+		t.Fatalf("stapled %d bytes, want the fetched response", len(staple))
+	}
+	resp, err := ocsp.ParseResponseForCert(staple, p.leaf, p.ca)
+	if err != nil || resp.Status != ocsp.Good {
+		t.Errorf("stapled response = %v, %v, want a good status", resp, err)
+	}
+
+	// Responses are no longer stapled once they expired
+	s.now = func() time.Time { return time.Now().Add(4 * time.Hour) }
+	if staple := handshake(t, p, cfg); staple != nil {
+		t.Errorf("stapled %d bytes after the next update", len(staple))
+	}
+}
+
+func TestStaplerRefreshFailure(t *testing.T) {
+	p := newTestPKI(t, true)
+	s, err := NewStapler(p.cert, p.leaf, p.ca)
+	if err != nil {
+		t.Fatalf("NewStapler: %v", err)
+	}
+	if _, err := s.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	previous := s.Staple()
+
+	// The previous response is kept while the responder fails
+	p.fail = true
+	if _, err := s.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded with a failing responder")
+	}
+	if !bytes.Equal(s.Staple(), previous) {
+		t.Error("previous response dropped after a failed fetch")
+	}
+
+	// Revocations are stapled so the clients learn about them
+	p.fail, p.status = false, ocsp.Revoked
+	if _, err := s.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if resp, err := ocsp.ParseResponseForCert(s.Staple(), p.leaf, p.ca); err != nil || resp.Status != ocsp.Revoked {
+		t.Errorf("stapled response = %v, %v, want a revoked status", resp, err)
+	}
+}
+
+func TestStaplerRun(t *testing.T) {
+	p := newTestPKI(t, true)
+	s, err := NewStapler(p.cert, p.leaf, p.ca)
+	if err != nil {
+		t.Fatalf("NewStapler: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Staple() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if s.Staple() == nil || p.requests.Load() != 1 {
+		t.Errorf("staple = %d bytes after %d requests, want one fetch on start", len(s.Staple()), p.requests.Load())
+	}
+}
+
+func TestNewStaplerWithoutResponder(t *testing.T) {
+	p := newTestPKI(t, false)
+	if _, err := NewStapler(p.cert, p.leaf, p.ca); err == nil {
+		t.Error("NewStapler accepted a certificate without an OCSP responder")
+	}
+}
@@ -0,0 +1,291 @@
+package testutil
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goodieshq/gopostal/pkg/sender"
+)
+
+// Failure modes which can be injected into the fake Graph sendMail endpoint
+type Failure int
+
+const (
+	FailureThrottled   Failure = iota // 429 Too Many Requests
+	FailureForbidden                  // 403 Forbidden
+	FailureTimeout                    // the request hangs until the client gives up
+	FailureUnavailable                // 503 Service Unavailable
+)
+
+// Lifetime of the issued access tokens unless set with SetTokenLifetime
+const defaultTokenLifetime = time.Hour
+
+// A sendMail request recorded by the fake Graph server
+type SentMail struct {
+	Mailbox   string
+	SessionID string // value of the X-GoPostal-Session-ID header
+	Body      []byte // request body as sent
+	Request   sender.SendEmailRequest
+	MIME      []byte // decoded message for MIME (text/plain) requests
+}
+
+// FakeGraph is an httptest server emulating the Microsoft identity platform token endpoint and the Graph sendMail API.
+// Token requests are validated against the configured client credentials, each issued token is accepted by sendMail
+// until it expires, and sendMail payloads are recorded.
+type FakeGraph struct {
+	Server       *httptest.Server
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+
+	done          chan struct{}
+	mu            sync.Mutex
+	tokenRequests []time.Time
+	tokenFailing  bool
+	tokenLifetime time.Duration
+	tokens        map[string]time.Time // expiry of the issued tokens
+	delay         time.Duration
+	failures      []Failure
+	inFlight      map[string]int // sendMail requests in flight per mailbox, and across mailboxes under ""
+	peak          map[string]int
+	sent          []SentMail
+}
+
+// Start a new fake Graph server accepting the provided client credentials.
+func NewFakeGraph(tenantID, clientID, clientSecret string) *FakeGraph {
+	fg := &FakeGraph{
+		TenantID:      tenantID,
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		done:          make(chan struct{}),
+		tokenLifetime: defaultTokenLifetime,
+		tokens:        make(map[string]time.Time),
+		inFlight:      make(map[string]int),
+		peak:          make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{tenant}/oauth2/v2.0/token", fg.handleToken)
+	mux.HandleFunc("POST /v1.0/users/{mailbox}/sendMail", fg.handleSendMail)
+	fg.Server = httptest.NewServer(mux)
+	return fg
+}
+
+// Shut down the fake server.
+func (fg *FakeGraph) Close() {
+	close(fg.done)
+	fg.Server.Close()
+}
+
+// Returns the base URL of the fake server, suitable for both the login and Graph endpoints.
+func (fg *FakeGraph) URL() string {
+	return fg.Server.URL
+}
+
+// Create a GraphSender which talks to the fake server.
+func (fg *FakeGraph) NewSender(timeout time.Duration, retries int, backoff time.Duration) *sender.GraphSender {
+	gs := sender.NewGraphSender(fg.TenantID, fg.ClientID, fg.ClientSecret, timeout, retries, backoff)
+	gs.SetEndpoints(fg.URL(), fg.URL())
+	return gs
+}
+
+// Queue failures to be returned by the next sendMail requests, in order.
+func (fg *FakeGraph) FailNext(failures ...Failure) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.failures = append(fg.failures, failures...)
+}
+
+// Make the token endpoint reject every request as if the client secret expired, or accept them again.
+func (fg *FakeGraph) FailTokens(failing bool) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.tokenFailing = failing
+}
+
+// Issue access tokens valid for the lifetime (an hour by default), rounded down to whole seconds as in the token
+// response. sendMail rejects the expired tokens.
+func (fg *FakeGraph) SetTokenLifetime(d time.Duration) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.tokenLifetime = d
+}
+
+// Hold each sendMail request for the delay before answering it, e.g. to keep calls in flight.
+func (fg *FakeGraph) SetDelay(d time.Duration) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.delay = d
+}
+
+// Returns the highest number of sendMail requests in flight at once for the mailbox, or across all mailboxes if the
+// mailbox is empty.
+func (fg *FakeGraph) PeakInFlight(mailbox string) int {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	return fg.peak[mailbox]
+}
+
+// Returns the sendMail requests which were accepted.
+func (fg *FakeGraph) Sent() []SentMail {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	return append([]SentMail(nil), fg.sent...)
+}
+
+// Returns the number of token requests received.
+func (fg *FakeGraph) TokenRequests() int {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	return len(fg.tokenRequests)
+}
+
+// Returns the times at which the token requests were received.
+func (fg *FakeGraph) TokenRequestTimes() []time.Time {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	return append([]time.Time(nil), fg.tokenRequests...)
+}
+
+func (fg *FakeGraph) handleToken(w http.ResponseWriter, r *http.Request) {
+	fg.mu.Lock()
+	fg.tokenRequests = append(fg.tokenRequests, time.Now())
+	n, failing, lifetime := len(fg.tokenRequests), fg.tokenFailing, fg.tokenLifetime
+	fg.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		writeGraphError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	switch {
+	case failing:
+		writeGraphError(w, http.StatusUnauthorized, "invalid_client", "client secret has expired")
+	case r.PathValue("tenant") != fg.TenantID:
+		writeGraphError(w, http.StatusBadRequest, "invalid_tenant", "unknown tenant")
+	case r.PostForm.Get("grant_type") != "client_credentials":
+		writeGraphError(w, http.StatusBadRequest, "unsupported_grant_type", "expected client_credentials")
+	case r.PostForm.Get("scope") != fg.URL()+"/.default":
+		writeGraphError(w, http.StatusBadRequest, "invalid_scope", "unexpected scope")
+	case r.PostForm.Get("client_id") != fg.ClientID || r.PostForm.Get("client_secret") != fg.ClientSecret:
+		writeGraphError(w, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+	default:
+		// Each token is distinct, so a token obtained before one expired is told from its replacement
+		token := fmt.Sprintf("fake-access-token-%d", n)
+		expiresIn := int(lifetime / time.Second)
+		fg.mu.Lock()
+		fg.tokens[token] = time.Now().Add(time.Duration(expiresIn) * time.Second)
+		fg.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sender.AuthTokenResponse{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   expiresIn,
+		})
+	}
+}
+
+func (fg *FakeGraph) handleSendMail(w http.ResponseWriter, r *http.Request) {
+	mailbox, _ := url.PathUnescape(r.PathValue("mailbox"))
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	fg.mu.Lock()
+	expiresAt, issued := fg.tokens[token]
+	fg.mu.Unlock()
+	switch {
+	case !issued:
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "access token is missing or invalid")
+		return
+	case time.Now().After(expiresAt):
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "access token has expired")
+		return
+	}
+
+	fg.mu.Lock()
+	var failure *Failure
+	if len(fg.failures) > 0 {
+		failure = &fg.failures[0]
+		fg.failures = fg.failures[1:]
+	}
+	delay := fg.delay
+	for _, key := range []string{mailbox, ""} {
+		fg.inFlight[key]++
+		fg.peak[key] = max(fg.peak[key], fg.inFlight[key])
+	}
+	fg.mu.Unlock()
+	defer func() {
+		fg.mu.Lock()
+		fg.inFlight[mailbox]--
+		fg.inFlight[""]--
+		fg.mu.Unlock()
+	}()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		case <-fg.done:
+			return
+		}
+	}
+
+	if failure != nil {
+		switch *failure {
+		case FailureThrottled:
+			w.Header().Set("Retry-After", "1")
+			writeGraphError(w, http.StatusTooManyRequests, "ApplicationThrottled", "too many requests")
+		case FailureForbidden:
+			writeGraphError(w, http.StatusForbidden, "ErrorAccessDenied", "access is denied")
+		case FailureUnavailable:
+			writeGraphError(w, http.StatusServiceUnavailable, "ServiceUnavailable", "service is unavailable")
+		case FailureTimeout:
+			// consume the body so the server notices when the client disconnects
+			io.Copy(io.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-fg.done:
+			}
+		}
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", err.Error())
+		return
+	}
+	sent := SentMail{Mailbox: mailbox, SessionID: r.Header.Get(sender.SessionIDHeader), Body: body}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+		if sent.MIME, err = base64.StdEncoding.DecodeString(string(body)); err != nil {
+			writeGraphError(w, http.StatusBadRequest, "ErrorMimeContentInvalidBase64String", "invalid base64 MIME content")
+			return
+		}
+	} else if err := json.Unmarshal(body, &sent.Request); err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", err.Error())
+		return
+	}
+
+	fg.mu.Lock()
+	fg.sent = append(fg.sent, sent)
+	fg.mu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeGraphError(w http.ResponseWriter, status int, code, message string) {
+	var resp sender.SendEmailErrorResponse
+	resp.Error.Code = code
+	resp.Error.Message = message
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
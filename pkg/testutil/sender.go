@@ -0,0 +1,70 @@
+package testutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/goodieshq/gopostal/pkg/sender"
+)
+
+// An email passed to CapturingSender.Send
+type CapturedEmail struct {
+	From     string
+	To       []string
+	Cc       []string
+	ReplyTo  []string
+	Subject  string
+	Body     []byte
+	Options  *sender.SendOptions
+	Metadata map[string]string
+}
+
+// CapturingSender implements sender.Sender by recording every email instead of delivering it.
+type CapturingSender struct {
+	mu     sync.Mutex
+	emails []CapturedEmail
+	Err    error   // returned from Send when set
+	Errs   []error // returned from successive Send calls, before Err
+}
+
+func NewCapturingSender() *CapturingSender {
+	return &CapturingSender{}
+}
+
+func (cs *CapturingSender) Send(ctx context.Context, msg *sender.Message) (*sender.Result, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.Errs) > 0 {
+		err := cs.Errs[0]
+		cs.Errs = cs.Errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cs.Err != nil {
+		return nil, cs.Err
+	}
+	opts := msg.SendOptions
+	cs.emails = append(cs.emails, CapturedEmail{
+		From:     msg.From,
+		To:       append([]string(nil), msg.To...),
+		Cc:       append([]string(nil), msg.Cc...),
+		ReplyTo:  append([]string(nil), msg.ReplyTo...),
+		Subject:  msg.Subject,
+		Body:     append([]byte(nil), msg.Body...),
+		Options:  &opts,
+		Metadata: msg.Metadata,
+	})
+	return &sender.Result{Attempts: 1}, nil
+}
+
+func (cs *CapturingSender) Authenticate(ctx context.Context) error {
+	return nil
+}
+
+// Returns the emails captured so far.
+func (cs *CapturingSender) Emails() []CapturedEmail {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return append([]CapturedEmail(nil), cs.emails...)
+}
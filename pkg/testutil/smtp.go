@@ -0,0 +1,88 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/goodieshq/gopostal/pkg/config"
+	"github.com/goodieshq/gopostal/pkg/receiver"
+)
+
+// Start an SMTP server for the listener configuration, listening through receiver.Listen like the relay does so PROXY
+// protocol, unix domain sockets, NOOP limiting and session tracing apply. TCP listeners are bound to an ephemeral loopback port instead
+// of their configured address. Returns the address the server is bound to, the socket path for unix domain socket
+// listeners, and a function which stops it.
+func StartListener(ctx context.Context, lc *config.ListenerConfig, send *config.SendConfig, global *config.RecvGlobalConfig) (string, func(), error) {
+	bind := *lc
+	if !bind.IsUnix() {
+		bind.Addr = "127.0.0.1:0"
+	}
+	l, err := receiver.Listen(&bind)
+	if err != nil {
+		return "", nil, err
+	}
+
+	srv := receiver.NewServer(ctx, lc, send, global)
+	if lc.DebugTrace {
+		srv.SetTracer(receiver.NewTracer(lc, &global.Trace))
+	}
+
+	go srv.Serve(l)
+	return l.Addr().String(), func() { srv.Close() }, nil
+}
+
+// Submit a message to the SMTP server at addr using a real go-smtp client. If auth is non-nil the client
+// authenticates before sending.
+func SubmitMessage(addr string, auth sasl.Client, from string, to []string, msg []byte) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	return submit(c, auth, from, to, msg)
+}
+
+// Submit a message to the implicit TLS (SMTPS) server at addr like SubmitMessage.
+func SubmitMessageTLS(addr string, tlsConfig *tls.Config, auth sasl.Client, from string, to []string, msg []byte) error {
+	c, err := smtp.DialTLS(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	return submit(c, auth, from, to, msg)
+}
+
+// Submit a message to the LMTP server at addr like SubmitMessage. The recipients the server refused after the message
+// was transferred are returned as an smtp.LMTPDataError.
+func SubmitMessageLMTP(addr string, from string, to []string, msg []byte) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return submit(smtp.NewClientLMTP(conn), nil, from, to, msg)
+}
+
+// Submit a message to the SMTP server listening on the unix domain socket at path like SubmitMessage.
+func SubmitMessageUnix(path string, auth sasl.Client, from string, to []string, msg []byte) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	return submit(smtp.NewClient(conn), auth, from, to, msg)
+}
+
+func submit(c *smtp.Client, auth sasl.Client, from string, to []string, msg []byte) error {
+	defer c.Close()
+
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(from, to, bytes.NewReader(msg)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// States of a circuit breaker
+const (
+	CircuitClosed   = "closed"    // calls are allowed
+	CircuitOpen     = "open"      // calls are refused until the open timeout has elapsed
+	CircuitHalfOpen = "half-open" // a single test call is allowed, whose outcome closes or reopens the circuit
+)
+
+// CircuitBreaker stops calling a failing service. After `threshold` consecutive failures the circuit opens and calls
+// are refused without being attempted. Once the open timeout has elapsed one test call is allowed: its success closes
+// the circuit, its failure opens it again.
+type CircuitBreaker struct {
+	mu          sync.Mutex
+	threshold   int
+	openTimeout time.Duration
+	state       string
+	failures    int       // consecutive failures while closed
+	openedAt    time.Time // time the circuit last opened
+	testing     bool      // the test call of the half-open circuit is in flight
+	now         func() time.Time
+}
+
+// Create a closed circuit breaker opening after `threshold` consecutive failures for `openTimeout`.
+func NewCircuitBreaker(threshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		state:       CircuitClosed,
+		now:         time.Now,
+	}
+}
+
+// Returns true if a call may be attempted, in which case its outcome must be recorded. A half-open circuit allows a
+// single call until its outcome is recorded. A nil circuit breaker allows every call.
+func (cb *CircuitBreaker) Allow() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && cb.now().Sub(cb.openedAt) >= cb.openTimeout {
+		cb.state = CircuitHalfOpen
+	}
+	switch cb.state {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if cb.testing {
+			return false
+		}
+		cb.testing = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Record the outcome of an allowed call. Returns the state of the circuit after the call, and whether the call changed
+// it.
+func (cb *CircuitBreaker) Record(failed bool) (string, bool) {
+	if cb == nil {
+		return CircuitClosed, false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	prev := cb.state
+	cb.testing = false
+	switch {
+	case !failed:
+		cb.state, cb.failures = CircuitClosed, 0
+	case cb.state == CircuitHalfOpen:
+		cb.state, cb.openedAt = CircuitOpen, cb.now()
+	case cb.state == CircuitClosed:
+		cb.failures++
+		if cb.failures >= cb.threshold {
+			cb.state, cb.openedAt, cb.failures = CircuitOpen, cb.now(), 0
+		}
+	}
+	return cb.state, cb.state != prev
+}
+
+// Returns the state of the circuit.
+func (cb *CircuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitOpen && cb.now().Sub(cb.openedAt) >= cb.openTimeout {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
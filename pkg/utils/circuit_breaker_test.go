@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	cb.now = func() time.Time { return now }
+
+	// Consecutive failures open the circuit, a success in between resets the count
+	for _, failed := range []bool{true, false, true} {
+		if !cb.Allow() {
+			t.Fatal("closed circuit refused a call")
+		}
+		cb.Record(failed)
+	}
+	if state := cb.State(); state != CircuitClosed {
+		t.Fatalf("state = %s after non-consecutive failures, want %s", state, CircuitClosed)
+	}
+	cb.Allow()
+	if state, changed := cb.Record(true); state != CircuitOpen || !changed {
+		t.Fatalf("Record = %s (changed %v), want %s", state, changed, CircuitOpen)
+	}
+	if cb.Allow() {
+		t.Fatal("open circuit allowed a call")
+	}
+
+	// After the timeout a single test call is allowed, whose failure opens the circuit again
+	now = now.Add(time.Minute)
+	if state := cb.State(); state != CircuitHalfOpen {
+		t.Fatalf("state = %s after the timeout, want %s", state, CircuitHalfOpen)
+	}
+	if !cb.Allow() || cb.Allow() {
+		t.Fatal("half-open circuit did not allow exactly one call")
+	}
+	if state, _ := cb.Record(true); state != CircuitOpen || cb.Allow() {
+		t.Fatalf("state = %s after the failed test call, want %s", state, CircuitOpen)
+	}
+
+	// A successful test call closes it
+	now = now.Add(time.Minute)
+	if !cb.Allow() {
+		t.Fatal("half-open circuit refused the test call")
+	}
+	if state, changed := cb.Record(false); state != CircuitClosed || !changed {
+		t.Fatalf("Record = %s (changed %v), want %s", state, changed, CircuitClosed)
+	}
+	if !cb.Allow() || !cb.Allow() {
+		t.Error("closed circuit refused calls")
+	}
+}
+
+func TestCircuitBreakerNil(t *testing.T) {
+	var cb *CircuitBreaker
+	if !cb.Allow() {
+		t.Error("nil circuit breaker refused a call")
+	}
+	if state, changed := cb.Record(true); state != CircuitClosed || changed {
+		t.Errorf("Record = %s (changed %v)", state, changed)
+	}
+}
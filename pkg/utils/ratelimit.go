@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows up to a limit of events per key within a sliding window.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+// Create a new rate limiter allowing `limit` events per key within `window`.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Record an event for the key. Returns false, without recording the event, if the key already reached the limit
+// within the window.
+func (r *RateLimiter) Allow(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-r.window)
+	for k, events := range r.events {
+		// Drop the events which left the window, and the keys without recent events
+		i := 0
+		for i < len(events) && !events[i].After(cutoff) {
+			i++
+		}
+		if i == len(events) {
+			delete(r.events, k)
+		} else {
+			r.events[k] = events[i:]
+		}
+	}
+
+	if len(r.events[key]) >= r.limit {
+		return false
+	}
+	r.events[key] = append(r.events[key], now)
+	return true
+}
+
+// Change the limit and window, keeping the recorded events.
+func (r *RateLimiter) SetLimit(limit int, window time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = limit
+	r.window = window
+}
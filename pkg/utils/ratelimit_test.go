@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := NewRateLimiter(2, 50*time.Millisecond)
+	for i, want := range []bool{true, true, false} {
+		if got := r.Allow("alerts@example.com"); got != want {
+			t.Errorf("event %d: Allow = %v, want %v", i, got, want)
+		}
+	}
+	if !r.Allow("ops@example.com") {
+		t.Error("another key is limited by the events of the first")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !r.Allow("alerts@example.com") {
+		t.Error("events are still limited after the window passed")
+	}
+	if n := len(r.events); n != 1 {
+		t.Errorf("%d keys tracked, want only the key with a recent event", n)
+	}
+}
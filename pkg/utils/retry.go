@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Names of the retry strategies
+const (
+	StrategyExponential = "exponential"
+	StrategyLinear      = "linear"
+	StrategyFixed       = "fixed"
+)
+
+// RetryStrategy determines how long to wait before retrying a failed operation.
+type RetryStrategy interface {
+	// Returns the delay after the given attempt failed, counting from 0
+	Wait(attempt int) time.Duration
+}
+
+// Doubles the delay after each attempt, starting from Base, with up to a quarter of Base added as jitter.
+type ExponentialBackoff struct {
+	Base time.Duration
+}
+
+func (b ExponentialBackoff) Wait(attempt int) time.Duration {
+	wait := b.Base * time.Duration(1<<attempt)
+	if jitter := int64(b.Base / 4); jitter > 0 {
+		wait += time.Duration(rand.Int63n(jitter))
+	}
+	return wait
+}
+
+// Increases the delay by Step after each attempt.
+type LinearBackoff struct {
+	Step time.Duration
+}
+
+func (b LinearBackoff) Wait(attempt int) time.Duration {
+	return b.Step * time.Duration(attempt+1)
+}
+
+// Waits the same delay after each attempt.
+type FixedDelay struct {
+	Delay time.Duration
+}
+
+func (d FixedDelay) Wait(int) time.Duration {
+	return d.Delay
+}
+
+// Bounds the delays of a retry strategy: the delay after the first attempt is Initial instead of the strategy's, and no
+// delay exceeds Max, jitter included. Zero values leave the strategy's delays unchanged.
+type BoundedBackoff struct {
+	Strategy RetryStrategy
+	Initial  time.Duration
+	Max      time.Duration
+}
+
+func (b BoundedBackoff) Wait(attempt int) time.Duration {
+	wait := b.Strategy.Wait(attempt)
+	if attempt == 0 && b.Initial > 0 {
+		wait = b.Initial
+	}
+	if b.Max > 0 && wait > b.Max {
+		wait = b.Max
+	}
+	return wait
+}
+
+// Create the named retry strategy, whose delays are based on the backoff.
+func NewRetryStrategy(name string, backoff time.Duration) (RetryStrategy, error) {
+	switch name {
+	case StrategyExponential:
+		return ExponentialBackoff{Base: backoff}, nil
+	case StrategyLinear:
+		return LinearBackoff{Step: backoff}, nil
+	case StrategyFixed:
+		return FixedDelay{Delay: backoff}, nil
+	default:
+		return nil, fmt.Errorf("unknown retry strategy '%s'", name)
+	}
+}
+
+// An error which retrying cannot resolve (e.g. a rejected request), returned by an operation to stop DoWithRetry.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Mark the error as permanent so the operation is not retried.
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// Returns true if the error, or an error it wraps, is permanent.
+func IsPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+// Run the operation up to the given number of attempts, waiting as determined by the strategy between attempts. Returns
+// the error of the last attempt, or the context's error if it is cancelled while waiting. Permanent errors are returned
+// without further attempts.
+func DoWithRetry(ctx context.Context, operation func() error, attempts int, strategy RetryStrategy) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		err = operation()
+		if err == nil {
+			return nil
+		}
+
+		if i == attempts-1 || IsPermanent(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(strategy.Wait(i)):
+			// continue to the next attempt
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
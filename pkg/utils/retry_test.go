@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryStrategies(t *testing.T) {
+	tests := []struct {
+		name string
+		want []time.Duration
+	}{
+		{StrategyLinear, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}},
+		{StrategyFixed, []time.Duration{time.Second, time.Second, time.Second}},
+	}
+	for _, tt := range tests {
+		strategy, err := NewRetryStrategy(tt.name, time.Second)
+		if err != nil {
+			t.Fatalf("NewRetryStrategy(%q): %v", tt.name, err)
+		}
+		for attempt, want := range tt.want {
+			if got := strategy.Wait(attempt); got != want {
+				t.Errorf("%s: Wait(%d) = %s, want %s", tt.name, attempt, got, want)
+			}
+		}
+	}
+
+	// Exponential backoff adds up to a quarter of the base as jitter
+	strategy, _ := NewRetryStrategy(StrategyExponential, time.Second)
+	for attempt, base := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if got := strategy.Wait(attempt); got < base || got >= base+time.Second/4 {
+			t.Errorf("exponential: Wait(%d) = %s, want [%s, %s)", attempt, got, base, base+time.Second/4)
+		}
+	}
+	if got := (ExponentialBackoff{}).Wait(3); got != 0 {
+		t.Errorf("exponential without a base: Wait(3) = %s", got)
+	}
+
+	if _, err := NewRetryStrategy("random", time.Second); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestBoundedBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy RetryStrategy
+		initial  time.Duration
+		max      time.Duration
+		want     []time.Duration
+	}{
+		{"unbounded", LinearBackoff{Step: time.Second}, 0, 0, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}},
+		{"initial", LinearBackoff{Step: time.Second}, 500 * time.Millisecond, 0, []time.Duration{500 * time.Millisecond, 2 * time.Second, 3 * time.Second}},
+		{"max", LinearBackoff{Step: time.Second}, 0, 2 * time.Second, []time.Duration{time.Second, 2 * time.Second, 2 * time.Second}},
+		{"initial and max", FixedDelay{Delay: time.Minute}, 100 * time.Millisecond, 10 * time.Second, []time.Duration{100 * time.Millisecond, 10 * time.Second}},
+	}
+	for _, tt := range tests {
+		b := BoundedBackoff{Strategy: tt.strategy, Initial: tt.initial, Max: tt.max}
+		for attempt, want := range tt.want {
+			if got := b.Wait(attempt); got != want {
+				t.Errorf("%s: Wait(%d) = %s, want %s", tt.name, attempt, got, want)
+			}
+		}
+	}
+
+	// The jitter of exponential backoff never exceeds the maximum
+	b := BoundedBackoff{Strategy: ExponentialBackoff{Base: time.Second}, Max: 3 * time.Second}
+	for attempt := range 10 {
+		if got := b.Wait(attempt); got > 3*time.Second {
+			t.Errorf("exponential: Wait(%d) = %s, want at most 3s", attempt, got)
+		}
+	}
+}
+
+func TestDoWithBackoffMax(t *testing.T) {
+	// An hour of backoff capped at a millisecond retries at once
+	attempts := 0
+	start := time.Now()
+	err := DoWithBackoff(context.Background(), func() error {
+		attempts++
+		return errors.New("failed")
+	}, 3, time.Hour, time.Millisecond)
+	if err == nil || attempts != 3 {
+		t.Fatalf("DoWithBackoff: %v after %d attempts, want an error after 3", err, attempts)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DoWithBackoff took %s, want the capped delays", elapsed)
+	}
+}
+
+// Records the attempts it is asked to wait after.
+type recordingStrategy struct {
+	waits []int
+}
+
+func (s *recordingStrategy) Wait(attempt int) time.Duration {
+	s.waits = append(s.waits, attempt)
+	return 0
+}
+
+func TestDoWithRetry(t *testing.T) {
+	failure := errors.New("failed")
+
+	// Waits between attempts, but not after the last one
+	strategy := &recordingStrategy{}
+	calls := 0
+	err := DoWithRetry(context.Background(), func() error {
+		calls++
+		return failure
+	}, 3, strategy)
+	if !errors.Is(err, failure) || calls != 3 || len(strategy.waits) != 2 || strategy.waits[1] != 1 {
+		t.Errorf("err = %v after %d calls and waits %v", err, calls, strategy.waits)
+	}
+
+	// Stops at the first success
+	strategy = &recordingStrategy{}
+	calls = 0
+	err = DoWithRetry(context.Background(), func() error {
+		calls++
+		if calls < 2 {
+			return failure
+		}
+		return nil
+	}, 3, strategy)
+	if err != nil || calls != 2 {
+		t.Errorf("err = %v after %d calls", err, calls)
+	}
+
+	// Stops waiting once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = DoWithRetry(ctx, func() error {
+		calls++
+		cancel()
+		return failure
+	}, 3, FixedDelay{Delay: time.Hour})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("err = %v after %d calls", err, calls)
+	}
+}
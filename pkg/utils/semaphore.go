@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+)
+
+// Returned by Semaphore.Acquire for a weight larger than the size of the semaphore, which could never be acquired
+var ErrWeightTooLarge = errors.New("weight exceeds the size of the semaphore")
+
+// Semaphore bounds the total weight held by its callers. Callers are served in the order they asked, so a caller
+// waiting for a large weight is not starved by smaller ones.
+type Semaphore struct {
+	mu      sync.Mutex
+	size    int64
+	held    int64
+	waiters list.List // of *semaphoreWaiter
+}
+
+type semaphoreWaiter struct {
+	n     int64
+	ready chan struct{} // closed once the weight was acquired
+}
+
+// Create a semaphore allowing a total weight of size to be held at once.
+func NewSemaphore(size int64) *Semaphore {
+	return &Semaphore{size: size}
+}
+
+// Acquire a weight of n, waiting until it is available or the context is done, which returns the context's error
+// without acquiring anything.
+func (s *Semaphore) Acquire(ctx context.Context, n int64) error {
+	s.mu.Lock()
+	if n > s.size {
+		s.mu.Unlock()
+		return ErrWeightTooLarge
+	}
+	if s.waiters.Len() == 0 && s.held+n <= s.size {
+		s.held += n
+		s.mu.Unlock()
+		return nil
+	}
+	w := &semaphoreWaiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Acquired while the context was done: give the weight back
+			s.held -= n
+			s.notify()
+		default:
+			s.waiters.Remove(elem)
+			// The callers queued behind this one may fit now
+			s.notify()
+		}
+		return ctx.Err()
+	}
+}
+
+// Release a weight of n acquired before.
+func (s *Semaphore) Release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held -= n
+	s.notify()
+}
+
+// Returns the weight currently held.
+func (s *Semaphore) Held() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held
+}
+
+// Change the size of the semaphore, keeping the weight held. Callers waiting for a weight larger than the new size
+// keep waiting until it is raised again or their context is done.
+func (s *Semaphore) SetSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = size
+	s.notify()
+}
+
+// Hand the weight out to the waiters in order, up to the first one which does not fit. Must be called with the lock
+// held.
+func (s *Semaphore) notify() {
+	for {
+		front := s.waiters.Front()
+		if front == nil {
+			return
+		}
+		w := front.Value.(*semaphoreWaiter)
+		if s.held+w.n > s.size {
+			return
+		}
+		s.held += w.n
+		s.waiters.Remove(front)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	s := NewSemaphore(10)
+	ctx := context.Background()
+	if err := s.Acquire(ctx, 6); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := s.Acquire(ctx, 11); !errors.Is(err, ErrWeightTooLarge) {
+		t.Errorf("Acquire of more than the size = %v, want ErrWeightTooLarge", err)
+	}
+
+	// A large weight queued first is served before a smaller one which would fit
+	large := make(chan error, 1)
+	go func() { large <- s.Acquire(ctx, 8) }()
+	waitQueued(s, 1)
+	small := make(chan error, 1)
+	go func() { small <- s.Acquire(ctx, 2) }()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-large:
+		t.Fatal("weight acquired beyond the size")
+	case <-small:
+		t.Fatal("small weight acquired ahead of the large weight queued before it")
+	default:
+	}
+
+	s.Release(6)
+	if err := <-large; err != nil {
+		t.Fatalf("Acquire of the large weight: %v", err)
+	}
+	if err := <-small; err != nil {
+		t.Fatalf("Acquire of the small weight: %v", err)
+	}
+	if held := s.Held(); held != 10 {
+		t.Errorf("Held = %d, want 10", held)
+	}
+}
+
+func TestSemaphoreCancelled(t *testing.T) {
+	s := NewSemaphore(4)
+	if err := s.Acquire(context.Background(), 3); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire past the deadline = %v, want context.DeadlineExceeded", err)
+	}
+	if n, held := queued(s), s.Held(); n != 0 || held != 3 {
+		t.Errorf("cancelled caller left %d waiters and %d held, want none and 3", n, held)
+	}
+
+	// Raising the size serves the waiters which fit now
+	done := make(chan error, 1)
+	go func() { done <- s.Acquire(context.Background(), 2) }()
+	waitQueued(s, 1)
+	s.SetSize(5)
+	if err := <-done; err != nil {
+		t.Fatalf("Acquire after SetSize: %v", err)
+	}
+}
+
+// Returns the number of callers waiting on the semaphore.
+func queued(s *Semaphore) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters.Len()
+}
+
+// Wait until n callers wait on the semaphore.
+func waitQueued(s *Semaphore, n int) {
+	for queued(s) < n {
+		time.Sleep(time.Millisecond)
+	}
+}
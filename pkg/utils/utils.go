@@ -3,7 +3,6 @@ package utils
 import (
 	"context"
 	"encoding/json"
-	"math/rand"
 	"time"
 )
 
@@ -16,32 +15,8 @@ func Dumps(object any) {
 	println(string(data))
 }
 
-func DoWithBackoff(ctx context.Context, operation func() error, attempts int, backoff time.Duration) error {
-	var err error
-	for i := 0; i < attempts; i++ {
-		if err = ctx.Err(); err != nil {
-			return err
-		}
-
-		err = operation()
-		if err == nil {
-			return nil
-		}
-
-		if i >= attempts {
-			return err
-		}
-
-		sleep := backoff * time.Duration(1<<i)
-		jitter := time.Duration(rand.Int63n(int64(backoff / 4)))
-		sleep += jitter
-
-		select {
-		case <-time.After(sleep):
-			// continue to the next attempt
-		case <-ctx.Done():
-			return ctx.Err()
-		}
-	}
-	return err
+// Run the operation with exponential backoff between attempts, waiting at most maxBackoff (0 for no limit). Shorthand
+// for DoWithRetry with a bounded ExponentialBackoff.
+func DoWithBackoff(ctx context.Context, operation func() error, attempts int, backoff, maxBackoff time.Duration) error {
+	return DoWithRetry(ctx, operation, attempts, BoundedBackoff{Strategy: ExponentialBackoff{Base: backoff}, Max: maxBackoff})
 }